@@ -0,0 +1,82 @@
+/**
+ * Security audit log.
+ *
+ * Records logins, failed logins and changes to how a user logs in, so
+ * they can see if someone else has been trying. Only events for accounts
+ * that exist are kept, for Config.AuditRetentionDays.
+ */
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AuditEvent.Event
+const (
+	auditLogin          = "login"
+	auditLoginFailed    = "login-failed"
+	auditLockedOut      = "locked-out"
+	auditLogout         = "logout"
+	auditLogoutAll      = "logout-everywhere"
+	auditPasswordChange = "password-changed"
+	auditTotpEnabled    = "totp-enabled"
+	auditTotpDisabled   = "totp-disabled"
+)
+
+// How often the audit log is checked for old events
+const auditPurgeInterval = time.Hour
+
+// Most events returned by one GET /user/me/audit
+const auditMaxEvents = 100
+
+// Adds an event to the user's audit log
+func audit(token string, r *http.Request, event string) {
+	ip := ""
+	if clientIP := requestIP(r); clientIP != nil {
+		ip = clientIP.String()
+	}
+	repo.AddAuditEvent(token, &AuditEvent{time.Now().Unix(), event, ip})
+}
+
+// The client's address. Behind nginx that is X-Real-IP,
+// see config/nginx/scramble.conf. The header is only believed from
+// loopback, which is trusted because nginx is what connects from there
+// and always sets it. Anyone else could send it too.
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if isTrustedClient(ip) {
+		if realIP := net.ParseIP(r.Header.Get("X-Real-IP")); realIP != nil {
+			return realIP
+		}
+	}
+	return ip
+}
+
+func StartAuditPurger() {
+	go func() {
+		for {
+			purgeAuditLog(time.Now())
+			time.Sleep(auditPurgeInterval)
+		}
+	}()
+}
+
+// Deletes events more than Config.AuditRetentionDays before now
+func purgeAuditLog(now time.Time) {
+	days := GetConfig().AuditRetentionDays
+	if days <= 0 {
+		return
+	}
+	before := now.Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	if count := repo.PurgeAuditEvents(before); count > 0 {
+		log.Printf("Purged %d audit event(s)\n", count)
+	}
+}
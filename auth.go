@@ -3,29 +3,40 @@ package main
 import (
 	"errors"
 	"net/http"
+	"time"
 )
 
-// Checks cookies, returns the logged-in user
+// Checks the session header, returns the logged-in user
+// Sessions come from loginHandler, see session.go. Users with two-factor
+// authentication only get one with their second factor, and turning it
+// on ends their other sessions, so a session is enough here.
 //
 // Returns nil and a descriptive error if authentication fails
 func authenticate(r *http.Request) (*UserID, error) {
-	token := r.Header.Get("x-scramble-token")
-	if token == "" {
+	secret := r.Header.Get("x-scramble-session")
+	if secret == "" {
 		return nil, errors.New("Not logged in")
 	}
-	passHash := r.Header.Get("x-scramble-passHash")
-	passHashOld := r.Header.Get("x-scramble-passHashOld")
-	return authenticateUserPass(token, passHash, passHashOld)
+	session := repo.LoadSession(sessionKey(secret), time.Now().Unix())
+	if session == nil {
+		return nil, errors.New("Session expired, please log in again")
+	}
+	userId := repo.LoadUserID(session.Token)
+	if userId == nil {
+		return nil, errors.New("User " + session.Token + " not found")
+	}
+	return userId, nil
 }
 
 // Checks given username nad passphrase hash, returns the logged-in user
 //
-// Returns nil and a descriptive error if authentication fails
+// Returns nil and an error if authentication fails. The error is the same
+// whether or not the user exists, so it can't be used to find accounts.
 func authenticateUserPass(token string, passHash string, passHashOld string) (*UserID, error) {
 	// look up the user
-	userId := LoadUserID(token)
+	userId := repo.LoadUserID(token)
 	if userId == nil {
-		return nil, errors.New("User " + token + " not found")
+		return nil, errIncorrectLogin
 	}
 
 	// verify password
@@ -35,5 +46,20 @@ func authenticateUserPass(token string, passHash string, passHashOld string) (*U
 	if passHashOld == userId.PasswordHashOld && passHashOld != "" {
 		return userId, nil
 	}
-	return nil, errors.New("Incorrect passphrase")
+	return nil, errIncorrectLogin
+}
+
+var errIncorrectLogin = errors.New("Incorrect username or passphrase")
+
+// For users with two-factor authentication, checks their code, see totp.go
+//
+// Returns a descriptive error if it is missing or wrong
+func authenticateSecondFactor(userId *UserID, code string) error {
+	if checkSecondFactor(userId.Token, code, time.Now()) {
+		return nil
+	}
+	if code == "" {
+		return errors.New("Two-factor code required")
+	}
+	return errors.New("Incorrect two-factor code")
 }
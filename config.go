@@ -14,17 +14,55 @@ type Config struct {
 	DbUser     string
 	DbPassword string
 	DbCatalog  string
+	DbDriver   string // "mysql", "sqlite3" or "memory"
+	DbPath     string // database file, for sqlite3
 
-	SmtpMxHost string
-	SmtpPort   int // internal, nginx handles TLS and forwards
+	SmtpMxHost      string
+	SmtpPort        int    // internal if nginx handles TLS and forwards, else 25
+	SmtpBindAddress string // "127.0.0.1" behind nginx, "" for all interfaces
+	SmtpTlsCertFile string // PEM certificate chain for STARTTLS, "" if nginx handles TLS
+	SmtpTlsKeyFile  string // PEM private key for SmtpTlsCertFile
+	SmtpTlsPort     int    // implicit TLS (SMTPS) port, 0 to disable
+	SmtpMaxSize     int    // largest message accepted, in bytes, advertised as SIZE
 
-	HttpPort   int // internal, nginx handles SSL and forwards
+	// Inbound connection policy, limits of 0 mean no limit.
+	// Connections from loopback, eg nginx, are exempt until XCLIENT.
+	SmtpMaxConnectionsPerIp    int      // open at the same time
+	SmtpConnectionsPerIpMinute int      // new connections
+	SmtpMessagesPerIpHour      int      // MAIL FROM commands
+	SmtpMessagesPerDomainHour  int      // MAIL FROM commands per sender domain
+	SmtpGreylistMinutes        int      // how long new senders must wait, 0 to disable greylisting
+	SmtpDnsbls                 []string // eg "zen.spamhaus.org", clients listed there are refused
 
-	Notaries   map[string]string // for seeding new accounts, and clients to query
+	SpamThreshold  float64 // inbound mail scoring this much goes to the spam box, see spamFilters
+	SpamBayesModel string  // JSON word counts, see BayesModel. "" to go without
+
+	HttpPort int // internal, nginx handles SSL and forwards
+
+	Notaries map[string]string // for seeding new accounts, and clients to query
 
 	ReservedNames []string // reserved usernames
 
 	AncestorIDsMaxBytes int // should match the VARCHAR() limit of email > ancestor_ids
+
+	OutboxRetryMinutes    int // first retry after a temporary failure, doubles after each one
+	OutboxMaxRetryMinutes int // upper bound on the time between retries
+	OutboxGiveUpHours     int // bounce mail that couldn't be delivered for this long
+
+	MxNegativeCacheMinutes int // how long a failed MX lookup is remembered
+
+	AdminUsers []string // usernames allowed to use the /admin/ API
+
+	TrashRetentionDays int // trashed mail is deleted for good after this long, 0 to keep it
+
+	SessionHours int // how long a login lasts, see loginHandler
+
+	// Failed logins allowed before a lockout, 0 means no limit. See LoginPolicy.
+	LoginFailuresPerAccount int
+	LoginFailuresPerIp      int
+	LoginLockoutMinutes     int // how long failures count, and lockouts last
+
+	AuditRetentionDays int // how long users can see their logins, see audit.go
 }
 
 func GetConfig() *Config {
@@ -32,41 +70,72 @@ func GetConfig() *Config {
 }
 
 var defaultConfig = Config{
-	"127.0.0.1",
-	"scramble",
-	"scramble",
-	"scramble",
-	"local.scramble.io",
-	8825,
-	8888,
-	map[string]string{
+	DbServer:   "127.0.0.1",
+	DbUser:     "scramble",
+	DbPassword: "scramble",
+	DbCatalog:  "scramble",
+	DbDriver:   "mysql",
+	DbPath:     "scramble.db",
+
+	SmtpMxHost:      "local.scramble.io",
+	SmtpPort:        8825,
+	SmtpBindAddress: "127.0.0.1",
+	SmtpTlsCertFile: "",
+	SmtpTlsKeyFile:  "",
+	SmtpTlsPort:     0,
+	SmtpMaxSize:     26214400,
+
+	SmtpMaxConnectionsPerIp:    10,
+	SmtpConnectionsPerIpMinute: 60,
+	SmtpMessagesPerIpHour:      500,
+	SmtpMessagesPerDomainHour:  1000,
+	SmtpGreylistMinutes:        0,
+	SmtpDnsbls:                 []string{},
+
+	SpamThreshold:  5.0,
+	SpamBayesModel: "",
+
+	HttpPort: 8888,
+
+	Notaries: map[string]string{
 		"local.scramble.io": "notaries/local.scramble.io",
 	},
-	[]string{"admin", "administrator", "root", "support", "help", "spam",
-		"info", "contact", "webmaster", "abuse", "security", "mailer-daemon",
-		"mailer", "daemon", "postmaster"},
-	10240,
-}
 
-var config = Config{
-	"127.0.0.1",
-	"scramble",
-	"scramble",
-	"scramble",
-	"local.scramble.io",
-	8825,
-	8888,
-	map[string]string{
-	},
-	[]string{"admin", "administrator", "root", "support", "help", "spam",
+	ReservedNames: []string{"admin", "administrator", "root", "support", "help", "spam",
 		"info", "contact", "webmaster", "abuse", "security", "mailer-daemon",
 		"mailer", "daemon", "postmaster"},
-	10240,
+
+	AncestorIDsMaxBytes: 10240,
+
+	OutboxRetryMinutes:    5,
+	OutboxMaxRetryMinutes: 240,
+	OutboxGiveUpHours:     120,
+
+	MxNegativeCacheMinutes: 5,
+
+	AdminUsers: []string{},
+
+	TrashRetentionDays: 30,
+
+	SessionHours: 24,
+
+	LoginFailuresPerAccount: 10,
+	LoginFailuresPerIp:      100,
+	LoginLockoutMinutes:     15,
+
+	AuditRetentionDays: 90,
 }
 
+// The defaults, less the notaries, which must come from config.json
+var config = func() Config {
+	c := defaultConfig
+	c.Notaries = map[string]string{}
+	return c
+}()
+
 func init() {
 	configFile := os.Getenv("HOME") + "/.scramble/config.json"
-	log.Printf("Reading " + configFile)
+	log.Printf("Reading %s", configFile)
 
 	// try to read configuration. if missing, write default
 	configBytes, err := ioutil.ReadFile(configFile)
@@ -96,6 +165,15 @@ func writeDefaultConfig(configFile string) {
 	}
 }
 
+func (cfg *Config) IsAdmin(token string) bool {
+	for _, n := range cfg.AdminUsers {
+		if strings.ToLower(n) == strings.ToLower(token) {
+			return true
+		}
+	}
+	return false
+}
+
 func (cfg *Config) IsReservedName(name string) bool {
 	for _, n := range cfg.ReservedNames {
 		if strings.ToLower(n) == strings.ToLower(name) {
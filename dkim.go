@@ -0,0 +1,592 @@
+/**
+ * DKIM, RFC 6376.
+ *
+ * Signs outbound mail with a key per email host, and verifies
+ * DKIM-Signature headers of inbound mail against the public keys
+ * that the signing domains publish in DNS.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DKIM results, RFC 8601 section 2.7.1
+const (
+	dkimNone      = "none"
+	dkimPass      = "pass"
+	dkimFail      = "fail"
+	dkimNeutral   = "neutral"
+	dkimTempError = "temperror"
+	dkimPermError = "permerror"
+)
+
+// Don't let a message make us do unbounded DNS lookups and RSA operations
+const dkimMaxSignatures = 5
+
+type dkimSignature struct {
+	Algorithm   string // "rsa-sha256"
+	Domain      string // d=
+	Selector    string // s=
+	HeaderCanon string // "simple" or "relaxed"
+	BodyCanon   string
+	Headers     []string // h=, the signed header fields in order
+	BodyHash    []byte   // bh=
+	Signature   []byte   // b=
+	Length      int64    // l=, or -1 if the whole body is signed
+	Expires     int64    // x=, or 0
+}
+
+var regexDkimB = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// Header fields we sign when present. From is always signed.
+var dkimSignedHeaders = []string{
+	"from", "to", "cc", "subject", "date", "message-id",
+	"in-reply-to", "references", "mime-version", "content-type",
+}
+
+// Serializes key generation, so that each email host gets one key
+var dkimKeyLock sync.Mutex
+
+// Returns the DKIM key for emailHost, generating one the first time
+func dkimKeyForHost(emailHost string) *DkimKey {
+	dkimKeyLock.Lock()
+	defer dkimKeyLock.Unlock()
+	if key := repo.LoadDkimKey(emailHost); key != nil {
+		return key
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	repo.AddDkimKey(&DkimKey{
+		EmailHost: emailHost,
+		Selector:  "scramble" + now.Format("200601"),
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		})),
+		UnixTime: now.Unix(),
+	})
+	key := repo.LoadDkimKey(emailHost)
+	name, value := dkimTxtRecord(key)
+	log.Printf("Created a DKIM key for %s, publish this TXT record:\n%s \"%s\"\n", emailHost, name, value)
+	return key
+}
+
+// The DNS TXT record name and value that publish key's public half
+func dkimTxtRecord(key *DkimKey) (string, string) {
+	der, err := x509.MarshalPKIXPublicKey(&dkimPrivateKey(key).PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return key.Selector + "._domainkey." + key.EmailHost,
+		"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+func dkimPrivateKey(key *DkimKey) *rsa.PrivateKey {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		log.Panicf("Invalid DKIM key for %s", key.EmailHost)
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		panic(err)
+	}
+	return privateKey
+}
+
+// Prepends a DKIM-Signature header field to message.
+// Signs with rsa-sha256 and relaxed canonicalization, which survives
+// the whitespace and line ending changes that happen in transit.
+func dkimSign(message string, key *DkimKey, now time.Time) string {
+	fields, body := splitMessage(message)
+
+	present := map[string]bool{}
+	for _, field := range fields {
+		present[headerFieldName(field)] = true
+	}
+	sig := &dkimSignature{
+		Algorithm:   "rsa-sha256",
+		Domain:      key.EmailHost,
+		Selector:    key.Selector,
+		HeaderCanon: "relaxed",
+		BodyCanon:   "relaxed",
+		Length:      -1,
+	}
+	for _, name := range dkimSignedHeaders {
+		if present[name] || name == "from" {
+			sig.Headers = append(sig.Headers, name)
+		}
+	}
+
+	field := "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=" + sig.Domain +
+		"; s=" + sig.Selector + ";\r\n" +
+		"\tt=" + strconv.FormatInt(now.Unix(), 10) + "; h=" + strings.Join(sig.Headers, ":") + ";\r\n" +
+		"\tbh=" + base64.StdEncoding.EncodeToString(sig.bodyHash(body)) + ";\r\n" +
+		"\tb="
+	signature, err := rsa.SignPKCS1v15(rand.Reader, dkimPrivateKey(key), crypto.SHA256,
+		sig.headerHash(fields, field))
+	if err != nil {
+		panic(err)
+	}
+
+	// fold b= so that the header lines stay short
+	b := base64.StdEncoding.EncodeToString(signature)
+	for len(b) > 64 {
+		field, b = field+b[:64]+"\r\n\t ", b[64:]
+	}
+	return field + b + "\r\n" + message
+}
+
+// Splits a message into raw header fields, continuation lines and
+// trailing CRLF included, and the body. Bare LFs become CRLFs.
+func splitMessage(message string) ([]string, string) {
+	message = strings.Replace(message, "\r\n", "\n", -1)
+	message = strings.Replace(message, "\n", "\r\n", -1)
+
+	var head, body string
+	if strings.HasPrefix(message, "\r\n") {
+		head, body = "", message[2:]
+	} else if i := strings.Index(message, "\r\n\r\n"); i >= 0 {
+		head, body = message[:i+2], message[i+4:]
+	} else {
+		head = message
+	}
+
+	fields := []string{}
+	for _, line := range strings.SplitAfter(head, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields, body
+}
+
+// Reads the header of a message, up to the empty line that ends it.
+// Returns its fields, like splitMessage, and where the body starts.
+func readMessageHeader(message io.Reader) ([]string, int64, error) {
+	reader := bufio.NewReader(message)
+	head := ""
+	offset := int64(0)
+	for {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		head += line
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+	fields, _ := splitMessage(head)
+	return fields, offset, nil
+}
+
+// "DKIM-Signature: v=1; ..." -> "dkim-signature"
+func headerFieldName(field string) string {
+	colon := strings.Index(field, ":")
+	if colon < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(field[:colon]))
+}
+
+// Parses tag=value lists, RFC 6376 section 3.2
+func parseDkimTags(list string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(list, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return nil, errors.New("dkim: malformed tag " + spec)
+		}
+		name := strings.TrimSpace(spec[:eq])
+		if _, dup := tags[name]; dup {
+			return nil, errors.New("dkim: duplicate tag " + name)
+		}
+		tags[name] = strings.TrimSpace(spec[eq+1:])
+	}
+	return tags, nil
+}
+
+// Removes folding whitespace from base64 tag values
+func dkimBase64(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+}
+
+func parseDkimSignature(field string) (*dkimSignature, error) {
+	tags, err := parseDkimTags(field[strings.Index(field, ":")+1:])
+	if err != nil {
+		return nil, err
+	}
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[required] == "" {
+			return nil, errors.New("dkim: missing tag " + required)
+		}
+	}
+	if tags["v"] != "1" {
+		return nil, errors.New("dkim: unsupported version " + tags["v"])
+	}
+
+	sig := &dkimSignature{
+		Algorithm:   strings.ToLower(tags["a"]),
+		Domain:      strings.ToLower(tags["d"]),
+		Selector:    tags["s"],
+		HeaderCanon: "simple",
+		BodyCanon:   "simple",
+		Length:      -1,
+	}
+	// rsa-sha1 is no longer safe to verify, RFC 8301 section 3.1
+	if sig.Algorithm != "rsa-sha256" {
+		return nil, errors.New("dkim: unsupported algorithm " + sig.Algorithm)
+	}
+	if c := strings.ToLower(tags["c"]); c != "" {
+		canons := strings.SplitN(c, "/", 2)
+		sig.HeaderCanon = canons[0]
+		if len(canons) == 2 {
+			sig.BodyCanon = canons[1]
+		}
+	}
+	for _, canon := range []string{sig.HeaderCanon, sig.BodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return nil, errors.New("dkim: unsupported canonicalization " + canon)
+		}
+	}
+	for _, name := range strings.Split(tags["h"], ":") {
+		sig.Headers = append(sig.Headers, strings.ToLower(strings.TrimSpace(name)))
+	}
+	hasFrom := false
+	for _, name := range sig.Headers {
+		hasFrom = hasFrom || name == "from"
+	}
+	if !hasFrom {
+		return nil, errors.New("dkim: From is not signed")
+	}
+	if sig.BodyHash, err = dkimBase64(tags["bh"]); err != nil {
+		return nil, err
+	}
+	if sig.Signature, err = dkimBase64(tags["b"]); err != nil {
+		return nil, err
+	}
+	if tags["l"] != "" {
+		if sig.Length, err = strconv.ParseInt(tags["l"], 10, 64); err != nil || sig.Length < 0 {
+			return nil, errors.New("dkim: invalid body length " + tags["l"])
+		}
+	}
+	if tags["x"] != "" {
+		if sig.Expires, err = strconv.ParseInt(tags["x"], 10, 64); err != nil {
+			return nil, errors.New("dkim: invalid expiration " + tags["x"])
+		}
+	}
+	return sig, nil
+}
+
+func (sig *dkimSignature) hash() (hash.Hash, crypto.Hash) {
+	return sha256.New(), crypto.SHA256
+}
+
+// Body canonicalization, RFC 6376 section 3.4.3 and 3.4.4, as the body
+// is written. Bare LFs count as CRLFs, like in splitMessage.
+// Close must be called at the end of the body.
+type dkimBodyCanonicalizer struct {
+	w          *bufio.Writer
+	relaxed    bool
+	emptyLines int  // held back, trailing empty lines are dropped
+	inLine     bool // the current line isn't empty
+	wsp        bool // relaxed only: held back, trailing whitespace is dropped
+	cr         bool // held back, it may start a CRLF
+	written    bool
+}
+
+func newDkimBodyCanonicalizer(w io.Writer, canon string) *dkimBodyCanonicalizer {
+	return &dkimBodyCanonicalizer{w: bufio.NewWriter(w), relaxed: canon == "relaxed"}
+}
+
+func (c *dkimBodyCanonicalizer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.cr {
+			c.cr = false
+			if b == '\n' {
+				c.endLine()
+				continue
+			}
+			c.content('\r')
+		}
+		switch {
+		case b == '\r':
+			c.cr = true
+		case b == '\n':
+			c.endLine()
+		case c.relaxed && (b == ' ' || b == '\t'):
+			c.wsp = true
+		default:
+			c.content(b)
+		}
+	}
+	return len(p), nil
+}
+
+// A byte of a line that isn't empty
+func (c *dkimBodyCanonicalizer) content(b byte) {
+	if !c.inLine {
+		for ; c.emptyLines > 0; c.emptyLines-- {
+			c.w.WriteString("\r\n")
+		}
+		c.inLine = true
+	}
+	if c.wsp {
+		c.w.WriteByte(' ')
+		c.wsp = false
+	}
+	c.w.WriteByte(b)
+}
+
+func (c *dkimBodyCanonicalizer) endLine() {
+	if c.inLine {
+		c.w.WriteString("\r\n")
+		c.written = true
+	} else {
+		c.emptyLines++
+	}
+	c.inLine = false
+	c.wsp = false
+}
+
+func (c *dkimBodyCanonicalizer) Close() error {
+	if c.cr {
+		c.cr = false
+		c.content('\r')
+	}
+	if c.inLine {
+		// the last line gets a CRLF even if it had none
+		c.endLine()
+	}
+	if !c.written && !c.relaxed {
+		// an empty body is a single CRLF in simple canonicalization
+		c.w.WriteString("\r\n")
+	}
+	return c.w.Flush()
+}
+
+// Header canonicalization, RFC 6376 section 3.4.1 and 3.4.2
+func dkimCanonHeader(field, canon string) string {
+	if canon == "simple" {
+		return field
+	}
+	colon := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimSpace(field[:colon]))
+	value := strings.Replace(field[colon+1:], "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, isWsp), " ")
+	return name + ":" + value + "\r\n"
+}
+
+func isWsp(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// Hashes the signed header fields and then the signature's own header
+// field, with an empty b= and no trailing CRLF.
+func (sig *dkimSignature) headerHash(fields []string, field string) []byte {
+	h, _ := sig.hash()
+
+	// the last instance of a header field is signed first
+	used := map[int]bool{}
+	for _, name := range sig.Headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && headerFieldName(fields[i]) == name {
+				used[i] = true
+				h.Write([]byte(dkimCanonHeader(fields[i], sig.HeaderCanon)))
+				break
+			}
+		}
+	}
+
+	colon := strings.Index(field, ":")
+	field = field[:colon+1] + regexDkimB.ReplaceAllString(field[colon+1:], "${1}${2}")
+	h.Write([]byte(strings.TrimSuffix(dkimCanonHeader(field, sig.HeaderCanon), "\r\n")))
+	return h.Sum(nil)
+}
+
+func (sig *dkimSignature) bodyHash(body string) []byte {
+	sum, err := sig.readBodyHash(strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	return sum
+}
+
+// Hashes the body as it is read, up to the l= length if there is one
+func (sig *dkimSignature) readBodyHash(body io.Reader) ([]byte, error) {
+	h, _ := sig.hash()
+	var w io.Writer = h
+	if sig.Length >= 0 {
+		w = &dkimLengthWriter{h, sig.Length}
+	}
+	canonicalizer := newDkimBodyCanonicalizer(w, sig.BodyCanon)
+	if _, err := io.Copy(canonicalizer, body); err != nil {
+		return nil, err
+	}
+	if err := canonicalizer.Close(); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Passes on the first n bytes written to it, and drops the rest
+type dkimLengthWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *dkimLengthWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		if _, err := w.w.Write(p[:w.n]); err != nil {
+			return 0, err
+		}
+		w.n = 0
+		return len(p), nil
+	}
+	w.n -= int64(len(p))
+	return w.w.Write(p)
+}
+
+// Looks up selector._domainkey.domain. The second return value is the
+// DKIM result to use if there's no usable key.
+func lookupDkimKey(resolver SenderAuthResolver, selector, domain string) (*rsa.PublicKey, string) {
+	txts, err := resolver.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, dkimTempError
+	}
+	if len(txts) == 0 {
+		return nil, dkimPermError
+	}
+	tags, err := parseDkimTags(txts[0])
+	if err != nil || (tags["v"] != "" && tags["v"] != "DKIM1") {
+		return nil, dkimPermError
+	}
+	if k := tags["k"]; k != "" && k != "rsa" {
+		return nil, dkimPermError
+	}
+	if tags["p"] == "" {
+		// revoked
+		return nil, dkimFail
+	}
+	der, err := dkimBase64(tags["p"])
+	if err != nil {
+		return nil, dkimPermError
+	}
+	if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, ""
+		}
+		return nil, dkimPermError
+	}
+	if rsaKey, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return rsaKey, ""
+	}
+	return nil, dkimPermError
+}
+
+// Verifies the DKIM signatures of a message. Its body is read again for
+// each signature rather than kept in memory.
+// Returns the overall result and the domains with a valid signature.
+func verifyDkim(resolver SenderAuthResolver, message io.ReadSeeker, now time.Time) (string, []string) {
+	fields, bodyStart, err := readMessageHeader(message)
+	if err != nil {
+		log.Printf("DKIM: could not read the message: %v\n", err)
+		return dkimTempError, nil
+	}
+
+	result := dkimNone
+	domains := []string{}
+	checked := 0
+	for _, field := range fields {
+		if headerFieldName(field) != "dkim-signature" {
+			continue
+		}
+		if checked++; checked > dkimMaxSignatures {
+			break
+		}
+		sigResult := verifyDkimSignature(resolver, field, fields, message, bodyStart, now)
+		if sigResult == dkimPass {
+			sig, _ := parseDkimSignature(field)
+			domains = append(domains, sig.Domain)
+		}
+		result = betterDkimResult(result, sigResult)
+	}
+	return result, domains
+}
+
+func verifyDkimSignature(resolver SenderAuthResolver, field string, fields []string, message io.ReadSeeker, bodyStart int64, now time.Time) string {
+	sig, err := parseDkimSignature(field)
+	if err != nil {
+		return dkimPermError
+	}
+	if sig.Expires != 0 && sig.Expires < now.Unix() {
+		return dkimFail
+	}
+	key, keyResult := lookupDkimKey(resolver, sig.Selector, sig.Domain)
+	if key == nil {
+		return keyResult
+	}
+	if _, err := message.Seek(bodyStart, io.SeekStart); err != nil {
+		log.Printf("DKIM: could not read the message: %v\n", err)
+		return dkimTempError
+	}
+	bodyHash, err := sig.readBodyHash(message)
+	if err != nil {
+		log.Printf("DKIM: could not read the message: %v\n", err)
+		return dkimTempError
+	}
+	if !bytes.Equal(bodyHash, sig.BodyHash) {
+		return dkimFail
+	}
+	_, cryptoHash := sig.hash()
+	if rsa.VerifyPKCS1v15(key, cryptoHash, sig.headerHash(fields, field), sig.Signature) != nil {
+		return dkimFail
+	}
+	return dkimPass
+}
+
+// One valid signature is enough, see RFC 6376 section 6.1
+var dkimResultRank = map[string]int{
+	dkimNone: 0, dkimPermError: 1, dkimTempError: 2, dkimFail: 3, dkimNeutral: 3, dkimPass: 4,
+}
+
+func betterDkimResult(a, b string) string {
+	if dkimResultRank[b] > dkimResultRank[a] {
+		return b
+	}
+	return a
+}
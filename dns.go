@@ -0,0 +1,402 @@
+/**
+ * A tiny DNS client for MX, address and TLSA lookups.
+ *
+ * The net package resolves names fine, but doesn't tell us how long the
+ * answers are good for. The MX cache needs TTLs, so we ask the system's
+ * nameserver ourselves and fall back on the net package when that fails.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeMX    = 15
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+	dnsTypeTLSA  = 52
+
+	dnsClassIN = 1
+
+	dnsRcodeNXDomain = 3
+)
+
+// Used when the answer came from the net package, which hides the TTL
+const dnsFallbackTTL = 10 * time.Minute
+
+var errDnsTruncated = errors.New("dns: truncated response")
+var errDnsMismatch = errors.New("dns: response doesn't match query")
+var errDnsNXDomain = errors.New("dns: no such domain")
+var errDnsShort = errors.New("dns: malformed response")
+
+// Resolves MX records along with how long they may be cached.
+type MxResolver interface {
+	// Returns no records and no error if the host has no MX records,
+	// errNoSuchDomain if it doesn't exist at all.
+	LookupMX(host string) ([]*net.MX, time.Duration, error)
+	// Returns a *net.DNSError with IsNotFound set if the host has no
+	// A/AAAA records.
+	LookupHost(host string) ([]string, time.Duration, error)
+}
+
+// Queries the first nameserver in /etc/resolv.conf over UDP, and over TCP
+// when the answer is too big for UDP
+type dnsResolver struct {
+	Timeout time.Duration
+}
+
+var systemResolver = &dnsResolver{Timeout: 5 * time.Second}
+
+type dnsAnswer struct {
+	Type uint16
+	TTL  uint32
+	MX   *net.MX
+	IP   net.IP
+	TLSA *tlsaRecord
+}
+
+func (r *dnsResolver) LookupMX(host string) ([]*net.MX, time.Duration, error) {
+	answers, _, err := r.query(host, dnsTypeMX)
+	if err == errDnsNXDomain {
+		return nil, 0, errNoSuchDomain
+	}
+	if err != nil {
+		mxs, err := net.LookupMX(host)
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+			// no such host, or no MX records
+			return nil, dnsFallbackTTL, nil
+		}
+		return mxs, dnsFallbackTTL, err
+	}
+	mxs := []*net.MX{}
+	for _, answer := range answers {
+		if answer.MX != nil {
+			mxs = append(mxs, answer.MX)
+		}
+	}
+	return mxs, dnsMinTTL(answers), nil
+}
+
+func (r *dnsResolver) LookupHost(host string) ([]string, time.Duration, error) {
+	addrs := []string{}
+	var answers []dnsAnswer
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		qAnswers, _, err := r.query(host, qtype)
+		if err == errDnsNXDomain {
+			break
+		}
+		if err != nil {
+			addrs, err := net.LookupHost(host)
+			return addrs, dnsFallbackTTL, err
+		}
+		answers = append(answers, qAnswers...)
+	}
+	for _, answer := range answers {
+		if answer.IP != nil {
+			addrs = append(addrs, answer.IP.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, dnsMinTTL(answers), nil
+}
+
+// Also returns whether the nameserver validated the answer, or the
+// failure, with DNSSEC. No validating resolver, no DANE.
+func (r *dnsResolver) LookupTLSA(name string) ([]*tlsaRecord, bool, error) {
+	answers, authenticated, err := r.query(name, dnsTypeTLSA)
+	if err == errDnsNXDomain {
+		return nil, authenticated, nil
+	}
+	if err != nil {
+		return nil, authenticated, err
+	}
+	records := []*tlsaRecord{}
+	for _, answer := range answers {
+		if answer.TLSA != nil {
+			records = append(records, answer.TLSA)
+		}
+	}
+	return records, authenticated, nil
+}
+
+func (r *dnsResolver) LookupTXT(name string) ([]string, error) {
+	txts, err := net.LookupTXT(name)
+	if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+		return nil, nil
+	}
+	return txts, err
+}
+
+// The shortest TTL of the answers, CNAMEs included
+func dnsMinTTL(answers []dnsAnswer) time.Duration {
+	if len(answers) == 0 {
+		return dnsFallbackTTL
+	}
+	ttl := answers[0].TTL
+	for _, answer := range answers {
+		if answer.TTL < ttl {
+			ttl = answer.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Sends a single recursive query and parses the answer section.
+// A nonexistent name (NXDOMAIN) fails with errDnsNXDomain.
+// Also returns whether the nameserver vouches for the answer, or the
+// error it answered with, with DNSSEC.
+func (r *dnsResolver) query(name string, qtype uint16) ([]dnsAnswer, bool, error) {
+	server, err := dnsNameserver()
+	if err != nil {
+		return nil, false, err
+	}
+	query, err := dnsPackQuery(dnsQueryID(), name, qtype)
+	if err != nil {
+		return nil, false, err
+	}
+	answers, authenticated, err := r.exchange("udp", server, query)
+	if err == errDnsTruncated {
+		// big MX and TLSA answers don't fit, ask again over TCP
+		answers, authenticated, err = r.exchange("tcp", server, query)
+	}
+	return answers, authenticated, err
+}
+
+// Sends query to server over "udp" or "tcp" and parses the response.
+// Over UDP, packets that don't answer the query are ignored, they are
+// likely forged.
+func (r *dnsResolver) exchange(network, server string, query []byte) ([]dnsAnswer, bool, error) {
+	conn, err := net.DialTimeout(network, server, r.Timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+
+	if network == "tcp" {
+		// messages are prefixed with their length, RFC 1035 section 4.2.2
+		msg := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		if _, err = conn.Write(append(msg, query...)); err != nil {
+			return nil, false, err
+		}
+		if _, err = io.ReadFull(conn, msg); err != nil {
+			return nil, false, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return nil, false, err
+		}
+		return dnsParseResponse(query, buf)
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, false, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, false, err
+		}
+		answers, authenticated, err := dnsParseResponse(query, buf[:n])
+		if err != errDnsMismatch {
+			return answers, authenticated, err
+		}
+	}
+}
+
+// A random query id, so that forged answers have to guess it
+func dnsQueryID() uint16 {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(id[:])
+}
+
+// First "nameserver" line of /etc/resolv.conf, as host:port
+func dnsNameserver() (string, error) {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("dns: no nameserver in /etc/resolv.conf")
+}
+
+func dnsPackQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0120) // recursion desired, authentic data wanted
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	binary.BigEndian.PutUint16(msg[10:], 1)     // one additional record, the OPT below
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("dns: invalid name %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	// EDNS0 (RFC 6891): 4096 byte UDP answers, DNSSEC OK
+	msg = append(msg, 0, 0, dnsTypeOPT, 0x10, 0x00, 0, 0, 0x80, 0, 0, 0)
+	return msg, nil
+}
+
+// Parses the response to query. It must have the query's id and echo
+// its question, otherwise it fails with errDnsMismatch.
+func dnsParseResponse(query, msg []byte) ([]dnsAnswer, bool, error) {
+	if len(msg) < 12 || msg[0] != query[0] || msg[1] != query[1] {
+		return nil, false, errDnsMismatch
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, false, errors.New("dns: not a response")
+	}
+	if flags&0x0200 != 0 {
+		return nil, false, errDnsTruncated
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, false, errDnsMismatch
+	}
+	qname, qnext, err := dnsReadName(query, 12)
+	if err != nil {
+		return nil, false, err
+	}
+	name, off, err := dnsReadName(msg, 12)
+	if err != nil {
+		return nil, false, err
+	}
+	if off+4 > len(msg) {
+		return nil, false, errDnsShort
+	}
+	// type and class
+	if !strings.EqualFold(name, qname) || string(msg[off:off+4]) != string(query[qnext:qnext+4]) {
+		return nil, false, errDnsMismatch
+	}
+	off += 4
+
+	authenticated := flags&0x0020 != 0
+	switch rcode := flags & 0x000f; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return nil, authenticated, errDnsNXDomain
+	default:
+		return nil, authenticated, fmt.Errorf("dns: server failure, rcode %d", rcode)
+	}
+	ancount := binary.BigEndian.Uint16(msg[6:])
+
+	answers := []dnsAnswer{}
+	for i := 0; i < int(ancount); i++ {
+		_, next, err := dnsReadName(msg, off)
+		if err != nil {
+			return nil, false, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, false, errDnsShort
+		}
+		answer := dnsAnswer{
+			Type: binary.BigEndian.Uint16(msg[off:]),
+			TTL:  binary.BigEndian.Uint32(msg[off+4:]),
+		}
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, false, errDnsShort
+		}
+		rdata := msg[off : off+rdlength]
+		switch answer.Type {
+		case dnsTypeMX:
+			if rdlength < 3 {
+				return nil, false, errDnsShort
+			}
+			host, _, err := dnsReadName(msg, off+2)
+			if err != nil {
+				return nil, false, err
+			}
+			answer.MX = &net.MX{Host: host, Pref: binary.BigEndian.Uint16(rdata)}
+		case dnsTypeA, dnsTypeAAAA:
+			if rdlength != net.IPv4len && rdlength != net.IPv6len {
+				return nil, false, errDnsShort
+			}
+			answer.IP = net.IP(append([]byte{}, rdata...))
+		case dnsTypeTLSA:
+			if rdlength < 4 {
+				return nil, false, errDnsShort
+			}
+			answer.TLSA = &tlsaRecord{
+				Usage:        rdata[0],
+				Selector:     rdata[1],
+				MatchingType: rdata[2],
+				Data:         append([]byte{}, rdata[3:]...),
+			}
+		case dnsTypeCNAME:
+			// the resolver already followed it, but its TTL counts too
+		default:
+			off += rdlength
+			continue
+		}
+		answers = append(answers, answer)
+		off += rdlength
+	}
+	return answers, authenticated, nil
+}
+
+// Reads a possibly compressed name starting at off.
+// Returns the name with a trailing dot, and the offset right after it.
+func dnsReadName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDnsShort
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDnsShort
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errDnsShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
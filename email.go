@@ -99,7 +99,8 @@ func GroupAddrsByHost(addrList string) map[string]EmailAddresses {
 	return hostAddrs
 }
 
-// Like GroupAddrsByHost, but resolves the hostname to Mx host.
+// Like GroupAddrsByHost, but resolves the hostname to its primary Mx host.
+// Delivery still fails over to the other Mx hosts, see smtpSend.
 // Returns two maps where the second is all the hosts for which the Mx lookup failed.
 func GroupAddrsByMxHost(addrList string) (map[string]EmailAddresses, map[string]EmailAddresses) {
 	hostAddrs := GroupAddrsByHost(addrList)
@@ -114,7 +115,7 @@ func GroupAddrsByMxHost(addrList string) (map[string]EmailAddresses, map[string]
 			continue
 		}
 		// Lookup Mx record
-		mxHost, err := mxLookUp(host)
+		mxHost, err := mxLookUpPrimary(host)
 		if err != nil {
 			failedHostAddrs[host] = addrs
 		} else {
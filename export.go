@@ -0,0 +1,122 @@
+/**
+ * Exports everything a user has on the server as one zip file.
+ *
+ * The archive is written as it is read, a page of mail at a time, so a
+ * big mailbox doesn't have to fit in memory. Everything in it stays
+ * encrypted the way it is stored, only the user's passphrase opens it.
+ *
+ *  account.json             keys, contacts and labels
+ *  mail/000001.json         an email and the boxes it is in
+ *  mail/000001/attachment-1 its attachments, ciphertext
+ *  drafts/000001.json       unsent mail
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Emails loaded from the repository at a time
+const exportPageSize = 100
+
+type exportedAccount struct {
+	Token            string
+	EmailAddress     string
+	PublicHash       string
+	PublicKey        string
+	CipherPrivateKey string
+	CipherContacts   *string
+	Labels           []Label
+}
+
+type exportedEmail struct {
+	Email
+	Boxes []string
+}
+
+// Writes the user's archive to w
+func writeExport(w io.Writer, userId *UserID) error {
+	archive := zip.NewWriter(w)
+	user := repo.LoadUser(userId.Token)
+	err := writeExportJson(archive, "account.json", &exportedAccount{
+		user.Token,
+		userId.EmailAddress,
+		user.PublicHash,
+		user.PublicKey,
+		user.CipherPrivateKey,
+		repo.LoadContacts(user.Token),
+		repo.LoadLabels(userId.EmailAddress),
+	})
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for afterID := ""; ; {
+		ids := repo.LoadMessageIDs(userId.EmailAddress, afterID, exportPageSize)
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			n++
+			if err = writeExportEmail(archive, fmt.Sprintf("mail/%06d", n), userId, id); err != nil {
+				return err
+			}
+		}
+		afterID = ids[len(ids)-1]
+	}
+
+	n = 0
+	for offset := 0; ; offset += exportPageSize {
+		headers := repo.LoadDrafts(userId.EmailAddress, offset, exportPageSize)
+		if len(headers) == 0 {
+			break
+		}
+		for _, header := range headers {
+			draft := repo.LoadDraft(userId.EmailAddress, header.MessageID)
+			if draft == nil {
+				continue // sent or discarded since
+			}
+			n++
+			if err = writeExportJson(archive, fmt.Sprintf("drafts/%06d.json", n), draft); err != nil {
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// Writes an email as name.json, and its attachments under name/
+func writeExportEmail(archive *zip.Writer, name string, userId *UserID, id string) error {
+	email := exportedEmail{repo.LoadMessage(id), repo.BoxesForMessage(userId.EmailAddress, id)}
+	email.Attachments = repo.LoadAttachmentHeaders(id)
+	if err := writeExportJson(archive, name+".json", &email); err != nil {
+		return err
+	}
+	for _, header := range email.Attachments {
+		attachment := repo.LoadAttachment(id, header.ID)
+		if attachment == nil {
+			continue
+		}
+		file, err := archive.Create(fmt.Sprintf("%s/attachment-%d", name, header.ID))
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(file, attachment.CipherContent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportJson(archive *zip.Writer, name string, value interface{}) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(file).Encode(value)
+}
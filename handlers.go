@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
@@ -46,7 +47,7 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 // that the public key we send here matches the hash they requested
 func publicKeyHandler(w http.ResponseWriter, r *http.Request) {
 	userPubHash := validateHash(r.URL.Path[len("/user/"):])
-	userPub := LoadPubKey(userPubHash)
+	userPub := repo.LoadPubKey(userPubHash)
 	if userPub == "" {
 		http.Error(w, "Not found", http.StatusNotFound)
 	} else {
@@ -112,7 +113,7 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 		allMxHosts[mxHost] = struct{}{}
 	}
 	for mxHost, _ := range allMxHosts {
-		mxHostInfos[mxHost] = GetMxHostInfo(mxHost)
+		mxHostInfos[mxHost] = repo.GetMxHostInfo(mxHost)
 	}
 
 	res := PublicKeysResponse{}
@@ -145,8 +146,8 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if len(notaries) > 1 || notaries[0] != GetConfig().SmtpMxHost {
-			log.Panicf("Expected 0 or 1 notary @" + GetConfig().SmtpMxHost +
-				", got [" + strings.Join(notaries, ",") + "]")
+			log.Panicf("Expected 0 or 1 notary @%s, got [%s]",
+				GetConfig().SmtpMxHost, strings.Join(notaries, ","))
 		}
 	}
 
@@ -217,12 +218,12 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			for _, addr := range pubKeyLookup {
 				name, hash := addr.NameAndHash()
-				pubHash := LoadPubHash(name, addr.Host)
+				pubHash := repo.LoadPubHash(name, addr.Host)
 				if pubHash == "" {
 					res.PublicKeys[addr.StringNoHash()] = &PublicKeysPubKeyError{PublicKeysStatusNoSuchUser, "", "Unknown address " + addr.StringNoHash()}
 					continue
 				}
-				pubKey := LoadPubKey(pubHash)
+				pubKey := repo.LoadPubKey(pubHash)
 				if hash == "" || pubHash == hash {
 					res.PublicKeys[addr.StringNoHash()] = &PublicKeysPubKeyError{PublicKeysStatusOK, pubKey, ""}
 				} else {
@@ -279,7 +280,7 @@ func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
 				if mxHostInfos[mxHost] == nil {
 					mxHostInfos[mxHost] = TrySetMxHostInfo(mxHost, false, "")
 				}
-				log.Println("Error in /publickeys/query json parse: %s", err.Error())
+				log.Printf("Error in /publickeys/query json parse: %s", err.Error())
 				continue
 			} else {
 				// Hey, a scramble host.
@@ -387,7 +388,7 @@ func reverseQueryHandler(w http.ResponseWriter, r *http.Request, userId *UserID)
 		if pubHash == "" {
 			continue
 		}
-		address := LoadAddressFromPubHash(pubHash)
+		address := repo.LoadAddressFromPubHash(pubHash)
 		res[pubHash] = address
 	}
 	resJson, err := json.Marshal(res)
@@ -416,13 +417,13 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Woot! New user %s %s\n", user.Token, user.PublicHash)
 
-	if !SaveUser(user) {
+	if !repo.SaveUser(user) {
 		http.Error(w, "That username is taken", http.StatusBadRequest)
 		return
 	}
 
 	// Add user to local name_resolution table
-	AddNameResolution(user.Token, user.EmailHost, user.PublicHash)
+	repo.AddNameResolution(user.Token, user.EmailHost, user.PublicHash)
 
 	// Seed user token & hash to notaries.
 	SeedUserToNotaries(user)
@@ -436,7 +437,7 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 // the user makes changes, the client encrypts and posts all contacts
 func contactsHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	if r.Method == "GET" {
-		cipherContactsHex := LoadContacts(userId.Token)
+		cipherContactsHex := repo.LoadContacts(userId.Token)
 		if cipherContactsHex == nil {
 			http.Error(w, "Not found", http.StatusNotFound)
 		} else {
@@ -447,13 +448,77 @@ func contactsHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 		if err != nil {
 			panic(err)
 		}
-		SaveContacts(userId.Token, string(cipherContactsHex))
+		repo.SaveContacts(userId.Token, string(cipherContactsHex))
 	}
 }
 
+// Most chunks one POST /user/me/search may save, and the longest chunk
+const (
+	searchMaxChunks     = 64
+	searchMaxChunkBytes = 256 * 1024
+)
+
+// GET /user/me/search?since=<version> for the chunks of the logged-in
+// user's encrypted search index that changed after that version, all of
+// them without it. Deleted chunks come back without CipherData.
+// POST /user/me/search saves chunks from a {BaseVersion, Chunks} JSON
+// body, a chunk without CipherData deletes it. If another device saved
+// since BaseVersion, it fails with HTTP 409 (Conflict) and the chunks
+// the client is missing, it merges them and tries again.
+// Like contacts, the chunks are encrypted on the client.
+func searchIndexHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	var res interface{}
+	if r.Method == "GET" {
+		since := int64(0)
+		if sinceStr := r.FormValue("since"); sinceStr != "" {
+			since = validateSearchVersion(sinceStr)
+		}
+		res = repo.LoadSearchIndex(userId.Token, since)
+	} else if r.Method == "POST" {
+		var update struct {
+			BaseVersion int64
+			Chunks      []SearchChunk
+		}
+		body := http.MaxBytesReader(w, r.Body, searchMaxChunks*(searchMaxChunkBytes+1024))
+		if err := json.NewDecoder(body).Decode(&update); err != nil {
+			http.Error(w, "Expected a search index update", http.StatusBadRequest)
+			return
+		}
+		if len(update.Chunks) == 0 || len(update.Chunks) > searchMaxChunks {
+			http.Error(w, fmt.Sprintf("Expected 1 to %d chunks", searchMaxChunks), http.StatusBadRequest)
+			return
+		}
+		for _, chunk := range update.Chunks {
+			validateSearchChunkID(chunk.ID)
+			if len(chunk.CipherData) > searchMaxChunkBytes {
+				http.Error(w, "Chunk "+chunk.ID+" is too long", http.StatusBadRequest)
+				return
+			}
+			if chunk.CipherData != "" {
+				validateHex(chunk.CipherData)
+			}
+		}
+		version, saved := repo.SaveSearchChunks(userId.Token, update.BaseVersion, update.Chunks)
+		if saved {
+			res = &SearchIndex{version, []SearchChunk{}}
+		} else {
+			w.WriteHeader(http.StatusConflict)
+			res = repo.LoadSearchIndex(userId.Token, update.BaseVersion)
+		}
+	} else {
+		http.Error(w, "Expected GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	resJson, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJson)
+}
+
 // GET /user/me/key for the logged-in user's encrypted private key
 func privateKeyHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
-	user := LoadUser(userId.Token)
+	user := repo.LoadUser(userId.Token)
 	if user == nil {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -461,6 +526,159 @@ func privateKeyHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	w.Write([]byte(user.CipherPrivateKey))
 }
 
+// POST /user/me/password changes the logged-in user's passphrase.
+// passHash or passHashOld prove they know the current one, newPassHash
+// replaces both and newCipherPrivateKey is the private key encrypted
+// with the new one. Old accounts use this to retire their SHA1 hash.
+// Ends all of the user's sessions and responds with a new one, like
+// loginHandler.
+func passwordHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	newPassHash := validatePassHash(r.FormValue("newPassHash"))
+	newCipherPrivateKey := validateHex(r.FormValue("newCipherPrivateKey"))
+	if !repo.ChangePassword(userId.Token, r.FormValue("passHash"), r.FormValue("passHashOld"),
+		newPassHash, newCipherPrivateKey) {
+		http.Error(w, "Incorrect passphrase", http.StatusUnauthorized)
+		return
+	}
+	count := repo.DeleteSessions(userId.Token)
+	log.Printf("Changed the passphrase of %s, ended %d session(s)\n", userId.Token, count)
+	audit(userId.Token, r, auditPasswordChange)
+	writeNewSession(w, userId)
+}
+
+// Two-factor authentication, see totp.go.
+// GET /user/me/totp/ says whether it is on, POST /user/me/totp/enroll
+// with the passphrase hashes starts over with a new secret and recovery
+// codes, POST /user/me/totp/verify with a code from the app turns it on
+// and POST /user/me/totp/disable with the passphrase hash and a code
+// turns it off.
+func totpHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	action := r.URL.Path[len("/user/me/totp/"):]
+	if action == "" && r.Method == "GET" {
+		totp := repo.LoadTotp(userId.Token)
+		resJson, err := json.Marshal(struct{ Enabled bool }{totp != nil && totp.Enabled})
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resJson)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "enroll":
+		if !reauthenticate(w, r, userId, false) {
+			return
+		}
+		secret := newTotpSecret()
+		codes, hashes := newRecoveryCodes()
+		if !repo.SaveTotp(userId.Token, secret, hashes) {
+			http.Error(w, "Two-factor authentication is already on", http.StatusConflict)
+			return
+		}
+		resJson, err := json.Marshal(struct {
+			Secret        string
+			URI           string
+			RecoveryCodes []string
+		}{secret, totpURI(secret, userId.EmailAddress), codes})
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resJson)
+	case "verify":
+		totp := repo.LoadTotp(userId.Token)
+		if totp == nil || totp.Enabled {
+			http.Error(w, "Nothing to verify, enroll first", http.StatusConflict)
+			return
+		}
+		if !checkTotpCode(userId.Token, totp, r.FormValue("code"), time.Now()) ||
+			!repo.EnableTotp(userId.Token) {
+			http.Error(w, "Incorrect two-factor code", http.StatusUnauthorized)
+			return
+		}
+		count := repo.DeleteSessions(userId.Token)
+		log.Printf("Turned on two-factor authentication for %s, ended %d session(s)\n",
+			userId.Token, count)
+		audit(userId.Token, r, auditTotpEnabled)
+		writeNewSession(w, userId)
+	case "disable":
+		if !reauthenticate(w, r, userId, true) {
+			return
+		}
+		repo.DeleteTotp(userId.Token)
+		log.Printf("Turned off two-factor authentication for %s\n", userId.Token)
+		audit(userId.Token, r, auditTotpDisabled)
+	default:
+		http.Error(w, "Unknown action "+action, http.StatusNotFound)
+	}
+}
+
+// GET /user/me/audit?offset=&limit= returns the user's audit log,
+// newest first, at most auditMaxEvents at a time
+func auditHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	query := r.URL.Query()
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		http.Error(w, "Expected a non-negative offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 0 {
+		http.Error(w, "Expected a non-negative limit", http.StatusBadRequest)
+		return
+	}
+	if limit > auditMaxEvents {
+		limit = auditMaxEvents
+	}
+	resJson, err := json.Marshal(struct {
+		Events []AuditEvent
+	}{repo.LoadAuditEvents(userId.Token, offset, limit)})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJson)
+}
+
+// GET /user/me/export streams a zip of everything the user has here,
+// see writeExport
+func exportHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	if r.Method != "GET" {
+		http.Error(w, "Expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"scramble-"+userId.Token+".zip\"")
+	if err := writeExport(w, userId); err != nil {
+		// too late for an error status, the client gets a broken zip
+		log.Printf("Export for %s failed: %v\n", userId.Token, err)
+	}
+}
+
+// POST /user/me/delete with the passphrase hashes, and a code for users
+// with two-factor authentication, deletes the account for good.
+// Their mail goes too, unless someone else here has a copy.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !reauthenticate(w, r, userId, true) {
+		return
+	}
+	count := repo.DeleteMailbox(userId.EmailAddress)
+	repo.DeleteNameResolution(userId.Token, userId.EmailHost)
+	// last, so the user can try again if anything before fails
+	repo.DeleteUser(userId.Token)
+	log.Printf("Deleted account %s with %d box row(s)\n", userId.Token, count)
+}
+
 func computeEmailHost(requestHost string) string {
 	if requestHost == "localhost" || strings.HasPrefix(requestHost, "localhost:") {
 		return GetConfig().SmtpMxHost
@@ -477,6 +695,113 @@ func computeEmailHost(requestHost string) string {
 	}
 }
 
+//
+// SESSION ROUTE
+//
+
+// POST /login with token, passHash and passHashOld starts a session.
+// Users with two-factor authentication also send totpCode.
+// Returns the session secret, which the client sends as the
+// x-scramble-session header from then on, and when it expires.
+// Too many failures lock the account or client out, see LoginPolicy.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ip := r.FormValue("token"), requestIP(r)
+	if wait := loginPolicy.Check(token, ip); wait > 0 {
+		tooManyFailures(w, wait)
+		return
+	}
+	userId, err := authenticateUserPass(token, r.FormValue("passHash"), r.FormValue("passHashOld"))
+	if err == nil {
+		totpCode := r.FormValue("totpCode")
+		err = authenticateSecondFactor(userId, totpCode)
+		if err != nil && totpCode == "" {
+			// the client asks for the code next, that's no failure
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	if err != nil {
+		lockedOut := loginPolicy.Fail(token, ip)
+		if repo.LoadUserID(token) != nil {
+			audit(token, r, auditLoginFailed)
+			if lockedOut {
+				audit(token, r, auditLockedOut)
+			}
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	loginPolicy.Succeed(token)
+	audit(token, r, auditLogin)
+	writeNewSession(w, userId)
+}
+
+// Checks the passphrase of a signed in user again, and their two-factor
+// code if checkCode is set, before something that can't be undone.
+// Failures count like failed logins, a stolen session is no way around
+// LoginPolicy. Responds with the error and returns false if it fails.
+func reauthenticate(w http.ResponseWriter, r *http.Request, userId *UserID, checkCode bool) bool {
+	ip := requestIP(r)
+	if wait := loginPolicy.Check(userId.Token, ip); wait > 0 {
+		tooManyFailures(w, wait)
+		return false
+	}
+	_, err := authenticateUserPass(userId.Token, r.FormValue("passHash"), r.FormValue("passHashOld"))
+	if err == nil && checkCode {
+		err = authenticateSecondFactor(userId, r.FormValue("code"))
+	}
+	if err != nil {
+		audit(userId.Token, r, auditLoginFailed)
+		if loginPolicy.Fail(userId.Token, ip) {
+			audit(userId.Token, r, auditLockedOut)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	loginPolicy.Succeed(userId.Token)
+	return true
+}
+
+// Responds to a client that is locked out for wait, see LoginPolicy
+func tooManyFailures(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+// Starts a session for the user, responds with its secret and expiry
+func writeNewSession(w http.ResponseWriter, userId *UserID) {
+	secret, session := startSession(userId, time.Now())
+	resJson, err := json.Marshal(struct {
+		Session string
+		Expires int64
+	}{secret, session.Expires})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(resJson)
+}
+
+// POST /logout ends the session it is sent with.
+// everywhere=true ends all of the user's sessions, on every device.
+func logoutHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("everywhere") == "true" {
+		count := repo.DeleteSessions(userId.Token)
+		log.Printf("Signed %s out of %d session(s)\n", userId.Token, count)
+		audit(userId.Token, r, auditLogoutAll)
+	} else {
+		repo.DeleteSession(sessionKey(r.Header.Get("x-scramble-session")))
+		audit(userId.Token, r, auditLogout)
+	}
+}
+
 //
 // INBOX ROUTE
 //
@@ -498,9 +823,28 @@ func inboxHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 
 	var emailHeaders []EmailHeader
 	var total int
-	if box == "inbox" || box == "archive" || box == "sent" {
-		emailHeaders = LoadBoxByThread(userId.EmailAddress, box, offset, limit)
-		total, err = CountBox(userId.EmailAddress, box)
+	var unread int
+	if box == "inbox" || box == "archive" || box == "sent" || box == "spam" || box == "trash" {
+		emailHeaders = repo.LoadBoxByThread(userId.EmailAddress, box, offset, limit)
+		total, err = repo.CountBox(userId.EmailAddress, box)
+		if err != nil {
+			panic(err)
+		}
+		unread, err = repo.CountUnread(userId.EmailAddress, box)
+		if err != nil {
+			panic(err)
+		}
+	} else if box == "drafts" {
+		emailHeaders = repo.LoadDrafts(userId.EmailAddress, offset, limit)
+		total, err = repo.CountDrafts(userId.EmailAddress)
+		if err != nil {
+			panic(err)
+		}
+	} else if strings.HasPrefix(box, "label/") {
+		// /box/label/<id> lists the threads with that label
+		id := validateLabelID(box[len("label/"):])
+		emailHeaders = repo.LoadLabelByThread(userId.EmailAddress, id, offset, limit)
+		total, err = repo.CountLabel(userId.EmailAddress, id)
 		if err != nil {
 			panic(err)
 		}
@@ -518,6 +862,7 @@ func inboxHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	summary.Offset = offset
 	summary.Limit = limit
 	summary.Total = total
+	summary.Unread = unread
 	summary.EmailHeaders = emailHeaders
 
 	summaryJson, err := json.Marshal(summary)
@@ -548,11 +893,14 @@ func emailFetchHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	// We may need this in the future:
 	_ = validateBox(r.FormValue("box"))
 
-	threadEmails := LoadThreadFromBoxes(userId.EmailAddress, threadID)
+	threadEmails := repo.LoadThreadFromBoxes(userId.EmailAddress, threadID)
 	if len(threadEmails) == 0 {
 		http.Error(w, "Not found or unauthorized", http.StatusUnauthorized)
 		return
 	}
+	for i := range threadEmails {
+		threadEmails[i].Attachments = repo.LoadAttachmentHeaders(threadEmails[i].MessageID)
+	}
 	resJson, err := json.Marshal(threadEmails)
 	if err != nil {
 		panic(err)
@@ -560,28 +908,146 @@ func emailFetchHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	w.Write(resJson)
 }
 
-// PUT /email/id can change things about an email, eg what box it's in
+// PUT /email/id can change things about an email, eg what box it's in.
+// Moving it into or out of spam, plaintext trains the spam model.
+// undelete=true moves it out of the trash, back where it came from.
+// addLabels=1,2 and removeLabels=3 change its labels instead.
 func emailBoxHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	id := validateMessageID(r.URL.Path[len("/email/"):])
-	newBox := validateBox(r.FormValue("box"))
 	moveThread := (r.FormValue("moveThread") == "true")
 
-	// For now just delete emails instead of moving to "trash".
+	if r.FormValue("addLabels") != "" || r.FormValue("removeLabels") != "" {
+		emailLabelHandler(w, r, userId, id, moveThread)
+		return
+	}
+
+	if r.FormValue("undelete") == "true" {
+		if moveThread {
+			repo.UndeleteThread(userId.EmailAddress, id)
+		} else {
+			repo.UndeleteEmail(userId.EmailAddress, id)
+		}
+		return
+	}
+
+	// Trashed mail is deleted for good after Config.TrashRetentionDays
+	newBox := validateBox(r.FormValue("box"))
 	if newBox == "trash" {
+		now := time.Now().Unix()
 		if moveThread {
-			DeleteThreadFromBoxes(userId.EmailAddress, id)
+			repo.TrashThread(userId.EmailAddress, id, now)
 		} else {
-			DeleteFromBoxes(userId.EmailAddress, id)
+			repo.TrashEmail(userId.EmailAddress, id, now)
 		}
 	} else {
+		trainSpamOnMove(userId.EmailAddress, id, newBox, r.FormValue("plaintext"))
 		if moveThread {
-			MoveThread(userId.EmailAddress, id, newBox)
+			repo.MoveThread(userId.EmailAddress, id, newBox)
 		} else {
-			MoveEmail(userId.EmailAddress, id, newBox)
+			repo.MoveEmail(userId.EmailAddress, id, newBox)
+		}
+	}
+}
+
+// Mail the user moves into the spam box, or out of it, is spam or isn't.
+// Only the client can read it, so it sends the plaintext subject and body
+// along for the spam model. It isn't kept, see bayesSpamFilter.Train.
+func trainSpamOnMove(address, id, newBox, plaintext string) {
+	if plaintext == "" {
+		return
+	}
+	wasSpam, wasHam := false, false
+	for _, box := range repo.BoxesForMessage(address, id) {
+		wasSpam = wasSpam || box == "spam"
+		wasHam = wasHam || box == "inbox" || box == "archive"
+	}
+	var err error
+	if newBox == "spam" && wasHam && !wasSpam {
+		err = bayesFilter.Train(plaintext, true)
+	} else if newBox != "spam" && wasSpam {
+		err = bayesFilter.Train(plaintext, false)
+	}
+	if err != nil {
+		log.Printf("Can't train the spam model: %v\n", err)
+	}
+}
+
+// PUT /email/flags sets flags on many emails at once, eg to mark a
+// thread read. msgIds and threadIds are comma separated, read and
+// starred are "true" or "false". Flags that aren't given stay as they are.
+func emailFlagsHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	if r.Method != "PUT" {
+		http.Error(w, "Expected PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	msgIDs, threadIDs := []string{}, []string{}
+	for _, id := range strings.Split(r.FormValue("msgIds"), ",") {
+		if id != "" {
+			msgIDs = append(msgIDs, validateMessageID(id))
+		}
+	}
+	for _, id := range strings.Split(r.FormValue("threadIds"), ",") {
+		if id != "" {
+			threadIDs = append(threadIDs, validateMessageID(id))
+		}
+	}
+	flags := map[string]bool{}
+	for _, flag := range []string{"read", "starred"} {
+		switch r.FormValue(flag) {
+		case "":
+		case "true":
+			flags[flag] = true
+		case "false":
+			flags[flag] = false
+		default:
+			http.Error(w, "Expected "+flag+"=true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	for flag, value := range flags {
+		repo.SetFlag(userId.EmailAddress, msgIDs, flag, value)
+		repo.SetThreadFlag(userId.EmailAddress, threadIDs, flag, value)
+	}
+}
+
+// Applies and removes labels, on one email or its whole thread
+func emailLabelHandler(w http.ResponseWriter, r *http.Request, userId *UserID, id string, wholeThread bool) {
+	messageIDs := []string{id}
+	if wholeThread {
+		threadIDs := repo.LoadThreadIDsForMessageIDs([]interface{}{id})
+		messageIDs = nil
+		if len(threadIDs) > 0 && threadIDs[0] != "" {
+			for _, email := range repo.LoadThreadFromBoxes(userId.EmailAddress, threadIDs[0]) {
+				messageIDs = append(messageIDs, email.MessageID)
+			}
+		}
+		if len(messageIDs) == 0 {
+			http.Error(w, "No such email "+id, http.StatusNotFound)
+			return
+		}
+	}
+	for _, param := range []string{"addLabels", "removeLabels"} {
+		for _, labelID := range strings.Split(r.FormValue(param), ",") {
+			if labelID == "" {
+				continue
+			}
+			ok := false
+			if param == "addLabels" {
+				ok = repo.AddLabel(userId.EmailAddress, validateLabelID(labelID), messageIDs)
+			} else {
+				ok = repo.RemoveLabel(userId.EmailAddress, validateLabelID(labelID), messageIDs)
+			}
+			if !ok {
+				http.Error(w, "No such label "+labelID, http.StatusNotFound)
+				return
+			}
 		}
 	}
 }
 
+// Total size of the files attached to an email we send
+const maxAttachmentBytes = 10 << 20
+
 // POST /email/ creates a new email from auth user
 func emailSendHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	email := new(Email)
@@ -593,6 +1059,11 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 	email.From = userId.EmailAddress
 	email.To = r.FormValue("to")
 
+	// Sending a draft keeps its thread, see draftHandler
+	if draft := repo.LoadDraft(userId.EmailAddress, email.MessageID); draft != nil {
+		email.ThreadID = draft.ThreadID
+	}
+
 	// XXX remove this case
 	if r.FormValue("cipherBody") == "" { // unencrypted
 		email.CipherSubject = r.FormValue("subject")
@@ -602,12 +1073,23 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 		email.CipherBody = validateMessageArmor(r.FormValue("cipherBody"))
 	}
 
+	// Files come as multipart/form-data, PGP encrypted like the body
+	attachments, err := readAttachmentUploads(r, email.MessageID, r.FormValue("cipherBody") != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// TODO: consider if transactions are required.
 	// TODO: saveMessage may fail if messageId is not unique.
-	SaveMessage(email)
+	repo.SaveMessage(email)
+	for _, attachment := range attachments {
+		repo.SaveAttachment(attachment)
+	}
 
 	// add message to sender's sent box
-	AddMessageToBox(email, userId.EmailAddress, "sent")
+	repo.AddMessageToBox(email, userId.EmailAddress, "sent")
+	repo.DeleteDraft(userId.EmailAddress, email.MessageID)
 
 	// TODO: separate goroutine?
 	// TODO: parallize mx lookup?
@@ -633,7 +1115,7 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 		if mxHost == GetConfig().SmtpMxHost {
 			// add to inbox locally
 			for _, addr := range addrs {
-				AddMessageToBox(email, addr.String(), "inbox")
+				repo.AddMessageToBox(email, addr.String(), "inbox")
 			}
 			continue
 		}
@@ -643,7 +1125,170 @@ func emailSendHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
 		//  and only once for multiple recipients on the same mxHost.
 		// This is because SMTP can support sending the same email to
 		//  multiple recipients on the same host at once.
-		AddMessageToBox(email, mxHost, "outbox")
+		repo.AddMessageToBox(email, mxHost, "outbox")
+	}
+}
+
+// Reads the "attachment" files of a multipart/form-data request
+func readAttachmentUploads(r *http.Request, messageID string, encrypted bool) ([]*Attachment, error) {
+	if r.MultipartForm == nil || r.MultipartForm.File == nil {
+		return nil, nil
+	}
+	attachments := []*Attachment{}
+	total := 0
+	for i, fileHeader := range r.MultipartForm.File["attachment"] {
+		file, err := fileHeader.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if total += len(content); total > maxAttachmentBytes {
+			return nil, fmt.Errorf("Attachments are limited to %d bytes", maxAttachmentBytes)
+		}
+		if encrypted && !validateMessageArmorSafe(string(content)) {
+			return nil, fmt.Errorf("Attachment %s is not a PGP message", fileHeader.Filename)
+		}
+		contentType := fileHeader.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachments = append(attachments, &Attachment{
+			AttachmentHeader: AttachmentHeader{
+				ID:          i + 1,
+				Filename:    fileHeader.Filename,
+				ContentType: contentType,
+			},
+			MessageID:     messageID,
+			CipherContent: string(content),
+		})
+	}
+	return attachments, nil
+}
+
+// GET /email/attachment?msgId=...&id=... returns one attachment of an
+// email in one of the user's boxes, as a PGP message
+func attachmentHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	msgID := validateMessageID(r.FormValue("msgId"))
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid attachment id", http.StatusBadRequest)
+		return
+	}
+	var attachment *Attachment
+	if len(repo.BoxesForMessage(userId.EmailAddress, msgID)) > 0 {
+		attachment = repo.LoadAttachment(msgID, id)
+	}
+	if attachment == nil {
+		http.Error(w, "Not found or unauthorized", http.StatusUnauthorized)
+		return
+	}
+	filename := attachment.Filename
+	if !strings.HasSuffix(filename, ".asc") {
+		filename += ".asc"
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": filename}))
+	w.Write([]byte(attachment.CipherContent))
+}
+
+//
+// LABEL ROUTE
+//
+
+// GET /label/ lists the user's labels, POST /label/ creates one.
+// PUT /label/<id> renames it, DELETE /label/<id> deletes it.
+// Names are PGP messages only the user can decrypt, the server never
+// learns them. Emails are labeled through PUT /email/<id>.
+func labelHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	idStr := r.URL.Path[len("/label/"):]
+	if idStr == "" {
+		var resJson []byte
+		var err error
+		if r.Method == "GET" {
+			resJson, err = json.Marshal(repo.LoadLabels(userId.EmailAddress))
+		} else if r.Method == "POST" {
+			cipherName := validateMessageArmor(r.FormValue("cipherName"))
+			id := repo.CreateLabel(userId.EmailAddress, cipherName)
+			resJson, err = json.Marshal(Label{id, cipherName})
+		} else {
+			http.Error(w, "Expected GET or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resJson)
+		return
+	}
+
+	id := validateLabelID(idStr)
+	found := false
+	if r.Method == "PUT" {
+		cipherName := validateMessageArmor(r.FormValue("cipherName"))
+		found = repo.RenameLabel(userId.EmailAddress, id, cipherName)
+	} else if r.Method == "DELETE" {
+		found = repo.DeleteLabel(userId.EmailAddress, id)
+	} else {
+		http.Error(w, "Expected PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if !found {
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+//
+// DRAFT ROUTE
+//
+
+// GET /draft/<id> loads a draft to edit it, PUT /draft/<id> creates or
+// updates it as the user types, DELETE /draft/<id> discards it.
+// /box/drafts lists them. Drafts are encrypted for the user alone, to
+// send one the client encrypts it for the recipients and POSTs it to
+// /email/ with the draft's id as msgId.
+func draftHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	id := validateMessageID(r.URL.Path[len("/draft/"):])
+	if r.Method == "GET" {
+		draft := repo.LoadDraft(userId.EmailAddress, id)
+		if draft == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		resJson, err := json.Marshal(draft)
+		if err != nil {
+			panic(err)
+		}
+		w.Write(resJson)
+	} else if r.Method == "PUT" {
+		// a late autosave must not bring back mail that was sent.
+		// Only the user's own mail counts, anyone can pick a message id.
+		for _, box := range repo.BoxesForMessage(userId.EmailAddress, id) {
+			if box == "sent" {
+				http.Error(w, "Already sent", http.StatusConflict)
+				return
+			}
+		}
+		draft := new(Email)
+		draft.MessageID = id
+		draft.ThreadID = validateMessageID(r.FormValue("threadId"))
+		draft.AncestorIDs = ParseAngledEmailAddresses(r.FormValue("ancestorIds"), " ").
+			AngledStringCappedToBytes(" ", GetConfig().AncestorIDsMaxBytes)
+		draft.UnixTime = time.Now().Unix()
+		draft.To = r.FormValue("to")
+		draft.CipherSubject = validateMessageArmor(r.FormValue("cipherSubject"))
+		draft.CipherBody = validateMessageArmor(r.FormValue("cipherBody"))
+		repo.SaveDraft(userId.EmailAddress, draft)
+	} else if r.Method == "DELETE" {
+		if !repo.DeleteDraft(userId.EmailAddress, id) {
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	} else {
+		http.Error(w, "Expected GET, PUT or DELETE", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -690,6 +1335,28 @@ func notaryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(resJson)
 }
 
+// GET /admin/dkim to see the DKIM TXT record that must be published
+// for an email host, ?host= or the host of this request.
+// Creates the key if the host doesn't have one yet.
+func dkimRecordHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	host := strings.ToLower(strings.TrimSpace(r.FormValue("host")))
+	if host == "" {
+		host = computeEmailHost(r.Host)
+	}
+	name, value := dkimTxtRecord(dkimKeyForHost(host))
+
+	resJson, err := json.Marshal(struct {
+		Name  string `json:"name"`
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}{name, "TXT", value})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resJson)
+}
+
 func publicKeySeedHandler(w http.ResponseWriter, r *http.Request) {
 	address := ParseEmailAddress(r.FormValue("address"))
 	pubHash := validateHash(r.FormValue("pubHash"))
@@ -701,12 +1368,12 @@ func publicKeySeedHandler(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: maybe also do a sanity check on the timestamp.
 
-	mxHost, err := mxLookUp(address.Host)
+	mxHost, err := mxLookUpPrimary(address.Host)
 	if err != nil {
 		log.Panicf("Cannot seed address %v, mx lookup failed.", address.String())
 	}
 
-	mxHostInfo := GetMxHostInfo(mxHost)
+	mxHostInfo := repo.GetMxHostInfo(mxHost)
 	if mxHostInfo == nil || mxHostInfo.NotaryPublicKey == "" {
 		resp, err := http.Get("https://"+mxHost+"/publickeys/notary")
 		if err != nil {
@@ -725,17 +1392,42 @@ func publicKeySeedHandler(w http.ResponseWriter, r *http.Request) {
 			log.Panicf("Cannot seed address %v,"+
 				" could not parse mx host notary info", address.String())
 		}
-		mxHostInfo = SetMxHostInfo(mxHost, true, parsed.PubKey)
+		mxHostInfo = repo.SetMxHostInfo(mxHost, true, parsed.PubKey)
 	}
 
 	signed := StringForNotaryToSign(address.Name, address.Host, pubHash, timestamp)
 	ok := VerifySignature(mxHostInfo.NotaryPublicKey, signed, signature)
 
 	if ok {
-		AddNameResolution(address.Name, address.Host, pubHash)
+		repo.AddNameResolution(address.Name, address.Host, pubHash)
 		// TODO respond with our own signature to speed up user account creation.
 	} else {
 		log.Panicf("Cannot seed address %v, bad signature!", address.String())
 	}
 
 }
+
+//
+// ADMIN
+//
+
+// POST /admin/mx-cache/flush to forget cached MX lookups, eg after a
+// domain fixed its DNS. Flushes a single domain if ?host= is given.
+func mxCacheFlushHandler(w http.ResponseWriter, r *http.Request, userId *UserID) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host := strings.ToLower(strings.TrimSpace(r.FormValue("host")))
+	flushed := mxCache.Flush(host)
+	log.Printf("%s flushed %d mx cache entries (host %q)\n", userId.Token, flushed, host)
+
+	resJson, err := json.Marshal(struct {
+		Flushed int `json:"flushed"`
+	}{flushed})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resJson)
+}
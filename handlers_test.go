@@ -1,21 +1,27 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/base32"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
+	repo = NewMemoryRepo()
 	ensureTestUser()
 }
 
 func ensureTestUser() *User {
-	DeleteUser("test")
+	repo.DeleteUser("test")
 
 	user := &User{
 		UserID: UserID{
@@ -46,8 +52,11 @@ OewXcIuOdtHovjU05JwUjYcg30lZ
 		CipherPrivateKey: `11547b42d5b6219fc5937a1cf38ae2ef9c50267e7a93fa5c7c0517ae37f62a6e10edfbf9d2f2ac2f11d1cb8cd75ff7c471b61b11c8a8bfea9b39397a7c57a149ce5cb47cc11d3b8c313a082188ce266c1c61770c128bc7ede95597076d7cda44ee96b385e3b54df472a2520da0c76639aa381aa36a237e7eade675e6a7346c7fc029342c7585dcb02dc7d370393f9015bc93a66082854162959747dbce655b3f21f8fd994fac923c5aac5b367e699349e5adba05f763e176606c55d01800805d135439802709fd4a1334ca7649dc8a1e90f4fdaea209275839dea2b206ce0a1f914507ec7a70698303aaf33bd5065a1504bd2fad13bd4cb8d32aca58f3905ffb3b59dacbb5a2c12114512a366d1f129d334a9c457d5ad75ddc123e5d80f29470a0ebb017d7a2449c0d1edbbd4bef1f0258fe2095cc03a9e48a838b3549a2f503d5595e86f74c7f7708a643588159dbf09132204526734ecf901d6a76f42688cbef926c50efc6ad3e4a8f910ac15dd2e629a748075e11a8b4d8544e3381cf08acadf59d941708e247c0e35078916dff86476dea70e752c715cb228221b483388eb5dca1af3f3854117c31fd3c73c823ca005c11fad22f994395a9916c9c8a013c3d534464e638079d67711b373b7b5f2ba7ac1f6af02b53edd69c95c012bd601ba5246496d4ec8bf66f2080a9848e584f3e47b89f7e656439a330dafd08b25fc634ff5d73bdfbedd6de2a0fe0a61ade243a5987fe1ef09bb2671ada524cb183269bae23b29dfe4a2b53fb5ddc00f8650289ac7bbb9415454e73d051bdc97d6e9a8a8b98103e5926e186b65f1918c78599bf2212f2e2cba314aebf370720f38a1cf86b321b017cd6d71902537f4b21becc1e76ef7149cc1ecf204f27751f32197bed77605950a86308b712a4c4741ca0a20d76806a37219501b8603b588f576aff83d69e2b16916315904ee903535d9efb372df88bb472eda8000d0736eeff4410bb781f8de80115071164826aec58159681c3d14bc66727d85b2f0ce5d790d2530054e50bd9435fd5e6402ef9df428db3b11750ef75839b8f640407e16b8fc5d62c97afaa3927988e25f56048be3122e00c752a9192c4520075dd6df6481c15a9fb430a166d422b26f05004040be7f9311d912ce52971a3cce8409ff7b86fc5d86fdb94d53c63b20412b448e8f7d0873976a2679f04d692412b63df41c4a231358112c2c860a07aef2d689dbfde3b48237ba9cf31d258d82cd5fea68e02c336dbf644f10e5e8e98f98bf79308a5aae3195aec76a7ec5bd7b9832d4bfb1ece7589157f6b49dbc24560a267d51fa2bc5496666019853f39065cc21c5e07c1f73c439e64a2993f0909febc58a640e28f6c9fe5c4c0fc7cef80d1f0a548e4cdec8614246d2a4b6c42fd47f3b7616db858562ff88703e756790ebc3a71171ccc093899b3f3c7849f09da66364ce720bae92e5b107e7f342dd768f73330ec12f348f89978015f35c481a6a582915ecad39cdb451ea4c77a037bf3fe4738f33648017c43e4d6b6d21ec51bc7caa166cf667fa5d376958a90745d16a911912092ca01b2291abcc536ca90a919eb59b343c77b3054d090447b10cea61c12f657770988f6bf47a7c290c09151266f26803c2b11d3a886263e7b1314f7fcf7b652f0837b33bc6045b14f54ab692556d8c42eeaed634038b89923591a9f27f56c79562102223cfa1a3f5bac8bffdd179f0613a6fd69dd548a9666270b1005bb57de7ff6123994a7edc0265a7c6264febb449bd98c5081f12e2432624ccf59639f7ad89eb62746b810364a5754abbbc2e1990fa1e7ac80f868cc05b5f578ce63cb5d5bc5198ab6c469a63a45d2172cc79d387487760f0b1dda00f8021e492f1ed59e3c331d1e8bb616dbb5e78598e3d9aec83dba8f22039adeabaec11ca5c60c270d76864932604314a92035e93e7fb98751d9bc5efc47d48ddf106274581d19410c4934fc6bbb3ad3948d8b08bd46286f136bab271e71f8230392f96d36c0bc686746f6aeab61d55cdc58117f7a4a67838adeeab990dc56a5b0f5597c7c0b33e0c14c538807fcfb9f74ae881d5dffa365f37c1655e789ffb7fd764eedaab49281cdeeda406e7b0ea9126152093b3fa613838f20a53521b9417e6dd4752aff2eb9601f2873fbf1e921a60311102fc6b3d7bffb8431c3bad3df93fb2fe683191e674267a28c6c0eded4c47f76168241b3b5047945ebeb9051102ab602dc4e4fc21dda28917894357610eabce0e3d5dce40a6946b557328a0626881047a02426fdd5b83d177a5b1202073996d84702cadd9dcd0d16875262228d6ffc4de11ef5ad79b57016c5a4c7fd67174d62ddaea6e1f618cb5dd035a608b9bbef3a27ae83c794b0123003b2097ce58e008a44b219f2c3206864a81bc4e0a467704991bd1c1209f00260af96cfd52caf4d560770462859c87c1befc0b99a8f4b562abef9ea5d78482184e53eb9c00e45dad86dce04fc360ffaf8caec87d62f4220befed94d07255ea90e5ffbbfeaabfc6e3a7e3d476e94cd934c62057a31062a70`,
 		// vim syntax highlite fix `
 	}
-	SaveUser(user)
-	return LoadUser("test")
+	repo.SaveUser(user)
+	if repo.GetNameResolution(user.Token, user.EmailHost) == "" {
+		repo.AddNameResolution(user.Token, user.EmailHost, user.PublicHash)
+	}
+	return repo.LoadUser("test")
 }
 
 func requestLoggedIn(handler http.HandlerFunc, method string, path string, form url.Values) *httptest.ResponseRecorder {
@@ -91,11 +100,11 @@ func TestPublicKeysHandler(t *testing.T) {
 	}
 	var hostResultError = parsed.NameResolution[GetConfig().SmtpMxHost]
 	if hostResultError == nil {
-		log.Fatal("Name resolution failed for host %s", GetConfig().SmtpMxHost)
+		log.Fatalf("Name resolution failed for host %s", GetConfig().SmtpMxHost)
 	}
 	var notaryRes = hostResultError.Result[tUser.EmailAddress]
 	if notaryRes.PubHash != tUser.PublicHash {
-		log.Fatal("Name resolution should have returned pubHash for %s", tUser.EmailAddress)
+		log.Fatalf("Name resolution should have returned pubHash for %s", tUser.EmailAddress)
 	}
 	if notaryRes.Timestamp < 1380000000 || 9999999999 <= notaryRes.Timestamp {
 		log.Fatal("Timestamp out of range")
@@ -106,7 +115,7 @@ func TestPublicKeysHandler(t *testing.T) {
 
 	log.Printf("%v \n", parsed)
 	var dneRes = parsed.PublicKeys["doesnotexist@"+GetConfig().SmtpMxHost]
-	if dneRes.Error != "Unknown name doesnotexist" {
+	if dneRes.Error != "Unknown address doesnotexist@"+GetConfig().SmtpMxHost {
 		log.Fatal("Unexpected error message for name that does not exist")
 	}
 
@@ -116,3 +125,501 @@ func TestPublicKeysHandler(t *testing.T) {
 	}
 
 }
+
+// Calls a handler behind auth() as the test user. target may have a query.
+func requestAsTestUser(handler func(http.ResponseWriter, *http.Request, *UserID),
+	method string, target string, form url.Values) *httptest.ResponseRecorder {
+	record := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, nil)
+	req.Form = form
+	handler(record, req, repo.LoadUserID("test"))
+	return record
+}
+
+func TestLabelHandler(t *testing.T) {
+	tUser := ensureTestUser()
+	email := testEmail("labeled@"+GetConfig().SmtpMxHost, "labeled@"+GetConfig().SmtpMxHost, 100)
+	repo.SaveMessage(email)
+	repo.AddMessageToBox(email, tUser.EmailAddress, "inbox")
+
+	cipherName := "-----BEGIN PGP MESSAGE-----\n\nwork\n-----END PGP MESSAGE-----"
+	record := requestAsTestUser(labelHandler, "POST", "/label/", url.Values{"cipherName": {cipherName}})
+	var label Label
+	if err := json.Unmarshal(record.Body.Bytes(), &label); err != nil || label.CipherName != cipherName {
+		t.Fatalf("POST /label/ returned %d %s", record.Code, record.Body.String())
+	}
+	id := strconv.FormatInt(label.ID, 10)
+
+	record = requestAsTestUser(emailHandler, "PUT", "/email/"+email.MessageID,
+		url.Values{"addLabels": {id}, "moveThread": {"true"}})
+	if record.Code != http.StatusOK {
+		t.Fatalf("Labeling returned %d %s", record.Code, record.Body.String())
+	}
+	record = requestAsTestUser(emailHandler, "PUT", "/email/nosuchemail@"+GetConfig().SmtpMxHost,
+		url.Values{"addLabels": {id}, "moveThread": {"true"}})
+	if record.Code != http.StatusNotFound {
+		t.Fatalf("Labeling the thread of an unknown email returned %d", record.Code)
+	}
+	record = requestAsTestUser(inboxHandler, "GET", "/box/label/"+id+"?offset=0&limit=10", url.Values{})
+	var summary BoxSummary
+	if err := json.Unmarshal(record.Body.Bytes(), &summary); err != nil || summary.Total != 1 ||
+		summary.EmailHeaders[0].MessageID != email.MessageID {
+		t.Fatalf("GET /box/label/%s returned %d %s", id, record.Code, record.Body.String())
+	}
+
+	record = requestAsTestUser(labelHandler, "DELETE", "/label/"+id, url.Values{})
+	if record.Code != http.StatusOK || len(repo.LoadLabels(tUser.EmailAddress)) != 0 {
+		t.Fatalf("DELETE /label/%s returned %d", id, record.Code)
+	}
+	record = requestAsTestUser(labelHandler, "DELETE", "/label/"+id, url.Values{})
+	if record.Code != http.StatusNotFound {
+		t.Fatalf("Deleting a deleted label returned %d", record.Code)
+	}
+}
+
+func TestEmailFlagsHandler(t *testing.T) {
+	tUser := ensureTestUser()
+	email := testEmail("flagged@"+GetConfig().SmtpMxHost, "flagged@"+GetConfig().SmtpMxHost, 100)
+	repo.SaveMessage(email)
+	repo.AddMessageToBox(email, tUser.EmailAddress, "inbox")
+
+	record := requestAsTestUser(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", url.Values{})
+	var summary BoxSummary
+	if err := json.Unmarshal(record.Body.Bytes(), &summary); err != nil || summary.Unread == 0 {
+		t.Fatalf("GET /box/inbox returned %d %s", record.Code, record.Body.String())
+	}
+	unread := summary.Unread
+
+	record = requestAsTestUser(emailFlagsHandler, "PUT", "/email/flags",
+		url.Values{"threadIds": {email.ThreadID}, "read": {"true"}, "starred": {"true"}})
+	if record.Code != http.StatusOK {
+		t.Fatalf("PUT /email/flags returned %d %s", record.Code, record.Body.String())
+	}
+	record = requestAsTestUser(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", url.Values{})
+	if err := json.Unmarshal(record.Body.Bytes(), &summary); err != nil || summary.Unread != unread-1 {
+		t.Fatalf("GET /box/inbox returned %d %s", record.Code, record.Body.String())
+	}
+
+	record = requestAsTestUser(emailFlagsHandler, "PUT", "/email/flags",
+		url.Values{"msgIds": {email.MessageID}, "read": {"false"}, "starred": {"maybe"}})
+	if record.Code != http.StatusBadRequest {
+		t.Fatalf("PUT /email/flags with a bad value returned %d", record.Code)
+	}
+	thread := repo.LoadThreadFromBoxes(tUser.EmailAddress, email.ThreadID)
+	if !thread[0].Read || !thread[0].Starred {
+		t.Fatalf("A bad request changed flags: %v", thread[0])
+	}
+}
+
+func TestSearchIndexHandler(t *testing.T) {
+	ensureTestUser()
+	post := func(body string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/user/me/search", strings.NewReader(body))
+		searchIndexHandler(record, req, repo.LoadUserID("test"))
+		return record
+	}
+	var index SearchIndex
+	record := post(`{"BaseVersion": 0, "Chunks": [{"ID": "terms-0", "CipherData": "c0ffee"}]}`)
+	if err := json.Unmarshal(record.Body.Bytes(), &index); err != nil || record.Code != http.StatusOK || index.Version != 1 {
+		t.Fatalf("POST /user/me/search returned %d %s", record.Code, record.Body.String())
+	}
+
+	// a device that hasn't seen version 1 gets it back with the conflict
+	record = post(`{"BaseVersion": 0, "Chunks": [{"ID": "terms-1", "CipherData": "beef"}]}`)
+	if err := json.Unmarshal(record.Body.Bytes(), &index); err != nil || record.Code != http.StatusConflict ||
+		index.Version != 1 || len(index.Chunks) != 1 || index.Chunks[0].CipherData != "c0ffee" {
+		t.Fatalf("POST /user/me/search returned %d %s for a stale version", record.Code, record.Body.String())
+	}
+	if record = post(`{"BaseVersion": 1, "Chunks": []}`); record.Code != http.StatusBadRequest {
+		t.Fatalf("POST /user/me/search returned %d without chunks", record.Code)
+	}
+
+	record = requestAsTestUser(searchIndexHandler, "GET", "/user/me/search", url.Values{"since": {"1"}})
+	if err := json.Unmarshal(record.Body.Bytes(), &index); err != nil || index.Version != 1 || len(index.Chunks) != 0 {
+		t.Fatalf("GET /user/me/search returned %d %s", record.Code, record.Body.String())
+	}
+}
+
+func TestDraftHandler(t *testing.T) {
+	tUser := ensureTestUser()
+	msgID := "draft@" + GetConfig().SmtpMxHost
+	threadID := "draft-thread@" + GetConfig().SmtpMxHost
+	draft := url.Values{
+		"threadId":      {threadID},
+		"to":            {tUser.EmailAddress},
+		"cipherSubject": {"-----BEGIN PGP MESSAGE-----\n\nsubject\n-----END PGP MESSAGE-----"},
+		"cipherBody":    {"-----BEGIN PGP MESSAGE-----\n\nbody\n-----END PGP MESSAGE-----"},
+	}
+	if record := requestAsTestUser(draftHandler, "PUT", "/draft/"+msgID, draft); record.Code != http.StatusOK {
+		t.Fatalf("PUT /draft/ returned %d %s", record.Code, record.Body.String())
+	}
+	record := requestAsTestUser(draftHandler, "GET", "/draft/"+msgID, url.Values{})
+	var loaded Email
+	if err := json.Unmarshal(record.Body.Bytes(), &loaded); err != nil || loaded.ThreadID != threadID {
+		t.Fatalf("GET /draft/ returned %d %s", record.Code, record.Body.String())
+	}
+	record = requestAsTestUser(inboxHandler, "GET", "/box/drafts?offset=0&limit=10", url.Values{})
+	var summary BoxSummary
+	if err := json.Unmarshal(record.Body.Bytes(), &summary); err != nil || summary.Total != 1 {
+		t.Fatalf("GET /box/drafts returned %d %s", record.Code, record.Body.String())
+	}
+
+	// sending it keeps the draft's id and thread, and replaces the draft
+	sent := url.Values{
+		"msgId":         {msgID},
+		"threadId":      {msgID},
+		"to":            {tUser.EmailAddress},
+		"cipherSubject": draft["cipherSubject"],
+		"cipherBody":    draft["cipherBody"],
+	}
+	if record = requestAsTestUser(emailHandler, "POST", "/email/", sent); record.Code != http.StatusOK {
+		t.Fatalf("POST /email/ returned %d %s", record.Code, record.Body.String())
+	}
+	if email := repo.LoadMessage(msgID); email.ThreadID != threadID {
+		t.Fatalf("Sent the draft in thread %s, expected %s", email.ThreadID, threadID)
+	}
+	if repo.LoadDraft(tUser.EmailAddress, msgID) != nil {
+		t.Fatal("Sending a draft should delete it")
+	}
+	if record = requestAsTestUser(draftHandler, "PUT", "/draft/"+msgID, draft); record.Code != http.StatusConflict {
+		t.Fatalf("PUT /draft/ returned %d after the draft was sent", record.Code)
+	}
+	if record = requestAsTestUser(draftHandler, "DELETE", "/draft/"+msgID, url.Values{}); record.Code != http.StatusNotFound {
+		t.Fatalf("DELETE /draft/ returned %d for a sent draft", record.Code)
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	ensureTestUser()
+	login := func(passHash string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.Form = url.Values{"token": {"test"}, "passHash": {passHash}}
+		loginHandler(record, req)
+		return record
+	}
+	withSession := func(handler func(http.ResponseWriter, *http.Request, *UserID), method, target, secret string) int {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("x-scramble-session", secret)
+		auth(handler)(record, req)
+		return record.Code
+	}
+
+	if record := login("0000000000000000000000000000000000000000"); record.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /login returned %d for a wrong passphrase", record.Code)
+	}
+	var sessions [2]struct {
+		Session string
+		Expires int64
+	}
+	for i := range sessions {
+		record := login("5026f031ceea00023da878da2be4660ae85040e8")
+		if err := json.Unmarshal(record.Body.Bytes(), &sessions[i]); err != nil || sessions[i].Session == "" {
+			t.Fatalf("POST /login returned %d %s", record.Code, record.Body.String())
+		}
+	}
+	if code := withSession(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", sessions[0].Session); code != http.StatusOK {
+		t.Fatalf("GET /box/inbox returned %d with a session", code)
+	}
+	if code := withSession(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", "not a session"); code != http.StatusUnauthorized {
+		t.Fatalf("GET /box/inbox returned %d with a made up session", code)
+	}
+
+	// logging out ends that session only, everywhere ends them all
+	withSession(logoutHandler, "POST", "/logout", sessions[0].Session)
+	if code := withSession(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", sessions[0].Session); code != http.StatusUnauthorized {
+		t.Fatalf("GET /box/inbox returned %d after logging out", code)
+	}
+	if code := withSession(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", sessions[1].Session); code != http.StatusOK {
+		t.Fatalf("GET /box/inbox returned %d with another session", code)
+	}
+	withSession(logoutHandler, "POST", "/logout?everywhere=true", sessions[1].Session)
+	if code := withSession(inboxHandler, "GET", "/box/inbox?offset=0&limit=10", sessions[1].Session); code != http.StatusUnauthorized {
+		t.Fatalf("GET /box/inbox returned %d after signing out everywhere", code)
+	}
+}
+
+func TestPasswordHandler(t *testing.T) {
+	tUser := ensureTestUser()
+	defer ensureTestUser()
+	// like an account from before scrypt, see migratePasswordHash
+	repo.DeleteUser("test")
+	tUser.PasswordHashOld, tUser.PasswordHash = tUser.PasswordHash, ""
+	repo.SaveUser(tUser)
+	secret, _ := startSession(&tUser.UserID, time.Now())
+
+	change := func(passHash, passHashOld string) *httptest.ResponseRecorder {
+		return requestAsTestUser(passwordHandler, "POST", "/user/me/password", url.Values{
+			"passHash":            {passHash},
+			"passHashOld":         {passHashOld},
+			"newPassHash":         {"1111111111111111111111111111111111111111"},
+			"newCipherPrivateKey": {"abcdef"},
+		})
+	}
+	if record := change("", "0000000000000000000000000000000000000000"); record.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /user/me/password returned %d for a wrong passphrase", record.Code)
+	}
+	record := change("", tUser.PasswordHashOld)
+	var res struct{ Session string }
+	if err := json.Unmarshal(record.Body.Bytes(), &res); err != nil || res.Session == "" {
+		t.Fatalf("POST /user/me/password returned %d %s", record.Code, record.Body.String())
+	}
+	user := repo.LoadUser("test")
+	if user.PasswordHash != "1111111111111111111111111111111111111111" ||
+		user.PasswordHashOld != "" || user.CipherPrivateKey != "abcdef" {
+		t.Fatalf("POST /user/me/password saved %v", user.UserID)
+	}
+	if repo.LoadSession(sessionKey(secret), time.Now().Unix()) != nil {
+		t.Fatal("Changing the passphrase should end the other sessions")
+	}
+	if repo.LoadSession(sessionKey(res.Session), time.Now().Unix()) == nil {
+		t.Fatal("Changing the passphrase should start a new session")
+	}
+	if _, err := authenticateUserPass("test", "", tUser.PasswordHashOld); err == nil {
+		t.Fatal("The legacy hash still logs in")
+	}
+}
+
+func TestTotpHandler(t *testing.T) {
+	tUser := ensureTestUser()
+	defer repo.DeleteTotp(tUser.Token)
+	passHash := "5026f031ceea00023da878da2be4660ae85040e8"
+	login := func(totpCode string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.Form = url.Values{"token": {"test"}, "passHash": {passHash}, "totpCode": {totpCode}}
+		loginHandler(record, req)
+		return record
+	}
+
+	if record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/enroll",
+		url.Values{"passHash": {"0000000000000000000000000000000000000000"}}); record.Code != http.StatusUnauthorized {
+		t.Fatalf("Enrolling returned %d for a wrong passphrase", record.Code)
+	}
+	record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/enroll", url.Values{"passHash": {passHash}})
+	var enrollment struct {
+		Secret        string
+		URI           string
+		RecoveryCodes []string
+	}
+	if err := json.Unmarshal(record.Body.Bytes(), &enrollment); err != nil || len(enrollment.RecoveryCodes) != totpRecoveryCodes {
+		t.Fatalf("Enrolling returned %d %s", record.Code, record.Body.String())
+	}
+	// not on until verified
+	if record := login(""); record.Code != http.StatusOK {
+		t.Fatalf("POST /login returned %d before the second factor was verified", record.Code)
+	}
+
+	key, _ := base32.StdEncoding.DecodeString(enrollment.Secret)
+	now := time.Now()
+	code := totpCode(key, now.Unix()/totpStep, totpDigits)
+	staleCode := totpCode(key, now.Unix()/totpStep-5, totpDigits)
+	if record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/verify",
+		url.Values{"code": {staleCode}}); record.Code != http.StatusUnauthorized {
+		t.Fatalf("Verifying returned %d for a wrong code", record.Code)
+	}
+	if record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/verify", url.Values{"code": {code}}); record.Code != http.StatusOK {
+		t.Fatalf("Verifying returned %d %s", record.Code, record.Body.String())
+	}
+
+	// now logging in takes a code, and each code works once
+	if record := login(""); record.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /login returned %d without a code", record.Code)
+	}
+	if record := login(code); record.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /login returned %d for a code that was used", record.Code)
+	}
+	nextCode := totpCode(key, now.Unix()/totpStep+1, totpDigits)
+	if record := login(nextCode); record.Code != http.StatusOK {
+		t.Fatalf("POST /login returned %d for the next code", record.Code)
+	}
+	recoveryCode := enrollment.RecoveryCodes[0]
+	if record := login(strings.ToUpper(recoveryCode)); record.Code != http.StatusOK {
+		t.Fatalf("POST /login returned %d for a recovery code", record.Code)
+	}
+	if record := login(recoveryCode); record.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /login returned %d for a used recovery code", record.Code)
+	}
+
+	if record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/disable",
+		url.Values{"passHash": {passHash}}); record.Code != http.StatusUnauthorized {
+		t.Fatalf("Disabling returned %d without a code", record.Code)
+	}
+	if record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/disable",
+		url.Values{"passHash": {passHash}, "code": {enrollment.RecoveryCodes[1]}}); record.Code != http.StatusOK {
+		t.Fatalf("Disabling returned %d %s", record.Code, record.Body.String())
+	}
+	if record := login(""); record.Code != http.StatusOK {
+		t.Fatalf("POST /login returned %d after disabling two-factor authentication", record.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ensureTestUser()
+	defer func(p *LoginPolicy) { loginPolicy = p }(loginPolicy)
+	loginPolicy = NewLoginPolicy()
+	defer func(c Config) { config = c }(config)
+	config.LoginFailuresPerAccount = 3
+	login := func(token, passHash string) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = "127.0.0.1:4321"
+		req.Header.Set("X-Real-IP", "192.0.2.1")
+		req.Form = url.Values{"token": {token}, "passHash": {passHash}}
+		loginHandler(record, req)
+		return record
+	}
+	passHash := "5026f031ceea00023da878da2be4660ae85040e8"
+
+	// the same answer whether or not the account exists
+	unknown := login("nosuchuser", passHash)
+	wrong := login("test", "0000000000000000000000000000000000000000")
+	if unknown.Code != http.StatusUnauthorized || unknown.Body.String() != wrong.Body.String() {
+		t.Fatalf("POST /login returned %d %q for an unknown user, %d %q for a wrong passphrase",
+			unknown.Code, unknown.Body.String(), wrong.Code, wrong.Body.String())
+	}
+	if record := login("test", passHash); record.Code != http.StatusOK {
+		t.Fatalf("POST /login returned %d", record.Code)
+	}
+	for i := 0; i < 3; i++ {
+		login("test", "0000000000000000000000000000000000000000")
+	}
+	record := login("test", passHash)
+	if record.Code != http.StatusTooManyRequests || record.Header().Get("Retry-After") == "" {
+		t.Fatalf("POST /login returned %d after too many failures", record.Code)
+	}
+
+	record = requestAsTestUser(auditHandler, "GET", "/user/me/audit?offset=0&limit=5", nil)
+	var res struct{ Events []AuditEvent }
+	if err := json.Unmarshal(record.Body.Bytes(), &res); err != nil || len(res.Events) != 5 {
+		t.Fatalf("GET /user/me/audit returned %d %s", record.Code, record.Body.String())
+	}
+	if res.Events[0].Event != auditLockedOut || res.Events[1].Event != auditLoginFailed ||
+		res.Events[0].IP != "192.0.2.1" {
+		t.Errorf("Expected a lockout from 192.0.2.1 last, got %v", res.Events)
+	}
+	found := false
+	for _, event := range res.Events {
+		found = found || event.Event == auditLogin
+	}
+	if !found {
+		t.Errorf("Expected the login in the audit log, got %v", res.Events)
+	}
+	for _, query := range []string{"offset=-1&limit=5", "offset=0&limit=-1", "offset=0&limit=x"} {
+		record = requestAsTestUser(auditHandler, "GET", "/user/me/audit?"+query, nil)
+		if record.Code != http.StatusBadRequest {
+			t.Errorf("GET /user/me/audit?%s returned %d, expected 400", query, record.Code)
+		}
+	}
+}
+
+func TestReauthenticateLockout(t *testing.T) {
+	ensureTestUser()
+	defer func(p *LoginPolicy) { loginPolicy = p }(loginPolicy)
+	loginPolicy = NewLoginPolicy()
+	defer func(c Config) { config = c }(config)
+	config.LoginFailuresPerAccount = 3
+	passHash := "5026f031ceea00023da878da2be4660ae85040e8"
+	wrong := url.Values{"passHash": {"0000000000000000000000000000000000000000"}}
+
+	// a session is no way to guess the passphrase faster than /login
+	for i := 0; i < 3; i++ {
+		record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/enroll", wrong)
+		if record.Code != http.StatusUnauthorized {
+			t.Fatalf("Enrolling returned %d with a wrong passphrase", record.Code)
+		}
+	}
+	record := requestAsTestUser(totpHandler, "POST", "/user/me/totp/enroll", url.Values{"passHash": {passHash}})
+	if record.Code != http.StatusTooManyRequests || record.Header().Get("Retry-After") == "" {
+		t.Fatalf("Enrolling returned %d after too many failures", record.Code)
+	}
+	record = requestAsTestUser(deleteUserHandler, "POST", "/user/me/delete", url.Values{"passHash": {passHash}})
+	if record.Code != http.StatusTooManyRequests || repo.LoadUserID("test") == nil {
+		t.Fatalf("Deleting returned %d after too many failures", record.Code)
+	}
+	record = requestAsTestUser(totpHandler, "POST", "/user/me/totp/disable", url.Values{"passHash": {passHash}})
+	if record.Code != http.StatusTooManyRequests {
+		t.Fatalf("Disabling returned %d after too many failures", record.Code)
+	}
+}
+
+func TestExportAndDeleteUser(t *testing.T) {
+	tUser := ensureTestUser()
+	repo.SaveUser(&User{
+		UserID:           UserID{Token: "zoe", PasswordHash: "zoepass", PublicHash: "zoehash", EmailHost: tUser.EmailHost},
+		PublicKey:        "zoe key",
+		CipherPrivateKey: "zoe private key",
+	})
+	repo.AddNameResolution("zoe", tUser.EmailHost, "zoehash")
+	repo.SaveContacts("zoe", "zoe contacts")
+	zoe := repo.LoadUserID("zoe")
+
+	own := testEmail("zoe-own@local.scramble.io", "zoe-own@local.scramble.io", 100)
+	shared := testEmail("zoe-shared@local.scramble.io", "zoe-shared@local.scramble.io", 200)
+	repo.SaveMessage(own)
+	repo.SaveMessage(shared)
+	repo.AddMessageToBox(own, zoe.EmailAddress, "archive")
+	repo.AddMessageToBox(shared, zoe.EmailAddress, "sent")
+	repo.AddMessageToBox(shared, tUser.EmailAddress, "inbox")
+	repo.SaveAttachment(&Attachment{AttachmentHeader{1, "a.pdf", "application/pdf", 0}, own.MessageID, "cipher file"})
+	repo.SaveDraft(zoe.EmailAddress, testEmail("zoe-draft@local.scramble.io", "zoe-draft@local.scramble.io", 300))
+
+	record := httptest.NewRecorder()
+	exportHandler(record, httptest.NewRequest("GET", "/user/me/export", nil), zoe)
+	body := record.Body.Bytes()
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("GET /user/me/export returned %d, not a zip: %v", record.Code, err)
+	}
+	files := map[string]string{}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(reader)
+		reader.Close()
+		files[file.Name] = buf.String()
+	}
+	var account exportedAccount
+	if err = json.Unmarshal([]byte(files["account.json"]), &account); err != nil ||
+		account.CipherPrivateKey != "zoe private key" || account.CipherContacts == nil ||
+		*account.CipherContacts != "zoe contacts" {
+		t.Fatalf("Exported account.json %s", files["account.json"])
+	}
+	var email exportedEmail
+	if err = json.Unmarshal([]byte(files["mail/000001.json"]), &email); err != nil ||
+		email.MessageID != own.MessageID || len(email.Boxes) != 1 || email.Boxes[0] != "archive" ||
+		len(email.Attachments) != 1 {
+		t.Fatalf("Exported mail/000001.json %s", files["mail/000001.json"])
+	}
+	if files["mail/000001/attachment-1"] != "cipher file" || files["mail/000002.json"] == "" ||
+		files["drafts/000001.json"] == "" {
+		t.Fatalf("Expected an attachment, another email and a draft, got %d files", len(files))
+	}
+
+	deleteUser := func(passHash string) int {
+		record := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/user/me/delete", nil)
+		req.Form = url.Values{"passHash": {passHash}}
+		deleteUserHandler(record, req, zoe)
+		return record.Code
+	}
+	if code := deleteUser("wrong"); code != http.StatusUnauthorized || repo.LoadUser("zoe") == nil {
+		t.Fatalf("POST /user/me/delete returned %d for a wrong passphrase", code)
+	}
+	if code := deleteUser("zoepass"); code != http.StatusOK {
+		t.Fatalf("POST /user/me/delete returned %d", code)
+	}
+	if repo.LoadUser("zoe") != nil || repo.LoadContacts("zoe") != nil ||
+		repo.GetNameResolution("zoe", tUser.EmailHost) != "" {
+		t.Fatal("Expected the user, their contacts and their name to be gone")
+	}
+	threadIDs := repo.LoadThreadIDsForMessageIDs([]interface{}{own.MessageID, shared.MessageID})
+	if threadIDs[0] != "" || threadIDs[1] != shared.ThreadID {
+		t.Fatalf("Expected only the email test still has, got %v", threadIDs)
+	}
+}
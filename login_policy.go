@@ -0,0 +1,115 @@
+/**
+ * Brute-force protection for logins.
+ *
+ * Counts failed logins per account and per client address. Once either
+ * has Config.LoginFailuresPerAccount or Config.LoginFailuresPerIp of
+ * them, logins are refused until Config.LoginLockoutMinutes pass.
+ * Accounts that don't exist are counted the same, so the answers don't
+ * say which ones do.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Safe for concurrent use by all HTTP requests.
+type LoginPolicy struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	accounts  map[string]*loginFailures // per token
+	ips       map[string]*loginFailures // per client ip
+	nextPrune time.Time
+}
+
+// Failed logins within a window of time
+type loginFailures struct {
+	count       int
+	ends        time.Time
+	lockedUntil time.Time
+}
+
+var loginPolicy = NewLoginPolicy()
+
+func NewLoginPolicy() *LoginPolicy {
+	return &LoginPolicy{
+		now:      time.Now,
+		accounts: map[string]*loginFailures{},
+		ips:      map[string]*loginFailures{},
+	}
+}
+
+// Called before checking a login. Returns how long the account or the
+// client is locked out for, 0 if it may try.
+func (p *LoginPolicy) Check(token string, ip net.IP) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune()
+	now := p.now()
+	wait := time.Duration(0)
+	for _, f := range []*loginFailures{p.accounts[token], p.ips[ip.String()]} {
+		if f != nil && f.lockedUntil.Sub(now) > wait {
+			wait = f.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Counts a failed login. Returns true if it locked the account out.
+func (p *LoginPolicy) Fail(token string, ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lockedOut := p.count(p.accounts, token, GetConfig().LoginFailuresPerAccount)
+	// behind nginx without X-Real-IP everyone is loopback, see requestIP
+	if !isTrustedClient(ip) {
+		p.count(p.ips, ip.String(), GetConfig().LoginFailuresPerIp)
+	}
+	return lockedOut
+}
+
+// Called after a login works. The client keeps its failures, an attacker
+// can have an account of their own.
+func (p *LoginPolicy) Succeed(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.accounts, token)
+}
+
+// Counts a failure for key, locks it out when it reaches limit.
+// A limit of 0 means no limit. Returns true if it was locked out just now.
+// Must hold p.mu.
+func (p *LoginPolicy) count(failures map[string]*loginFailures, key string, limit int) bool {
+	now := p.now()
+	window := time.Duration(GetConfig().LoginLockoutMinutes) * time.Minute
+	f := failures[key]
+	if f == nil || !now.Before(f.ends) && !now.Before(f.lockedUntil) {
+		f = &loginFailures{0, now.Add(window), time.Time{}}
+		failures[key] = f
+	}
+	f.count++
+	if limit > 0 && f.count >= limit && f.lockedUntil.IsZero() {
+		f.lockedUntil = now.Add(window)
+		return true
+	}
+	return false
+}
+
+// Forgets failures that no longer count. Must hold p.mu.
+func (p *LoginPolicy) prune() {
+	now := p.now()
+	if now.Before(p.nextPrune) {
+		return
+	}
+	p.nextPrune = now.Add(time.Minute)
+	for _, failures := range []map[string]*loginFailures{p.accounts, p.ips} {
+		for key, f := range failures {
+			if !now.Before(f.ends) && !now.Before(f.lockedUntil) {
+				delete(failures, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoginPolicy(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config.LoginFailuresPerAccount = 3
+	config.LoginFailuresPerIp = 5
+	config.LoginLockoutMinutes = 15
+
+	now := time.Unix(1380000000, 0)
+	policy := NewLoginPolicy()
+	policy.now = func() time.Time { return now }
+	ip := net.ParseIP("10.0.0.1")
+
+	// per account, from anywhere
+	for i, fail := range []struct {
+		ip        string
+		lockedOut bool
+	}{{"10.0.0.1", false}, {"10.0.0.2", false}, {"10.0.0.3", true}} {
+		if policy.Check("alice", net.ParseIP(fail.ip)) != 0 {
+			t.Fatalf("Expected login %d to be let in", i)
+		}
+		if lockedOut := policy.Fail("alice", net.ParseIP(fail.ip)); lockedOut != fail.lockedOut {
+			t.Fatalf("Fail() = %v after %d failures", lockedOut, i+1)
+		}
+	}
+	if wait := policy.Check("alice", net.ParseIP("10.0.0.4")); wait != 15*time.Minute {
+		t.Errorf("Expected alice to be locked out for 15 minutes, got %v", wait)
+	}
+	if policy.Check("bob", net.ParseIP("10.0.0.4")) != 0 {
+		t.Error("Expected other accounts to be let in")
+	}
+	now = now.Add(15 * time.Minute)
+	if policy.Check("alice", ip) != 0 {
+		t.Error("Expected the lockout to be over")
+	}
+
+	// per client, any account
+	for _, token := range []string{"bob", "carol", "dave", "erin"} {
+		policy.Fail(token, ip)
+	}
+	policy.Succeed("bob")
+	if policy.Check("frank", ip) != 0 {
+		t.Fatal("Expected the client to be let in after four failures")
+	}
+	policy.Fail("frank", ip)
+	if policy.Check("bob", ip) == 0 {
+		t.Error("Expected the client to be locked out after five failures")
+	}
+	if policy.Check("bob", net.ParseIP("10.0.0.2")) != 0 {
+		t.Error("A login that worked should reset the account")
+	}
+
+	// everyone is loopback behind nginx without X-Real-IP
+	for i := 0; i < 10; i++ {
+		policy.Fail("user"+string(rune('a'+i)), net.ParseIP("127.0.0.1"))
+	}
+	if policy.Check("george", net.ParseIP("127.0.0.1")) != 0 {
+		t.Error("Loopback clients shouldn't be locked out")
+	}
+
+	// failures that are over don't count
+	now = now.Add(15 * time.Minute)
+	policy.Fail("carol", ip)
+	policy.Fail("carol", ip)
+	if policy.Check("carol", ip) != 0 {
+		t.Error("Expected old failures to be forgotten")
+	}
+}
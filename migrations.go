@@ -6,7 +6,7 @@ import (
 	"strings"
 )
 
-var migrations = []func() error{
+var migrations = []func(*sql.DB) error{
 	migrateCreateUser,
 	migrateCreateEmail,
 	migrateAddContacts,
@@ -23,13 +23,35 @@ var migrations = []func() error{
 	migrateCreateMxHosts,
 	migrateAddNotaryKey,
 	migrateAddNameResolutionTimestamp,
+	migrateOutboxRetry,
+	migrateBoxAddTlsStatus,
+	migrateEmailAddSenderAuth,
+	migrateAddDkimKey,
+	migrateAddAttachment,
+	migrateAddSpamBox,
+	migrateEmailAddSpamScore,
+	migrateBoxAddTrash,
+	migrateAddLabels,
+	migrateBoxAddFlags,
+	migrateAddSearchIndex,
+	migrateAddDrafts,
+	migrateAddSessions,
+	migrateAddTotp,
+	migrateAddAuditLog,
 }
 
-func migrateDb() {
+// Applies the dialect's migrations that haven't been applied yet.
+func migrateDb(db *sql.DB, dialect *sqlDialect) {
+	migrations := dialect.Migrations
+
 	// create the table, if needed
-	_, err := db.Exec(`create table if not exists migration (
+	createMigration := `create table if not exists migration (
         version int not null
-    ) engine=InnoDB`)
+    )`
+	if dialect.Name == "mysql" {
+		createMigration += " engine=InnoDB"
+	}
+	_, err := db.Exec(createMigration)
 	if err != nil {
 		panic(err)
 	}
@@ -46,7 +68,7 @@ func migrateDb() {
 	// apply migrations
 	for ; version < len(migrations); version++ {
 		log.Printf("Migrating DB version %d to %d\n", version, version+1)
-		err = migrations[version]()
+		err = migrations[version](db)
 		if err != nil {
 			panic(err)
 		}
@@ -58,7 +80,7 @@ func migrateDb() {
 	}
 }
 
-func migrateCreateUser() error {
+func migrateCreateUser(db *sql.DB) error {
 	_, err := db.Exec(`create table if not exists user (
         token varchar(100) not null,
         password_hash char(40) not null,
@@ -72,7 +94,7 @@ func migrateCreateUser() error {
 	return err
 }
 
-func migrateCreateEmail() error {
+func migrateCreateEmail(db *sql.DB) error {
 	_, err := db.Exec(`create table if not exists email (
         message_id char(40) not null,
         unix_time bigint not null,
@@ -93,12 +115,12 @@ func migrateCreateEmail() error {
 	return err
 }
 
-func migrateAddContacts() error {
+func migrateAddContacts(db *sql.DB) error {
 	_, err := db.Exec(`alter table user add column cipher_contacts longtext`)
 	return err
 }
 
-func migratePasswordHash() error {
+func migratePasswordHash(db *sql.DB) error {
 	_, err := db.Exec(`alter table user 
         add column password_hash_old char(160) not null default "" 
         after password_hash`)
@@ -109,7 +131,7 @@ func migratePasswordHash() error {
 	return err
 }
 
-func migrateEmailRefactor() error {
+func migrateEmailRefactor(db *sql.DB) error {
 
 	// Migration of existing data
 	// Load everything onto memory, wipe table, then reinsert.
@@ -245,17 +267,17 @@ func migrateEmailRefactor() error {
 	return err
 }
 
-func migrateLengthenSubject() error {
+func migrateLengthenSubject(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE email MODIFY cipher_subject TEXT`)
 	return err
 }
 
-func migrateShortenToken() error {
+func migrateShortenToken(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE user MODIFY token VARCHAR(64)`)
 	return err
 }
 
-func migrateAddUserEmailAddress() error {
+func migrateAddUserEmailAddress(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE user ADD COLUMN email_host VARCHAR(254) NOT NULL DEFAULT ""`)
 	if err != nil {
 		return err
@@ -264,7 +286,7 @@ func migrateAddUserEmailAddress() error {
 	return err
 }
 
-func migrateCreateNameResolution() error {
+func migrateCreateNameResolution(db *sql.DB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS name_resolution (
 		name           VARCHAR(64),
 		host           VARCHAR(255),
@@ -348,7 +370,7 @@ func migrateCreateNameResolution() error {
 	return err
 }
 
-func migrateMakeNameResolutionUnique() error {
+func migrateMakeNameResolutionUnique(db *sql.DB) error {
 	// some MySQL versions will crap out when dropping/adding the same index in one line.
 	_, err := db.Exec(`ALTER TABLE name_resolution DROP INDEX host`)
 	if err != nil {
@@ -358,7 +380,7 @@ func migrateMakeNameResolutionUnique() error {
 	return err
 }
 
-func migrateEmailThreading() error {
+func migrateEmailThreading(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE email ` +
 		`MODIFY message_id VARCHAR(255) NOT NULL, ` +
 		`ADD COLUMN ancestor_ids VARCHAR(10240) NOT NULL, ` +
@@ -397,17 +419,17 @@ func migrateEmailThreading() error {
 	return err
 }
 
-func migrateBoxAddForeignKey() error {
+func migrateBoxAddForeignKey(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE box ADD FOREIGN KEY (message_id) REFERENCES email(message_id)`)
 	return err
 }
 
-func migrateBoxAddError() error {
+func migrateBoxAddError(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE box ADD COLUMN error TEXT`)
 	return err
 }
 
-func migrateCreateMxHosts() error {
+func migrateCreateMxHosts(db *sql.DB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS mx_hosts (
         host         VARCHAR(254) NOT NULL,
         is_scramble  BOOL NOT NULL,
@@ -418,13 +440,379 @@ func migrateCreateMxHosts() error {
 	return err
 }
 
-func migrateAddNotaryKey() error {
+func migrateAddNotaryKey(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE mx_hosts ADD COLUMN notary_public_key TEXT`)
 	return err
 }
 
 
-func migrateAddNameResolutionTimestamp() error {
+func migrateAddNameResolutionTimestamp(db *sql.DB) error {
 	_, err := db.Exec(`ALTER TABLE name_resolution ADD COLUMN unix_time BIGINT NOT NULL`)
 	return err
 }
+
+func migrateOutboxRetry(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE box ` +
+		`MODIFY box ENUM('inbox','outbox','sent','archive','trash',` +
+		`'outbox-sent','outbox-processing','outbox-failed') NOT NULL, ` +
+		`ADD COLUMN attempts INT NOT NULL DEFAULT 0, ` +
+		`ADD COLUMN next_attempt BIGINT NOT NULL DEFAULT 0`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS outbox_recipient (
+        box_id   BIGINT NOT NULL,
+        address  VARCHAR(254) NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        status   ENUM('pending','sent','failed') NOT NULL,
+        error    TEXT,
+
+        PRIMARY KEY (box_id, address)
+    )`)
+	return err
+}
+
+func migrateBoxAddTlsStatus(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE box ADD COLUMN tls_status VARCHAR(16) NOT NULL DEFAULT ''`)
+	return err
+}
+
+func migrateEmailAddSenderAuth(db *sql.DB) error {
+	// one column per statement, for SQLite
+	for _, column := range []string{"spf_result", "dkim_result", "dmarc_result"} {
+		_, err := db.Exec(`ALTER TABLE email ADD COLUMN ` + column + ` VARCHAR(16) NOT NULL DEFAULT ''`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddDkimKey(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS dkim_key (
+        email_host  VARCHAR(254) NOT NULL,
+        selector    VARCHAR(63) NOT NULL,
+        private_key TEXT NOT NULL,
+        unix_time   BIGINT NOT NULL,
+
+        PRIMARY KEY (email_host)
+    )`)
+	return err
+}
+
+func migrateAddAttachment(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS attachment (
+        message_id     VARCHAR(255) NOT NULL,
+        id             INT NOT NULL,
+        filename       VARCHAR(255) NOT NULL,
+        content_type   VARCHAR(255) NOT NULL,
+        cipher_content MEDIUMTEXT NOT NULL,
+
+        PRIMARY KEY (message_id, id)
+    )`)
+	return err
+}
+
+func migrateAddSpamBox(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE box MODIFY box ` +
+		`ENUM('inbox','outbox','sent','archive','trash',` +
+		`'outbox-sent','outbox-processing','outbox-failed','spam') NOT NULL`)
+	return err
+}
+
+func migrateEmailAddSpamScore(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE email ADD COLUMN spam_score DOUBLE NOT NULL DEFAULT 0`)
+	return err
+}
+
+func migrateBoxAddTrash(db *sql.DB) error {
+	// one column per statement, for SQLite
+	for _, column := range []string{
+		`trashed_from VARCHAR(32) NOT NULL DEFAULT ''`,
+		`trash_time BIGINT NOT NULL DEFAULT 0`,
+	} {
+		if _, err := db.Exec(`ALTER TABLE box ADD COLUMN ` + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddLabels(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS label (
+        id          BIGINT NOT NULL AUTO_INCREMENT,
+        address     VARCHAR(254) NOT NULL,
+        cipher_name TEXT NOT NULL,
+
+        PRIMARY KEY (id),
+        INDEX (address)
+    )`)
+	if err != nil {
+		return err
+	}
+	return createEmailLabel(db)
+}
+
+// Which emails have which labels, for MySQL and SQLite.
+// thread_id and unix_time are copied from the email, like in box.
+func createEmailLabel(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS email_label (
+        label_id   BIGINT NOT NULL,
+        message_id VARCHAR(255) NOT NULL,
+        thread_id  VARCHAR(255) NOT NULL,
+        unix_time  BIGINT NOT NULL,
+
+        PRIMARY KEY (label_id, message_id)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX email_label_message ON email_label (message_id)`)
+	return err
+}
+
+func migrateBoxAddFlags(db *sql.DB) error {
+	// one column per statement, for SQLite
+	for _, column := range []string{"is_read", "is_starred"} {
+		_, err := db.Exec(`ALTER TABLE box ADD COLUMN ` + column + ` BOOL NOT NULL DEFAULT 0`)
+		if err != nil {
+			return err
+		}
+	}
+	// mail from before there were flags counts as read
+	_, err := db.Exec(`UPDATE box SET is_read = 1`)
+	return err
+}
+
+func migrateAddSearchIndex(db *sql.DB) error {
+	for _, stmt := range []string{
+		`ALTER TABLE user ADD COLUMN search_version BIGINT NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS search_chunk (
+            token       VARCHAR(64) NOT NULL,
+            chunk_id    VARCHAR(64) NOT NULL,
+            version     BIGINT NOT NULL,
+            cipher_data MEDIUMTEXT NOT NULL,
+
+            PRIMARY KEY (token, chunk_id)
+        )`,
+		`CREATE INDEX search_chunk_version ON search_chunk (token, version)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddDrafts(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS draft (
+        address        VARCHAR(254) NOT NULL,
+        message_id     VARCHAR(255) NOT NULL,
+        thread_id      VARCHAR(255) NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT NOT NULL,
+        cipher_body    MEDIUMTEXT NOT NULL,
+
+        PRIMARY KEY (address, message_id)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX draft_time ON draft (address, unix_time)`)
+	return err
+}
+
+func migrateAddSessions(db *sql.DB) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS user_session (
+            session_key CHAR(64) NOT NULL,
+            token       VARCHAR(64) NOT NULL,
+            unix_time   BIGINT NOT NULL,
+            expires     BIGINT NOT NULL,
+
+            PRIMARY KEY (session_key)
+        )`,
+		`CREATE INDEX user_session_token ON user_session (token)`,
+		`CREATE INDEX user_session_expires ON user_session (expires)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddTotp(db *sql.DB) error {
+	for _, stmt := range []string{
+		`ALTER TABLE user ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE user ADD COLUMN totp_enabled BOOL NOT NULL DEFAULT 0`,
+		`ALTER TABLE user ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS recovery_code (
+            token     VARCHAR(64) NOT NULL,
+            code_hash CHAR(64) NOT NULL,
+
+            PRIMARY KEY (token, code_hash)
+        )`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddAuditLog(db *sql.DB) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS audit_event (
+            token     VARCHAR(64) NOT NULL,
+            unix_time BIGINT NOT NULL,
+            event     VARCHAR(32) NOT NULL,
+            ip        VARCHAR(45) NOT NULL
+        )`,
+		`CREATE INDEX audit_event_token ON audit_event (token, unix_time)`,
+		`CREATE INDEX audit_event_time ON audit_event (unix_time)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// SQLITE
+//
+
+// SQLite databases start out at the schema the MySQL migrations above
+// arrive at, so they get a migration list of their own.
+var sqliteMigrations = []func(*sql.DB) error{
+	sqliteCreateSchema,
+	sqliteOutboxRetry,
+	migrateBoxAddTlsStatus,
+	migrateEmailAddSenderAuth,
+	migrateAddDkimKey,
+	migrateAddAttachment,
+	migrateEmailAddSpamScore,
+	migrateBoxAddTrash,
+	sqliteAddLabels,
+	migrateBoxAddFlags,
+	migrateAddSearchIndex,
+	migrateAddDrafts,
+	migrateAddSessions,
+	migrateAddTotp,
+	migrateAddAuditLog,
+}
+
+func sqliteCreateSchema(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS user (
+        token              VARCHAR(64) NOT NULL,
+        password_hash      CHAR(40) NOT NULL,
+        password_hash_old  CHAR(160) NOT NULL DEFAULT "",
+        public_hash        CHAR(40) NOT NULL,
+        public_key         VARCHAR(4000) NOT NULL,
+        cipher_private_key VARCHAR(4000) NOT NULL,
+        cipher_contacts    TEXT,
+        email_host         VARCHAR(254) NOT NULL DEFAULT "",
+
+        PRIMARY KEY (token),
+        UNIQUE (public_hash)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS email (
+        message_id     VARCHAR(255) NOT NULL,
+        unix_time      BIGINT NOT NULL,
+        from_email     VARCHAR(254) NOT NULL,
+        to_email       TEXT NOT NULL,
+        cipher_subject TEXT,
+        cipher_body    TEXT NOT NULL,
+        ancestor_ids   VARCHAR(10240) NOT NULL,
+        thread_id      VARCHAR(255) NOT NULL,
+
+        PRIMARY KEY (message_id)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS box (
+        id         INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id VARCHAR(255) NOT NULL REFERENCES email(message_id),
+        address    VARCHAR(254) NOT NULL,
+        box        VARCHAR(32) NOT NULL,
+        unix_time  BIGINT NOT NULL,
+        thread_id  VARCHAR(255) NOT NULL,
+        error      TEXT
+    )`)
+	if err != nil {
+		return err
+	}
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS box_address_box ON box (address, box, unix_time)`,
+		`CREATE INDEX IF NOT EXISTS box_address_message ON box (address, message_id)`,
+		`CREATE INDEX IF NOT EXISTS box_address_thread ON box (address, box, thread_id, unix_time)`,
+	} {
+		if _, err = db.Exec(index); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS name_resolution (
+        name      VARCHAR(64),
+        host      VARCHAR(255),
+        hash      CHAR(16),
+        unix_time BIGINT NOT NULL,
+
+        UNIQUE (host, name)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS mx_hosts (
+        host              VARCHAR(254) NOT NULL,
+        is_scramble       BOOL NOT NULL,
+        unix_time         BIGINT NOT NULL,
+        notary_public_key TEXT,
+
+        PRIMARY KEY (host)
+    )`)
+	return err
+}
+
+func sqliteOutboxRetry(db *sql.DB) error {
+	for _, stmt := range []string{
+		`ALTER TABLE box ADD COLUMN attempts INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE box ADD COLUMN next_attempt BIGINT NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS outbox_recipient (
+            box_id   BIGINT NOT NULL,
+            address  VARCHAR(254) NOT NULL,
+            attempts INT NOT NULL DEFAULT 0,
+            status   VARCHAR(16) NOT NULL,
+            error    TEXT,
+
+            PRIMARY KEY (box_id, address)
+        )`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqliteAddLabels(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS label (
+        id          INTEGER PRIMARY KEY AUTOINCREMENT,
+        address     VARCHAR(254) NOT NULL,
+        cipher_name TEXT NOT NULL
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS label_address ON label (address)`)
+	if err != nil {
+		return err
+	}
+	return createEmailLabel(db)
+}
@@ -27,6 +27,19 @@ type EmailHeader struct {
 	From          string
 	To            string
 	CipherSubject string
+
+	// Sender authentication verdicts for mail received over SMTP,
+	// eg "pass", "fail", "softfail". Empty for everything else.
+	SpfResult   string
+	DkimResult  string
+	DmarcResult string
+
+	// Points given by the spam filters, see scoreSpam. 0 if never scored.
+	SpamScore float64
+
+	// The user's flags, see SetFlag. Only set when loaded from their boxes.
+	Read    bool
+	Starred bool
 }
 
 // Represents a full email, header and body PGP encrypted.
@@ -34,6 +47,68 @@ type Email struct {
 	EmailHeader
 	CipherBody   string
 	AncestorIDs  string
+	Attachments  []AttachmentHeader
+}
+
+// Describes a file attached to an email, see Attachment
+type AttachmentHeader struct {
+	ID          int
+	Filename    string
+	ContentType string
+	Size        int // of the ciphertext
+}
+
+// A file attached to an email.
+// The content is PGP encrypted for the recipients, like the body.
+type Attachment struct {
+	AttachmentHeader
+	MessageID     string
+	CipherContent string
+}
+
+// A folder-like tag a user puts on their email.
+// The name is encrypted with the user's key, like their contacts.
+type Label struct {
+	ID         int64
+	CipherName string
+}
+
+// A logged-in client, see loginHandler.
+// Key is a hash of the secret the client was given, never the secret.
+type Session struct {
+	Key      string
+	Token    string
+	UnixTime int64
+	Expires  int64
+}
+
+// Something that happened to a user's account, see audit.go
+type AuditEvent struct {
+	UnixTime int64
+	Event    string
+	IP       string // of the client, "" if unknown
+}
+
+// A user's second factor, see totp.go
+type TotpConfig struct {
+	Secret   string // base32
+	Enabled  bool   // false until the user shows their app has the secret
+	LastStep int64  // the last time step a code was used for
+}
+
+// A piece of a user's search index. The client builds the index and
+// encrypts each chunk, like their contacts, so the server never sees a
+// search term. A chunk without CipherData was deleted.
+type SearchChunk struct {
+	ID         string
+	Version    int64 // the index version that last wrote this chunk
+	CipherData string
+}
+
+// A user's search index, or the chunks that changed since some version
+type SearchIndex struct {
+	Version int64
+	Chunks  []SearchChunk
 }
 
 type BoxSummary struct {
@@ -43,15 +118,28 @@ type BoxSummary struct {
 	Offset       int
 	Limit        int
 	Total        int
+	Unread       int
 	EmailHeaders []EmailHeader
 }
 
 // Represents an email in the box join table.
 type BoxedEmail struct {
 	Email
-	Id      int64
-	Box     string
-	Address string
+	Id          int64
+	Box         string
+	Address     string
+	Attempts    int    // delivery attempts so far, for outbox items
+	NextAttempt int64  // unix time of the next delivery attempt
+	TlsStatus   string // how the last delivery was protected, eg "dane"
+}
+
+// Delivery state of one recipient of an outbox item.
+type OutboxRecipient struct {
+	BoxID    int64
+	Address  string
+	Attempts int
+	Status   string // "pending", "sent" or "failed"
+	Error    string
 }
 
 // Known info about an mx host.
@@ -61,3 +149,12 @@ type MxHostInfo struct {
 	NotaryPublicKey string
 	UnixTime        int64
 }
+
+// The key we sign outgoing mail from an email host with.
+// The public half is published at <Selector>._domainkey.<EmailHost>
+type DkimKey struct {
+	EmailHost  string
+	Selector   string
+	PrivateKey string // PEM, PKCS #1
+	UnixTime   int64
+}
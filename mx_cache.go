@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Caches MX lookups, eg "gmail.com" -> ["gmail-smtp-in.l.google.com", ...]
+//
+// Entries live as long as their DNS TTL says. Failed lookups are cached
+// too, for Config.MxNegativeCacheMinutes, so that a broken domain doesn't
+// cost us a DNS round trip per recipient.
+// Safe for concurrent use by the HTTP handlers and the SMTP sender.
+type MxCache struct {
+	resolver MxResolver
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*mxCacheEntry
+}
+
+type mxCacheEntry struct {
+	servers []string
+	err     error
+	expires time.Time
+}
+
+var mxCache = NewMxCache(systemResolver)
+
+func NewMxCache(resolver MxResolver) *MxCache {
+	return &MxCache{
+		resolver: resolver,
+		now:      time.Now,
+		entries:  map[string]*mxCacheEntry{},
+	}
+}
+
+// Returns the SMTP servers for host, most preferred first.
+// A host without MX records is its own SMTP server (RFC 5321 section 5.1).
+func (c *MxCache) Lookup(host string) ([]string, error) {
+	c.mu.Lock()
+	entry := c.entries[host]
+	c.mu.Unlock()
+	if entry != nil && c.now().Before(entry.expires) {
+		return entry.servers, entry.err
+	}
+
+	// Resolve without holding the lock, DNS can be slow.
+	// Concurrent misses for the same host may both resolve, that's fine.
+	log.Printf("looking up smtp server (mx record) for %s\n", host)
+	servers, ttl, err := c.resolve(host)
+	if err != nil {
+		log.Printf("lookup failed for %s: %v\n", host, err)
+		ttl = time.Duration(GetConfig().MxNegativeCacheMinutes) * time.Minute
+	}
+
+	c.mu.Lock()
+	c.entries[host] = &mxCacheEntry{servers, err, c.now().Add(ttl)}
+	c.mu.Unlock()
+	return servers, err
+}
+
+func (c *MxCache) resolve(host string) ([]string, time.Duration, error) {
+	mxs, ttl, err := c.resolver.LookupMX(host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(mxs) == 0 {
+		// no MX records, fall back to the A/AAAA record
+		_, ttl, err = c.resolver.LookupHost(host)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, 0, errNoMailHost
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		mxs = []*net.MX{&net.MX{Host: host + ".", Pref: 0}}
+	}
+	servers, err := mxHostNames(host, mxs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return servers, ttl, nil
+}
+
+// Forgets the cached lookup for host, or everything if host is "".
+// Returns the number of entries removed.
+func (c *MxCache) Flush(host string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if host == "" {
+		count := len(c.entries)
+		c.entries = map[string]*mxCacheEntry{}
+		return count
+	}
+	if c.entries[host] == nil {
+		return 0
+	}
+	delete(c.entries, host)
+	return 1
+}
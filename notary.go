@@ -113,18 +113,18 @@ type NotaryResultError struct {
 // Returns the hash from name_resolution table.
 func ResolveName(name, host string) string {
 	addr := name + "@" + host
-	hash := GetNameResolution(name, host)
+	hash := repo.GetNameResolution(name, host)
 
 	if hash == "" {
 
-		mxHost, err := mxLookUp(host)
+		mxHost, err := mxLookUpPrimary(host)
 		if err != nil {
 			return "" // whatever, we were going to return "" anyways
 		}
 		if mxHost == GetConfig().SmtpMxHost {
 			log.Printf("Well, that's unexpected. Why didn't GetNameResolution pick up the hash for %v?\n"+
 				"Using user table instead. But really, this should be in the name_resolution table.", addr)
-			return LoadPubHash(name, host)
+			return repo.LoadPubHash(name, host)
 		}
 
 	}
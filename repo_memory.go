@@ -0,0 +1,1336 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Repository that keeps everything in maps.
+// Nothing is persisted, this exists so tests don't need a database.
+// It mirrors the behavior (and panics) of sqlRepo.
+type memoryRepo struct {
+	mu sync.Mutex
+
+	users          map[string]*User   // token -> user
+	cipherContacts map[string]*string // token -> contacts
+	emails         map[string]*Email  // message_id -> email
+	boxes          []*memoryBoxRow
+	lastBoxID      int64
+	outboxRcpts    map[int64][]OutboxRecipient // box id -> recipients
+	names          map[[2]string]string        // {host, name} -> hash
+	mxHosts        map[string]*MxHostInfo
+	dkimKeys       map[string]*DkimKey      // email host -> key
+	attachments    map[string][]*Attachment // message_id -> attachments
+	labels         map[int64]*memoryLabel
+	lastLabelID    int64
+	searchIndexes  map[string]*memorySearchIndex // token -> index
+	drafts         map[[2]string]*Email          // {address, message_id} -> draft
+	sessions       map[string]*Session           // key -> session
+	totps          map[string]*memoryTotp        // token -> second factor
+	auditEvents    map[string][]AuditEvent       // token -> events, oldest first
+}
+
+type memorySearchIndex struct {
+	Version int64
+	Chunks  map[string]SearchChunk // id -> chunk
+}
+
+type memoryTotp struct {
+	TotpConfig
+	RecoveryCodeHashes map[string]bool
+}
+
+type memoryLabel struct {
+	Label
+	Address    string
+	MessageIDs map[string]bool
+}
+
+// A row of the box join table
+type memoryBoxRow struct {
+	Id        int64
+	MessageID string
+	ThreadID  string
+	UnixTime  int64
+	Address   string
+	Box       string
+	Error     *string
+
+	Attempts    int
+	NextAttempt int64
+	TlsStatus   string
+
+	TrashedFrom string // the box it was in before 'trash'
+	TrashTime   int64
+
+	Read    bool
+	Starred bool
+}
+
+func NewMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		users:          map[string]*User{},
+		cipherContacts: map[string]*string{},
+		emails:         map[string]*Email{},
+		outboxRcpts:    map[int64][]OutboxRecipient{},
+		names:          map[[2]string]string{},
+		mxHosts:        map[string]*MxHostInfo{},
+		dkimKeys:       map[string]*DkimKey{},
+		attachments:    map[string][]*Attachment{},
+		labels:         map[int64]*memoryLabel{},
+		searchIndexes:  map[string]*memorySearchIndex{},
+		drafts:         map[[2]string]*Email{},
+		sessions:       map[string]*Session{},
+		totps:          map[string]*memoryTotp{},
+		auditEvents:    map[string][]AuditEvent{},
+	}
+}
+
+//
+// USERS
+//
+
+func (r *memoryRepo) SaveUser(user *User) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[user.Token] != nil {
+		return false
+	}
+	for _, other := range r.users {
+		if other.PublicHash == user.PublicHash {
+			return false
+		}
+	}
+	saved := *user
+	saved.EmailAddress = saved.Token + "@" + saved.EmailHost
+	r.users[user.Token] = &saved
+	return true
+}
+
+func (r *memoryRepo) DeleteUser(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.users, token)
+	delete(r.cipherContacts, token)
+	delete(r.searchIndexes, token)
+	r.deleteSessions(func(s *Session) bool { return s.Token == token })
+	delete(r.totps, token)
+	delete(r.auditEvents, token)
+}
+
+func (r *memoryRepo) LoadUser(token string) *User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user := r.users[token]
+	if user == nil {
+		return nil
+	}
+	loaded := *user
+	return &loaded
+}
+
+func (r *memoryRepo) LoadUserID(token string) *UserID {
+	user := r.LoadUser(token)
+	if user == nil {
+		return nil
+	}
+	return &user.UserID
+}
+
+func (r *memoryRepo) LoadPubHash(token, emailHost string) string {
+	user := r.LoadUser(token)
+	if user == nil || user.EmailHost != emailHost {
+		return ""
+	}
+	return user.PublicHash
+}
+
+func (r *memoryRepo) ServesEmailHost(emailHost string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.EmailHost == emailHost {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryRepo) userByPubHash(publicHash string) *User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.PublicHash == publicHash {
+			return user
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepo) LoadPubKey(publicHash string) string {
+	user := r.userByPubHash(publicHash)
+	if user == nil {
+		return ""
+	}
+	return user.PublicKey
+}
+
+func (r *memoryRepo) LoadAddressFromPubHash(publicHash string) string {
+	user := r.userByPubHash(publicHash)
+	if user == nil {
+		return ""
+	}
+	return user.Token + "@" + user.EmailHost
+}
+
+func (r *memoryRepo) LoadContacts(token string) *string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cipherContacts[token]
+}
+
+func (r *memoryRepo) SaveContacts(token string, cipherContacts string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[token] != nil {
+		r.cipherContacts[token] = &cipherContacts
+	}
+}
+
+func (r *memoryRepo) DeleteMailbox(address string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := map[string]bool{}
+	count := r.deleteBoxRows(func(row *memoryBoxRow) bool {
+		if row.Address == address {
+			ids[row.MessageID] = true
+			delete(r.outboxRcpts, row.Id)
+			return true
+		}
+		return false
+	})
+	for id, label := range r.labels {
+		if label.Address == address {
+			delete(r.labels, id)
+		}
+	}
+	for key := range r.drafts {
+		if key[0] == address {
+			delete(r.drafts, key)
+		}
+	}
+	for id := range ids {
+		r.deleteOrphanedEmail(id)
+	}
+	return count
+}
+
+func (r *memoryRepo) ChangePassword(token, passHash, passHashOld, newPassHash, newCipherPrivateKey string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user := r.users[token]
+	if user == nil {
+		return false
+	}
+	if (passHash == "" || passHash != user.PasswordHash) &&
+		(passHashOld == "" || passHashOld != user.PasswordHashOld) {
+		return false
+	}
+	user.PasswordHash = newPassHash
+	user.PasswordHashOld = ""
+	user.CipherPrivateKey = newCipherPrivateKey
+	return true
+}
+
+//
+// EMAIL HEADERS
+//
+
+// Box rows matching the filter, newest first. Caller holds the lock.
+func (r *memoryRepo) boxRows(filter func(*memoryBoxRow) bool) []*memoryBoxRow {
+	rows := []*memoryBoxRow{}
+	for _, row := range r.boxes {
+		if filter(row) {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].UnixTime > rows[j].UnixTime
+	})
+	return rows
+}
+
+func page(n, offset, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + limit
+	if end > n || limit < 0 {
+		end = n
+	}
+	return offset, end
+}
+
+func (r *memoryRepo) LoadBox(address string, box string, offset, limit int) []EmailHeader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.Box == box
+	})
+	start, end := page(len(rows), offset, limit)
+	headers := make([]EmailHeader, 0)
+	for _, row := range rows[start:end] {
+		headers = append(headers, withFlags(r.emails[row.MessageID].EmailHeader, []*memoryBoxRow{row}))
+	}
+	return headers
+}
+
+// The header with the user's flags from the given box rows: read unless
+// any of them is unread, starred if any of them is starred.
+func withFlags(header EmailHeader, rows []*memoryBoxRow) EmailHeader {
+	header.Read, header.Starred = true, false
+	for _, row := range rows {
+		header.Read = header.Read && row.Read
+		header.Starred = header.Starred || row.Starred
+	}
+	return header
+}
+
+func (r *memoryRepo) LoadBoxByThread(address string, box string, offset, limit int) []EmailHeader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.Box == box
+	})
+	// rows are newest first, so the first row seen is the thread's latest
+	latest := []*memoryBoxRow{}
+	threadRows := map[string][]*memoryBoxRow{}
+	for _, row := range rows {
+		if threadRows[row.ThreadID] == nil {
+			latest = append(latest, row)
+		}
+		threadRows[row.ThreadID] = append(threadRows[row.ThreadID], row)
+	}
+	start, end := page(len(latest), offset, limit)
+	headers := make([]EmailHeader, 0)
+	for _, row := range latest[start:end] {
+		headers = append(headers, withFlags(r.emails[row.MessageID].EmailHeader, threadRows[row.ThreadID]))
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].UnixTime > headers[j].UnixTime
+	})
+	return headers
+}
+
+func (r *memoryRepo) CountBox(address string, box string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.Box == box
+	})
+	return len(rows), nil
+}
+
+func (r *memoryRepo) CountUnread(address string, box string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.Box == box && !row.Read
+	})
+	return len(rows), nil
+}
+
+//
+// EMAIL
+//
+
+func (r *memoryRepo) SaveMessage(e *Email) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emails[e.MessageID] != nil {
+		log.Panicf("Duplicate message id %s", e.MessageID)
+	}
+	saved := *e
+	r.emails[e.MessageID] = &saved
+}
+
+func (r *memoryRepo) LoadMessage(id string) Email {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	email := r.emails[id]
+	if email == nil {
+		log.Panicf("Message %s not found", id)
+	}
+	return *email
+}
+
+func (r *memoryRepo) LoadThreadFromBoxes(address, threadId string) []Email {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.ThreadID == threadId
+	})
+	emails := []Email{}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if !seen[row.MessageID] {
+			seen[row.MessageID] = true
+			email := *r.emails[row.MessageID]
+			email.EmailHeader = withFlags(email.EmailHeader, r.messageRows(address, row.MessageID))
+			emails = append(emails, email)
+		}
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].UnixTime < emails[j].UnixTime
+	})
+	return emails
+}
+
+func (r *memoryRepo) LoadThreadIDsForMessageIDs(messageIDs []interface{}) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	threadIDs := []string{}
+	for _, messageID := range messageIDs {
+		threadID := ""
+		if email := r.emails[messageID.(string)]; email != nil {
+			threadID = email.ThreadID
+		}
+		threadIDs = append(threadIDs, threadID)
+	}
+	return threadIDs
+}
+
+func (r *memoryRepo) AddMessageToBox(e *Email, address string, box string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emails[e.MessageID] == nil {
+		log.Panicf("Cannot box message %s, no such email", e.MessageID)
+	}
+	r.lastBoxID++
+	r.boxes = append(r.boxes, &memoryBoxRow{
+		Id:        r.lastBoxID,
+		MessageID: e.MessageID,
+		ThreadID:  e.ThreadID,
+		UnixTime:  e.UnixTime,
+		Address:   address,
+		Box:       box,
+		Read:      isReadOnArrival(box),
+	})
+}
+
+// Removes box rows matching the filter, returns how many. Caller holds the lock.
+func (r *memoryRepo) deleteBoxRows(filter func(*memoryBoxRow) bool) int {
+	kept := []*memoryBoxRow{}
+	for _, row := range r.boxes {
+		if !filter(row) {
+			kept = append(kept, row)
+		}
+	}
+	count := len(r.boxes) - len(kept)
+	r.boxes = kept
+	return count
+}
+
+// Deletes the email unless some box still references it. Caller holds the lock.
+func (r *memoryRepo) deleteOrphanedEmail(id string) {
+	for _, row := range r.boxes {
+		if row.MessageID == id {
+			return
+		}
+	}
+	delete(r.emails, id)
+	delete(r.attachments, id)
+	for _, label := range r.labels {
+		delete(label.MessageIDs, id)
+	}
+}
+
+func (r *memoryRepo) DeleteFromBoxes(address string, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.deleteBoxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.MessageID == id
+	})
+	if count == 0 {
+		log.Panicf("Could not delete message %s for %s", id, address)
+	}
+	r.deleteOrphanedEmail(id)
+}
+
+func (r *memoryRepo) LoadMessageIDs(address string, afterID string, limit int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, row := range r.boxes {
+		if row.Address == address && row.MessageID > afterID && !seen[row.MessageID] {
+			seen[row.MessageID] = true
+			ids = append(ids, row.MessageID)
+		}
+	}
+	sort.Strings(ids)
+	start, end := page(len(ids), 0, limit)
+	return ids[start:end]
+}
+
+func (r *memoryRepo) BoxesForMessage(address string, id string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	boxes := []string{}
+	for _, row := range r.boxes {
+		if row.Address == address && row.MessageID == id {
+			boxes = append(boxes, row.Box)
+		}
+	}
+	return boxes
+}
+
+func isMovableBox(box string) bool {
+	return box == "inbox" || box == "archive" || box == "trash" || box == "spam"
+}
+
+func (r *memoryRepo) MoveEmail(address string, messageID string, newBox string) {
+	checkMovableBox(newBox)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.MessageID == messageID && isMovableBox(row.Box)
+	})
+	if len(rows) != 1 {
+		log.Panicf("Expected to move one message (%v/%v), found %v", address, messageID, len(rows))
+	}
+	rows[0].Box = newBox
+}
+
+//
+// ATTACHMENTS
+//
+
+func (r *memoryRepo) SaveAttachment(attachment *Attachment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, saved := range r.attachments[attachment.MessageID] {
+		if saved.ID == attachment.ID {
+			log.Panicf("Duplicate attachment %d for %s", attachment.ID, attachment.MessageID)
+		}
+	}
+	saved := *attachment
+	saved.Size = len(saved.CipherContent)
+	r.attachments[attachment.MessageID] = append(r.attachments[attachment.MessageID], &saved)
+}
+
+func (r *memoryRepo) LoadAttachmentHeaders(messageID string) []AttachmentHeader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	headers := []AttachmentHeader{}
+	for _, attachment := range r.attachments[messageID] {
+		headers = append(headers, attachment.AttachmentHeader)
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].ID < headers[j].ID })
+	return headers
+}
+
+func (r *memoryRepo) LoadAttachment(messageID string, id int) *Attachment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, attachment := range r.attachments[messageID] {
+		if attachment.ID == id {
+			loaded := *attachment
+			return &loaded
+		}
+	}
+	return nil
+}
+
+//
+// EMAIL (THREADS)
+//
+
+// Rows of the thread up to and including the given message. Caller holds the lock.
+func (r *memoryRepo) threadRowsUpTo(address string, messageID string) []*memoryBoxRow {
+	email := r.emails[messageID]
+	if email == nil {
+		return nil
+	}
+	return r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address &&
+			row.ThreadID == email.ThreadID &&
+			row.UnixTime <= email.UnixTime
+	})
+}
+
+func (r *memoryRepo) MoveThread(address string, messageID string, newBox string) {
+	checkMovableBox(newBox)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	moved := 0
+	for _, row := range r.threadRowsUpTo(address, messageID) {
+		if isMovableBox(row.Box) {
+			row.Box = newBox
+			moved++
+		}
+	}
+	if moved == 0 {
+		log.Panicf("Expected to move at least one message (%v/%v), found none", address, messageID)
+	}
+}
+
+func (r *memoryRepo) DeleteThreadFromBoxes(address string, messageID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := map[*memoryBoxRow]bool{}
+	for _, row := range r.threadRowsUpTo(address, messageID) {
+		rows[row] = true
+	}
+	count := r.deleteBoxRows(func(row *memoryBoxRow) bool {
+		return rows[row]
+	})
+	if count == 0 {
+		log.Panicf("Could not delete thread messages for message %s for %s",
+			messageID, address)
+	}
+	r.deleteOrphanedEmail(messageID)
+}
+
+//
+// TRASH
+//
+
+func isTrashableBox(box string) bool {
+	return box == "inbox" || box == "archive" || box == "sent" || box == "spam"
+}
+
+// Moves rows to 'trash'. Caller holds the lock.
+func (r *memoryRepo) trashRows(rows []*memoryBoxRow, unixTime int64) int {
+	trashed := 0
+	for _, row := range rows {
+		if isTrashableBox(row.Box) {
+			row.TrashedFrom, row.Box, row.TrashTime = row.Box, "trash", unixTime
+			trashed++
+		}
+	}
+	return trashed
+}
+
+// Moves rows in 'trash' back where they came from. Caller holds the lock.
+func (r *memoryRepo) undeleteRows(rows []*memoryBoxRow) int {
+	undeleted := 0
+	for _, row := range rows {
+		if row.Box == "trash" {
+			row.Box = row.TrashedFrom
+			if row.Box == "" {
+				row.Box = "inbox"
+			}
+			row.TrashedFrom, row.TrashTime = "", 0
+			undeleted++
+		}
+	}
+	return undeleted
+}
+
+// A user's rows for one message. Caller holds the lock.
+func (r *memoryRepo) messageRows(address string, messageID string) []*memoryBoxRow {
+	return r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Address == address && row.MessageID == messageID
+	})
+}
+
+func (r *memoryRepo) TrashEmail(address string, messageID string, unixTime int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.trashRows(r.messageRows(address, messageID), unixTime) == 0 {
+		log.Panicf("Expected to trash a message (%v/%v), found none", address, messageID)
+	}
+}
+
+func (r *memoryRepo) TrashThread(address string, messageID string, unixTime int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.trashRows(r.threadRowsUpTo(address, messageID), unixTime) == 0 {
+		log.Panicf("Expected to trash at least one message (%v/%v), found none", address, messageID)
+	}
+}
+
+func (r *memoryRepo) UndeleteEmail(address string, messageID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.undeleteRows(r.messageRows(address, messageID)) == 0 {
+		log.Panicf("Expected to undelete a message (%v/%v), found none", address, messageID)
+	}
+}
+
+func (r *memoryRepo) UndeleteThread(address string, messageID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.undeleteRows(r.threadRowsUpTo(address, messageID)) == 0 {
+		log.Panicf("Expected to undelete at least one message (%v/%v), found none", address, messageID)
+	}
+}
+
+func (r *memoryRepo) PurgeTrash(before int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := map[string]bool{}
+	count := r.deleteBoxRows(func(row *memoryBoxRow) bool {
+		if row.Box == "trash" && row.TrashTime < before {
+			ids[row.MessageID] = true
+			return true
+		}
+		return false
+	})
+	for id := range ids {
+		r.deleteOrphanedEmail(id)
+	}
+	return count
+}
+
+//
+// FLAGS
+//
+
+// Sets a flag on box rows. Caller holds the lock.
+func setRowFlag(rows []*memoryBoxRow, flag string, value bool) {
+	for _, row := range rows {
+		if flag == "read" {
+			row.Read = value
+		} else {
+			row.Starred = value
+		}
+	}
+}
+
+func (r *memoryRepo) SetFlag(address string, messageIDs []string, flag string, value bool) {
+	checkFlag(flag)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, messageID := range messageIDs {
+		setRowFlag(r.messageRows(address, messageID), flag, value)
+	}
+}
+
+func (r *memoryRepo) SetThreadFlag(address string, threadIDs []string, flag string, value bool) {
+	checkFlag(flag)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, threadID := range threadIDs {
+		setRowFlag(r.boxRows(func(row *memoryBoxRow) bool {
+			return row.Address == address && row.ThreadID == threadID
+		}), flag, value)
+	}
+}
+
+//
+// LABELS
+//
+
+func (r *memoryRepo) CreateLabel(address string, cipherName string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastLabelID++
+	r.labels[r.lastLabelID] = &memoryLabel{
+		Label:      Label{r.lastLabelID, cipherName},
+		Address:    address,
+		MessageIDs: map[string]bool{},
+	}
+	return r.lastLabelID
+}
+
+func (r *memoryRepo) LoadLabels(address string) []Label {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	labels := []Label{}
+	for _, label := range r.labels {
+		if label.Address == address {
+			labels = append(labels, label.Label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].ID < labels[j].ID })
+	return labels
+}
+
+// The label, if address owns it. Caller holds the lock.
+func (r *memoryRepo) ownLabel(address string, id int64) *memoryLabel {
+	label := r.labels[id]
+	if label == nil || label.Address != address {
+		return nil
+	}
+	return label
+}
+
+func (r *memoryRepo) RenameLabel(address string, id int64, cipherName string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	label := r.ownLabel(address, id)
+	if label == nil {
+		return false
+	}
+	label.CipherName = cipherName
+	return true
+}
+
+func (r *memoryRepo) DeleteLabel(address string, id int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ownLabel(address, id) == nil {
+		return false
+	}
+	delete(r.labels, id)
+	return true
+}
+
+func (r *memoryRepo) AddLabel(address string, id int64, messageIDs []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	label := r.ownLabel(address, id)
+	if label == nil {
+		return false
+	}
+	for _, messageID := range messageIDs {
+		if len(r.messageRows(address, messageID)) > 0 {
+			label.MessageIDs[messageID] = true
+		}
+	}
+	return true
+}
+
+func (r *memoryRepo) RemoveLabel(address string, id int64, messageIDs []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	label := r.ownLabel(address, id)
+	if label == nil {
+		return false
+	}
+	for _, messageID := range messageIDs {
+		delete(label.MessageIDs, messageID)
+	}
+	return true
+}
+
+// Labeled emails the user hasn't trashed or deleted, newest first.
+// Caller holds the lock.
+func (r *memoryRepo) labeledEmails(address string, id int64) []*Email {
+	label := r.ownLabel(address, id)
+	if label == nil {
+		return nil
+	}
+	emails := []*Email{}
+	for messageID := range label.MessageIDs {
+		for _, row := range r.messageRows(address, messageID) {
+			if row.Box != "trash" {
+				emails = append(emails, r.emails[messageID])
+				break
+			}
+		}
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].UnixTime > emails[j].UnixTime
+	})
+	return emails
+}
+
+func (r *memoryRepo) LoadLabelByThread(address string, id int64, offset, limit int) []EmailHeader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	latest := []*Email{}
+	seen := map[string]bool{}
+	for _, email := range r.labeledEmails(address, id) {
+		if !seen[email.ThreadID] {
+			seen[email.ThreadID] = true
+			latest = append(latest, email)
+		}
+	}
+	start, end := page(len(latest), offset, limit)
+	headers := make([]EmailHeader, 0)
+	for _, email := range latest[start:end] {
+		headers = append(headers, withFlags(email.EmailHeader, r.messageRows(address, email.MessageID)))
+	}
+	return headers
+}
+
+func (r *memoryRepo) CountLabel(address string, id int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.labeledEmails(address, id)), nil
+}
+
+//
+// SESSIONS
+//
+
+func (r *memoryRepo) SaveSession(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[session.Key] != nil {
+		log.Panicf("Duplicate session %s", session.Key)
+	}
+	saved := *session
+	r.sessions[session.Key] = &saved
+}
+
+func (r *memoryRepo) LoadSession(key string, now int64) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session := r.sessions[key]
+	if session == nil || session.Expires <= now {
+		return nil
+	}
+	loaded := *session
+	return &loaded
+}
+
+func (r *memoryRepo) DeleteSession(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleteSessions(func(s *Session) bool { return s.Key == key }) > 0
+}
+
+func (r *memoryRepo) DeleteSessions(token string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleteSessions(func(s *Session) bool { return s.Token == token })
+}
+
+func (r *memoryRepo) PurgeSessions(before int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleteSessions(func(s *Session) bool { return s.Expires <= before })
+}
+
+// Caller holds the lock
+func (r *memoryRepo) deleteSessions(match func(*Session) bool) int {
+	count := 0
+	for key, session := range r.sessions {
+		if match(session) {
+			delete(r.sessions, key)
+			count++
+		}
+	}
+	return count
+}
+
+//
+// AUDIT LOG
+//
+
+func (r *memoryRepo) AddAuditEvent(token string, event *AuditEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.auditEvents[token] = append(r.auditEvents[token], *event)
+}
+
+func (r *memoryRepo) LoadAuditEvents(token string, offset, limit int) []AuditEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := []AuditEvent{}
+	for i := len(r.auditEvents[token]) - 1; i >= 0; i-- {
+		events = append(events, r.auditEvents[token][i])
+	}
+	start, end := page(len(events), offset, limit)
+	return events[start:end]
+}
+
+func (r *memoryRepo) PurgeAuditEvents(before int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for token, events := range r.auditEvents {
+		kept := []AuditEvent{}
+		for _, event := range events {
+			if event.UnixTime < before {
+				count++
+			} else {
+				kept = append(kept, event)
+			}
+		}
+		r.auditEvents[token] = kept
+	}
+	return count
+}
+
+//
+// TWO-FACTOR AUTHENTICATION
+//
+
+func (r *memoryRepo) LoadTotp(token string) *TotpConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totp := r.totps[token]
+	if totp == nil {
+		return nil
+	}
+	loaded := totp.TotpConfig
+	return &loaded
+}
+
+func (r *memoryRepo) SaveTotp(token string, secret string, recoveryCodeHashes []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[token] == nil || r.totps[token] != nil && r.totps[token].Enabled {
+		return false
+	}
+	totp := &memoryTotp{TotpConfig{secret, false, 0}, map[string]bool{}}
+	for _, codeHash := range recoveryCodeHashes {
+		totp.RecoveryCodeHashes[codeHash] = true
+	}
+	r.totps[token] = totp
+	return true
+}
+
+func (r *memoryRepo) EnableTotp(token string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totp := r.totps[token]
+	if totp == nil || totp.Enabled {
+		return false
+	}
+	totp.Enabled = true
+	return true
+}
+
+func (r *memoryRepo) DeleteTotp(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.totps, token)
+}
+
+func (r *memoryRepo) UseTotpStep(token string, step int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totp := r.totps[token]
+	if totp == nil || totp.LastStep >= step {
+		return false
+	}
+	totp.LastStep = step
+	return true
+}
+
+func (r *memoryRepo) UseRecoveryCode(token string, codeHash string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totp := r.totps[token]
+	if totp == nil || !totp.Enabled || !totp.RecoveryCodeHashes[codeHash] {
+		return false
+	}
+	delete(totp.RecoveryCodeHashes, codeHash)
+	return true
+}
+
+//
+// DRAFTS
+//
+
+func (r *memoryRepo) SaveDraft(address string, draft *Email) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	saved := &Email{
+		EmailHeader: EmailHeader{
+			MessageID:     draft.MessageID,
+			ThreadID:      draft.ThreadID,
+			UnixTime:      draft.UnixTime,
+			From:          address,
+			To:            draft.To,
+			CipherSubject: draft.CipherSubject,
+			Read:          true,
+		},
+		CipherBody:  draft.CipherBody,
+		AncestorIDs: draft.AncestorIDs,
+	}
+	r.drafts[[2]string{address, draft.MessageID}] = saved
+}
+
+func (r *memoryRepo) LoadDraft(address string, messageID string) *Email {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	draft := r.drafts[[2]string{address, messageID}]
+	if draft == nil {
+		return nil
+	}
+	copied := *draft
+	return &copied
+}
+
+func (r *memoryRepo) LoadDrafts(address string, offset, limit int) []EmailHeader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	headers := []EmailHeader{}
+	for key, draft := range r.drafts {
+		if key[0] == address {
+			headers = append(headers, draft.EmailHeader)
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].UnixTime > headers[j].UnixTime
+	})
+	start, end := page(len(headers), offset, limit)
+	return headers[start:end]
+}
+
+func (r *memoryRepo) CountDrafts(address string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for key := range r.drafts {
+		if key[0] == address {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *memoryRepo) DeleteDraft(address string, messageID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := [2]string{address, messageID}
+	if r.drafts[key] == nil {
+		return false
+	}
+	delete(r.drafts, key)
+	return true
+}
+
+//
+// SEARCH INDEX
+//
+
+func (r *memoryRepo) LoadSearchIndex(token string, since int64) *SearchIndex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[token] == nil {
+		log.Panicf("No such user %s", token)
+	}
+	index := &SearchIndex{Chunks: []SearchChunk{}}
+	saved := r.searchIndexes[token]
+	if saved == nil {
+		return index
+	}
+	index.Version = saved.Version
+	for _, chunk := range saved.Chunks {
+		if chunk.Version > since {
+			index.Chunks = append(index.Chunks, chunk)
+		}
+	}
+	sort.Slice(index.Chunks, func(i, j int) bool {
+		a, b := index.Chunks[i], index.Chunks[j]
+		return a.Version < b.Version || a.Version == b.Version && a.ID < b.ID
+	})
+	return index
+}
+
+func (r *memoryRepo) SaveSearchChunks(token string, baseVersion int64, chunks []SearchChunk) (int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[token] == nil {
+		log.Panicf("No such user %s", token)
+	}
+	saved := r.searchIndexes[token]
+	if saved == nil {
+		saved = &memorySearchIndex{0, map[string]SearchChunk{}}
+	}
+	if saved.Version != baseVersion {
+		return saved.Version, false
+	}
+	saved.Version++
+	for _, chunk := range chunks {
+		chunk.Version = saved.Version
+		saved.Chunks[chunk.ID] = chunk
+	}
+	r.searchIndexes[token] = saved
+	return saved.Version, true
+}
+
+//
+// OUTBOX
+//
+
+func (r *memoryRepo) CheckoutOutbox(limit int) []*BoxedEmail {
+	r.mu.Lock()
+	now := time.Now().Unix()
+	rows := r.boxRows(func(row *memoryBoxRow) bool {
+		return row.Box == "outbox" && row.NextAttempt <= now
+	})
+	boxedEmails := []*BoxedEmail{}
+	// oldest first
+	for i := len(rows) - 1; i >= 0 && len(boxedEmails) < limit; i-- {
+		row := rows[i]
+		boxedEmails = append(boxedEmails, &BoxedEmail{
+			*r.emails[row.MessageID],
+			row.Id,
+			row.Box,
+			row.Address,
+			row.Attempts,
+			row.NextAttempt,
+			row.TlsStatus,
+		})
+	}
+	r.mu.Unlock()
+	r.MarkOutboxAs(boxedEmails, "outbox-processing")
+	return boxedEmails
+}
+
+func (r *memoryRepo) RequeueOutbox() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, row := range r.boxes {
+		if row.Box == "outbox-processing" {
+			row.Box = "outbox"
+		}
+	}
+}
+
+func (r *memoryRepo) RescheduleOutbox(boxedEmail *BoxedEmail, nextAttempt int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, row := range r.boxes {
+		if row.Id == boxedEmail.Id && row.Box == "outbox-processing" {
+			row.Box = "outbox"
+			row.Attempts++
+			row.NextAttempt = nextAttempt
+		}
+	}
+}
+
+func (r *memoryRepo) MarkOutboxAs(boxedEmails []*BoxedEmail, newBox string) {
+	if len(boxedEmails) == 0 {
+		return
+	}
+	checkOutboxMark(newBox)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := map[int64]bool{}
+	for _, boxedEmail := range boxedEmails {
+		ids[boxedEmail.Id] = true
+	}
+	now := time.Now().Unix()
+	for _, row := range r.boxes {
+		if ids[row.Id] && (row.Box == "outbox" || row.Box == "outbox-processing" ||
+			row.Box == "outbox-sent" || row.Box == "outbox-failed") {
+			row.Box = newBox
+			row.UnixTime = now
+		}
+	}
+}
+
+func (r *memoryRepo) MarkSendError(boxedEmail *BoxedEmail, errorMessage *string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, row := range r.boxes {
+		if row.Id == boxedEmail.Id {
+			row.Error = errorMessage
+		}
+	}
+}
+
+func (r *memoryRepo) MarkTlsStatus(boxedEmail *BoxedEmail, tlsStatus string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, row := range r.boxes {
+		if row.Id == boxedEmail.Id {
+			row.TlsStatus = tlsStatus
+		}
+	}
+}
+
+func (r *memoryRepo) LoadOutboxRecipients(boxID int64) []*OutboxRecipient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rcpts := []*OutboxRecipient{}
+	for _, rcpt := range r.outboxRcpts[boxID] {
+		loaded := rcpt
+		rcpts = append(rcpts, &loaded)
+	}
+	sort.Slice(rcpts, func(i, j int) bool {
+		return rcpts[i].Address < rcpts[j].Address
+	})
+	return rcpts
+}
+
+func (r *memoryRepo) SaveOutboxRecipients(rcpts []*OutboxRecipient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rcpt := range rcpts {
+		saved := r.outboxRcpts[rcpt.BoxID]
+		found := false
+		for i := range saved {
+			if saved[i].Address == rcpt.Address {
+				saved[i] = *rcpt
+				found = true
+			}
+		}
+		if !found {
+			saved = append(saved, *rcpt)
+		}
+		r.outboxRcpts[rcpt.BoxID] = saved
+	}
+}
+
+//
+// NOTARY
+//
+
+func (r *memoryRepo) AddNameResolution(name, host, hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := [2]string{host, name}
+	if _, ok := r.names[key]; ok {
+		log.Panicf("Duplicate name resolution for %s@%s", name, host)
+	}
+	r.names[key] = hash
+}
+
+func (r *memoryRepo) GetNameResolution(name, host string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.names[[2]string{host, name}]
+}
+
+func (r *memoryRepo) DeleteNameResolution(name, host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.names, [2]string{host, name})
+}
+
+func (r *memoryRepo) SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) *MxHostInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := &MxHostInfo{host, isScramble, notaryPublicKey, time.Now().Unix()}
+	saved := *info
+	r.mxHosts[host] = &saved
+	return info
+}
+
+func (r *memoryRepo) GetMxHostInfo(host string) *MxHostInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.mxHosts[host]
+	if info == nil {
+		return nil
+	}
+	loaded := *info
+	return &loaded
+}
+
+//
+// DKIM
+//
+
+func (r *memoryRepo) AddDkimKey(key *DkimKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dkimKeys[key.EmailHost] == nil {
+		saved := *key
+		r.dkimKeys[key.EmailHost] = &saved
+	}
+}
+
+func (r *memoryRepo) LoadDkimKey(emailHost string) *DkimKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := r.dkimKeys[emailHost]
+	if key == nil {
+		return nil
+	}
+	loaded := *key
+	return &loaded
+}
@@ -0,0 +1,1717 @@
+package main
+
+import "database/sql"
+import _ "github.com/go-sql-driver/mysql"
+import _ "github.com/mattn/go-sqlite3"
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	//"github.com/jaekwon/go-prelude/colors"
+)
+
+// The few statements that MySQL and SQLite can't agree on.
+// Everything else in sqlRepo is written to run on both.
+type sqlDialect struct {
+	Name         string
+	InsertIgnore string // "insert ignore" vs "insert or ignore"
+	Migrations   []func(*sql.DB) error
+}
+
+var mysqlDialect = &sqlDialect{
+	"mysql",
+	"INSERT IGNORE",
+	migrations,
+}
+
+var sqliteDialect = &sqlDialect{
+	"sqlite3",
+	"INSERT OR IGNORE",
+	sqliteMigrations,
+}
+
+// Returns "ON DUPLICATE KEY UPDATE col = VALUES(col), ..." or the
+// SQLite equivalent, for the given unique key and columns to update.
+func (d *sqlDialect) upsert(key string, cols ...string) string {
+	sets := []string{}
+	for _, col := range cols {
+		if d.Name == "mysql" {
+			sets = append(sets, col+" = VALUES("+col+")")
+		} else {
+			sets = append(sets, col+" = excluded."+col)
+		}
+	}
+	if d.Name == "mysql" {
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	}
+	return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// Repository backed by a database/sql connection
+type sqlRepo struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func NewMySQLRepo(conf *Config) *sqlRepo {
+	mysqlHost := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?charset=utf8",
+		conf.DbUser,
+		conf.DbPassword,
+		conf.DbServer,
+		conf.DbCatalog)
+
+	// connect to the database, ping periodically to maintain the connection
+	log.Printf("Connecting to %s\n", mysqlHost)
+	db, err := sql.Open("mysql", mysqlHost)
+	if err != nil {
+		panic(err)
+	}
+	r := &sqlRepo{db, mysqlDialect}
+	go r.ping()
+
+	// migrate the database
+	migrateDb(db, r.dialect)
+	return r
+}
+
+func NewSQLiteRepo(path string) *sqlRepo {
+	log.Printf("Opening SQLite database %s\n", path)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		panic(err)
+	}
+	// SQLite allows only one writer at a time anyways
+	db.SetMaxOpenConns(1)
+	r := &sqlRepo{db, sqliteDialect}
+	migrateDb(db, r.dialect)
+	return r
+}
+
+func (r *sqlRepo) ping() {
+	ticker := time.Tick(time.Minute)
+	for {
+		<-ticker
+		err := r.db.Ping()
+		if err != nil {
+			log.Printf("DB not ok: %v\n", err)
+		} else {
+			log.Printf("DB ok\n")
+		}
+	}
+}
+
+//
+// USERS
+//
+
+func (r *sqlRepo) SaveUser(user *User) bool {
+	res, err := r.db.Exec(r.dialect.InsertIgnore+" into user"+
+		" (token, password_hash, public_hash, public_key, cipher_private_key, email_host)"+
+		" values (?, ?, ?, ?, ?, ?)",
+		user.Token, user.PasswordHash,
+		user.PublicHash, user.PublicKey,
+		user.CipherPrivateKey, user.EmailHost)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return nrows == 1
+}
+
+func (r *sqlRepo) DeleteUser(token string) {
+	_, err := r.db.Exec("delete from user where token=?", token)
+	if err != nil {
+		log.Panicf("Could not delete user %s: %v", token, err)
+	}
+	_, err = r.db.Exec("DELETE FROM search_chunk WHERE token = ?", token)
+	if err != nil {
+		log.Panicf("Could not delete search index of %s: %v", token, err)
+	}
+	r.DeleteSessions(token)
+	r.DeleteTotp(token)
+	_, err = r.db.Exec("DELETE FROM audit_event WHERE token = ?", token)
+	if err != nil {
+		log.Panicf("Could not delete audit log of %s: %v", token, err)
+	}
+}
+
+func (r *sqlRepo) DeleteMailbox(address string) int {
+	rows, err := r.db.Query("SELECT DISTINCT message_id FROM box WHERE address = ?", address)
+	if err != nil {
+		panic(err)
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			panic(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, stmt := range []string{
+		"DELETE FROM outbox_recipient WHERE box_id IN (SELECT id FROM box WHERE address = ?)",
+		"DELETE FROM email_label WHERE label_id IN (SELECT id FROM label WHERE address = ?)",
+		"DELETE FROM label WHERE address = ?",
+		"DELETE FROM draft WHERE address = ?",
+	} {
+		if _, err = r.db.Exec(stmt, address); err != nil {
+			panic(err)
+		}
+	}
+	res, err := r.db.Exec("DELETE FROM box WHERE address = ?", address)
+	if err != nil {
+		panic(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	for _, id := range ids {
+		r.deleteOrphanedEmail(id)
+	}
+	return int(count)
+}
+
+func (r *sqlRepo) LoadUser(token string) *User {
+	var user User
+	user.Token = token
+	err := r.db.QueryRow("select"+
+		" password_hash, password_hash_old, public_hash, public_key, cipher_private_key, email_host"+
+		" from user where token=?", token).Scan(
+		&user.PasswordHash,
+		&user.PasswordHashOld,
+		&user.PublicHash,
+		&user.PublicKey,
+		&user.CipherPrivateKey,
+		&user.EmailHost)
+	user.EmailAddress = user.Token + "@" + user.EmailHost
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &user
+}
+
+func (r *sqlRepo) LoadUserID(token string) *UserID {
+	var user UserID
+	user.Token = token
+	err := r.db.QueryRow("select"+
+		" password_hash, password_hash_old, public_hash, email_host"+
+		" from user where token=?", token).Scan(
+		&user.PasswordHash,
+		&user.PasswordHashOld,
+		&user.PublicHash,
+		&user.EmailHost)
+	user.EmailAddress = user.Token + "@" + user.EmailHost
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &user
+}
+
+// Loads a given public hash by a user's token (name) & email_host
+func (r *sqlRepo) LoadPubHash(token, emailHost string) string {
+	var hash string
+	err := r.db.QueryRow("SELECT public_hash "+
+		" FROM user WHERE token=? and email_host=?",
+		token, emailHost).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// Whether any user has an address on emailHost
+func (r *sqlRepo) ServesEmailHost(emailHost string) bool {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM user WHERE email_host=?",
+		emailHost).Scan(&count)
+	if err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+// Loads a given public key by it's hash
+// The client then verifies that the key is correct
+func (r *sqlRepo) LoadPubKey(publicHash string) string {
+	var publicKey string
+	err := r.db.QueryRow("SELECT public_key "+
+		"FROM user WHERE public_hash=?",
+		publicHash).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return publicKey
+}
+
+// Loads an address from a user's pubHash.
+// This exists to upgrade legacy contacts.
+func (r *sqlRepo) LoadAddressFromPubHash(publicHash string) string {
+	var token, emailHost string
+	err := r.db.QueryRow("SELECT token, email_host "+
+		"FROM user WHERE public_hash=?",
+		publicHash).Scan(&token, &emailHost)
+	if err == sql.ErrNoRows {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return token + "@" + emailHost
+}
+
+// Loads a user's contacts, or nil if the user doesn't exist
+// Returns an encrypted blob for which only they have the key
+func (r *sqlRepo) LoadContacts(token string) *string {
+	var cipherContacts *string
+	err := r.db.QueryRow("SELECT cipher_contacts "+
+		"FROM user WHERE token=?", token).Scan(
+		&cipherContacts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return cipherContacts
+}
+
+func (r *sqlRepo) SaveContacts(token string, cipherContacts string) {
+	_, err := r.db.Exec("UPDATE user "+
+		"SET cipher_contacts=? WHERE token=?",
+		cipherContacts, token)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// One statement, so a concurrent change can't slip in between the
+// check and the update
+func (r *sqlRepo) ChangePassword(token, passHash, passHashOld, newPassHash, newCipherPrivateKey string) bool {
+	res, err := r.db.Exec("UPDATE user "+
+		"SET password_hash = ?, password_hash_old = '', cipher_private_key = ? "+
+		"WHERE token = ? AND ((password_hash = ? AND password_hash <> '') OR "+
+		"(password_hash_old = ? AND password_hash_old <> ''))",
+		newPassHash, newCipherPrivateKey, token, passHash, passHashOld)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return nrows == 1
+}
+
+//
+// EMAIL HEADERS
+//
+
+// Loads all email headers in a certain box
+// For example, inbox or sent box
+// That are encrypted for a given user
+func (r *sqlRepo) LoadBox(address string, box string, offset, limit int) []EmailHeader {
+	rows, err := r.db.Query("SELECT m.message_id, m.unix_time, "+
+		" m.from_email, m.to_email, m.cipher_subject, m.thread_id, "+
+		" m.spf_result, m.dkim_result, m.dmarc_result, m.spam_score, "+
+		" b.is_read, b.is_starred "+
+		" FROM email AS m INNER JOIN box AS b "+
+		" ON b.message_id = m.message_id "+
+		" WHERE b.address = ? and b.box=? "+
+		" ORDER BY b.unix_time DESC"+
+		" LIMIT ?, ? ",
+		address, box,
+		offset, limit)
+	if err != nil {
+		panic(err)
+	}
+	return rowsToHeaders(rows)
+}
+
+// Like LoadBox(), but only returns the latest mail in the box for each thread.
+// A thread is read unless any of its mail in the box is unread, and
+// starred if any of it is starred.
+func (r *sqlRepo) LoadBoxByThread(address string, box string, offset, limit int) []EmailHeader {
+	rows, err := r.db.Query("SELECT e.message_id, e.unix_time, "+
+		"e.from_email, e.to_email, e.cipher_subject, e.thread_id, "+
+		"e.spf_result, e.dkim_result, e.dmarc_result, e.spam_score, "+
+		"m.is_read, m.is_starred "+
+		"FROM email AS e INNER JOIN ( "+
+		"SELECT box.message_id, max.is_read, max.is_starred FROM box INNER JOIN ( "+
+		"SELECT MAX(unix_time) AS unix_time, thread_id, "+
+		"MIN(is_read) AS is_read, MAX(is_starred) AS is_starred FROM box "+
+		"WHERE address = ? AND box = ? GROUP BY thread_id "+
+		"ORDER BY unix_time DESC "+
+		"LIMIT ?, ? "+
+		") AS max ON "+
+		"max.unix_time = box.unix_time AND "+
+		"max.thread_id = box.thread_id AND "+
+		"box.address = ? AND box.box = ? "+
+		") AS m ON e.message_id = m.message_id "+
+		"ORDER BY e.unix_time DESC ",
+		address, box,
+		offset, limit,
+		address, box,
+	)
+	if err != nil {
+		panic(err)
+	}
+	return rowsToHeaders(rows)
+}
+
+func (r *sqlRepo) CountBox(address string, box string) (count int, err error) {
+	err = r.db.QueryRow("SELECT count(*) FROM box "+
+		" WHERE address = ? and box = ?",
+		address, box).Scan(&count)
+	return
+}
+
+func (r *sqlRepo) CountUnread(address string, box string) (count int, err error) {
+	err = r.db.QueryRow("SELECT count(*) FROM box "+
+		" WHERE address = ? and box = ? and is_read = ?",
+		address, box, false).Scan(&count)
+	return
+}
+
+func rowsToHeaders(rows *sql.Rows) []EmailHeader {
+	defer rows.Close()
+	// collect a short description of each email
+	headers := make([]EmailHeader, 0)
+	for rows.Next() {
+		var header EmailHeader
+		err := rows.Scan(
+			&header.MessageID,
+			&header.UnixTime,
+			&header.From,
+			&header.To,
+			&header.CipherSubject,
+			&header.ThreadID,
+			&header.SpfResult,
+			&header.DkimResult,
+			&header.DmarcResult,
+			&header.SpamScore,
+			&header.Read,
+			&header.Starred,
+		)
+		if err != nil {
+			panic(err)
+		}
+		headers = append(headers, header)
+	}
+
+	return headers
+}
+
+//
+// EMAIL
+//
+
+// Saves a single email, encrypted for (potentially) multiple recipients.
+// A single mail server only needs one email for all recipients & sender.
+// Associating emails to boxes are done in a join table.
+// Outgoing emails for external servers also require an entry in the 'email' table.
+func (r *sqlRepo) SaveMessage(e *Email) {
+	_, err := r.db.Exec("insert into email "+
+		"(message_id, unix_time, from_email, to_email, "+
+		" cipher_subject, cipher_body, "+
+		" ancestor_ids, thread_id, "+
+		" spf_result, dkim_result, dmarc_result, spam_score) "+
+		"values (?,?,?,?,?,?,?,?,?,?,?,?)",
+		e.MessageID,
+		e.UnixTime,
+		e.From,
+		e.To,
+		e.CipherSubject,
+		e.CipherBody,
+		e.AncestorIDs,
+		e.ThreadID,
+		e.SpfResult,
+		e.DkimResult,
+		e.DmarcResult,
+		e.SpamScore,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Retrieves a single message, by id
+func (r *sqlRepo) LoadMessage(id string) Email {
+	var email Email
+	err := r.db.QueryRow("SELECT "+
+		"unix_time, from_email, to_email, "+
+		"cipher_subject, cipher_body, "+
+		"ancestor_ids, thread_id, "+
+		"spf_result, dkim_result, dmarc_result, spam_score "+
+		"FROM email WHERE message_id=?",
+		id).Scan(
+		&email.UnixTime,
+		&email.From,
+		&email.To,
+		&email.CipherSubject,
+		&email.CipherBody,
+		&email.AncestorIDs,
+		&email.ThreadID,
+		&email.SpfResult,
+		&email.DkimResult,
+		&email.DmarcResult,
+		&email.SpamScore,
+	)
+	email.MessageID = id
+	if err != nil {
+		panic(err)
+	}
+	return email
+}
+
+// Load emails for a given thread in given boxes.
+func (r *sqlRepo) LoadThreadFromBoxes(address, threadId string) []Email {
+	rows, err := r.db.Query("SELECT "+
+		"e.message_id, e.unix_time, e.from_email, e.to_email, "+
+		"e.cipher_subject, e.cipher_body, "+
+		"e.ancestor_ids, e.thread_id, "+
+		"e.spf_result, e.dkim_result, e.dmarc_result, e.spam_score, "+
+		"m.is_read, m.is_starred "+
+		"FROM email AS e INNER JOIN ( "+
+		"SELECT box.message_id, MIN(is_read) AS is_read, MAX(is_starred) AS is_starred "+
+		"FROM box WHERE "+
+		"box.address = ? AND "+
+		"box.thread_id = ? "+
+		"GROUP BY box.message_id "+
+		") AS m ON e.message_id = m.message_id "+
+		"ORDER BY e.unix_time ASC",
+		address,
+		threadId,
+	)
+	if err != nil {
+		panic(err)
+	}
+	return rowsToEmails(rows)
+}
+
+func rowsToEmails(rows *sql.Rows) []Email {
+	defer rows.Close()
+	emails := []Email{}
+	for rows.Next() {
+		var email Email
+		err := rows.Scan(
+			&email.MessageID,
+			&email.UnixTime,
+			&email.From,
+			&email.To,
+			&email.CipherSubject,
+			&email.CipherBody,
+			&email.AncestorIDs,
+			&email.ThreadID,
+			&email.SpfResult,
+			&email.DkimResult,
+			&email.DmarcResult,
+			&email.SpamScore,
+			&email.Read,
+			&email.Starred,
+		)
+		if err != nil {
+			panic(err)
+		}
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// Load thread_ids given message_ids.
+// This is used to compute the thread_id of an incoming email.
+// Returns threadIDs in the same order as messageIDs.
+// e.g. [<id1>, <id1>, "", "", <id2>, ...]
+// messageIDs: an []interface{} of strings
+func (r *sqlRepo) LoadThreadIDsForMessageIDs(messageIDs []interface{}) []string {
+	messageIDsPH := "?" + strings.Repeat(",?", len(messageIDs)-1)
+	rows, err := r.db.Query("SELECT message_id, thread_id "+
+		"FROM email WHERE message_id IN ("+messageIDsPH+")",
+		messageIDs...,
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	lookup := map[string]string{}
+	for rows.Next() {
+		var messageID, threadID string
+		err := rows.Scan(&messageID, &threadID)
+		if err != nil {
+			panic(err)
+		}
+		lookup[messageID] = threadID
+	}
+	threadIDs := []string{}
+	for _, messageID := range messageIDs {
+		threadIDs = append(threadIDs, lookup[messageID.(string)])
+	}
+	return threadIDs
+}
+
+// Associates a message to a box (e.g. inbox, archive)
+// Also used to queue outbox messages, in which case
+// the address is just the host portion.
+func (r *sqlRepo) AddMessageToBox(e *Email, address string, box string) {
+	_, err := r.db.Exec("INSERT INTO box "+
+		"(message_id, unix_time, thread_id, address, box, is_read) "+
+		"VALUES (?,?,?,?,?,?)",
+		e.MessageID,
+		e.UnixTime,
+		e.ThreadID,
+		address,
+		box,
+		isReadOnArrival(box),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Deletes a message from any of a user's box.
+// If the email is no longer referenced, it gets deleted
+// from the email table as well.
+func (r *sqlRepo) DeleteFromBoxes(address string, id string) {
+	res, err := r.db.Exec("DELETE FROM box "+
+		"WHERE address=? AND message_id=?",
+		address, id)
+	if err != nil {
+		panic(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil || count == 0 {
+		log.Panicf("Could not delete message %s for %s: %v",
+			id, address, err)
+	}
+	r.deleteOrphanedEmail(id)
+}
+
+// Deletes the email row unless some box still references it
+func (r *sqlRepo) deleteOrphanedEmail(id string) {
+	_, err := r.db.Exec("DELETE FROM email WHERE message_id=? AND "+
+		"NOT EXISTS (SELECT 1 FROM box WHERE box.message_id=?)",
+		id, id)
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.db.Exec("DELETE FROM attachment WHERE message_id=? AND "+
+		"NOT EXISTS (SELECT 1 FROM email WHERE email.message_id=?)",
+		id, id)
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.db.Exec("DELETE FROM email_label WHERE message_id=? AND "+
+		"NOT EXISTS (SELECT 1 FROM email WHERE email.message_id=?)",
+		id, id)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqlRepo) LoadMessageIDs(address string, afterID string, limit int) []string {
+	rows, err := r.db.Query("SELECT DISTINCT message_id FROM box "+
+		"WHERE address = ? AND message_id > ? ORDER BY message_id LIMIT ?",
+		address, afterID, limit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			panic(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+	return ids
+}
+
+// See which boxes message belongs in for user.
+// e.g. ["inbox", "sent"]
+func (r *sqlRepo) BoxesForMessage(address string, id string) []string {
+	rows, err := r.db.Query("select box from box "+
+		"where address=? and message_id=?",
+		address, id)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	boxes := []string{}
+	for rows.Next() {
+		var box string
+		err := rows.Scan(&box)
+		if err != nil {
+			panic(err)
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes
+}
+
+// Move the email to another box.
+// This function only works within the 'inbox'/'archive'/'trash'/'spam' boxes
+func (r *sqlRepo) MoveEmail(address string, messageID string, newBox string) {
+	checkMovableBox(newBox)
+	res, err := r.db.Exec("update box "+
+		"set box=? "+
+		"where address=? and message_id=? and box in ('inbox', 'archive', 'trash', 'spam')",
+		newBox, address, messageID)
+	if err != nil {
+		panic(err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	if rows != 1 {
+		log.Panicf("Expected to move one message (%v/%v), found %v", address, messageID, rows)
+	}
+}
+
+//
+// ATTACHMENTS
+//
+
+func (r *sqlRepo) SaveAttachment(attachment *Attachment) {
+	_, err := r.db.Exec("INSERT INTO attachment "+
+		"(message_id, id, filename, content_type, cipher_content) "+
+		"VALUES (?,?,?,?,?)",
+		attachment.MessageID,
+		attachment.ID,
+		attachment.Filename,
+		attachment.ContentType,
+		attachment.CipherContent,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Everything but the content, in order
+func (r *sqlRepo) LoadAttachmentHeaders(messageID string) []AttachmentHeader {
+	rows, err := r.db.Query("SELECT id, filename, content_type, LENGTH(cipher_content) "+
+		"FROM attachment WHERE message_id=? ORDER BY id",
+		messageID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	headers := []AttachmentHeader{}
+	for rows.Next() {
+		var header AttachmentHeader
+		err = rows.Scan(&header.ID, &header.Filename, &header.ContentType, &header.Size)
+		if err != nil {
+			panic(err)
+		}
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+func (r *sqlRepo) LoadAttachment(messageID string, id int) *Attachment {
+	attachment := &Attachment{MessageID: messageID}
+	err := r.db.QueryRow("SELECT id, filename, content_type, cipher_content "+
+		"FROM attachment WHERE message_id=? AND id=?",
+		messageID, id).Scan(
+		&attachment.ID,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.CipherContent,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		panic(err)
+	}
+	attachment.Size = len(attachment.CipherContent)
+	return attachment
+}
+
+//
+// EMAIL (THREADS)
+//
+
+// Looks up the thread of a message, and the message's time.
+// Thread operations apply to the thread up to and including that message.
+func (r *sqlRepo) threadUpTo(messageID string) (threadID string, unixTime int64) {
+	err := r.db.QueryRow("SELECT thread_id, unix_time FROM email "+
+		"WHERE message_id = ?", messageID).Scan(&threadID, &unixTime)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	return
+}
+
+// Move emails in a thread to another box.
+// This function only works within the 'inbox'/'archive'/'trash'/'spam' boxes
+func (r *sqlRepo) MoveThread(address string, messageID string, newBox string) {
+	checkMovableBox(newBox)
+	threadID, unixTime := r.threadUpTo(messageID)
+	res, err := r.db.Exec("UPDATE box SET box = ? "+
+		"WHERE "+
+		"address = ? AND "+
+		"thread_id = ? AND "+
+		"unix_time <= ? AND "+
+		"box IN ('inbox', 'archive', 'trash', 'spam') ",
+		newBox, address, threadID, unixTime)
+	if err != nil {
+		panic(err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	if rows == 0 {
+		log.Panicf("Expected to move at least one message (%v/%v), found none", address, messageID)
+	}
+}
+
+// Deletes messages of a thread from any of a user's box.
+// If the email is no longer referenced, it gets deleted
+// from the email table as well.
+func (r *sqlRepo) DeleteThreadFromBoxes(address string, messageID string) {
+	threadID, unixTime := r.threadUpTo(messageID)
+	res, err := r.db.Exec("DELETE FROM box "+
+		"WHERE "+
+		"thread_id = ? AND "+
+		"unix_time <= ? AND "+
+		"address = ? ",
+		threadID, unixTime, address)
+	if err != nil {
+		panic(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil || count == 0 {
+		log.Panicf("Could not delete thread messages for message %s for %s: %v",
+			messageID, address, err)
+	}
+	r.deleteOrphanedEmail(messageID)
+}
+
+//
+// TRASH
+//
+
+// Boxes that mail can be trashed from. The outbox is still being delivered.
+const trashableBoxes = "('inbox', 'archive', 'sent', 'spam')"
+
+// Moves a message to 'trash' in all of a user's boxes,
+// remembering where it was and when it was trashed.
+func (r *sqlRepo) TrashEmail(address string, messageID string, unixTime int64) {
+	res, err := r.db.Exec("UPDATE box "+
+		"SET trashed_from = box, box = 'trash', trash_time = ? "+
+		"WHERE address = ? AND message_id = ? AND box IN "+trashableBoxes,
+		unixTime, address, messageID)
+	r.checkAffected(res, err, "trash", address, messageID)
+}
+
+// Moves a thread, up to and including the given message, to 'trash'
+func (r *sqlRepo) TrashThread(address string, messageID string, unixTime int64) {
+	threadID, threadTime := r.threadUpTo(messageID)
+	res, err := r.db.Exec("UPDATE box "+
+		"SET trashed_from = box, box = 'trash', trash_time = ? "+
+		"WHERE address = ? AND thread_id = ? AND unix_time <= ? AND box IN "+trashableBoxes,
+		unixTime, address, threadID, threadTime)
+	r.checkAffected(res, err, "trash", address, messageID)
+}
+
+// Moves a trashed message back to the box it came from
+func (r *sqlRepo) UndeleteEmail(address string, messageID string) {
+	res, err := r.db.Exec("UPDATE box "+
+		"SET box = CASE WHEN trashed_from = '' THEN 'inbox' ELSE trashed_from END, "+
+		"trashed_from = '', trash_time = 0 "+
+		"WHERE address = ? AND message_id = ? AND box = 'trash'",
+		address, messageID)
+	r.checkAffected(res, err, "undelete", address, messageID)
+}
+
+// Moves the trashed messages of a thread, up to and including the given
+// message, back to the boxes they came from
+func (r *sqlRepo) UndeleteThread(address string, messageID string) {
+	threadID, threadTime := r.threadUpTo(messageID)
+	res, err := r.db.Exec("UPDATE box "+
+		"SET box = CASE WHEN trashed_from = '' THEN 'inbox' ELSE trashed_from END, "+
+		"trashed_from = '', trash_time = 0 "+
+		"WHERE address = ? AND thread_id = ? AND unix_time <= ? AND box = 'trash'",
+		address, threadID, threadTime)
+	r.checkAffected(res, err, "undelete", address, messageID)
+}
+
+// Panics unless an update changed at least one row
+func (r *sqlRepo) checkAffected(res sql.Result, err error, what, address, messageID string) {
+	if err != nil {
+		panic(err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	if rows == 0 {
+		log.Panicf("Expected to %s at least one message (%v/%v), found none", what, address, messageID)
+	}
+}
+
+// Deletes everything trashed before the given time for good,
+// along with emails no box references any more
+func (r *sqlRepo) PurgeTrash(before int64) int {
+	rows, err := r.db.Query("SELECT DISTINCT message_id FROM box "+
+		"WHERE box = 'trash' AND trash_time < ?", before)
+	if err != nil {
+		panic(err)
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			panic(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	res, err := r.db.Exec("DELETE FROM box WHERE box = 'trash' AND trash_time < ?", before)
+	if err != nil {
+		panic(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	for _, id := range ids {
+		r.deleteOrphanedEmail(id)
+	}
+	return int(count)
+}
+
+//
+// FLAGS
+//
+
+// Box columns for the flags, see checkFlag
+var flagColumns = map[string]string{
+	"read":    "is_read",
+	"starred": "is_starred",
+}
+
+func (r *sqlRepo) SetFlag(address string, messageIDs []string, flag string, value bool) {
+	checkFlag(flag)
+	for _, messageID := range messageIDs {
+		_, err := r.db.Exec("UPDATE box SET "+flagColumns[flag]+" = ? "+
+			"WHERE address = ? AND message_id = ?",
+			value, address, messageID)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *sqlRepo) SetThreadFlag(address string, threadIDs []string, flag string, value bool) {
+	checkFlag(flag)
+	for _, threadID := range threadIDs {
+		_, err := r.db.Exec("UPDATE box SET "+flagColumns[flag]+" = ? "+
+			"WHERE address = ? AND thread_id = ?",
+			value, address, threadID)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+//
+// LABELS
+//
+
+func (r *sqlRepo) CreateLabel(address string, cipherName string) int64 {
+	res, err := r.db.Exec("INSERT INTO label (address, cipher_name) VALUES (?,?)",
+		address, cipherName)
+	if err != nil {
+		panic(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (r *sqlRepo) LoadLabels(address string) []Label {
+	rows, err := r.db.Query("SELECT id, cipher_name FROM label "+
+		"WHERE address = ? ORDER BY id", address)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	labels := []Label{}
+	for rows.Next() {
+		var label Label
+		if err := rows.Scan(&label.ID, &label.CipherName); err != nil {
+			panic(err)
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+func (r *sqlRepo) ownsLabel(address string, id int64) bool {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM label WHERE id = ? AND address = ?",
+		id, address).Scan(&count)
+	if err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+func (r *sqlRepo) RenameLabel(address string, id int64, cipherName string) bool {
+	if !r.ownsLabel(address, id) {
+		return false
+	}
+	_, err := r.db.Exec("UPDATE label SET cipher_name = ? WHERE id = ?", cipherName, id)
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// Deletes the label and takes it off every email. The emails stay.
+func (r *sqlRepo) DeleteLabel(address string, id int64) bool {
+	if !r.ownsLabel(address, id) {
+		return false
+	}
+	_, err := r.db.Exec("DELETE FROM email_label WHERE label_id = ?", id)
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.db.Exec("DELETE FROM label WHERE id = ?", id)
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// Labels emails in any of the user's boxes. Others are skipped.
+func (r *sqlRepo) AddLabel(address string, id int64, messageIDs []string) bool {
+	if !r.ownsLabel(address, id) {
+		return false
+	}
+	for _, messageID := range messageIDs {
+		_, err := r.db.Exec(r.dialect.InsertIgnore+" INTO email_label "+
+			"(label_id, message_id, thread_id, unix_time) "+
+			"SELECT ?, message_id, thread_id, unix_time FROM email "+
+			"WHERE message_id = ? AND "+
+			"EXISTS (SELECT 1 FROM box WHERE box.address = ? AND box.message_id = ?)",
+			id, messageID, address, messageID)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return true
+}
+
+func (r *sqlRepo) RemoveLabel(address string, id int64, messageIDs []string) bool {
+	if !r.ownsLabel(address, id) {
+		return false
+	}
+	for _, messageID := range messageIDs {
+		_, err := r.db.Exec("DELETE FROM email_label WHERE label_id = ? AND message_id = ?",
+			id, messageID)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return true
+}
+
+// Labeled emails the user hasn't trashed or deleted
+const labeledInBoxes = "email_label.label_id = ? AND " +
+	"EXISTS (SELECT 1 FROM label WHERE label.id = email_label.label_id AND label.address = ?) AND " +
+	"EXISTS (SELECT 1 FROM box WHERE box.address = ? AND " +
+	"box.message_id = email_label.message_id AND box.box <> 'trash') "
+
+// Like LoadBoxByThread, the latest labeled email of each thread
+func (r *sqlRepo) LoadLabelByThread(address string, id int64, offset, limit int) []EmailHeader {
+	rows, err := r.db.Query("SELECT e.message_id, e.unix_time, "+
+		"e.from_email, e.to_email, e.cipher_subject, e.thread_id, "+
+		"e.spf_result, e.dkim_result, e.dmarc_result, e.spam_score, "+
+		"(SELECT MIN(is_read) FROM box WHERE box.address = ? AND box.message_id = e.message_id), "+
+		"(SELECT MAX(is_starred) FROM box WHERE box.address = ? AND box.message_id = e.message_id) "+
+		"FROM email AS e INNER JOIN ( "+
+		"SELECT email_label.message_id FROM email_label INNER JOIN ( "+
+		"SELECT MAX(unix_time) AS unix_time, thread_id FROM email_label "+
+		"WHERE "+labeledInBoxes+"GROUP BY thread_id "+
+		"ORDER BY unix_time DESC "+
+		"LIMIT ?, ? "+
+		") AS max ON "+
+		"max.unix_time = email_label.unix_time AND "+
+		"max.thread_id = email_label.thread_id AND "+
+		labeledInBoxes+
+		") AS m ON e.message_id = m.message_id "+
+		"ORDER BY e.unix_time DESC ",
+		address, address,
+		id, address, address,
+		offset, limit,
+		id, address, address,
+	)
+	if err != nil {
+		panic(err)
+	}
+	return rowsToHeaders(rows)
+}
+
+func (r *sqlRepo) CountLabel(address string, id int64) (count int, err error) {
+	err = r.db.QueryRow("SELECT count(*) FROM email_label WHERE "+labeledInBoxes,
+		id, address, address).Scan(&count)
+	return
+}
+
+//
+// SESSIONS
+//
+
+func (r *sqlRepo) SaveSession(session *Session) {
+	_, err := r.db.Exec("INSERT INTO user_session (session_key, token, unix_time, expires) "+
+		"VALUES (?, ?, ?, ?)",
+		session.Key, session.Token, session.UnixTime, session.Expires)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqlRepo) LoadSession(key string, now int64) *Session {
+	session := &Session{Key: key}
+	err := r.db.QueryRow("SELECT token, unix_time, expires FROM user_session "+
+		"WHERE session_key = ? AND expires > ?", key, now).Scan(
+		&session.Token, &session.UnixTime, &session.Expires)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return session
+}
+
+func (r *sqlRepo) DeleteSession(key string) bool {
+	return r.deleteSessions("session_key = ?", key) > 0
+}
+
+func (r *sqlRepo) DeleteSessions(token string) int {
+	return r.deleteSessions("token = ?", token)
+}
+
+func (r *sqlRepo) PurgeSessions(before int64) int {
+	return r.deleteSessions("expires <= ?", before)
+}
+
+func (r *sqlRepo) deleteSessions(where string, arg interface{}) int {
+	res, err := r.db.Exec("DELETE FROM user_session WHERE "+where, arg)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return int(nrows)
+}
+
+//
+// AUDIT LOG
+//
+
+func (r *sqlRepo) AddAuditEvent(token string, event *AuditEvent) {
+	_, err := r.db.Exec("INSERT INTO audit_event (token, unix_time, event, ip) "+
+		"VALUES (?, ?, ?, ?)", token, event.UnixTime, event.Event, event.IP)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqlRepo) LoadAuditEvents(token string, offset, limit int) []AuditEvent {
+	rows, err := r.db.Query("SELECT unix_time, event, ip FROM audit_event "+
+		"WHERE token = ? ORDER BY unix_time DESC LIMIT ?, ?",
+		token, offset, limit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	events := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		if err = rows.Scan(&event.UnixTime, &event.Event, &event.IP); err != nil {
+			panic(err)
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+	return events
+}
+
+func (r *sqlRepo) PurgeAuditEvents(before int64) int {
+	res, err := r.db.Exec("DELETE FROM audit_event WHERE unix_time < ?", before)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return int(nrows)
+}
+
+//
+// TWO-FACTOR AUTHENTICATION
+//
+
+func (r *sqlRepo) LoadTotp(token string) *TotpConfig {
+	totp := new(TotpConfig)
+	err := r.db.QueryRow("SELECT totp_secret, totp_enabled, totp_last_step "+
+		"FROM user WHERE token = ?", token).Scan(
+		&totp.Secret, &totp.Enabled, &totp.LastStep)
+	if err == sql.ErrNoRows || totp.Secret == "" {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return totp
+}
+
+func (r *sqlRepo) SaveTotp(token string, secret string, recoveryCodeHashes []string) bool {
+	tx, err := r.db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	res, err := tx.Exec("UPDATE user SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 "+
+		"WHERE token = ? AND totp_enabled = 0", secret, token)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if nrows, err := res.RowsAffected(); err != nil || nrows == 0 {
+		tx.Rollback()
+		if err != nil {
+			panic(err)
+		}
+		return false
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_code WHERE token = ?", token); err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.Exec("INSERT INTO recovery_code (token, code_hash) VALUES (?, ?)", token, codeHash)
+		if err != nil {
+			tx.Rollback()
+			panic(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (r *sqlRepo) EnableTotp(token string) bool {
+	res, err := r.db.Exec("UPDATE user SET totp_enabled = 1 "+
+		"WHERE token = ? AND totp_secret <> '' AND totp_enabled = 0", token)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return nrows > 0
+}
+
+func (r *sqlRepo) DeleteTotp(token string) {
+	_, err := r.db.Exec("UPDATE user SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 "+
+		"WHERE token = ?", token)
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.db.Exec("DELETE FROM recovery_code WHERE token = ?", token)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// One statement, so two requests can't both use the same code
+func (r *sqlRepo) UseTotpStep(token string, step int64) bool {
+	res, err := r.db.Exec("UPDATE user SET totp_last_step = ? "+
+		"WHERE token = ? AND totp_last_step < ?", step, token, step)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return nrows > 0
+}
+
+// Recovery codes are deleted as they are used, and only work once the
+// user has enabled two-factor authentication
+func (r *sqlRepo) UseRecoveryCode(token string, codeHash string) bool {
+	res, err := r.db.Exec("DELETE FROM recovery_code WHERE token = ? AND code_hash = ? AND "+
+		"EXISTS (SELECT 1 FROM user WHERE user.token = ? AND totp_enabled = 1)",
+		token, codeHash, token)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return nrows > 0
+}
+
+//
+// DRAFTS
+//
+
+func (r *sqlRepo) SaveDraft(address string, draft *Email) {
+	_, err := r.db.Exec("INSERT INTO draft (address, message_id, thread_id, ancestor_ids, "+
+		"unix_time, to_email, cipher_subject, cipher_body) VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+		r.dialect.upsert("address, message_id", "thread_id", "ancestor_ids",
+			"unix_time", "to_email", "cipher_subject", "cipher_body"),
+		address, draft.MessageID, draft.ThreadID, draft.AncestorIDs,
+		draft.UnixTime, draft.To, draft.CipherSubject, draft.CipherBody)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns nil if the user has no such draft
+func (r *sqlRepo) LoadDraft(address string, messageID string) *Email {
+	draft := new(Email)
+	draft.MessageID, draft.From, draft.Read = messageID, address, true
+	err := r.db.QueryRow("SELECT thread_id, ancestor_ids, unix_time, "+
+		"to_email, cipher_subject, cipher_body FROM draft "+
+		"WHERE address = ? AND message_id = ?", address, messageID).Scan(
+		&draft.ThreadID, &draft.AncestorIDs, &draft.UnixTime,
+		&draft.To, &draft.CipherSubject, &draft.CipherBody)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return draft
+}
+
+// Latest first, like a box
+func (r *sqlRepo) LoadDrafts(address string, offset, limit int) []EmailHeader {
+	rows, err := r.db.Query("SELECT message_id, thread_id, unix_time, "+
+		"to_email, cipher_subject FROM draft "+
+		"WHERE address = ? ORDER BY unix_time DESC LIMIT ?, ?",
+		address, offset, limit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	headers := []EmailHeader{}
+	for rows.Next() {
+		header := EmailHeader{From: address, Read: true}
+		err = rows.Scan(&header.MessageID, &header.ThreadID, &header.UnixTime,
+			&header.To, &header.CipherSubject)
+		if err != nil {
+			panic(err)
+		}
+		headers = append(headers, header)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+	return headers
+}
+
+func (r *sqlRepo) CountDrafts(address string) (count int, err error) {
+	err = r.db.QueryRow("SELECT count(*) FROM draft WHERE address = ?",
+		address).Scan(&count)
+	return
+}
+
+func (r *sqlRepo) DeleteDraft(address string, messageID string) bool {
+	res, err := r.db.Exec("DELETE FROM draft WHERE address = ? AND message_id = ?",
+		address, messageID)
+	if err != nil {
+		panic(err)
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	return nrows > 0
+}
+
+//
+// SEARCH INDEX
+//
+
+func (r *sqlRepo) LoadSearchIndex(token string, since int64) *SearchIndex {
+	index := &SearchIndex{Chunks: []SearchChunk{}}
+	err := r.db.QueryRow("SELECT search_version FROM user WHERE token = ?",
+		token).Scan(&index.Version)
+	if err != nil {
+		panic(err)
+	}
+	// nothing past the version read above, a save may be under way
+	rows, err := r.db.Query("SELECT chunk_id, version, cipher_data "+
+		"FROM search_chunk WHERE token = ? AND version > ? AND version <= ? "+
+		"ORDER BY version, chunk_id",
+		token, since, index.Version)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chunk SearchChunk
+		if err = rows.Scan(&chunk.ID, &chunk.Version, &chunk.CipherData); err != nil {
+			panic(err)
+		}
+		index.Chunks = append(index.Chunks, chunk)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+	return index
+}
+
+func (r *sqlRepo) SaveSearchChunks(token string, baseVersion int64, chunks []SearchChunk) (int64, bool) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	// bumping the version first keeps concurrent saves from interleaving
+	res, err := tx.Exec("UPDATE user SET search_version = search_version + 1 "+
+		"WHERE token = ? AND search_version = ?", token, baseVersion)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if nrows, err := res.RowsAffected(); err != nil || nrows == 0 {
+		tx.Rollback()
+		if err != nil {
+			panic(err)
+		}
+		return r.LoadSearchIndex(token, 0).Version, false
+	}
+	version := baseVersion + 1
+	for _, chunk := range chunks {
+		_, err = tx.Exec("INSERT INTO search_chunk (token, chunk_id, version, cipher_data) "+
+			"VALUES (?, ?, ?, ?) "+r.dialect.upsert("token, chunk_id", "version", "cipher_data"),
+			token, chunk.ID, version, chunk.CipherData)
+		if err != nil {
+			tx.Rollback()
+			panic(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return version, true
+}
+
+//
+// OUTBOX
+//
+
+// Load outbox items that are due and set box as 'outbox-processing'
+func (r *sqlRepo) CheckoutOutbox(limit int) []*BoxedEmail {
+	rows, err := r.db.Query("SELECT m.message_id, m.unix_time, "+
+		" m.from_email, m.to_email, m.cipher_subject, m.cipher_body, "+
+		" m.thread_id, m.ancestor_ids, "+
+		" b.id, b.box, b.address, b.attempts, b.next_attempt, b.tls_status "+
+		" FROM email AS m INNER JOIN box AS b "+
+		" ON b.message_id = m.message_id "+
+		" WHERE b.box='outbox' AND b.next_attempt <= ? "+
+		" ORDER BY b.unix_time ASC "+
+		" LIMIT ?",
+		time.Now().Unix(),
+		limit)
+	if err != nil {
+		panic(err)
+	}
+	boxedEmails := []*BoxedEmail{}
+	for rows.Next() {
+		var boxed BoxedEmail
+		rows.Scan(
+			&boxed.MessageID,
+			&boxed.UnixTime,
+			&boxed.From,
+			&boxed.To,
+			&boxed.CipherSubject,
+			&boxed.CipherBody,
+			&boxed.ThreadID,
+			&boxed.AncestorIDs,
+			&boxed.Id,
+			&boxed.Box,
+			&boxed.Address,
+			&boxed.Attempts,
+			&boxed.NextAttempt,
+			&boxed.TlsStatus,
+		)
+		boxedEmails = append(boxedEmails, &boxed)
+	}
+	rows.Close()
+	r.MarkOutboxAs(boxedEmails, "outbox-processing")
+	return boxedEmails
+}
+
+// Puts items stuck in 'outbox-processing', eg after a crash, back in the outbox
+func (r *sqlRepo) RequeueOutbox() {
+	_, err := r.db.Exec("UPDATE box SET box='outbox' WHERE box='outbox-processing'")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Puts an item back in the outbox after a failed attempt,
+// to be checked out again at nextAttempt
+func (r *sqlRepo) RescheduleOutbox(boxedEmail *BoxedEmail, nextAttempt int64) {
+	_, err := r.db.Exec("UPDATE box SET box='outbox', "+
+		"attempts=attempts+1, next_attempt=? "+
+		"WHERE id=? AND box='outbox-processing'",
+		nextAttempt,
+		boxedEmail.Id,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Mark box items as "outbox-sent" or "outbox-processing", etc
+func (r *sqlRepo) MarkOutboxAs(boxedEmails []*BoxedEmail, newBox string) {
+	if len(boxedEmails) == 0 {
+		return
+	}
+	checkOutboxMark(newBox)
+	boxedIds := []interface{}{}
+	for _, boxedEmail := range boxedEmails {
+		boxedIds = append(boxedIds, strconv.FormatInt(boxedEmail.Id, 10))
+	}
+	boxedIdsPH := "?" + strings.Repeat(",?", len(boxedIds)-1)
+	_, err := r.db.Exec("UPDATE box SET box=?, unix_time=? WHERE "+
+		"id IN ("+boxedIdsPH+") AND box IN ('outbox', 'outbox-processing', 'outbox-sent', 'outbox-failed') ",
+		// For more information on this abomination, read
+		// https://groups.google.com/d/msg/golang-dev/yszLiYREbK4/sH1AWu23l18J
+		append([]interface{}{
+			newBox,
+			time.Now().Unix(),
+		},
+			boxedIds...,
+		)...,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Sets the error message on an email we were unable to send,
+// or clears the error message if err is null
+func (r *sqlRepo) MarkSendError(boxedEmail *BoxedEmail, errorMessage *string) {
+	_, err := r.db.Exec("UPDATE box SET error=? WHERE id=?",
+		errorMessage,
+		boxedEmail.Id,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Records how the delivery was protected, see smtp_tls_policy.go
+func (r *sqlRepo) MarkTlsStatus(boxedEmail *BoxedEmail, tlsStatus string) {
+	_, err := r.db.Exec("UPDATE box SET tls_status=? WHERE id=?",
+		tlsStatus,
+		boxedEmail.Id,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Loads the per-recipient delivery state of an outbox item.
+// Empty until the first delivery attempt.
+func (r *sqlRepo) LoadOutboxRecipients(boxID int64) []*OutboxRecipient {
+	rows, err := r.db.Query("SELECT address, attempts, status, COALESCE(error, '') "+
+		"FROM outbox_recipient WHERE box_id=? ORDER BY address",
+		boxID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	rcpts := []*OutboxRecipient{}
+	for rows.Next() {
+		rcpt := &OutboxRecipient{BoxID: boxID}
+		err := rows.Scan(&rcpt.Address, &rcpt.Attempts, &rcpt.Status, &rcpt.Error)
+		if err != nil {
+			panic(err)
+		}
+		rcpts = append(rcpts, rcpt)
+	}
+	return rcpts
+}
+
+func (r *sqlRepo) SaveOutboxRecipients(rcpts []*OutboxRecipient) {
+	for _, rcpt := range rcpts {
+		_, err := r.db.Exec("INSERT INTO outbox_recipient "+
+			"(box_id, address, attempts, status, error) "+
+			"VALUES (?,?,?,?,?) "+
+			r.dialect.upsert("box_id, address", "attempts", "status", "error"),
+			rcpt.BoxID,
+			rcpt.Address,
+			rcpt.Attempts,
+			rcpt.Status,
+			rcpt.Error,
+		)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+//
+// NOTARY
+//
+
+func (r *sqlRepo) AddNameResolution(name, host, hash string) {
+	_, err := r.db.Exec("INSERT INTO name_resolution "+
+		"(name, host, hash, unix_time) "+
+		"VALUES (?,?,?,?)",
+		name,
+		host,
+		hash,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqlRepo) GetNameResolution(name, host string) (hash string) {
+	err := r.db.QueryRow("SELECT "+
+		"hash FROM name_resolution WHERE "+
+		"name=? AND host=?",
+		name, host).Scan(
+		&hash)
+	if err == sql.ErrNoRows {
+		return ""
+	}
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (r *sqlRepo) DeleteNameResolution(name, host string) {
+	_, err := r.db.Exec("DELETE FROM name_resolution WHERE name = ? AND host = ?", name, host)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqlRepo) SetMxHostInfo(host string, isScramble bool, notaryPublicKey string) *MxHostInfo {
+	now := time.Now().Unix()
+	_, err := r.db.Exec("INSERT INTO mx_hosts "+
+		"(host, is_scramble, notary_public_key, unix_time) "+
+		"VALUES (?,?,?,?) "+
+		r.dialect.upsert("host", "is_scramble", "notary_public_key", "unix_time"),
+		host,
+		isScramble,
+		notaryPublicKey,
+		now,
+	)
+	if err != nil {
+		panic(err)
+	}
+	return &MxHostInfo{host, isScramble, notaryPublicKey, now}
+}
+
+func (r *sqlRepo) GetMxHostInfo(host string) *MxHostInfo {
+	var info MxHostInfo
+	err := r.db.QueryRow("SELECT "+
+		"host, is_scramble, COALESCE(notary_public_key, ''), unix_time "+
+		"FROM mx_hosts WHERE host=?",
+		host).Scan(
+		&info.Host,
+		&info.IsScramble,
+		&info.NotaryPublicKey,
+		&info.UnixTime,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		panic(err)
+	default:
+		return &info
+	}
+}
+
+//
+// DKIM
+//
+
+func (r *sqlRepo) AddDkimKey(key *DkimKey) {
+	_, err := r.db.Exec(r.dialect.InsertIgnore+" INTO dkim_key "+
+		"(email_host, selector, private_key, unix_time) "+
+		"VALUES (?,?,?,?)",
+		key.EmailHost,
+		key.Selector,
+		key.PrivateKey,
+		key.UnixTime,
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqlRepo) LoadDkimKey(emailHost string) *DkimKey {
+	var key DkimKey
+	err := r.db.QueryRow("SELECT "+
+		"email_host, selector, private_key, unix_time "+
+		"FROM dkim_key WHERE email_host=?",
+		emailHost).Scan(
+		&key.EmailHost,
+		&key.Selector,
+		&key.PrivateKey,
+		&key.UnixTime,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		panic(err)
+	default:
+		return &key
+	}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs the same checks against every Repository that doesn't need a server.
+func forEachRepo(t *testing.T, test func(t *testing.T, r Repository)) {
+	dir, err := ioutil.TempDir("", "scramble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	test(t, NewMemoryRepo())
+	test(t, NewSQLiteRepo(filepath.Join(dir, "test.db")))
+}
+
+func testEmail(id, threadID string, unixTime int64) *Email {
+	return &Email{
+		EmailHeader: EmailHeader{
+			MessageID:     id,
+			ThreadID:      threadID,
+			UnixTime:      unixTime,
+			From:          "alice@local.scramble.io",
+			To:            "bob@local.scramble.io",
+			CipherSubject: "subject " + id,
+		},
+		CipherBody: "body " + id,
+	}
+}
+
+func TestRepoUsers(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		user := &User{
+			UserID:           UserID{Token: "alice", PasswordHash: "pass", PublicHash: "alicehash", EmailHost: "local.scramble.io"},
+			PublicKey:        "alice key",
+			CipherPrivateKey: "alice private key",
+		}
+		if !r.SaveUser(user) {
+			t.Fatal("SaveUser() failed for a new user")
+		}
+		if r.SaveUser(user) {
+			t.Fatal("SaveUser() should fail for a taken username")
+		}
+		loaded := r.LoadUser("alice")
+		if loaded == nil || loaded.EmailAddress != "alice@local.scramble.io" || loaded.PublicKey != "alice key" {
+			t.Fatalf("LoadUser() returned %v", loaded)
+		}
+		if r.LoadPubKey("alicehash") != "alice key" {
+			t.Fatal("LoadPubKey() did not find alice's key")
+		}
+		if r.LoadAddressFromPubHash("alicehash") != "alice@local.scramble.io" {
+			t.Fatal("LoadAddressFromPubHash() did not find alice")
+		}
+		if !r.ServesEmailHost("local.scramble.io") || r.ServesEmailHost("example.com") {
+			t.Fatal("ServesEmailHost() should only know alice's host")
+		}
+		r.SaveContacts("alice", "cipher contacts")
+		if contacts := r.LoadContacts("alice"); contacts == nil || *contacts != "cipher contacts" {
+			t.Fatalf("LoadContacts() returned %v", contacts)
+		}
+		r.DeleteUser("alice")
+		if r.LoadUserID("alice") != nil {
+			t.Fatal("DeleteUser() did not delete alice")
+		}
+	})
+}
+
+func TestRepoBoxes(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		bob := "bob@local.scramble.io"
+		first := testEmail("1@local.scramble.io", "1@local.scramble.io", 100)
+		reply := testEmail("2@local.scramble.io", "1@local.scramble.io", 200)
+		other := testEmail("3@local.scramble.io", "3@local.scramble.io", 150)
+		reply.SpfResult, reply.DkimResult, reply.DmarcResult = "pass", "none", "fail"
+		reply.SpamScore = 3.5
+		for _, e := range []*Email{first, reply, other} {
+			r.SaveMessage(e)
+			r.AddMessageToBox(e, bob, "inbox")
+		}
+
+		if count, _ := r.CountBox(bob, "inbox"); count != 3 {
+			t.Fatalf("Expected 3 messages in inbox, got %d", count)
+		}
+		headers := r.LoadBoxByThread(bob, "inbox", 0, 10)
+		if len(headers) != 2 || headers[0].MessageID != reply.MessageID || headers[1].MessageID != other.MessageID {
+			t.Fatalf("LoadBoxByThread() returned %v", headers)
+		}
+		if headers[0].SpfResult != "pass" || headers[0].DmarcResult != "fail" || headers[0].SpamScore != 3.5 {
+			t.Fatalf("LoadBoxByThread() lost the sender auth results: %v", headers[0])
+		}
+		thread := r.LoadThreadFromBoxes(bob, first.ThreadID)
+		if len(thread) != 2 || thread[0].MessageID != first.MessageID || thread[1].SpamScore != 3.5 {
+			t.Fatalf("LoadThreadFromBoxes() returned %v", thread)
+		}
+		threadIDs := r.LoadThreadIDsForMessageIDs([]interface{}{reply.MessageID, "nope@nowhere"})
+		if threadIDs[0] != first.ThreadID || threadIDs[1] != "" {
+			t.Fatalf("LoadThreadIDsForMessageIDs() returned %v", threadIDs)
+		}
+
+		r.MoveThread(bob, reply.MessageID, "archive")
+		if count, _ := r.CountBox(bob, "archive"); count != 2 {
+			t.Fatalf("Expected 2 messages in archive, got %d", count)
+		}
+		r.MoveEmail(bob, other.MessageID, "spam")
+		r.MoveEmail(bob, other.MessageID, "archive")
+		if boxes := r.BoxesForMessage(bob, other.MessageID); len(boxes) != 1 || boxes[0] != "archive" {
+			t.Fatalf("BoxesForMessage() returned %v", boxes)
+		}
+
+		r.DeleteThreadFromBoxes(bob, reply.MessageID)
+		if thread := r.LoadThreadFromBoxes(bob, first.ThreadID); len(thread) != 0 {
+			t.Fatalf("DeleteThreadFromBoxes() left %v", thread)
+		}
+		r.DeleteFromBoxes(bob, other.MessageID)
+		if count, _ := r.CountBox(bob, "archive"); count != 0 {
+			t.Fatalf("Expected an empty archive, got %d", count)
+		}
+	})
+}
+
+func TestRepoOutbox(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		e := testEmail("4@local.scramble.io", "4@local.scramble.io", 100)
+		r.SaveMessage(e)
+		r.AddMessageToBox(e, "mx.example.com", "outbox")
+
+		msgs := r.CheckoutOutbox(10)
+		if len(msgs) != 1 || msgs[0].Address != "mx.example.com" || msgs[0].CipherBody != e.CipherBody {
+			t.Fatalf("CheckoutOutbox() returned %v", msgs)
+		}
+		if again := r.CheckoutOutbox(10); len(again) != 0 {
+			t.Fatalf("CheckoutOutbox() returned a message twice")
+		}
+		rcpts := []*OutboxRecipient{
+			{msgs[0].Id, "a@example.com", 1, "sent", ""},
+			{msgs[0].Id, "b@example.com", 1, "pending", "451 try again"},
+		}
+		r.SaveOutboxRecipients(rcpts)
+		rcpts[1].Attempts = 2
+		r.SaveOutboxRecipients(rcpts[1:])
+		if loaded := r.LoadOutboxRecipients(msgs[0].Id); len(loaded) != 2 || loaded[1].Attempts != 2 {
+			t.Fatalf("LoadOutboxRecipients() returned %v", loaded)
+		}
+
+		// retry later, not now
+		r.RescheduleOutbox(msgs[0], time.Now().Unix()+3600)
+		if again := r.CheckoutOutbox(10); len(again) != 0 {
+			t.Fatalf("CheckoutOutbox() returned a message before its next attempt")
+		}
+
+		// a crashed sender leaves messages in outbox-processing
+		stuck := testEmail("5@local.scramble.io", "5@local.scramble.io", 100)
+		r.SaveMessage(stuck)
+		r.AddMessageToBox(stuck, "mx.example.com", "outbox")
+		if checkedOut := r.CheckoutOutbox(10); len(checkedOut) != 1 {
+			t.Fatalf("CheckoutOutbox() returned %v", checkedOut)
+		}
+		r.RequeueOutbox()
+		requeued := r.CheckoutOutbox(10)
+		if len(requeued) != 1 || requeued[0].MessageID != stuck.MessageID {
+			t.Fatalf("RequeueOutbox() did not put the message back, got %v", requeued)
+		}
+		r.MarkTlsStatus(requeued[0], "dane")
+		r.RequeueOutbox()
+		if requeued = r.CheckoutOutbox(10); len(requeued) != 1 || requeued[0].TlsStatus != "dane" {
+			t.Fatalf("MarkTlsStatus() was not recorded, got %v", requeued)
+		}
+
+		errMsg := "connection refused"
+		r.MarkSendError(msgs[0], &errMsg)
+		r.MarkOutboxAs(msgs, "outbox-sent")
+		if count, _ := r.CountBox("mx.example.com", "outbox-sent"); count != 1 {
+			t.Fatalf("Expected 1 sent message, got %d", count)
+		}
+	})
+}
+
+func TestRepoNotary(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		r.AddNameResolution("alice", "example.com", "alicehash")
+		if r.GetNameResolution("alice", "example.com") != "alicehash" {
+			t.Fatal("GetNameResolution() did not find alice")
+		}
+		if r.GetMxHostInfo("mx.example.com") != nil {
+			t.Fatal("GetMxHostInfo() found an unknown host")
+		}
+		r.SetMxHostInfo("mx.example.com", false, "")
+		r.SetMxHostInfo("mx.example.com", true, "notary key")
+		info := r.GetMxHostInfo("mx.example.com")
+		if info == nil || !info.IsScramble || info.NotaryPublicKey != "notary key" {
+			t.Fatalf("GetMxHostInfo() returned %v", info)
+		}
+	})
+}
+
+func TestRepoDkimKey(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		if r.LoadDkimKey("example.com") != nil {
+			t.Fatal("LoadDkimKey() found a key that was never added")
+		}
+		r.AddDkimKey(&DkimKey{"example.com", "first", "first key", 100})
+		r.AddDkimKey(&DkimKey{"example.com", "second", "second key", 200})
+		key := r.LoadDkimKey("example.com")
+		if key == nil || key.Selector != "first" || key.PrivateKey != "first key" {
+			t.Fatalf("LoadDkimKey() returned %v, expected the first key to stay", key)
+		}
+	})
+}
+
+func TestRepoAttachments(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		bob := "bob@local.scramble.io"
+		email := testEmail("files@local.scramble.io", "files@local.scramble.io", 100)
+		r.SaveMessage(email)
+		r.AddMessageToBox(email, bob, "inbox")
+		r.SaveAttachment(&Attachment{AttachmentHeader{2, "b.png", "image/png", 0}, email.MessageID, "second"})
+		r.SaveAttachment(&Attachment{AttachmentHeader{1, "a.pdf", "application/pdf", 0}, email.MessageID, "first!"})
+
+		headers := r.LoadAttachmentHeaders(email.MessageID)
+		if len(headers) != 2 || headers[0].Filename != "a.pdf" || headers[0].Size != 6 || headers[1].ID != 2 {
+			t.Fatalf("LoadAttachmentHeaders() returned %v", headers)
+		}
+		attachment := r.LoadAttachment(email.MessageID, 2)
+		if attachment == nil || attachment.CipherContent != "second" || attachment.ContentType != "image/png" {
+			t.Fatalf("LoadAttachment() returned %v", attachment)
+		}
+		if r.LoadAttachment(email.MessageID, 3) != nil {
+			t.Fatal("LoadAttachment() found an attachment that doesn't exist")
+		}
+
+		// deleted along with the email
+		r.DeleteFromBoxes(bob, email.MessageID)
+		if headers := r.LoadAttachmentHeaders(email.MessageID); len(headers) != 0 {
+			t.Fatalf("Attachments outlived their email: %v", headers)
+		}
+	})
+}
+
+func TestRepoTrash(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		bob := "bob@local.scramble.io"
+		first := testEmail("t1@local.scramble.io", "t1@local.scramble.io", 100)
+		reply := testEmail("t2@local.scramble.io", "t1@local.scramble.io", 200)
+		other := testEmail("t3@local.scramble.io", "t3@local.scramble.io", 150)
+		r.SaveMessage(first)
+		r.AddMessageToBox(first, bob, "inbox")
+		r.SaveMessage(reply)
+		r.AddMessageToBox(reply, bob, "sent")
+		r.SaveMessage(other)
+		r.AddMessageToBox(other, bob, "archive")
+
+		r.TrashThread(bob, reply.MessageID, 1000)
+		r.TrashEmail(bob, other.MessageID, 2000)
+		if count, _ := r.CountBox(bob, "trash"); count != 3 {
+			t.Fatalf("Expected 3 messages in trash, got %d", count)
+		}
+		if headers := r.LoadBox(bob, "trash", 0, 10); len(headers) != 3 {
+			t.Fatalf("LoadBox() returned %v for the trash", headers)
+		}
+
+		// back where they came from
+		r.UndeleteThread(bob, reply.MessageID)
+		if boxes := r.BoxesForMessage(bob, first.MessageID); len(boxes) != 1 || boxes[0] != "inbox" {
+			t.Fatalf("UndeleteThread() moved the first message to %v", boxes)
+		}
+		if boxes := r.BoxesForMessage(bob, reply.MessageID); len(boxes) != 1 || boxes[0] != "sent" {
+			t.Fatalf("UndeleteThread() moved the reply to %v", boxes)
+		}
+
+		r.TrashEmail(bob, first.MessageID, 3000)
+		if n := r.PurgeTrash(2500); n != 1 {
+			t.Fatalf("PurgeTrash() deleted %d rows, expected the one trashed before", n)
+		}
+		if r.LoadThreadIDsForMessageIDs([]interface{}{other.MessageID})[0] != "" {
+			t.Fatal("PurgeTrash() kept an email no box references")
+		}
+		r.UndeleteEmail(bob, first.MessageID)
+		if count, _ := r.CountBox(bob, "inbox"); count != 1 {
+			t.Fatalf("Expected the first message back in the inbox, got %d", count)
+		}
+		if n := r.PurgeTrash(5000); n != 0 {
+			t.Fatalf("PurgeTrash() deleted %d rows from an empty trash", n)
+		}
+	})
+}
+
+func TestRepoLabels(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		bob := "bob@local.scramble.io"
+		first := testEmail("l1@local.scramble.io", "l1@local.scramble.io", 100)
+		reply := testEmail("l2@local.scramble.io", "l1@local.scramble.io", 200)
+		other := testEmail("l3@local.scramble.io", "l3@local.scramble.io", 150)
+		for _, e := range []*Email{first, reply, other} {
+			r.SaveMessage(e)
+			r.AddMessageToBox(e, bob, "inbox")
+		}
+
+		work := r.CreateLabel(bob, "cipher work")
+		home := r.CreateLabel(bob, "cipher home")
+		if labels := r.LoadLabels(bob); len(labels) != 2 || labels[0].ID != work || labels[1].CipherName != "cipher home" {
+			t.Fatalf("LoadLabels() returned %v", labels)
+		}
+		if !r.RenameLabel(bob, home, "cipher family") || r.LoadLabels(bob)[1].CipherName != "cipher family" {
+			t.Fatal("RenameLabel() did not rename")
+		}
+		if r.RenameLabel("eve@local.scramble.io", home, "mine now") || r.AddLabel("eve@local.scramble.io", work, []string{first.MessageID}) {
+			t.Fatal("Someone else used bob's label")
+		}
+
+		// several labels on one email, skipping emails bob doesn't have
+		r.AddLabel(bob, work, []string{first.MessageID, reply.MessageID, other.MessageID, "nope@nowhere"})
+		r.AddLabel(bob, home, []string{other.MessageID})
+		if count, _ := r.CountLabel(bob, work); count != 3 {
+			t.Fatalf("Expected 3 emails labeled work, got %d", count)
+		}
+		headers := r.LoadLabelByThread(bob, work, 0, 10)
+		if len(headers) != 2 || headers[0].MessageID != reply.MessageID || headers[1].MessageID != other.MessageID {
+			t.Fatalf("LoadLabelByThread() returned %v", headers)
+		}
+		if headers := r.LoadLabelByThread("eve@local.scramble.io", work, 0, 10); len(headers) != 0 {
+			t.Fatalf("LoadLabelByThread() showed bob's label to eve: %v", headers)
+		}
+
+		// trashed mail drops out, removed labels too
+		r.TrashEmail(bob, reply.MessageID, 1000)
+		r.RemoveLabel(bob, work, []string{other.MessageID})
+		headers = r.LoadLabelByThread(bob, work, 0, 10)
+		if len(headers) != 1 || headers[0].MessageID != first.MessageID {
+			t.Fatalf("LoadLabelByThread() returned %v", headers)
+		}
+
+		if !r.DeleteLabel(bob, work) || len(r.LoadLabels(bob)) != 1 || r.DeleteLabel(bob, work) {
+			t.Fatal("DeleteLabel() did not delete")
+		}
+		if count, _ := r.CountLabel(bob, home); count != 1 {
+			t.Fatalf("Expected 1 email labeled home, got %d", count)
+		}
+	})
+}
+
+func TestRepoFlags(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		bob := "bob@local.scramble.io"
+		first := testEmail("f1@local.scramble.io", "f1@local.scramble.io", 100)
+		reply := testEmail("f2@local.scramble.io", "f1@local.scramble.io", 200)
+		other := testEmail("f3@local.scramble.io", "f3@local.scramble.io", 150)
+		sent := testEmail("f4@local.scramble.io", "f4@local.scramble.io", 50)
+		for _, e := range []*Email{first, reply, other} {
+			r.SaveMessage(e)
+			r.AddMessageToBox(e, bob, "inbox")
+		}
+		r.SaveMessage(sent)
+		r.AddMessageToBox(sent, bob, "sent")
+
+		if unread, _ := r.CountUnread(bob, "inbox"); unread != 3 {
+			t.Fatalf("Expected 3 unread in inbox, got %d", unread)
+		}
+		if headers := r.LoadBox(bob, "sent", 0, 10); len(headers) != 1 || !headers[0].Read {
+			t.Fatalf("Mail we sent should be read, got %v", headers)
+		}
+
+		r.SetFlag(bob, []string{reply.MessageID}, "read", true)
+		r.SetFlag(bob, []string{first.MessageID}, "starred", true)
+		if unread, _ := r.CountUnread(bob, "inbox"); unread != 2 {
+			t.Fatalf("Expected 2 unread in inbox, got %d", unread)
+		}
+		// a thread is unread while any of it is, starred if any of it is
+		headers := r.LoadBoxByThread(bob, "inbox", 0, 10)
+		if len(headers) != 2 || headers[0].MessageID != reply.MessageID || headers[0].Read || !headers[0].Starred {
+			t.Fatalf("LoadBoxByThread() returned %v", headers)
+		}
+		if headers[1].Read || headers[1].Starred {
+			t.Fatalf("LoadBoxByThread() returned flags for an untouched thread: %v", headers[1])
+		}
+		thread := r.LoadThreadFromBoxes(bob, first.ThreadID)
+		if len(thread) != 2 || thread[0].Read || !thread[0].Starred || !thread[1].Read || thread[1].Starred {
+			t.Fatalf("LoadThreadFromBoxes() returned %v", thread)
+		}
+
+		r.SetThreadFlag(bob, []string{first.ThreadID, other.ThreadID}, "read", true)
+		if unread, _ := r.CountUnread(bob, "inbox"); unread != 0 {
+			t.Fatalf("Expected no unread in inbox, got %d", unread)
+		}
+		if unread, _ := r.CountUnread("eve@local.scramble.io", "inbox"); unread != 0 {
+			t.Fatalf("Expected an empty inbox for eve, got %d unread", unread)
+		}
+	})
+}
+
+func TestRepoSearchIndex(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		r.SaveUser(&User{
+			UserID:    UserID{Token: "carol", PasswordHash: "pass", PublicHash: "carolhash", EmailHost: "local.scramble.io"},
+			PublicKey: "carol key",
+		})
+		if index := r.LoadSearchIndex("carol", 0); index.Version != 0 || len(index.Chunks) != 0 {
+			t.Fatalf("Expected an empty index, got %v", index)
+		}
+		version, ok := r.SaveSearchChunks("carol", 0, []SearchChunk{{"a", 0, "0a"}, {"b", 0, "0b"}})
+		if !ok || version != 1 {
+			t.Fatalf("SaveSearchChunks() = %d, %v", version, ok)
+		}
+		version, ok = r.SaveSearchChunks("carol", 1, []SearchChunk{{"b", 0, ""}, {"c", 0, "0c"}})
+		if !ok || version != 2 {
+			t.Fatalf("SaveSearchChunks() = %d, %v", version, ok)
+		}
+
+		// another device, still at version 1
+		if version, ok = r.SaveSearchChunks("carol", 1, []SearchChunk{{"a", 0, "ff"}}); ok || version != 2 {
+			t.Fatalf("SaveSearchChunks() = %d, %v for a stale base version", version, ok)
+		}
+		index := r.LoadSearchIndex("carol", 1)
+		if index.Version != 2 || len(index.Chunks) != 2 ||
+			index.Chunks[0] != (SearchChunk{"b", 2, ""}) || index.Chunks[1] != (SearchChunk{"c", 2, "0c"}) {
+			t.Fatalf("LoadSearchIndex() returned %v", index)
+		}
+		if index = r.LoadSearchIndex("carol", 0); len(index.Chunks) != 3 || index.Chunks[0] != (SearchChunk{"a", 1, "0a"}) {
+			t.Fatalf("LoadSearchIndex() returned %v", index)
+		}
+
+		r.DeleteUser("carol")
+		r.SaveUser(&User{
+			UserID:    UserID{Token: "carol", PasswordHash: "pass", PublicHash: "carolhash", EmailHost: "local.scramble.io"},
+			PublicKey: "carol key",
+		})
+		if index = r.LoadSearchIndex("carol", 0); len(index.Chunks) != 0 {
+			t.Fatalf("DeleteUser() left the search index behind: %v", index)
+		}
+	})
+}
+
+func TestRepoDrafts(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		bob := "bob@local.scramble.io"
+		older := testEmail("d1@local.scramble.io", "d1@local.scramble.io", 100)
+		newer := testEmail("d2@local.scramble.io", "t1@local.scramble.io", 200)
+		r.SaveDraft(bob, older)
+		r.SaveDraft(bob, newer)
+		newer.CipherBody = "edited body"
+		r.SaveDraft(bob, newer)
+
+		if count, _ := r.CountDrafts(bob); count != 2 {
+			t.Fatalf("Expected 2 drafts, got %d", count)
+		}
+		headers := r.LoadDrafts(bob, 0, 10)
+		if len(headers) != 2 || headers[0].MessageID != newer.MessageID || headers[1].MessageID != older.MessageID {
+			t.Fatalf("LoadDrafts() returned %v", headers)
+		}
+		draft := r.LoadDraft(bob, newer.MessageID)
+		if draft == nil || draft.CipherBody != "edited body" || draft.ThreadID != newer.ThreadID || draft.From != bob {
+			t.Fatalf("LoadDraft() returned %v", draft)
+		}
+
+		// drafts are private
+		eve := "eve@local.scramble.io"
+		if r.LoadDraft(eve, newer.MessageID) != nil || len(r.LoadDrafts(eve, 0, 10)) != 0 {
+			t.Fatal("Eve can see Bob's drafts")
+		}
+		if r.DeleteDraft(eve, newer.MessageID) {
+			t.Fatal("Eve deleted Bob's draft")
+		}
+
+		if !r.DeleteDraft(bob, newer.MessageID) || r.DeleteDraft(bob, newer.MessageID) {
+			t.Fatal("DeleteDraft() should delete a draft once")
+		}
+		if count, _ := r.CountDrafts(bob); count != 1 || r.LoadDraft(bob, newer.MessageID) != nil {
+			t.Fatalf("Expected only the older draft to be left, got %d", count)
+		}
+	})
+}
+
+func TestRepoSessions(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		r.SaveSession(&Session{"key1", "alice", 100, 200})
+		r.SaveSession(&Session{"key2", "alice", 150, 250})
+		r.SaveSession(&Session{"key3", "bob", 100, 300})
+
+		if session := r.LoadSession("key1", 150); session == nil || *session != (Session{"key1", "alice", 100, 200}) {
+			t.Fatalf("LoadSession() returned %v", session)
+		}
+		if r.LoadSession("key1", 200) != nil || r.LoadSession("nokey", 150) != nil {
+			t.Fatal("LoadSession() returned an expired or unknown session")
+		}
+		if !r.DeleteSession("key1") || r.DeleteSession("key1") {
+			t.Fatal("DeleteSession() should delete a session once")
+		}
+		r.SaveSession(&Session{"key4", "alice", 150, 400})
+		if count := r.PurgeSessions(260); count != 1 || r.LoadSession("key2", 150) != nil {
+			t.Fatalf("PurgeSessions() deleted %d sessions, expected key2", count)
+		}
+		if count := r.DeleteSessions("alice"); count != 1 || r.LoadSession("key3", 260) == nil {
+			t.Fatalf("DeleteSessions() deleted %d sessions, expected only alice's", count)
+		}
+	})
+}
+
+func TestRepoChangePassword(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		r.SaveUser(&User{
+			UserID:           UserID{Token: "dave", PasswordHash: "pass", PublicHash: "davehash", EmailHost: "local.scramble.io"},
+			PublicKey:        "dave key",
+			CipherPrivateKey: "private key",
+		})
+		if r.ChangePassword("dave", "wrong", "", "new pass", "new private key") ||
+			r.ChangePassword("dave", "", "", "new pass", "new private key") {
+			t.Fatal("ChangePassword() should check the current hash")
+		}
+		if r.LoadUser("dave").CipherPrivateKey != "private key" {
+			t.Fatal("A failed ChangePassword() changed the private key")
+		}
+		if !r.ChangePassword("dave", "pass", "", "new pass", "new private key") {
+			t.Fatal("ChangePassword() failed with the current hash")
+		}
+		user := r.LoadUser("dave")
+		if user.PasswordHash != "new pass" || user.PasswordHashOld != "" || user.CipherPrivateKey != "new private key" {
+			t.Fatalf("ChangePassword() saved %v", user)
+		}
+		if r.ChangePassword("dave", "pass", "", "newer pass", "newer private key") {
+			t.Fatal("ChangePassword() accepted the replaced hash")
+		}
+	})
+}
+
+func TestRepoTotp(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		r.SaveUser(&User{
+			UserID:    UserID{Token: "erin", PasswordHash: "pass", PublicHash: "erinhash", EmailHost: "local.scramble.io"},
+			PublicKey: "erin key",
+		})
+		if r.LoadTotp("erin") != nil {
+			t.Fatal("LoadTotp() returned a second factor for a new user")
+		}
+		if !r.SaveTotp("erin", "SECRET1", []string{"hash1", "hash2"}) {
+			t.Fatal("SaveTotp() failed")
+		}
+		if r.UseRecoveryCode("erin", "hash1") {
+			t.Fatal("UseRecoveryCode() worked before the second factor was on")
+		}
+		// enrolling again before verifying starts over
+		if !r.SaveTotp("erin", "SECRET2", []string{"hash3", "hash4"}) {
+			t.Fatal("SaveTotp() failed to start over")
+		}
+		if !r.EnableTotp("erin") || r.EnableTotp("erin") {
+			t.Fatal("EnableTotp() should work once")
+		}
+		if totp := r.LoadTotp("erin"); totp == nil || *totp != (TotpConfig{"SECRET2", true, 0}) {
+			t.Fatalf("LoadTotp() returned %v", totp)
+		}
+		if r.SaveTotp("erin", "SECRET3", nil) {
+			t.Fatal("SaveTotp() replaced a second factor that is on")
+		}
+
+		if !r.UseTotpStep("erin", 100) || r.UseTotpStep("erin", 100) || r.UseTotpStep("erin", 99) {
+			t.Fatal("UseTotpStep() should only accept later steps")
+		}
+		if r.UseRecoveryCode("erin", "hash1") || !r.UseRecoveryCode("erin", "hash3") ||
+			r.UseRecoveryCode("erin", "hash3") {
+			t.Fatal("UseRecoveryCode() should accept current codes, once")
+		}
+
+		r.DeleteTotp("erin")
+		if r.LoadTotp("erin") != nil || r.UseRecoveryCode("erin", "hash4") {
+			t.Fatal("DeleteTotp() left the second factor")
+		}
+	})
+}
+
+func TestRepoAuditLog(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		r.AddAuditEvent("alice", &AuditEvent{100, auditLogin, "10.0.0.1"})
+		r.AddAuditEvent("alice", &AuditEvent{200, auditLoginFailed, "2001:db8::1"})
+		r.AddAuditEvent("alice", &AuditEvent{300, auditLogout, ""})
+		r.AddAuditEvent("bob", &AuditEvent{150, auditLogin, "10.0.0.2"})
+
+		events := r.LoadAuditEvents("alice", 0, 2)
+		if len(events) != 2 || events[0] != (AuditEvent{300, auditLogout, ""}) ||
+			events[1] != (AuditEvent{200, auditLoginFailed, "2001:db8::1"}) {
+			t.Fatalf("LoadAuditEvents() returned %v", events)
+		}
+		if events = r.LoadAuditEvents("alice", 2, 2); len(events) != 1 || events[0].UnixTime != 100 {
+			t.Fatalf("LoadAuditEvents() returned %v for the second page", events)
+		}
+		if count := r.PurgeAuditEvents(200); count != 2 {
+			t.Fatalf("PurgeAuditEvents() deleted %d events", count)
+		}
+		if len(r.LoadAuditEvents("alice", 0, 10)) != 2 || len(r.LoadAuditEvents("bob", 0, 10)) != 0 {
+			t.Fatal("PurgeAuditEvents() deleted the wrong events")
+		}
+	})
+}
+
+func TestRepoDeleteMailbox(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, r Repository) {
+		alice, bob := "alice@local.scramble.io", "bob@local.scramble.io"
+		own := testEmail("own@local.scramble.io", "own@local.scramble.io", 100)
+		shared := testEmail("shared@local.scramble.io", "shared@local.scramble.io", 200)
+		r.SaveMessage(own)
+		r.SaveMessage(shared)
+		r.AddMessageToBox(own, bob, "inbox")
+		r.AddMessageToBox(own, bob, "sent")
+		r.AddMessageToBox(shared, bob, "inbox")
+		r.AddMessageToBox(shared, alice, "sent")
+		r.SaveAttachment(&Attachment{AttachmentHeader{1, "a.pdf", "application/pdf", 0}, own.MessageID, "file"})
+		r.SaveDraft(bob, testEmail("draft@local.scramble.io", "draft@local.scramble.io", 300))
+		label := r.CreateLabel(bob, "cipher name")
+		r.AddLabel(bob, label, []string{own.MessageID})
+
+		if ids := r.LoadMessageIDs(bob, "", 1); len(ids) != 1 || ids[0] != own.MessageID {
+			t.Fatalf("LoadMessageIDs() returned %v", ids)
+		}
+		if ids := r.LoadMessageIDs(bob, own.MessageID, 10); len(ids) != 1 || ids[0] != shared.MessageID {
+			t.Fatalf("LoadMessageIDs() returned %v for the second page", ids)
+		}
+
+		if count := r.DeleteMailbox(bob); count != 3 {
+			t.Fatalf("DeleteMailbox() deleted %d box rows", count)
+		}
+		if ids := r.LoadMessageIDs(bob, "", 10); len(ids) != 0 {
+			t.Fatalf("DeleteMailbox() left %v", ids)
+		}
+		threadIDs := r.LoadThreadIDsForMessageIDs([]interface{}{own.MessageID, shared.MessageID})
+		if threadIDs[0] != "" || threadIDs[1] != shared.ThreadID {
+			t.Fatalf("Expected only the email alice still has, got %v", threadIDs)
+		}
+		if len(r.LoadAttachmentHeaders(own.MessageID)) != 0 {
+			t.Fatal("DeleteMailbox() left the attachments")
+		}
+		if count, _ := r.CountDrafts(bob); count != 0 || len(r.LoadLabels(bob)) != 0 {
+			t.Fatal("DeleteMailbox() left drafts or labels")
+		}
+		if boxes := r.BoxesForMessage(alice, shared.MessageID); len(boxes) != 1 {
+			t.Fatalf("DeleteMailbox() changed alice's boxes: %v", boxes)
+		}
+
+		r.AddNameResolution("bob", "local.scramble.io", "bobhash")
+		r.DeleteNameResolution("bob", "local.scramble.io")
+		if hash := r.GetNameResolution("bob", "local.scramble.io"); hash != "" {
+			t.Fatalf("DeleteNameResolution() left %s", hash)
+		}
+	})
+}
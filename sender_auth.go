@@ -0,0 +1,175 @@
+/**
+ * Authenticates the senders of inbound SMTP mail.
+ *
+ * Runs SPF and DKIM, then applies the DMARC policy of the domain in
+ * the From header, RFC 7489. The verdicts are stored with the email
+ * so that the inbox can flag spoofed senders.
+ */
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// DNS lookups needed to authenticate senders, see dnsResolver
+type SenderAuthResolver interface {
+	MxResolver
+	// Returns no records and no error if there are none.
+	LookupTXT(name string) ([]string, error)
+}
+
+var senderAuthResolver SenderAuthResolver = systemResolver
+
+// DMARC results, RFC 8601 section 2.7.1
+const (
+	dmarcNone      = "none"
+	dmarcPass      = "pass"
+	dmarcFail      = "fail"
+	dmarcTempError = "temperror"
+	dmarcPermError = "permerror"
+)
+
+// Verdicts for one inbound message, in the terms of RFC 8601
+type SenderAuth struct {
+	Spf   string
+	Dkim  string
+	Dmarc string
+
+	// The From domain failed DMARC and asks receivers to reject such mail
+	Reject bool
+}
+
+// A _dmarc TXT record, RFC 7489 section 6.3
+type dmarcRecord struct {
+	Policy          string // "none", "quarantine" or "reject"
+	SubdomainPolicy string
+	StrictDkim      bool
+	StrictSpf       bool
+}
+
+// Authenticates a message received from remoteIP.
+// mailFrom is the envelope sender, "" for bounces. message is the
+// unstuffed DATA, from is its From header.
+func authenticateSender(resolver SenderAuthResolver, remoteIP net.IP, helo, mailFrom string, message io.ReadSeeker,
+	from *mail.Address) *SenderAuth {
+	auth := new(SenderAuth)
+
+	// SPF checks the MAIL FROM domain, or the HELO name for bounces
+	sender := mailFrom
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	_, spfDomain := splitAddress(sender)
+	spfDomain = strings.ToLower(spfDomain)
+	auth.Spf = checkSpf(resolver, remoteIP, spfDomain, sender, helo)
+
+	var dkimDomains []string
+	auth.Dkim, dkimDomains = verifyDkim(resolver, message, time.Now())
+
+	_, fromDomain := splitAddress(strings.ToLower(from.Address))
+	record, policy, result := lookupDmarc(resolver, fromDomain)
+	if record == nil {
+		auth.Dmarc = result
+		return auth
+	}
+
+	auth.Dmarc = dmarcFail
+	if auth.Spf == spfPass && dmarcAligned(spfDomain, fromDomain, record.StrictSpf) {
+		auth.Dmarc = dmarcPass
+	}
+	for _, domain := range dkimDomains {
+		if dmarcAligned(domain, fromDomain, record.StrictDkim) {
+			auth.Dmarc = dmarcPass
+		}
+	}
+	auth.Reject = auth.Dmarc == dmarcFail && policy == "reject"
+	log.Printf("Sender auth for %s: spf=%s dkim=%s dmarc=%s (p=%s)\n",
+		from.Address, auth.Spf, auth.Dkim, auth.Dmarc, policy)
+	return auth
+}
+
+// Finds the DMARC record for domain, falling back to its organizational
+// domain. Returns the record and the policy that applies to domain, or
+// nil and the DMARC result to use.
+func lookupDmarc(resolver SenderAuthResolver, domain string) (*dmarcRecord, string, string) {
+	record, err := lookupDmarcRecord(resolver, domain)
+	if err == nil && record == nil && orgDomain(domain) != domain {
+		record, err = lookupDmarcRecord(resolver, orgDomain(domain))
+		if record != nil {
+			return record, record.SubdomainPolicy, ""
+		}
+	}
+	if err != nil {
+		return nil, "", dmarcTempError
+	}
+	if record == nil {
+		return nil, "", dmarcNone
+	}
+	return record, record.Policy, ""
+}
+
+func lookupDmarcRecord(resolver SenderAuthResolver, domain string) (*dmarcRecord, error) {
+	txts, err := resolver.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		tags, err := parseDkimTags(txt)
+		if err != nil || tags["v"] != "DMARC1" {
+			continue
+		}
+		record := &dmarcRecord{
+			Policy:     strings.ToLower(tags["p"]),
+			StrictDkim: strings.ToLower(tags["adkim"]) == "s",
+			StrictSpf:  strings.ToLower(tags["aspf"]) == "s",
+		}
+		switch record.Policy {
+		case "none", "quarantine", "reject":
+		default:
+			// RFC 7489 section 6.6.3: no valid p=, no DMARC
+			continue
+		}
+		record.SubdomainPolicy = strings.ToLower(tags["sp"])
+		if record.SubdomainPolicy == "" {
+			record.SubdomainPolicy = record.Policy
+		}
+		// pct= sampling is ignored, the policy applies to every message
+		return record, nil
+	}
+	return nil, nil
+}
+
+// Identifier alignment, RFC 7489 section 3.1
+func dmarcAligned(domain, fromDomain string, strict bool) bool {
+	domain = strings.ToLower(domain)
+	if strict {
+		return domain == fromDomain
+	}
+	return orgDomain(domain) == orgDomain(fromDomain)
+}
+
+// Second level labels that are public suffixes under many country codes,
+// eg co.uk, com.au. Stands in for the full Public Suffix List.
+var publicSecondLevels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true,
+	"gov": true, "net": true, "org": true, "ne": true, "or": true,
+}
+
+// The organizational domain, eg "mail.example.co.uk" -> "example.co.uk"
+func orgDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	keep := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && publicSecondLevels[labels[len(labels)-2]] {
+		keep = 3
+	}
+	if len(labels) <= keep {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-keep:], ".")
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubAuthResolver struct {
+	txt      map[string][]string
+	mxs      map[string][]*net.MX
+	addrs    map[string][]string
+	nxdomain map[string]bool
+}
+
+func (r *stubAuthResolver) LookupTXT(name string) ([]string, error) {
+	return r.txt[name], nil
+}
+
+func (r *stubAuthResolver) LookupMX(host string) ([]*net.MX, time.Duration, error) {
+	if r.nxdomain[strings.TrimSuffix(host, ".")] {
+		return nil, 0, errNoSuchDomain
+	}
+	return r.mxs[strings.TrimSuffix(host, ".")], time.Minute, nil
+}
+
+func (r *stubAuthResolver) LookupHost(host string) ([]string, time.Duration, error) {
+	addrs := r.addrs[strings.TrimSuffix(host, ".")]
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host}
+	}
+	return addrs, time.Minute, nil
+}
+
+func newStubAuthResolver() *stubAuthResolver {
+	return &stubAuthResolver{
+		txt: map[string][]string{
+			"example.com":          {"some verification token", "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all"},
+			"_spf.example.net":     {"v=spf1 a:relay.example.net mx:example.net ~all"},
+			"redirect.example.org": {"v=spf1 redirect=example.com"},
+			"macro.example.org":    {"v=spf1 exists:%{ir}.%{l1r-}.allow.example.org -all"},
+			"loop.example.org":     {"v=spf1 include:loop.example.org -all"},
+			"two.example.org":      {"v=spf1 -all", "v=spf1 +all"},
+			"void.example.org":     {"v=spf1 mx:gone.example.org ip4:192.0.2.0/24 -all"},
+		},
+		mxs: map[string][]*net.MX{
+			"example.net": {{Host: "mx.example.net.", Pref: 10}},
+		},
+		addrs: map[string][]string{
+			"relay.example.net":               {"198.51.100.7"},
+			"mx.example.net":                  {"2001:db8::25"},
+			"9.2.0.192.bob.allow.example.org": {"127.0.0.2"},
+		},
+		nxdomain: map[string]bool{"gone.example.org": true},
+	}
+}
+
+func TestCheckSpf(t *testing.T) {
+	resolver := newStubAuthResolver()
+	for _, test := range []struct {
+		ip, domain, sender, result string
+	}{
+		{"192.0.2.9", "example.com", "bob@example.com", spfPass},
+		{"198.51.100.7", "example.com", "bob@example.com", spfPass},
+		{"2001:db8::25", "example.com", "bob@example.com", spfPass},
+		{"203.0.113.1", "example.com", "bob@example.com", spfFail},
+		{"192.0.2.9", "redirect.example.org", "bob@redirect.example.org", spfPass},
+		{"203.0.113.1", "redirect.example.org", "bob@redirect.example.org", spfFail},
+		{"192.0.2.9", "macro.example.org", "bob-smith@macro.example.org", spfPass},
+		{"192.0.2.9", "macro.example.org", "alice@macro.example.org", spfFail},
+		{"192.0.2.9", "loop.example.org", "bob@loop.example.org", spfPermError},
+		{"192.0.2.9", "two.example.org", "bob@two.example.org", spfPermError},
+		{"192.0.2.9", "nospf.example.org", "bob@nospf.example.org", spfNone},
+		{"192.0.2.9", "void.example.org", "bob@void.example.org", spfPass},
+	} {
+		result := checkSpf(resolver, net.ParseIP(test.ip), test.domain, test.sender, "mail.example.com")
+		if result != test.result {
+			t.Errorf("checkSpf(%s, %s) = %s, expected %s", test.ip, test.domain, result, test.result)
+		}
+	}
+}
+
+// Signs message the way a remote mail server would
+func dkimSignForTest(t *testing.T, key *rsa.PrivateKey, message, domain, canon string) string {
+	fields, body := splitMessage(message)
+	sig := &dkimSignature{
+		Algorithm:   "rsa-sha256",
+		HeaderCanon: canon,
+		BodyCanon:   canon,
+		Headers:     []string{"from", "subject"},
+		Length:      -1,
+	}
+	field := "DKIM-Signature: v=1; a=rsa-sha256; c=" + canon + "/" + canon + ";\r\n" +
+		"\td=" + domain + "; s=test; h=From:Subject;\r\n" +
+		"\tbh=" + base64.StdEncoding.EncodeToString(sig.bodyHash(body)) + ";\r\n" +
+		"\tb=\r\n"
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sig.headerHash(fields, field))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(field, "\r\n") + base64.StdEncoding.EncodeToString(signature) + "\r\n" + message
+}
+
+func TestVerifyDkim(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	resolver := newStubAuthResolver()
+	resolver.txt["test._domainkey.example.com"] = []string{
+		"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}
+	resolver.txt["test._domainkey.revoked.example.com"] = []string{"v=DKIM1; p="}
+
+	message := "From: Bob <bob@example.com>\r\nTo: alice@local.scramble.io\r\n" +
+		"Subject:  Hello \r\n\tworld\r\n\r\nHi Alice,\r\n\r\nthis is signed.  \r\n\r\n\r\n"
+	now := time.Now()
+
+	for _, canon := range []string{"simple", "relaxed"} {
+		signed := dkimSignForTest(t, key, message, "example.com", canon)
+		result, domains := verifyDkim(resolver, strings.NewReader(signed), now)
+		if result != dkimPass || len(domains) != 1 || domains[0] != "example.com" {
+			t.Errorf("verifyDkim(%s) = %s, %v, expected a pass for example.com", canon, result, domains)
+		}
+		tampered := strings.Replace(signed, "this is signed", "this is forged", 1)
+		if result, _ = verifyDkim(resolver, strings.NewReader(tampered), now); result != dkimFail {
+			t.Errorf("verifyDkim(%s) = %s for a tampered body", canon, result)
+		}
+		tampered = strings.Replace(signed, "Hello", "Goodbye", 1)
+		if result, _ = verifyDkim(resolver, strings.NewReader(tampered), now); result != dkimFail {
+			t.Errorf("verifyDkim(%s) = %s for a tampered subject", canon, result)
+		}
+	}
+
+	// relaxed canonicalization survives whitespace changes in transit
+	signed := dkimSignForTest(t, key, message, "example.com", "relaxed")
+	rewrapped := strings.Replace(signed, "Subject:  Hello \r\n\tworld", "Subject: Hello world", 1)
+	rewrapped = strings.Replace(rewrapped, "signed.  \r\n", "signed.\r\n", 1)
+	if result, _ := verifyDkim(resolver, strings.NewReader(rewrapped), now); result != dkimPass {
+		t.Errorf("verifyDkim() = %s for a message with rewrapped whitespace", result)
+	}
+
+	if result, _ := verifyDkim(resolver, strings.NewReader(message), now); result != dkimNone {
+		t.Errorf("verifyDkim() = %s for an unsigned message", result)
+	}
+	revoked := dkimSignForTest(t, key, message, "revoked.example.com", "relaxed")
+	if result, _ := verifyDkim(resolver, strings.NewReader(revoked), now); result != dkimFail {
+		t.Errorf("verifyDkim() = %s for a revoked key", result)
+	}
+	unknown := dkimSignForTest(t, key, message, "example.org", "relaxed")
+	if result, _ := verifyDkim(resolver, strings.NewReader(unknown), now); result != dkimPermError {
+		t.Errorf("verifyDkim() = %s without a published key", result)
+	}
+	sha1 := strings.Replace(dkimSignForTest(t, key, message, "example.com", "relaxed"),
+		"a=rsa-sha256", "a=rsa-sha1", 1)
+	if result, _ := verifyDkim(resolver, strings.NewReader(sha1), now); result != dkimPermError {
+		t.Errorf("verifyDkim() = %s for an rsa-sha1 signature", result)
+	}
+}
+
+func TestDkimSign(t *testing.T) {
+	key := dkimKeyForHost("sign.example.com")
+	if again := dkimKeyForHost("sign.example.com"); again.PrivateKey != key.PrivateKey {
+		t.Fatal("dkimKeyForHost() should keep one key per email host")
+	}
+	name, value := dkimTxtRecord(key)
+	if name != key.Selector+"._domainkey.sign.example.com" || !strings.HasPrefix(value, "v=DKIM1; k=rsa; p=") {
+		t.Fatalf("dkimTxtRecord() returned %s %s", name, value)
+	}
+	resolver := newStubAuthResolver()
+	resolver.txt[name] = []string{value}
+
+	// like smtpTemplate, with bare LFs that become CRLFs on the wire
+	message := "Message-ID: <1@sign.example.com>\nContent-Type: text/plain\n" +
+		"From: <bob@sign.example.com>\nTo: <alice@example.org>\nSubject: Encrypted subject\n\n" +
+		"-----BEGIN PGP MESSAGE-----\n..\n-----END PGP MESSAGE-----\n"
+	signed := dkimSign(message, key, time.Now())
+	if !strings.HasPrefix(signed, "DKIM-Signature: ") ||
+		!strings.Contains(signed, "h=from:to:subject:message-id:content-type;") {
+		t.Fatalf("dkimSign() returned\n%s", signed)
+	}
+	onTheWire := strings.Replace(strings.Replace(signed, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	result, domains := verifyDkim(resolver, strings.NewReader(onTheWire), time.Now())
+	if result != dkimPass || len(domains) != 1 || domains[0] != "sign.example.com" {
+		t.Errorf("verifyDkim() = %s, %v for a message we signed", result, domains)
+	}
+}
+
+func TestDkimBodyHash(t *testing.T) {
+	// RFC 6376 section 3.4.5, with a bare LF that counts as a CRLF
+	body := " C \r\nD \t E\n\r\n\r\n"
+	for canon, expected := range map[string]string{
+		"simple":  " C \r\nD \t E\r\n",
+		"relaxed": " C\r\nD E\r\n",
+	} {
+		for _, length := range []int64{-1, 4} {
+			sig := &dkimSignature{BodyCanon: canon, Length: length}
+			canonical := expected
+			if length >= 0 {
+				canonical = expected[:length]
+			}
+			if sum := sha256.Sum256([]byte(canonical)); !bytes.Equal(sig.bodyHash(body), sum[:]) {
+				t.Errorf("bodyHash(%s, l=%d) should hash %q", canon, length, canonical)
+			}
+		}
+	}
+	empty := sha256.Sum256([]byte("\r\n"))
+	if sig := (&dkimSignature{BodyCanon: "simple", Length: -1}); !bytes.Equal(sig.bodyHash(""), empty[:]) {
+		t.Error("bodyHash(simple) should hash an empty body as a CRLF")
+	}
+}
+
+func TestAuthenticateSender(t *testing.T) {
+	resolver := newStubAuthResolver()
+	resolver.txt["_dmarc.example.com"] = []string{"v=DMARC1; p=reject; sp=quarantine; aspf=s"}
+	resolver.txt["news.example.com"] = []string{"v=spf1 ip4:192.0.2.0/24 -all"}
+	message := "From: bob@example.com\r\nSubject: hi\r\n\r\nhi\r\n"
+	from := func(addr string) *mail.Address {
+		return &mail.Address{Address: addr}
+	}
+
+	auth := authenticateSender(resolver, net.ParseIP("192.0.2.9"), "mail.example.com",
+		"bob@example.com", strings.NewReader(message), from("bob@example.com"))
+	if auth.Spf != spfPass || auth.Dkim != dkimNone || auth.Dmarc != dmarcPass || auth.Reject {
+		t.Errorf("Expected an aligned SPF pass, got %v", auth)
+	}
+
+	auth = authenticateSender(resolver, net.ParseIP("203.0.113.1"), "evil.example.org",
+		"bob@example.com", strings.NewReader(message), from("bob@example.com"))
+	if auth.Spf != spfFail || auth.Dmarc != dmarcFail || !auth.Reject {
+		t.Errorf("Expected a spoofed sender to be rejected, got %v", auth)
+	}
+
+	// SPF passes for news.example.com, but aspf=s wants an exact match
+	auth = authenticateSender(resolver, net.ParseIP("192.0.2.9"), "mail.example.com",
+		"bounces@news.example.com", strings.NewReader(message), from("bob@example.com"))
+	if auth.Spf != spfPass || auth.Dmarc != dmarcFail || !auth.Reject {
+		t.Errorf("Expected strict SPF alignment to fail, got %v", auth)
+	}
+
+	// subdomains get sp=, flag the mail but deliver it
+	auth = authenticateSender(resolver, net.ParseIP("203.0.113.1"), "evil.example.org",
+		"bob@example.org", strings.NewReader(message), from("bob@news.example.com"))
+	if auth.Dmarc != dmarcFail || auth.Reject {
+		t.Errorf("Expected the subdomain policy to quarantine, got %v", auth)
+	}
+
+	auth = authenticateSender(resolver, net.ParseIP("203.0.113.1"), "evil.example.org",
+		"bob@example.org", strings.NewReader(message), from("bob@example.org"))
+	if auth.Dmarc != dmarcNone || auth.Reject {
+		t.Errorf("Expected no DMARC verdict without a record, got %v", auth)
+	}
+}
+
+func TestOrgDomain(t *testing.T) {
+	for domain, org := range map[string]string{
+		"example.com":        "example.com",
+		"a.b.example.com":    "example.com",
+		"mail.example.co.uk": "example.co.uk",
+		"example.co.uk":      "example.co.uk",
+		"mail.example.io":    "example.io",
+		"com":                "com",
+	} {
+		if orgDomain(domain) != org {
+			t.Errorf("orgDomain(%s) = %s, expected %s", domain, orgDomain(domain), org)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	if ip := clientIP("212.96.64.216"); ip == nil || ip.String() != "212.96.64.216" {
+		t.Errorf("clientIP() = %v for an XCLIENT address", ip)
+	}
+	if ip := clientIP("[2001:db8::1]:25"); ip == nil || ip.String() != "2001:db8::1" {
+		t.Errorf("clientIP() = %v for an IPv6 address with a port", ip)
+	}
+	if isTrustedClient(clientIP("[UNAVAILABLE]")) {
+		t.Error("isTrustedClient() should not trust an unknown address")
+	}
+	if !isTrustedClient(clientIP("127.0.0.1:25")) {
+		t.Error("isTrustedClient() should trust loopback")
+	}
+}
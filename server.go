@@ -9,6 +9,9 @@ import (
 )
 
 func main() {
+	// Storage, see repo.go
+	repo = OpenRepository(GetConfig())
+
 	// Rest API
 	http.HandleFunc("/user/", userHandler)                            // create users, look up hash->pubkey
 	http.HandleFunc("/publickeys/notary", notaryHandler)              // this notary & default client notaries
@@ -16,12 +19,28 @@ func main() {
 	http.HandleFunc("/publickeys/query", publicKeysHandler)           // look up name->pubhash&pubkey
 	http.HandleFunc("/publickeys/reverse", auth(reverseQueryHandler)) // look up pubhash->name_address
 	http.HandleFunc("/nginx_proxy", nginxProxyHandler)                // needed for nginx smtp tls proxy
+	http.HandleFunc("/login", loginHandler)                           // start a session
 
 	// Private Rest API
-	http.HandleFunc("/user/me/contacts", auth(contactsHandler)) // load contacts
-	http.HandleFunc("/user/me/key", auth(privateKeyHandler))    // load encrypted privkey
-	http.HandleFunc("/email/", auth(emailHandler))              // load email body
-	http.HandleFunc("/box/", auth(inboxHandler))                // load email headers
+	http.HandleFunc("/logout", auth(logoutHandler))               // end one or all sessions
+	http.HandleFunc("/user/me/contacts", auth(contactsHandler))   // load contacts
+	http.HandleFunc("/user/me/key", auth(privateKeyHandler))      // load encrypted privkey
+	http.HandleFunc("/user/me/password", auth(passwordHandler))   // change passphrase
+	http.HandleFunc("/user/me/search", auth(searchIndexHandler))  // sync encrypted search index
+	http.HandleFunc("/user/me/totp/", auth(totpHandler))          // two-factor authentication
+	http.HandleFunc("/user/me/audit", auth(auditHandler))         // logins and failed logins
+	http.HandleFunc("/user/me/export", auth(exportHandler))       // download everything
+	http.HandleFunc("/user/me/delete", auth(deleteUserHandler))   // delete the account
+	http.HandleFunc("/email/", auth(emailHandler))                // load email body
+	http.HandleFunc("/email/attachment", auth(attachmentHandler)) // load one attachment
+	http.HandleFunc("/email/flags", auth(emailFlagsHandler))      // mark read, starred
+	http.HandleFunc("/box/", auth(inboxHandler))                  // load email headers
+	http.HandleFunc("/label/", auth(labelHandler))                // create, rename, delete labels
+	http.HandleFunc("/draft/", auth(draftHandler))                // autosave unsent mail
+
+	// Admin Rest API
+	http.HandleFunc("/admin/mx-cache/flush", adminAuth(mxCacheFlushHandler)) // forget cached mx lookups
+	http.HandleFunc("/admin/dkim", adminAuth(dkimRecordHandler))             // DKIM TXT record to publish
 
 	// Resources
 	http.HandleFunc("/", staticHandler) // html, js, css
@@ -30,13 +49,25 @@ func main() {
 	StartSMTPServer()
 	StartSMTPSaver()
 
+	// SMTP Outgoing Messages
+	StartSMTPSender()
+
+	// Deletes trashed mail after Config.TrashRetentionDays
+	StartTrashPurger()
+
+	// Deletes sessions after Config.SessionHours
+	StartSessionPurger()
+
+	// Deletes audit events after Config.AuditRetentionDays
+	StartAuditPurger()
+
 	// Serve HTTP on localhost only. Let Nginx terminate HTTPS for us.
 	address := fmt.Sprintf("127.0.0.1:%d", GetConfig().HttpPort)
 	log.Printf("Listening on http://%s\n", address)
 	log.Fatal(http.ListenAndServe(address, recoverAndLog(http.DefaultServeMux)))
 }
 
-// Wraps an HTTP handler, adding cookie authentication.
+// Wraps an HTTP handler, adding session authentication.
 //
 // The outer function either sends a HTTP 401 (Unauthorized),
 // or calls the inner function passing in a valid logged-in username.
@@ -52,6 +83,18 @@ func auth(handler func(http.ResponseWriter, *http.Request, *UserID)) http.Handle
 	})
 }
 
+// Like auth, but only lets Config.AdminUsers through.
+// Everyone else gets a HTTP 403 (Forbidden).
+func adminAuth(handler func(http.ResponseWriter, *http.Request, *UserID)) http.HandlerFunc {
+	return auth(func(w http.ResponseWriter, r *http.Request, userId *UserID) {
+		if !GetConfig().IsAdmin(userId.Token) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r, userId)
+	})
+}
+
 // Wraps an HTTP handler, adding error logging.
 //
 // If the inner function panics, the outer function recovers, logs, sends an
@@ -0,0 +1,52 @@
+/**
+ * Login sessions.
+ *
+ * POST /login trades the passphrase hash for a random session secret,
+ * which authenticates the requests after it. The server only keeps a
+ * hash of the secret. Sessions expire after Config.SessionHours, the
+ * user can end them one at a time or everywhere at once.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// How often expired sessions are deleted
+const sessionPurgeInterval = time.Hour
+
+// Creates a session for the user. Returns the secret the client has to
+// send with every request, and the session.
+func startSession(userId *UserID, now time.Time) (string, *Session) {
+	secret := hex.EncodeToString(randomBytes(32))
+	session := &Session{
+		Key:      sessionKey(secret),
+		Token:    userId.Token,
+		UnixTime: now.Unix(),
+		Expires:  now.Add(time.Duration(GetConfig().SessionHours) * time.Hour).Unix(),
+	}
+	repo.SaveSession(session)
+	return secret, session
+}
+
+// The repository key of the session with the given secret.
+// A copy of the database doesn't log anyone in.
+func sessionKey(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func StartSessionPurger() {
+	go func() {
+		for {
+			if count := repo.PurgeSessions(time.Now().Unix()); count > 0 {
+				log.Printf("Purged %d expired session(s)\n", count)
+			}
+			time.Sleep(sessionPurgeInterval)
+		}
+	}()
+}
@@ -0,0 +1,158 @@
+/**
+ * Bounces, aka delivery status notifications (RFC 3464).
+ *
+ * When outgoing mail can't be delivered, the sender gets a
+ * multipart/report in their inbox, threaded with the original message.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var regexSmtpReply = regexp.MustCompile(`^[245]\d\d `)
+var regexEnhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}`)
+
+const bounceTemplate = "From: Mail Delivery System <mailer-daemon@%s>\r\n" +
+	"To: <%s>\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Date: %s\r\n" +
+	"In-Reply-To: <%s>\r\n" +
+	"References: %s\r\n" +
+	"Auto-Submitted: auto-replied\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n" +
+	"\r\n" +
+	"%s"
+
+// Puts a bounce for the failed recipients into the sender's inbox.
+func bounce(msg *BoxedEmail, failed []*OutboxRecipient, gaveUp bool) {
+	sender, ok := ParseEmailAddressSafe(msg.From)
+	if !ok {
+		log.Printf("Not bouncing %s, invalid sender %s\n", msg.MessageID, msg.From)
+		return
+	}
+	user := repo.LoadUserID(sender.Name)
+	if user == nil || user.EmailAddress != msg.From {
+		log.Printf("Not bouncing %s, sender %s is not local\n", msg.MessageID, msg.From)
+		return
+	}
+
+	now := time.Now()
+	raw := composeBounce(msg, failed, gaveUp, now)
+	data, err := parseSmtpData(strings.NewReader(raw))
+	if err != nil {
+		log.Printf("Could not parse bounce for %s: %v\n", msg.MessageID, err)
+		return
+	}
+	err = deliverMailLocally(&SmtpMessage{
+		time:     now.Unix(),
+		mailFrom: "mailer-daemon@" + GetConfig().SmtpMxHost,
+		rcptTo:   []string{msg.From},
+		data:     *data,
+	})
+	if err != nil {
+		log.Printf("Could not deliver bounce for %s: %v\n", msg.MessageID, err)
+		return
+	}
+	log.Printf("Bounced %s to %s for %d recipient(s)\n", msg.MessageID, msg.From, len(failed))
+}
+
+// Builds the multipart/report: a human readable explanation,
+// the message/delivery-status, and the headers of the original message.
+func composeBounce(msg *BoxedEmail, failed []*OutboxRecipient, gaveUp bool, now time.Time) string {
+	reportingMta := GetConfig().SmtpMxHost
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	// human readable part
+	part, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", reportingMta)
+	if gaveUp {
+		fmt.Fprintf(part, "Your message could not be delivered for %d hours, "+
+			"so we stopped trying to deliver it to these recipients:\r\n\r\n",
+			GetConfig().OutboxGiveUpHours)
+	} else {
+		fmt.Fprintf(part, "Your message could not be delivered "+
+			"to these recipients:\r\n\r\n")
+	}
+	for _, rcpt := range failed {
+		fmt.Fprintf(part, "<%s>: %s\r\n", rcpt.Address, rcpt.Error)
+	}
+
+	// machine readable part
+	part, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", reportingMta)
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n", time.Unix(msg.UnixTime, 0).Format(time.RFC1123Z))
+	for _, rcpt := range failed {
+		fmt.Fprintf(part, "\r\n")
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", rcpt.Address)
+		fmt.Fprintf(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", bounceStatus(rcpt, gaveUp))
+		fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", msg.Address)
+		if code := bounceDiagnosticCode(rcpt); code != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", code)
+		}
+		fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	// original headers. The subject may be encrypted, see smtpSendTo()
+	part, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/rfc822-headers"},
+	})
+	plainSubject := msg.CipherSubject
+	if validateMessageArmorSafe(msg.CipherSubject) {
+		plainSubject = "Encrypted subject"
+	}
+	fmt.Fprintf(part, "Message-ID: <%s>\r\n", msg.MessageID)
+	fmt.Fprintf(part, "From: <%s>\r\n", msg.From)
+	fmt.Fprintf(part, "To: %s\r\n", ParseEmailAddresses(msg.To).AngledString(","))
+	fmt.Fprintf(part, "Subject: %s\r\n", plainSubject)
+	mw.Close()
+
+	references := strings.TrimSpace(msg.AncestorIDs + " <" + msg.MessageID + ">")
+	return fmt.Sprintf(bounceTemplate,
+		reportingMta,
+		msg.From,
+		now.Format(time.RFC1123Z),
+		msg.MessageID,
+		references,
+		mw.Boundary(),
+		body.String())
+}
+
+// RFC 3463 status code for a failed recipient, eg "5.1.1"
+func bounceStatus(rcpt *OutboxRecipient, gaveUp bool) string {
+	if gaveUp {
+		// delivery time expired
+		return "4.4.7"
+	}
+	if code := bounceDiagnosticCode(rcpt); code != "" {
+		if status := regexEnhancedStatus.FindString(code[4:]); status != "" {
+			return status
+		}
+		return code[:1] + ".0.0"
+	}
+	return "5.0.0"
+}
+
+// The remote server's reply, eg "550 5.1.1 No such user", or "" if
+// the failure wasn't an SMTP reply.
+func bounceDiagnosticCode(rcpt *OutboxRecipient) string {
+	if regexSmtpReply.MatchString(rcpt.Error) {
+		return rcpt.Error
+	}
+	return ""
+}
@@ -1,63 +1,101 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"sort"
 	"strings"
 	"time"
 )
 
-// Cache MX lookups, eg "gmail.com" -> "gmail-smtp-in.l.google.com"
-var mxCache map[string]string
 var mxHost string
 
+// Port that other mail servers accept mail on. Tests point it elsewhere.
+var remoteSmtpPort = "25"
+
 func init() {
-	mxCache = make(map[string]string)
 	mxHost = GetConfig().SmtpMxHost
+}
+
+func StartSMTPSender() {
 	go smtpSendLoop()
 }
 
-// Looks up the SMTP server for an email host
-// For example, mxLookUp("gmail.com") returns "gmail-smtp-in.l.google.com"
-func mxLookUp(host string) (string, error) {
-	cachedServer := mxCache[host]
-	if cachedServer != "" {
-		return cachedServer, nil
-	}
+// Lookups that fail for good. Mail to such a domain bounces right away.
+var (
+	errNullMx       = errors.New("domain does not accept mail (null MX)")
+	errNoSuchDomain = errors.New("no such domain")
+	errNoMailHost   = errors.New("domain has no MX or A/AAAA records")
+)
+
+// Looks up the SMTP servers for an email host, most preferred first.
+// For example, mxLookUp("gmail.com") returns
+// ["gmail-smtp-in.l.google.com", "alt1.gmail-smtp-in.l.google.com", ...]
+// See MxCache.
+func mxLookUp(host string) ([]string, error) {
+	return mxCache.Lookup(host)
+}
 
-	log.Printf("looking up smtp server (mx record) for %s\n", host)
-	mxs, err := net.LookupMX(host)
+// Like mxLookUp, but returns only the most preferred SMTP server.
+// Outgoing mail is grouped by this server, see GroupAddrsByMxHost.
+func mxLookUpPrimary(host string) (string, error) {
+	servers, err := mxLookUp(host)
 	if err != nil {
-		log.Printf("lookup failed for %s\n", host)
 		return "", err
 	}
-	bestServer, bestPref := "", 1<<16
-	for _, mx := range mxs {
-		if int(mx.Pref) < bestPref {
-			bestPref = int(mx.Pref)
-			bestServer = mx.Host
-		}
-	}
+	return servers[0], nil
+}
 
-	// trailing dot means full domain name
-	if strings.HasSuffix(bestServer, ".") {
-		bestServer = bestServer[:len(bestServer)-1]
-	} else {
-		bestServer = bestServer + "." + host
+// Sorts MX records by preference and turns them into host names.
+// A single "." record is a null MX (RFC 7505), the host takes no mail.
+func mxHostNames(host string, mxs []*net.MX) ([]string, error) {
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, errNullMx
 	}
+	sorted := make([]*net.MX, len(mxs))
+	copy(sorted, mxs)
+	sort.Stable(byPref(sorted))
 
-	mxCache[host] = bestServer
-	return bestServer, nil
+	servers := []string{}
+	for _, mx := range sorted {
+		server := mx.Host
+		// trailing dot means full domain name
+		if strings.HasSuffix(server, ".") {
+			server = server[:len(server)-1]
+		} else {
+			server = server + "." + host
+		}
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s has no usable MX records", host)
+	}
+	return servers, nil
 }
 
+type byPref []*net.MX
+
+func (mxs byPref) Len() int           { return len(mxs) }
+func (mxs byPref) Swap(i, j int)      { mxs[i], mxs[j] = mxs[j], mxs[i] }
+func (mxs byPref) Less(i, j int) bool { return mxs[i].Pref < mxs[j].Pref }
+
 // Polls the outbox every second.
 // Sends all messages over SMTP.
 func smtpSendLoop() {
+	// anything left mid-delivery by the last run gets another try
+	repo.RequeueOutbox()
 	for {
-		msgs := CheckoutOutbox(10)
+		msgs := repo.CheckoutOutbox(10)
 		for _, msg := range msgs {
 			go smtpSendAndMark(msg)
 		}
@@ -65,62 +103,317 @@ func smtpSendLoop() {
 	}
 }
 
+// Attempts delivery to each recipient that is still pending.
+// Temporary failures are retried with exponential backoff until
+// OutboxGiveUpHours have passed, permanent ones bounce right away.
 func smtpSendAndMark(msg *BoxedEmail) {
-	err := smtpSend(msg)
-	if err != nil {
+	rcpts := outboxRecipients(msg)
+	pending := []*OutboxRecipient{}
+	for _, rcpt := range rcpts {
+		if rcpt.Status == "pending" {
+			pending = append(pending, rcpt)
+		}
+	}
+
+	now := time.Now()
+	giveUp := now.Sub(time.Unix(msg.UnixTime, 0)) >
+		time.Duration(GetConfig().OutboxGiveUpHours)*time.Hour
+	results, tlsStatus := smtpSend(msg, pending)
+
+	failed := []*OutboxRecipient{}
+	stillPending := false
+	errMsgs := []string{}
+	for _, rcpt := range pending {
+		err := results[rcpt.Address]
+		rcpt.Attempts++
+		if err == nil {
+			rcpt.Status = "sent"
+			rcpt.Error = ""
+			continue
+		}
+		rcpt.Error = smtpErrorString(err)
+		errMsgs = append(errMsgs, rcpt.Address+": "+rcpt.Error)
+		if !isTransientSmtpError(err) || giveUp {
+			rcpt.Status = "failed"
+			failed = append(failed, rcpt)
+		} else {
+			stillPending = true
+		}
+	}
+	repo.SaveOutboxRecipients(rcpts)
+	if tlsStatus != "" {
+		repo.MarkTlsStatus(msg, tlsStatus)
+	}
+
+	if len(rcpts) == 0 {
+		errMsgs = append(errMsgs, "Could not resolve any recipient to mx host "+msg.Address)
+	}
+	if len(errMsgs) > 0 {
 		// Failed to send. Tell the user everything we know...
-		log.Printf("Message sending failed: %v\n", err)
-		errMsg := err.Error()
-		MarkSendError(msg, &errMsg)
+		errMsg := strings.Join(errMsgs, "\n")
+		log.Printf("Message sending failed: %v\n", errMsg)
+		repo.MarkSendError(msg, &errMsg)
+	} else {
+		repo.MarkSendError(msg, nil)
+	}
+	if len(failed) > 0 {
+		bounce(msg, failed, giveUp)
+	}
+
+	switch {
+	case stillPending, len(rcpts) == 0 && !giveUp:
+		next := now.Add(outboxBackoff(msg.Attempts + 1))
+		log.Printf("Retrying message %s at %v\n", msg.MessageID, next)
+		repo.RescheduleOutbox(msg, next.Unix())
+	case len(rcpts) == 0:
+		log.Printf("Giving up on message %s\n", msg.MessageID)
+		repo.MarkOutboxAs([]*BoxedEmail{msg}, "outbox-failed")
+	default:
+		allSent := true
+		for _, rcpt := range rcpts {
+			allSent = allSent && rcpt.Status == "sent"
+		}
+		if allSent {
+			repo.MarkOutboxAs([]*BoxedEmail{msg}, "outbox-sent")
+		} else {
+			repo.MarkOutboxAs([]*BoxedEmail{msg}, "outbox-failed")
+		}
 	}
-	MarkOutboxAs([]*BoxedEmail{msg}, "outbox-sent")
 }
 
-func smtpSend(msg *BoxedEmail) error {
+// Returns the recipients of an outbox item and their delivery state.
+// Before the first attempt, those are the addresses in To that are
+// served by the item's mx host.
+func outboxRecipients(msg *BoxedEmail) []*OutboxRecipient {
+	rcpts := repo.LoadOutboxRecipients(msg.Id)
+	if len(rcpts) > 0 {
+		return rcpts
+	}
 	mxHostAddrs, _ := GroupAddrsByMxHost(msg.To)
-	var sent = false
-	for mxHost, addrs := range mxHostAddrs {
-		if mxHost != msg.Address {
-			continue
+	for _, addr := range mxHostAddrs[msg.Address] {
+		rcpts = append(rcpts, &OutboxRecipient{msg.Id, addr.String(), 0, "pending", ""})
+	}
+	return rcpts
+}
+
+// Time to wait after the given number of failed attempts
+func outboxBackoff(attempts int) time.Duration {
+	delay := time.Duration(GetConfig().OutboxRetryMinutes) * time.Minute
+	maxDelay := time.Duration(GetConfig().OutboxMaxRetryMinutes) * time.Minute
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// 4xx replies are temporary, 5xx replies are permanent, and so is a
+// domain that takes no mail. Anything else, like a refused connection
+// or a timeout, is worth another try.
+func isTransientSmtpError(err error) bool {
+	if smtpErr, ok := err.(*textproto.Error); ok {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	switch err {
+	case errNullMx, errNoSuchDomain, errNoMailHost:
+		return false
+	}
+	return true
+}
+
+// Like err.Error(), but SMTP replies are kept as the server sent them,
+// eg "550 5.1.1 No such user"
+func smtpErrorString(err error) string {
+	if smtpErr, ok := err.(*textproto.Error); ok {
+		return fmt.Sprintf("%03d %s", smtpErr.Code, smtpErr.Msg)
+	}
+	return err.Error()
+}
+
+// Sends the message to the given recipients, failing over through
+// the mx hosts of each recipient's domain.
+// Returns the outcome per recipient address, nil meaning delivered,
+// and the weakest TLS any of the deliveries used.
+func smtpSend(msg *BoxedEmail, rcpts []*OutboxRecipient) (map[string]error, string) {
+	results := map[string]error{}
+	tlsStatus := ""
+	hostAddrs := map[string]EmailAddresses{}
+	for _, rcpt := range rcpts {
+		addr := ParseEmailAddress(rcpt.Address)
+		hostAddrs[addr.Host] = append(hostAddrs[addr.Host], addr)
+	}
+	for host, addrs := range hostAddrs {
+		var rcptErrs map[string]error
+		var hostTlsStatus string
+		smtpHosts, err := mxLookUp(host)
+		if err == nil {
+			rcptErrs, hostTlsStatus, err = smtpSendToAny(msg, host, smtpHosts, addrs)
 		}
-		err := smtpSendTo(msg, mxHost, addrs)
-		if err != nil {
-			err := errors.New(fmt.Sprintf("SMTP sending failed to mxHost %v for addrs %v\n", mxHost, addrs))
-			return err
+		if err == nil {
+			tlsStatus = weakerTlsStatus(tlsStatus, hostTlsStatus)
+		}
+		for _, addr := range addrs.Strings() {
+			if rcptErrs[addr] != nil {
+				results[addr] = rcptErrs[addr]
+			} else {
+				results[addr] = err
+			}
+		}
+		if err == nil && len(rcptErrs) == 0 {
+			log.Printf("Email sent!\n")
 		}
-		sent = true
 	}
-	if sent {
-		log.Printf("Email sent!\n")
-		return nil
-	} else {
-		err := errors.New(fmt.Sprintf("SMTP sending failed to mxHost %v for (all) addrs %v\n", msg.Address, msg.To))
-		return err
+	return results, tlsStatus
+}
+
+// Tries each smtpHost in turn until one of them answers for the recipients.
+// Only temporary failures of the whole session, like a refused connection,
+// a 421 greeting or an unmet TLS policy, move on to the next host.
+func smtpSendToAny(email *BoxedEmail, domain string, smtpHosts []string, addrs EmailAddresses) (map[string]error, string, error) {
+	var rcptErrs map[string]error
+	var tlsStatus string
+	var err error
+	for _, smtpHost := range smtpHosts {
+		var policy *tlsPolicy
+		policy, err = tlsPolicies.ForHost(domain, smtpHost)
+		if err == nil {
+			rcptErrs, tlsStatus, err = smtpSendTo(email, smtpHost, addrs, policy)
+		}
+		if err == nil || !isTransientSmtpError(err) {
+			return rcptErrs, tlsStatus, err
+		}
+		log.Printf("SMTP: sending to %s failed, trying the next mx host: %v\n", smtpHost, err)
 	}
+	return rcptErrs, "", err
 }
 
 const smtpTemplate = `Message-ID: <%s>%s
-Content-Type: text/plain
+MIME-Version: 1.0
+Content-Type: %s
 From: <%s>
 To: %s
 Subject: %s
 
-%s%s`
+%s`
 
 const threadHeadersTemplate = `
 In-Reply-To: <%s>
 X-Scramble-Thread-ID: <%s>
 References: %s`
 
-func smtpSendTo(email *BoxedEmail, smtpHost string, addrs EmailAddresses) error {
-	var plainSubject, prependToBody string
+const cipherSubjectHeaderTemplate = `
+X-Scramble-Cipher-Subject: %s`
+
+// Wraps an armored message into a multipart/encrypted body, RFC 3156
+// section 4. Returns its Content-Type and the body itself.
+func pgpMimeBody(cipherText string) (string, string) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	part.Write([]byte("Version: 1\r\n"))
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		panic(err)
+	}
+	part.Write([]byte(cipherText))
+	writer.Close()
+
+	contentType := mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": writer.Boundary(),
+	})
+	return contentType, buf.String()
+}
+
+// Wraps the body and the email's attachments into a multipart/mixed body.
+// Returns its Content-Type and the body itself.
+func smtpMultipartBody(messageID, bodyContentType, body string, headers []AttachmentHeader) (string, string) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if bodyContentType == "text/plain" {
+		bodyContentType = "text/plain; charset=utf-8"
+	}
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {bodyContentType},
+	})
+	if err != nil {
+		panic(err)
+	}
+	part.Write([]byte(body))
+
+	for _, header := range headers {
+		attachment := repo.LoadAttachment(messageID, header.ID)
+		filename, content := attachment.Filename, attachment.CipherContent
+		partHeader := textproto.MIMEHeader{}
+		if validateMessageArmorSafe(content) {
+			// recipients decrypt it themselves, name it so their client knows how
+			if !strings.HasSuffix(filename, ".asc") && !strings.HasSuffix(filename, ".pgp") {
+				filename += ".asc"
+			}
+			partHeader.Set("Content-Type", mime.FormatMediaType("application/octet-stream",
+				map[string]string{"name": filename}))
+			partHeader.Set("Content-Transfer-Encoding", "7bit")
+		} else {
+			contentType := mime.FormatMediaType(attachment.ContentType, map[string]string{"name": filename})
+			if contentType == "" {
+				contentType = mime.FormatMediaType("application/octet-stream", map[string]string{"name": filename})
+			}
+			partHeader.Set("Content-Type", contentType)
+			partHeader.Set("Content-Transfer-Encoding", "base64")
+			content = wrapLines(base64.StdEncoding.EncodeToString([]byte(content)), 76)
+		}
+		partHeader.Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": filename}))
+
+		part, err = writer.CreatePart(partHeader)
+		if err != nil {
+			panic(err)
+		}
+		part.Write([]byte(content))
+	}
+	writer.Close()
+
+	contentType := mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()})
+	return contentType, buf.String()
+}
+
+// Breaks s into lines of at most n characters, joined by CRLF
+func wrapLines(s string, n int) string {
+	var lines []string
+	for len(s) > n {
+		lines, s = append(lines, s[:n]), s[n:]
+	}
+	return strings.Join(append(lines, s), "\r\n")
+}
+
+// Delivers the email to addrs on smtpHost, using TLS as the policy says.
+// Returns the addresses that smtpHost rejected with their errors and the
+// TLS status of the delivery, or an error that applies to every recipient.
+func smtpSendTo(email *BoxedEmail, smtpHost string, addrs EmailAddresses, policy *tlsPolicy) (map[string]error, string, error) {
+	// The encrypted subject travels in a header, for Scramble recipients.
+	// Other clients find a copy of it in the encrypted body.
+	var plainSubject, cipherSubjectHeader string
 	if validateMessageArmorSafe(email.CipherSubject) {
 		plainSubject = "Encrypted subject"
-		prependToBody = email.CipherSubject + "\n"
+		cipherSubjectHeader = fmt.Sprintf(cipherSubjectHeaderTemplate,
+			wrapLines(base64.StdEncoding.EncodeToString([]byte(email.CipherSubject)), 76))
+		cipherSubjectHeader = strings.Replace(cipherSubjectHeader, "\r\n", "\r\n ", -1)
 	} else {
 		//TODO: fix naming conventions
 		plainSubject = email.CipherSubject
-		prependToBody = ""
 	}
 
 	// Construct In-Reply-To/References/X-Scramble-Thread-ID headers
@@ -133,55 +426,82 @@ func smtpSendTo(email *BoxedEmail, smtpHost string, addrs EmailAddresses) error
 			email.AncestorIDs,
 		)
 	}
+	contentType, body := "text/plain", email.CipherBody
+	if validateMessageArmorSafe(email.CipherBody) {
+		contentType, body = pgpMimeBody(email.CipherBody)
+	}
+	if attachments := repo.LoadAttachmentHeaders(email.MessageID); len(attachments) > 0 {
+		contentType, body = smtpMultipartBody(email.MessageID, contentType, body, attachments)
+	}
+
 	// Fill in smtpTemplate
 	msg := fmt.Sprintf(smtpTemplate,
 		email.MessageID,
-		threadHeaders,
+		threadHeaders+cipherSubjectHeader,
+		contentType,
 		email.From,
 		ParseEmailAddresses(email.To).AngledString(","),
 		plainSubject,
-		prependToBody,
-		email.CipherBody)
+		body)
+	_, fromHost := splitAddress(email.From)
+	msg = dkimSign(msg, dkimKeyForHost(fromHost), time.Now())
 	log.Printf("SMTP: sending to %s %v\n%s\n", smtpHost, addrs, msg)
 
-	c, err := smtp.Dial(smtpHost + ":25")
+	c, err := smtp.Dial(net.JoinHostPort(smtpHost, remoteSmtpPort))
 	if err != nil {
-		return err
+		return nil, "", err
 	}
+	defer c.Close()
 	log.Println("hello")
 	if err = c.Hello(mxHost); err != nil {
-		return err
+		return nil, "", err
 	}
 	log.Println("starting tls")
+	tlsStatus := tlsStatusNone
 	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(nil); err != nil {
-			return err
+		if err = c.StartTLS(policy.clientConfig(smtpHost)); err != nil {
+			return nil, "", err
 		}
+		state, _ := c.TLSConnectionState()
+		if tlsStatus, err = policy.verify(smtpHost, state); err != nil {
+			return nil, "", err
+		}
+	} else if policy.Enforce {
+		return nil, "", fmt.Errorf("%s doesn't offer STARTTLS, required by its %s policy",
+			smtpHost, policy.Status)
 	}
 	log.Println("from")
 	if err = c.Mail(email.From); err != nil {
-		return err
+		return nil, "", err
 	}
 	log.Println("to")
+	rcptErrs := map[string]error{}
 	for _, addr := range addrs.Strings() {
 		log.Println("to " + addr)
 		if err = c.Rcpt(addr); err != nil {
-			return err
+			rcptErrs[addr] = err
 		}
 	}
+	if len(rcptErrs) == len(addrs) {
+		// nobody to send DATA to
+		c.Quit()
+		return rcptErrs, tlsStatus, nil
+	}
 	log.Println("data")
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return rcptErrs, "", err
 	}
 	_, err = w.Write([]byte(msg))
 	if err != nil {
-		return err
+		return rcptErrs, "", err
 	}
 	log.Println("close")
 	err = w.Close()
 	if err != nil {
-		return err
+		return rcptErrs, "", err
 	}
-	return c.Quit()
+	// the message was accepted, a failed QUIT must not make us send it again
+	c.Quit()
+	return rcptErrs, tlsStatus, nil
 }
@@ -0,0 +1,239 @@
+/**
+ * Connection policy for the SMTP listener.
+ *
+ * Limits how often and how much one host, or one sender domain, may send
+ * us, checks clients against DNS blocklists and optionally greylists
+ * mail from senders we haven't seen yet. Loopback clients are trusted,
+ * behind nginx the real client is only known after XCLIENT.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS lookups needed for DNSBL checks, see dnsResolver
+type DnsblResolver interface {
+	// Returns an error if the host has no A/AAAA records.
+	LookupHost(host string) ([]string, time.Duration, error)
+}
+
+// How long a greylisted sender has to come back, and how long we remember
+// one that did. Postgrey uses the same.
+const (
+	greylistRetryWindow = 2 * 24 * time.Hour
+	greylistPassedFor   = 35 * 24 * time.Hour
+)
+
+// Safe for concurrent use by all SMTP clients.
+type SmtpPolicy struct {
+	resolver DnsblResolver
+	now      func() time.Time
+
+	mu             sync.Mutex
+	open           map[string]int        // connections per client ip
+	connections    map[string]*rateCount // per client ip, per minute
+	ipMessages     map[string]*rateCount // per client ip, per hour
+	domainMessages map[string]*rateCount // per MAIL FROM domain, per hour
+	greylist       map[string]*greylistEntry
+	nextPrune      time.Time
+}
+
+// Events within a fixed window of time
+type rateCount struct {
+	count int
+	ends  time.Time
+}
+
+// A client network, sender and recipient we have seen
+type greylistEntry struct {
+	firstSeen time.Time
+	passed    bool // came back after the delay
+	expires   time.Time
+}
+
+var smtpPolicy = NewSmtpPolicy(systemResolver)
+
+func NewSmtpPolicy(resolver DnsblResolver) *SmtpPolicy {
+	return &SmtpPolicy{
+		resolver:       resolver,
+		now:            time.Now,
+		open:           map[string]int{},
+		connections:    map[string]*rateCount{},
+		ipMessages:     map[string]*rateCount{},
+		domainMessages: map[string]*rateCount{},
+		greylist:       map[string]*greylistEntry{},
+	}
+}
+
+// Called when a client connects, or says who it is with XCLIENT.
+// Returns the SMTP reply refusing it, or "" and the client has to
+// Disconnect later.
+func (p *SmtpPolicy) Connect(ip net.IP) string {
+	if ip == nil {
+		return "554 5.7.1 Unknown client address"
+	}
+	if isTrustedClient(ip) {
+		return ""
+	}
+	if zone := p.dnsblListing(ip); zone != "" {
+		return fmt.Sprintf("554 5.7.1 Service unavailable; client host [%s] blocked using %s", ip, zone)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune()
+	key := ip.String()
+	if max := GetConfig().SmtpMaxConnectionsPerIp; max > 0 && p.open[key] >= max {
+		return "421 4.7.0 Too many connections from your host, try again later"
+	}
+	if !p.count(p.connections, key, time.Minute, GetConfig().SmtpConnectionsPerIpMinute) {
+		return "421 4.7.0 Too many connections from your host, slow down"
+	}
+	p.open[key]++
+	return ""
+}
+
+// Called when a client that was let in by Connect goes away
+func (p *SmtpPolicy) Disconnect(ip net.IP) {
+	if ip == nil || isTrustedClient(ip) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := ip.String()
+	if p.open[key]--; p.open[key] <= 0 {
+		delete(p.open, key)
+	}
+}
+
+// Called for each MAIL FROM. Returns the SMTP reply refusing it, if any.
+func (p *SmtpPolicy) Mail(ip net.IP, mailFrom string) string {
+	if isTrustedClient(ip) {
+		return ""
+	}
+	_, domain := splitAddress(strings.ToLower(mailFrom))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.count(p.ipMessages, ip.String(), time.Hour, GetConfig().SmtpMessagesPerIpHour) {
+		return "451 4.7.1 Too many messages from your host, try again later"
+	}
+	// bounces have no domain to count against
+	if domain != "" && !p.count(p.domainMessages, domain, time.Hour, GetConfig().SmtpMessagesPerDomainHour) {
+		return "451 4.7.1 Too many messages from " + domain + ", try again later"
+	}
+	return ""
+}
+
+// Called for each accepted RCPT TO. Greylists senders we don't know yet,
+// real mail servers come back after a while, most spam bots don't.
+// Returns the SMTP reply refusing the recipient for now, if any.
+func (p *SmtpPolicy) Recipient(ip net.IP, mailFrom, rcpt string) string {
+	delay := time.Duration(GetConfig().SmtpGreylistMinutes) * time.Minute
+	if delay <= 0 || isTrustedClient(ip) {
+		return ""
+	}
+	// big senders retry from another machine in the same network
+	network := ip.Mask(net.CIDRMask(64, 128))
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(net.CIDRMask(24, 32))
+	}
+	key := network.String() + " " + strings.ToLower(mailFrom) + " " + rcpt
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	entry := p.greylist[key]
+	switch {
+	case entry == nil || !now.Before(entry.expires):
+		p.greylist[key] = &greylistEntry{firstSeen: now, expires: now.Add(greylistRetryWindow)}
+	case entry.passed || now.Sub(entry.firstSeen) >= delay:
+		entry.passed = true
+		entry.expires = now.Add(greylistPassedFor)
+		return ""
+	}
+	return "451 4.7.1 Greylisted, please try again later"
+}
+
+// Counts an event, unless key already had limit of them in this window.
+// A limit of 0 means no limit. Must hold p.mu.
+func (p *SmtpPolicy) count(counts map[string]*rateCount, key string, window time.Duration, limit int) bool {
+	now := p.now()
+	c := counts[key]
+	if c == nil || !now.Before(c.ends) {
+		c = &rateCount{0, now.Add(window)}
+		counts[key] = c
+	}
+	if limit > 0 && c.count >= limit {
+		return false
+	}
+	c.count++
+	return true
+}
+
+// Forgets windows and greylist entries that are over. Must hold p.mu.
+func (p *SmtpPolicy) prune() {
+	now := p.now()
+	if now.Before(p.nextPrune) {
+		return
+	}
+	p.nextPrune = now.Add(time.Minute)
+	for _, counts := range []map[string]*rateCount{p.connections, p.ipMessages, p.domainMessages} {
+		for key, c := range counts {
+			if !now.Before(c.ends) {
+				delete(counts, key)
+			}
+		}
+	}
+	for key, entry := range p.greylist {
+		if !now.Before(entry.expires) {
+			delete(p.greylist, key)
+		}
+	}
+}
+
+// Returns the first of Config.SmtpDnsbls that lists ip, or ""
+func (p *SmtpPolicy) dnsblListing(ip net.IP) string {
+	for _, zone := range GetConfig().SmtpDnsbls {
+		// no answer means not listed, a list that is down doesn't stop mail
+		addrs, _, err := p.resolver.LookupHost(dnsblName(ip, zone))
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			// 127.255.255.x are errors, eg Spamhaus refusing public resolvers
+			if strings.HasPrefix(addr, "127.") && !strings.HasPrefix(addr, "127.255.255.") {
+				return zone
+			}
+		}
+	}
+	return ""
+}
+
+// "1.2.3.4", "zen.example.org" -> "4.3.2.1.zen.example.org"
+// IPv6 addresses are reversed nibble by nibble, RFC 5782 section 2.4
+func dnsblName(ip net.IP, zone string) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(ip4[i]))
+		}
+	} else {
+		ip16 := ip.To16()
+		for i := 15; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x.%x", ip16[i]&0xf, ip16[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
+
+// Mail relayed by something on this host was checked there, if at all.
+// An address we couldn't parse could be anyone's, so it isn't trusted.
+func isTrustedClient(ip net.IP) bool {
+	return ip != nil && ip.IsLoopback()
+}
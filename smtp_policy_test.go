@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubDnsblResolver map[string][]string
+
+func (r stubDnsblResolver) LookupHost(host string) ([]string, time.Duration, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, time.Hour, nil
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func TestSmtpPolicy(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config.SmtpMaxConnectionsPerIp = 2
+	config.SmtpConnectionsPerIpMinute = 3
+	config.SmtpMessagesPerIpHour = 2
+	config.SmtpMessagesPerDomainHour = 3
+	config.SmtpDnsbls = []string{"dnsbl.example.org"}
+
+	now := time.Unix(1380000000, 0)
+	policy := NewSmtpPolicy(stubDnsblResolver{
+		"2.0.0.127.dnsbl.example.org": {"127.0.0.2"},
+		"66.0.0.10.dnsbl.example.org": {"127.0.0.4"},
+		"99.0.0.10.dnsbl.example.org": {"127.255.255.254"},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.dnsbl.example.org": {"127.0.0.2"},
+	})
+	policy.now = func() time.Time { return now }
+	ip := net.ParseIP("10.0.0.1")
+
+	// blocklists
+	if reply := policy.Connect(net.ParseIP("10.0.0.66")); !strings.HasPrefix(reply, "554 5.7.1") {
+		t.Errorf("Expected a listed client to be refused, got %q", reply)
+	}
+	if reply := policy.Connect(net.ParseIP("2001:db8::1")); !strings.HasPrefix(reply, "554 5.7.1") {
+		t.Errorf("Expected a listed IPv6 client to be refused, got %q", reply)
+	}
+	if reply := policy.Connect(net.ParseIP("10.0.0.99")); reply != "" {
+		t.Errorf("A blocklist error code is no listing, got %q", reply)
+	}
+	policy.Disconnect(net.ParseIP("10.0.0.99"))
+	if reply := policy.Connect(net.ParseIP("127.0.0.2")); reply != "" {
+		t.Errorf("Loopback clients should be trusted, got %q", reply)
+	}
+
+	// connections
+	if policy.Connect(ip) != "" || policy.Connect(ip) != "" {
+		t.Fatal("Expected two connections to be let in")
+	}
+	if reply := policy.Connect(ip); !strings.HasPrefix(reply, "421") {
+		t.Errorf("Expected a third open connection to be refused, got %q", reply)
+	}
+	policy.Disconnect(ip)
+	if reply := policy.Connect(ip); reply != "" {
+		t.Errorf("Expected a connection once another closed, got %q", reply)
+	}
+	policy.Disconnect(ip)
+	if reply := policy.Connect(ip); !strings.HasPrefix(reply, "421") {
+		t.Errorf("Expected a fourth connection within a minute to be refused, got %q", reply)
+	}
+	now = now.Add(time.Minute)
+	if reply := policy.Connect(ip); reply != "" {
+		t.Errorf("Expected a connection in the next minute, got %q", reply)
+	}
+
+	// messages, per ip and per sender domain
+	for i := 0; i < 2; i++ {
+		if reply := policy.Mail(ip, "bob@example.com"); reply != "" {
+			t.Fatalf("Expected message %d to be allowed, got %q", i, reply)
+		}
+	}
+	if reply := policy.Mail(ip, "bob@example.com"); !strings.HasPrefix(reply, "451") {
+		t.Errorf("Expected the per ip message limit, got %q", reply)
+	}
+	if reply := policy.Mail(net.ParseIP("10.0.1.1"), "alice@EXAMPLE.com"); reply != "" {
+		t.Errorf("Expected another host to get through, got %q", reply)
+	}
+	if reply := policy.Mail(net.ParseIP("10.0.2.1"), "carol@example.com"); !strings.HasPrefix(reply, "451") {
+		t.Errorf("Expected the per domain message limit, got %q", reply)
+	}
+	now = now.Add(time.Hour)
+	if reply := policy.Mail(ip, "bob@example.com"); reply != "" {
+		t.Errorf("Expected the limits to reset after an hour, got %q", reply)
+	}
+
+	// greylisting
+	if reply := policy.Recipient(ip, "bob@example.com", "test@local.scramble.io"); reply != "" {
+		t.Errorf("Greylisting is off by default, got %q", reply)
+	}
+	config.SmtpGreylistMinutes = 5
+	if reply := policy.Recipient(ip, "bob@example.com", "test@local.scramble.io"); !strings.HasPrefix(reply, "451") {
+		t.Errorf("Expected a new sender to be greylisted, got %q", reply)
+	}
+	now = now.Add(time.Minute)
+	if reply := policy.Recipient(ip, "bob@example.com", "test@local.scramble.io"); !strings.HasPrefix(reply, "451") {
+		t.Errorf("Expected an early retry to be greylisted, got %q", reply)
+	}
+	now = now.Add(5 * time.Minute)
+	if reply := policy.Recipient(net.ParseIP("10.0.0.2"), "bob@example.com", "test@local.scramble.io"); reply != "" {
+		t.Errorf("Expected a retry from the same network to pass, got %q", reply)
+	}
+	now = now.Add(10 * 24 * time.Hour)
+	if reply := policy.Recipient(ip, "bob@example.com", "test@local.scramble.io"); reply != "" {
+		t.Errorf("Expected a known sender to pass, got %q", reply)
+	}
+}
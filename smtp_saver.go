@@ -49,13 +49,21 @@ func saveEmail(msg *SmtpMessage) bool {
 
 func deliverMailLocally(msg *SmtpMessage) error {
 
-	var cipherSubject, cipherBody string
+	var cipherSubject, cipherBody, plaintext string
 	cipherPackets := regexSMTPTemplatep.FindAllString(msg.data.textBody, -1)
-	// TODO: better way to distinguish between encrypted and unencrypted mail
-	if len(cipherPackets) == 2 {
+	if msg.data.cipherBody != "" {
+		// PGP/MIME. Only other Scramble servers send the subject encrypted.
+		cipherSubject = msg.data.cipherSubject
+		if cipherSubject == "" {
+			cipherSubject = encryptForUsers(msg.data.subject, msg.rcptTo)
+		}
+		cipherBody = msg.data.cipherBody
+	} else if len(cipherPackets) == 2 && strings.TrimSpace(regexSMTPTemplatep.ReplaceAllString(msg.data.textBody, "")) == "" {
+		// inline subject and body, as older Scramble servers send them
 		cipherSubject = cipherPackets[0]
 		cipherBody = cipherPackets[1]
 	} else {
+		plaintext = msg.data.subject + "\n" + msg.data.textBody
 		cipherSubject = encryptForUsers(msg.data.subject, msg.rcptTo)
 		cipherBody = encryptForUsers(msg.data.textBody, msg.rcptTo)
 	}
@@ -64,6 +72,10 @@ func deliverMailLocally(msg *SmtpMessage) error {
 	email.MessageID = msg.data.messageID.String()
 	email.UnixTime = msg.time
 	email.From = msg.mailFrom
+	if email.From == "" {
+		// a bounce, show who it's from
+		email.From = msg.data.from.Address
+	}
 	// TODO: separate To and CC, add BCC
 	email.To = joinAddresses(append(msg.data.toList, msg.data.ccList...))
 	email.CipherSubject = cipherSubject
@@ -71,16 +83,44 @@ func deliverMailLocally(msg *SmtpMessage) error {
 	email.ThreadID = msg.data.threadID.String()
 	email.AncestorIDs = msg.data.ancestorIDs.AngledStringCappedToBytes(
         " ", GetConfig().AncestorIDsMaxBytes)
+	if msg.auth != nil {
+		email.SpfResult = msg.auth.Spf
+		email.DkimResult = msg.auth.Dkim
+		email.DmarcResult = msg.auth.Dmarc
+	}
+	box := "inbox"
+	score, isSpam := scoreSpam(msg, plaintext)
+	email.SpamScore = score
+	if isSpam {
+		box = "spam"
+	}
 
 	// TODO: consider if transactions are required.
 	// TODO: saveMessage may fail if messageId is not unique.
-	SaveMessage(email)
+	repo.SaveMessage(email)
 	log.Printf("Saved new email %s from %s to %s\n",
 		email.MessageID, email.From, email.To)
 
-	// add to inbox locally
+	// attachments are encrypted just like the body, unless they already are
+	for i, part := range msg.data.attachments {
+		cipherContent := string(part.content)
+		if !validateMessageArmorSafe(cipherContent) {
+			cipherContent = encryptForUsers(cipherContent, msg.rcptTo)
+		}
+		repo.SaveAttachment(&Attachment{
+			AttachmentHeader: AttachmentHeader{
+				ID:          i + 1,
+				Filename:    part.filename,
+				ContentType: part.contentType,
+			},
+			MessageID:     email.MessageID,
+			CipherContent: cipherContent,
+		})
+	}
+
+	// add to inbox, or spam, locally
 	for _, addr := range msg.rcptTo {
-		AddMessageToBox(email, addr, "inbox")
+		repo.AddMessageToBox(email, addr, box)
 	}
 
 	return nil
@@ -98,7 +138,7 @@ func encryptForUsers(plaintext string, addrs []string) string {
 	keys := make([]*openpgp.Entity, 0)
 	for _, addr := range addrs {
 		token := strings.Split(addr, "@")[0]
-		user := LoadUser(token)
+		user := repo.LoadUser(token)
 		if user == nil {
 			// we've already told the SMTP sender that those
 			// recipients don't exist on this server
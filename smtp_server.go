@@ -25,6 +25,7 @@ import (
 	"compress/zlib"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
@@ -38,10 +39,13 @@ import (
 	"mime/multipart"
 	"net"
 	"net/mail"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Public interface: a stream of SmtpMessages
@@ -52,6 +56,8 @@ type SmtpMessage struct {
 	rcptTo   []string
 
 	data SmtpMessageData
+	// nil unless the message came in over the network
+	auth *SenderAuth
 
 	saveSuccess chan bool
 }
@@ -61,19 +67,32 @@ type SmtpMessageData struct {
     threadID    EmailAddress
     ancestorIDs EmailAddresses
 
+	header    mail.Header // for the spam filters
 	from      *mail.Address
 	toList    []*mail.Address
 	ccList    []*mail.Address
 	subject   string
-	body      string
 	textBody  string
+	// non-text parts, and html if there's no text version
+	attachments []*mimeAttachment
+
+	// the armored payload of a PGP/MIME encrypted message, RFC 3156,
+	// and the encrypted subject if it came from another Scramble server
+	cipherBody    string
+	cipherSubject string
+}
+
+// A part of an inbound message that isn't its text
+type mimeAttachment struct {
+	filename    string
+	contentType string
+	content     []byte
 }
 
 var SaveMailChan chan *SmtpMessage
 
 // Private implementation
 
-var emailRegex = regexp.MustCompile(`<(.+?)>`)
 var mimeHeaderRegex = regexp.MustCompile(`=\?(.+?)\?([QBqp])\?(.+?)\?=`)
 var charsetIllegalCharRegex = regexp.MustCompile(`[_:.\/\\]`)
 
@@ -87,35 +106,75 @@ type client struct {
 	bufout   *bufio.Writer
 	killTime int64
 	errors   int
+	tls      bool
+	policyIP net.IP // the address smtpPolicy let in, if any
 
 	// Email properties
 	time       int64
 	mailFrom   string
 	rcptTo     []string
-	subject    string
-	data       string
 	remoteAddr string
 }
 
+// Where a session is, RFC 5321 section 4.1.4
+const (
+	stateGreet = iota // the greeting is due
+	stateHello        // waiting for HELO or EHLO
+	stateReady        // greeted, no mail transaction
+	stateMail         // after MAIL FROM
+	stateRcpt         // after at least one accepted RCPT TO
+	stateData         // reading the message
+)
+
+// Server timeouts, RFC 5321 section 4.5.3.2
+const (
+	commandTimeout = 5 * time.Minute
+	dataTimeout    = 3 * time.Minute // between two reads of DATA
+)
+
+// RFC 5321 section 4.5.3.1: at least 512 for commands, more for extensions
+const maxCommandLength = 2048
+
+// RFC 5321 section 4.5.3.1.8 asks for at least 100
+const maxRecipients = 100
+
 var serverName string
 var listenAddress string
 var maxSize int
-var timeout time.Duration
 var sem chan int
+var tlsConfig *tls.Config
 
 func configure() {
 	// MX server name
 	serverName = GetConfig().SmtpMxHost
-	// SMTP port that nginx forwards to
-	listenAddress = fmt.Sprintf("127.0.0.1:%d", GetConfig().SmtpPort)
+	// SMTP port, either facing the internet or behind nginx
+	listenAddress = fmt.Sprintf("%s:%d", GetConfig().SmtpBindAddress, GetConfig().SmtpPort)
 	// max email size
-	maxSize = 131072
-	// timeout for reads
-	timeout = time.Duration(20)
-	// currently active client list, 500 is maxClients
-	sem = make(chan int, 500)
+	maxSize = GetConfig().SmtpMaxSize
+	// currently active client list, 500 is maxClients.
+	// Kept when configured again, clients still running hold a slot.
+	if sem == nil {
+		sem = make(chan int, 500)
+	}
 	// database writing workers
 	SaveMailChan = make(chan *SmtpMessage, 5)
+	// certificate for STARTTLS and implicit TLS, if we terminate TLS ourselves
+	tlsConfig = loadTlsConfig(GetConfig().SmtpTlsCertFile, GetConfig().SmtpTlsKeyFile)
+}
+
+// Returns nil if no certificate is configured, eg because nginx handles TLS
+func loadTlsConfig(certFile, keyFile string) *tls.Config {
+	if certFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Panicf("Cannot load SMTP TLS certificate %s: %v", certFile, err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   GetConfig().SmtpMxHost,
+	}
 }
 
 func StartSMTPServer() {
@@ -129,25 +188,66 @@ func StartSMTPServer() {
 		log.Printf("Listening on %s (SMTP)\n", listenAddress)
 	}
 
-	go handleClients(listener)
+	go handleClients(listener, false)
+
+	// Implicit TLS (SMTPS), where the client starts with a TLS handshake
+	if GetConfig().SmtpTlsPort == 0 || tlsConfig == nil {
+		return
+	}
+	tlsAddress := fmt.Sprintf("%s:%d", GetConfig().SmtpBindAddress, GetConfig().SmtpTlsPort)
+	tlsListener, err := net.Listen("tcp", tlsAddress)
+	if err != nil {
+		log.Printf("Cannot listen on port, %v\n", err)
+		return
+	}
+	log.Printf("Listening on %s (SMTP over TLS)\n", tlsAddress)
+	go handleClients(tlsListener, true)
 }
 
-func handleClients(listener net.Listener) {
+// Longest pause after failing to accept a client, eg out of file descriptors
+const maxAcceptDelay = time.Second
+
+// Accepts clients until the listener is closed, then waits for the
+// ones it accepted to finish
+func handleClients(listener net.Listener, implicitTls bool) {
+	var clients sync.WaitGroup
+	defer clients.Wait()
 	var clientId int64
+	var acceptDelay time.Duration
 	for clientId = 1; ; clientId++ {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Printf("Accept error: %s\n", err)
+			// back off like net/http does, instead of spinning
+			if acceptDelay == 0 {
+				acceptDelay = 5 * time.Millisecond
+			} else if acceptDelay *= 2; acceptDelay > maxAcceptDelay {
+				acceptDelay = maxAcceptDelay
+			}
+			log.Printf("Accept error: %s, retrying in %v\n", err, acceptDelay)
+			time.Sleep(acceptDelay)
 			continue
 		}
+		acceptDelay = 0
+		if implicitTls {
+			// the handshake happens on the first read or write
+			conn = tls.Server(conn, tlsConfig)
+		}
 		sem <- 1 // Wait for active queue to drain.
-		go handleClient(&client{
+		clients.Add(1)
+		go func(c *client) {
+			defer clients.Done()
+			handleClient(c)
+		}(&client{
 			conn:       conn,
 			remoteAddr: conn.RemoteAddr().String(),
 			time:       time.Now().Unix(),
 			bufin:      bufio.NewReader(conn),
 			bufout:     bufio.NewWriter(conn),
 			clientId:   clientId,
+			tls:        implicitTls,
 		})
 	}
 }
@@ -157,154 +257,308 @@ func handleClient(client *client) {
 	// TODO: is it safe to show the clientId counter & sem?
 	//  it is nice debug info
 	greeting := "220 " + serverName +
-		" SMTP Scramble-SMTPd #" + strconv.FormatInt(client.clientId, 10) +
+		" ESMTP Scramble-SMTPd #" + strconv.FormatInt(client.clientId, 10) +
 		" (" + strconv.Itoa(len(sem)) + ") " + time.Now().Format(time.RFC1123Z)
-	advertiseTls := "250-STARTTLS\r\n"
-	for i := 0; i < 100; i++ {
+	for {
 		switch client.state {
-		case 0: // GREET
+		case stateGreet:
+			if reply := connectClient(client); reply != "" {
+				responseAdd(client, reply)
+				killClient(client)
+				break
+			}
 			responseAdd(client, greeting)
-			client.state = 1
-		case 1: // READ COMMAND
+			client.state = stateHello
+		case stateData:
+			readSmtpData(client)
+			if client.killTime > 0 {
+				return
+			}
+		default:
 			input, err := readSmtp(client)
-			if err != nil {
-				log.Printf("Read error: %v\n", err)
-				if err == io.EOF {
-					// client closed the connection already
-					return
-				}
-				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					// too slow, timeout
-					return
-				}
+			if err == errLineTooLong {
+				responseAdd(client, "500 5.5.2 Line too long")
+				killClient(client)
 				break
 			}
-			input = strings.Trim(input, " \n\r")
-			cmd := strings.ToUpper(input)
-			switch {
-			case strings.Index(cmd, "HELO") == 0:
-				if len(input) > 5 {
-					client.helo = input[5:]
-				}
-				responseAdd(client, "250 "+serverName+" Hello ")
-			case strings.Index(cmd, "EHLO") == 0:
-				if len(input) > 5 {
-					client.helo = input[5:]
-				}
-				responseAdd(client, "250-"+serverName+
-					" Sup "+client.helo+"["+client.remoteAddr+"]"+"\r\n"+
-					"250-SIZE "+strconv.Itoa(maxSize)+"\r\n"+
-					advertiseTls+"250 HELP")
-			case strings.Index(cmd, "MAIL FROM:") == 0:
-				email := extractEmail(input[10:])
-				if email == "" {
-					responseAdd(client, "550 Invalid address")
-					killClient(client)
-				} else {
-					client.mailFrom = email
-					responseAdd(client, "250 Accepted")
-				}
-			case strings.Index(cmd, "XCLIENT") == 0:
-				// Nginx sends this
-				// XCLIENT ADDR=212.96.64.216 NAME=[UNAVAILABLE]
-				client.remoteAddr = input[13:]
-				client.remoteAddr = client.remoteAddr[0:strings.Index(client.remoteAddr, " ")]
-				log.Println("Remote client address: " + client.remoteAddr)
-				responseAdd(client, "250 OK")
-			case strings.Index(cmd, "RCPT TO:") == 0:
-				email := extractEmail(input[8:])
-				if email == "" {
-					responseAdd(client, "550 Invalid address")
-					killClient(client)
-				} else {
-					client.rcptTo = append(client.rcptTo, email)
-					responseAdd(client, "250 Accepted")
-				}
-			case strings.Index(cmd, "NOOP") == 0:
-				responseAdd(client, "250 OK")
-			case strings.Index(cmd, "RSET") == 0:
-				client.mailFrom = ""
-				client.rcptTo = nil
-				responseAdd(client, "250 OK")
-			case strings.Index(cmd, "DATA") == 0:
-				responseAdd(client, "354 Enter message, ending with \".\" on a line by itself")
-				client.state = 2
-			case (strings.Index(cmd, "STARTTLS") == 0):
-				// with Nginx this shouldn't happen
-				// responseAdd(client, "220 Ready to start TLS")
-				log.Panic("STARTTLS requested but not supported. Nginx SMTP SSL support?")
-			case strings.Index(cmd, "QUIT") == 0:
-				responseAdd(client, "221 Bye")
-				killClient(client)
-			default:
-				responseAdd(client, fmt.Sprintf("500 unrecognized command"))
-				client.errors++
-				if client.errors > 3 {
-					responseAdd(client, fmt.Sprintf("500 Too many unrecognized commands"))
-					killClient(client)
-				}
+			if err != nil {
+				// closed, or too slow
+				log.Printf("Read error: %v\n", err)
+				return
 			}
-		case 2: // READ DATA
-			var err error
-			client.data, err = readSmtp(client)
-			if err == nil {
-				// DEBUG ONLY: log the full message so that we can diagnose SMTP problems
-				log.Printf("YOU'VE GOT MAIL\n%s\n", client.data)
-
-				// place on the channel so that one of the save mail workers can pick it up
-				smtpMessage, err := createSmtpMessage(client)
-
-				var success bool
-				if err == nil {
-					SaveMailChan <- smtpMessage
-					// wait for the save to complete
-					success = <-smtpMessage.saveSuccess
-				} else {
-					log.Printf("Could not parse SMTP message: %v", err)
-					success = false
-				}
-
-				if success {
-					responseAdd(client, "250 OK : queued")
-				} else {
-					responseAdd(client, "554 Error : transaction failed")
-				}
-			} else {
-				log.Printf("DATA read error: %v\n", err)
+			if !handleCommand(client, strings.TrimRight(input, "\r\n")) {
+				return
 			}
-			client.state = 1
 		}
 		// Send a response back to the client
 		err := responseWrite(client)
 		if err != nil {
-			if err == io.EOF {
-				// client closed the connection already
-				return
+			// closed, or too slow
+			return
+		}
+		if client.killTime > 0 {
+			return
+		}
+	}
+}
+
+// Handles one command and sets the reply. Returns false if the
+// connection is gone.
+func handleCommand(client *client, input string) bool {
+	verb, arg := input, ""
+	if i := strings.Index(input, " "); i >= 0 {
+		verb, arg = input[:i], strings.TrimLeft(input[i+1:], " ")
+	}
+	switch strings.ToUpper(verb) {
+	case "HELO", "EHLO":
+		if arg == "" {
+			responseAdd(client, "501 5.5.4 Syntax: "+strings.ToUpper(verb)+" hostname")
+			break
+		}
+		// also ends any mail transaction
+		client.helo = arg
+		resetTransaction(client)
+		client.state = stateReady
+		if strings.ToUpper(verb) == "HELO" {
+			responseAdd(client, "250 "+serverName+" Hello "+client.helo)
+			break
+		}
+		extensions := []string{
+			serverName + " Hello " + client.helo + " [" + client.remoteAddr + "]",
+			"PIPELINING",
+			"SIZE " + strconv.Itoa(maxSize),
+			"8BITMIME",
+			"ENHANCEDSTATUSCODES",
+			"SMTPUTF8",
+		}
+		if tlsConfig != nil && !client.tls {
+			extensions = append(extensions, "STARTTLS")
+		}
+		responseAdd(client, "250-"+strings.Join(extensions[:len(extensions)-1], "\r\n250-")+
+			"\r\n250 "+extensions[len(extensions)-1])
+	case "MAIL":
+		if client.state == stateHello {
+			responseAdd(client, "503 5.5.1 Send HELO or EHLO first")
+			break
+		}
+		if client.state != stateReady {
+			responseAdd(client, "503 5.5.1 Nested MAIL command")
+			break
+		}
+		addr, params, ok := parsePath(arg, "FROM:")
+		if !ok || (addr != "" && !validateSenderAddress(addr, params)) {
+			responseAdd(client, "501 5.1.7 Bad sender address syntax")
+			break
+		}
+		if reply := checkMailParams(params); reply != "" {
+			responseAdd(client, reply)
+			break
+		}
+		if reply := smtpPolicy.Mail(client.policyIP, addr); reply != "" {
+			log.Printf("Refused mail from %s at %s: %s\n", addr, client.remoteAddr, reply)
+			responseAdd(client, reply)
+			break
+		}
+		// "" is the null sender of bounces
+		client.mailFrom = addr
+		client.state = stateMail
+		responseAdd(client, "250 2.1.0 OK")
+	case "RCPT":
+		if client.state != stateMail && client.state != stateRcpt {
+			responseAdd(client, "503 5.5.1 Need MAIL command")
+			break
+		}
+		addr, params, ok := parsePath(arg, "TO:")
+		if !ok || !validateAddressSafe(addr) {
+			responseAdd(client, "501 5.1.3 Bad recipient address syntax")
+			break
+		}
+		if len(params) > 0 {
+			responseAdd(client, "555 5.5.4 Unsupported RCPT TO parameter")
+			break
+		}
+		if len(client.rcptTo) >= maxRecipients {
+			responseAdd(client, "452 4.5.3 Too many recipients")
+			break
+		}
+		rcpt, reply := checkRecipient(addr)
+		if reply == "" {
+			reply = smtpPolicy.Recipient(client.policyIP, client.mailFrom, rcpt)
+		}
+		if reply != "" {
+			log.Printf("Refused recipient %s: %s\n", addr, reply)
+			responseAdd(client, reply)
+		} else {
+			client.rcptTo = append(client.rcptTo, rcpt)
+			client.state = stateRcpt
+			responseAdd(client, "250 2.1.5 OK")
+		}
+	case "DATA":
+		switch client.state {
+		case stateRcpt:
+			responseAdd(client, "354 Enter message, ending with \".\" on a line by itself")
+			client.state = stateData
+		case stateMail:
+			responseAdd(client, "554 5.5.1 No valid recipients")
+		default:
+			responseAdd(client, "503 5.5.1 Need MAIL and RCPT commands")
+		}
+	case "XCLIENT":
+		// Nginx sends this
+		// XCLIENT ADDR=212.96.64.216 NAME=[UNAVAILABLE]
+		// Without nginx in front, clients could use it to spoof their address.
+		if !isLoopback(client.conn.RemoteAddr()) {
+			responseAdd(client, "550 5.7.0 XCLIENT not allowed")
+			break
+		}
+		addr := ""
+		for _, attr := range strings.Fields(arg) {
+			if strings.HasPrefix(strings.ToUpper(attr), "ADDR=") {
+				addr = attr[5:]
 			}
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				// too slow, timeout
-				return
+		}
+		// eg ADDR=[UNAVAILABLE]. Carrying on would leave the sender
+		// looking like nginx, which is trusted.
+		if clientIP(addr) == nil {
+			responseAdd(client, "550 5.7.0 Unknown client address")
+			killClient(client)
+			break
+		}
+		client.remoteAddr = addr
+		log.Println("Remote client address: " + client.remoteAddr)
+		if reply := connectClient(client); reply != "" {
+			responseAdd(client, reply)
+			killClient(client)
+			break
+		}
+		// the session starts over, as the real client
+		client.helo = ""
+		resetTransaction(client)
+		client.state = stateHello
+		responseAdd(client, "250 2.0.0 OK")
+	case "NOOP":
+		responseAdd(client, "250 2.0.0 OK")
+	case "RSET":
+		resetTransaction(client)
+		if client.state != stateHello {
+			client.state = stateReady
+		}
+		responseAdd(client, "250 2.0.0 OK")
+	case "VRFY":
+		responseAdd(client, "252 2.5.2 Cannot VRFY user, but will accept message and attempt delivery")
+	case "HELP":
+		responseAdd(client, "214 2.0.0 See RFC 5321")
+	case "EXPN", "TURN", "ETRN", "BDAT", "AUTH":
+		responseAdd(client, "502 5.5.1 Command not implemented")
+	case "STARTTLS":
+		if client.tls {
+			responseAdd(client, "503 5.5.1 Already running TLS")
+		} else if tlsConfig == nil {
+			// nginx is supposed to handle TLS for us
+			responseAdd(client, "454 4.7.0 TLS not available")
+		} else if client.state == stateMail || client.state == stateRcpt {
+			responseAdd(client, "503 5.5.1 STARTTLS is not allowed during a mail transaction")
+		} else {
+			responseAdd(client, "220 2.0.0 Ready to start TLS")
+			if err := responseWrite(client); err != nil {
+				return false
 			}
+			// pipelined commands aren't waited for, see responseWrite
+			if err := client.bufout.Flush(); err != nil {
+				return false
+			}
+			if err := startTls(client); err != nil {
+				log.Printf("TLS handshake failed: %v\n", err)
+				return false
+			}
+			client.state = stateHello
 		}
-		if client.killTime > 1 {
-			return
+	case "QUIT":
+		responseAdd(client, "221 2.0.0 Bye")
+		killClient(client)
+	default:
+		responseAdd(client, "500 5.5.2 Command unrecognized")
+		client.errors++
+		if client.errors > 3 {
+			responseAdd(client, "421 4.7.0 Too many unrecognized commands")
+			killClient(client)
 		}
 	}
+	return true
+}
+
+// Reads the message after DATA and sets the reply
+func readSmtpData(client *client) {
+	data := newSmtpDataReader(client)
+	smtpMessage, err := createSmtpMessage(client, data)
+	// whatever wasn't parsed still has to be read, up to the "." line
+	if _, drainErr := io.Copy(ioutil.Discard, data); drainErr != nil && err == nil {
+		err = drainErr
+	}
+	resetTransaction(client)
+	client.state = stateReady
+	if data.err != io.EOF && data.err != errDataTooLarge {
+		log.Printf("DATA read error: %v\n", data.err)
+		killClient(client)
+		return
+	}
 
+	if data.err == errDataTooLarge {
+		responseAdd(client, "552 5.3.4 Message size exceeds fixed maximum message size")
+		return
+	}
+	if err != nil {
+		log.Printf("Could not parse SMTP message: %v", err)
+		responseAdd(client, "554 5.6.0 Error: transaction failed, malformed message")
+		return
+	}
+	if smtpMessage.auth != nil && smtpMessage.auth.Reject {
+		responseAdd(client, "550 5.7.1 Rejected by the sender domain's DMARC policy")
+		return
+	}
+
+	// place on the channel so that one of the save mail workers can pick it up
+	SaveMailChan <- smtpMessage
+	// wait for the save to complete
+	if <-smtpMessage.saveSuccess {
+		responseAdd(client, "250 2.0.0 OK : queued")
+	} else {
+		responseAdd(client, "451 4.3.0 Error : transaction failed, try again later")
+	}
 }
 
-func createSmtpMessage(client *client) (*SmtpMessage, error) {
+// Ends the current mail transaction, if any
+func resetTransaction(client *client) {
+	client.mailFrom = ""
+	client.rcptTo = nil
+}
+
+func createSmtpMessage(client *client, data io.Reader) (*SmtpMessage, error) {
 	// check mailFrom and rcptTo, etc.
 	if err := validateEmailData(client); err != nil {
 		return nil, err
 	}
 
+	// DKIM needs the raw message after it is parsed, so it goes to disk
+	// rather than memory
+	spool, err := spoolSmtpData(data)
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
+
 	// parse the smtp body (which contains from, to, subject, body)
-	smtpData, err := parseSmtpData(client.data)
+	smtpData, err := parseSmtpData(spool)
 	if err != nil {
 		return nil, err
 	}
 
+	var auth *SenderAuth
+	if ip := clientIP(client.remoteAddr); !isTrustedClient(ip) {
+		auth = authenticateSender(senderAuthResolver, ip, client.helo, client.mailFrom,
+			spool, smtpData.from)
+	}
+
 	// return a fully parsed, received email
 	return &SmtpMessage{
 		time:     client.time,
@@ -312,14 +566,34 @@ func createSmtpMessage(client *client) (*SmtpMessage, error) {
 		rcptTo:   client.rcptTo,
 
 		data: *smtpData,
+		auth: auth,
 
 		saveSuccess: make(chan bool),
 	}, nil
 }
 
-func parseSmtpData(smtpData string) (*SmtpMessageData, error) {
+// Copies a message to a temporary file, which is gone once it is closed
+func spoolSmtpData(data io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile("", "scramble-smtp-")
+	if err != nil {
+		return nil, err
+	}
+	// unlinked right away, so nothing is left behind if we crash
+	os.Remove(file.Name())
+	if _, err = io.Copy(file, data); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Parses a message as it is read from smtpData
+func parseSmtpData(smtpData io.Reader) (*SmtpMessageData, error) {
 	// parse the mail data to get the headers & body
-	parsed, err := mail.ReadMessage(strings.NewReader(smtpData))
+	parsed, err := mail.ReadMessage(smtpData)
 	if err != nil {
 		return nil, err
 	}
@@ -347,6 +621,7 @@ func parseSmtpData(smtpData string) (*SmtpMessageData, error) {
 	}
 
 	data := new(SmtpMessageData)
+	data.header = parsed.Header
 	data.messageID = messageID
     data.threadID = threadID
     data.ancestorIDs = ancestorIDs
@@ -368,80 +643,299 @@ func parseSmtpData(smtpData string) (*SmtpMessageData, error) {
 	// parse subject
 	data.subject = mimeHeaderDecode(parsed.Header.Get("Subject"))
 
-	// parse the body
-	// TODO: multipart support
-	bodyBytes, err := ioutil.ReadAll(parsed.Body)
-	if err != nil {
-		return nil, err
+	// If from another Scramble server, get the encrypted subject
+	if encoded := parsed.Header.Get("X-Scramble-Cipher-Subject"); encoded != "" {
+		cipherSubject, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err == nil && validateMessageArmorSafe(string(cipherSubject)) {
+			data.cipherSubject = string(cipherSubject)
+		}
 	}
-	data.body = string(bodyBytes)
 
-	// get the body as plain text. parse multipart mime if needed
-	contentType := parsed.Header.Get("Content-Type")
-	mediaType, params, err := mime.ParseMediaType(contentType)
+	// get the body as plain text, everything else becomes an attachment
+	data.textBody, data.cipherBody, data.attachments, err = readMimeEntity(parsed.Header, parsed.Body)
 	if err != nil {
 		return nil, err
 	}
-	if mediaType == "text/plain" {
-		data.textBody = data.body
-	} else if strings.HasPrefix(mediaType, "multipart/") {
-		data.textBody, err = readPlainText(strings.NewReader(data.body), params["boundary"])
+	return data, nil
+}
+
+// The headers of a MIME entity, a mail.Header or a textproto.MIMEHeader
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// Reads a MIME entity. Returns its text/plain content, the armored payload
+// if it is PGP/MIME encrypted, and everything else as attachments.
+func readMimeEntity(header mimeHeader, body io.Reader) (string, string, []*mimeAttachment, error) {
+	// No Content-Type header altogether, assume plain text
+	mediaType, params := "text/plain", map[string]string{}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
 		if err != nil {
-			return nil, err
+			return "", "", nil, err
 		}
 	}
-	return data, nil
+	protocol := strings.ToLower(params["protocol"])
+	switch {
+	case mediaType == "multipart/encrypted" && protocol == "application/pgp-encrypted":
+		return readPgpEncrypted(body, params["boundary"])
+	case mediaType == "multipart/signed" && protocol == "application/pgp-signature":
+		return readPgpSigned(body, params["boundary"])
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return readMultipart(body, mediaType, params["boundary"])
+	}
+
+	// quoted-printable parts are already decoded by the multipart reader
+	content, err := readDecoded(body, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return "", "", nil, err
+	}
+	disposition := header.Get("Content-Disposition")
+	if mediaType == "text/plain" && !strings.HasPrefix(strings.ToLower(disposition), "attachment") {
+		return string(content), "", nil, nil
+	}
+	return "", "", []*mimeAttachment{{
+		partFilename(disposition, params),
+		mediaType,
+		content,
+	}}, nil
 }
 
-func readPlainText(reader io.Reader, multiBoundary string) (string, error) {
+// Walks a multipart body. Returns the text/plain parts, joined, the first
+// PGP/MIME payload and the other parts as attachments. Of a
+// multipart/alternative, only the text/plain version is kept if there is one.
+func readMultipart(reader io.Reader, mediaType, multiBoundary string) (string, string, []*mimeAttachment, error) {
 	multiReader := multipart.NewReader(reader, multiBoundary)
 	var plainTexts []string
+	var cipherText string
+	var attachments, alternatives []*mimeAttachment
 	for {
 		part, err := multiReader.NextPart()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return "", err
-		}
-		partContentType := part.Header["Content-Type"][0]
-		var partMediaType string
-		var params map[string]string
-		if partContentType == "" {
-			// No Content-Type header altogether
-			// Assume plain text
-			partMediaType = "text/plain"
+			return "", "", nil, err
+		}
+		text, partCipherText, partAttachments, err := readMimeEntity(part.Header, part)
+		if err != nil {
+			return "", "", nil, err
+		}
+		plainTexts = append(plainTexts, text)
+		if cipherText == "" {
+			cipherText = partCipherText
+		}
+		if mediaType == "multipart/alternative" {
+			alternatives = append(alternatives, partAttachments...)
 		} else {
-			partMediaType, params, err = mime.ParseMediaType(partContentType)
-			if err != nil {
-				return "", err
-			}
+			attachments = append(attachments, partAttachments...)
 		}
+	}
 
-		if partMediaType == "text/plain" {
-			textBodyBytes, err := ioutil.ReadAll(part)
-			if err != nil {
-				return "", err
-			} else {
-				textBody := string(textBodyBytes)
-				plainTexts = append(plainTexts, textBody)
+	// other versions of the text, eg html, are only worth keeping without one
+	if strings.Join(plainTexts, "") == "" {
+		attachments = append(attachments, alternatives...)
+	}
+	return strings.Join(plainTexts, ""), cipherText, attachments, nil
+}
+
+// Reads a multipart/encrypted body, RFC 3156 section 4. The first part
+// only says "Version: 1", the second is the armored message. Anything
+// else is read as an ordinary multipart body.
+func readPgpEncrypted(reader io.Reader, multiBoundary string) (string, string, []*mimeAttachment, error) {
+	text, cipherText, attachments, err := readMultipart(reader, "multipart/encrypted", multiBoundary)
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, attachment := range attachments {
+		if attachment.contentType != "application/octet-stream" {
+			continue
+		}
+		content := strings.TrimSpace(string(attachment.content))
+		if validateMessageArmorSafe(content) {
+			return "", content, nil, nil
+		}
+	}
+	return text, cipherText, attachments, nil
+}
+
+// Reads a multipart/signed body, RFC 3156 section 5. The signature covers
+// the exact bytes of the first part, headers and all, so that part is kept
+// verbatim as an attachment next to the signature. Its text is read as usual.
+func readPgpSigned(reader io.Reader, multiBoundary string) (string, string, []*mimeAttachment, error) {
+	parts, closed, err := splitMultipart(reader, multiBoundary)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(parts) != 2 {
+		// put the parts back together, the preamble and epilogue are of no use
+		body := ""
+		for _, part := range parts {
+			body += "--" + multiBoundary + "\r\n" + part + "\r\n"
+		}
+		if closed {
+			body += "--" + multiBoundary + "--\r\n"
+		}
+		return readMultipart(strings.NewReader(body), "multipart/signed", multiBoundary)
+	}
+	signed, err := mail.ReadMessage(strings.NewReader(parts[0]))
+	if err != nil {
+		return "", "", nil, err
+	}
+	signature, err := mail.ReadMessage(strings.NewReader(parts[1]))
+	if err != nil {
+		return "", "", nil, err
+	}
+	signatureBytes, err := readDecoded(signature.Body, signature.Header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	text, cipherText, attachments, err := readMimeEntity(signed.Header, signed.Body)
+	if err != nil {
+		return "", "", nil, err
+	}
+	attachments = append(attachments,
+		&mimeAttachment{"signed.eml", "message/rfc822", []byte(parts[0])},
+		&mimeAttachment{"signature.asc", "application/pgp-signature", signatureBytes},
+	)
+	return text, cipherText, attachments, nil
+}
+
+// Splits a multipart body into its parts, byte for byte, RFC 2046
+// section 5.1.1. The line break before each delimiter belongs to the
+// delimiter. The preamble and epilogue are dropped. Also returns whether
+// the close delimiter was there, the body is only read up to it.
+func splitMultipart(body io.Reader, multiBoundary string) ([]string, bool, error) {
+	delimiter := "--" + multiBoundary
+	reader := bufio.NewReader(body)
+	var parts []string
+	var part *bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		trimmed := strings.TrimRight(line, " \t\r\n")
+		if trimmed == delimiter || trimmed == delimiter+"--" {
+			if part != nil {
+				content := strings.TrimSuffix(part.String(), "\n")
+				parts = append(parts, strings.TrimSuffix(content, "\r"))
 			}
-		} else if strings.HasPrefix(partMediaType, "multipart/") {
-			subBoundary := params["boundary"]
-			subPartText, err := readPlainText(part, subBoundary)
-			if err != nil {
-				return "", err
+			if trimmed != delimiter {
+				return parts, true, nil
 			}
-			plainTexts = append(plainTexts, subPartText)
+			part = new(bytes.Buffer)
+		} else if part != nil {
+			part.WriteString(line)
+		}
+		if err == io.EOF {
+			return parts, false, nil
+		} else if err != nil {
+			return nil, false, err
 		}
 	}
+}
 
-	return strings.Join(plainTexts, ""), nil
+// Reads a body or part, decoding its Content-Transfer-Encoding on the way.
+// Badly encoded content is cut short, read errors are returned.
+func readDecoded(body io.Reader, encoding string) ([]byte, error) {
+	source := &errorKeepingReader{reader: body}
+	var decoder io.Reader = source
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		decoder = base64.NewDecoder(base64.StdEncoding, source)
+	case "quoted-printable":
+		decoder = qprintable.NewDecoder(qprintable.BinaryEncoding, source)
+	}
+	content, _ := ioutil.ReadAll(decoder)
+	if source.err != nil && source.err != io.EOF {
+		return nil, source.err
+	}
+	return content, nil
+}
+
+// Remembers the error of the reader it wraps, so that it can be told
+// apart from a decoding error
+type errorKeepingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *errorKeepingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// The filename of a part, from Content-Disposition or the name parameter
+// of Content-Type. Never contains a path.
+func partFilename(disposition string, contentTypeParams map[string]string) string {
+	_, dispositionParams, _ := mime.ParseMediaType(disposition)
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = contentTypeParams["name"]
+	}
+	filename = mimeHeaderDecode(filename)
+	filename = filename[strings.LastIndexAny(filename, "/\\")+1:]
+	if filename == "" {
+		filename = "attachment"
+	}
+	return filename
+}
+
+// Upgrades the connection to TLS, see RFC 3207.
+// Anything the client pipelined after STARTTLS is dropped, and so is
+// everything we learned from it before the handshake.
+func startTls(client *client) error {
+	tlsConn := tls.Server(client.conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(commandTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	client.conn = tlsConn
+	client.bufin = bufio.NewReader(tlsConn)
+	client.bufout = bufio.NewWriter(tlsConn)
+	client.tls = true
+	client.helo = ""
+	resetTransaction(client)
+	return nil
+}
+
+// "1.2.3.4:5678" or, from XCLIENT, "1.2.3.4" or "IPV6:::1"
+func clientIP(remoteAddr string) net.IP {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	if strings.HasPrefix(strings.ToUpper(remoteAddr), "IPV6:") {
+		remoteAddr = remoteAddr[5:]
+	}
+	return net.ParseIP(remoteAddr)
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
 }
 
 func responseAdd(client *client, line string) {
 	client.response = line + "\r\n"
 }
+// Checks the client's address against smtpPolicy, again after XCLIENT.
+// Returns the SMTP reply refusing it, if any.
+func connectClient(client *client) string {
+	smtpPolicy.Disconnect(client.policyIP)
+	client.policyIP = nil
+	ip := clientIP(client.remoteAddr)
+	if reply := smtpPolicy.Connect(ip); reply != "" {
+		log.Printf("Refused client %s: %s\n", client.remoteAddr, reply)
+		return reply
+	}
+	client.policyIP = ip
+	return ""
+}
+
 func closeClient(client *client) {
+	smtpPolicy.Disconnect(client.policyIP)
 	client.conn.Close()
 	<-sem // Done; enable next client to run.
 }
@@ -449,91 +943,208 @@ func killClient(client *client) {
 	client.killTime = time.Now().Unix()
 }
 
+var errLineTooLong = errors.New("Maximum command length exceeded")
+
+// Reads one command line
 func readSmtp(client *client) (input string, err error) {
 	var reply string
-	// Command state terminator by default
-	suffix := "\r\n"
-	if client.state == 2 {
-		// DATA state
-		suffix = "\r\n.\r\n"
-	}
 	for err == nil {
-		client.conn.SetDeadline(time.Now().Add(timeout * time.Second))
+		client.conn.SetDeadline(time.Now().Add(commandTimeout))
 		reply, err = client.bufin.ReadString('\n')
 		if reply != "" {
 			input = input + reply
-			if len(input) > maxSize {
-				err = errors.New("Maximum DATA size exceeded (" + strconv.Itoa(maxSize) + ")")
-				return input, err
-			}
-			if client.state == 2 {
-				// Extract the subject while we are at it.
-				scanSubject(client, reply)
+			if len(input) > maxCommandLength {
+				return input, errLineTooLong
 			}
 		}
 		if err != nil {
 			break
 		}
-		if strings.HasSuffix(input, suffix) {
+		if strings.HasSuffix(input, "\r\n") {
 			break
 		}
 	}
 	return input, err
 }
 
-// Scan the data part for a Subject line. Can be a multi-line
-func scanSubject(client *client, reply string) {
-	if client.subject == "" && (len(reply) > 8) {
-		test := strings.ToUpper(reply[0:9])
-		if i := strings.Index(test, "SUBJECT: "); i == 0 {
-			// first line with \r\n
-			client.subject = reply[9:]
+var errDataTooLarge = errors.New("Maximum DATA size exceeded")
+
+// Reads the DATA of one message as it arrives, RFC 5321 section 4.5.2.
+// Undoes the dot-stuffing and ends at the "." line. Only CRLF "." CRLF
+// ends the message, a bare LF in there could be used to smuggle a second
+// message past other servers. Past maxSize the rest of the message is
+// read and thrown away, then Read returns errDataTooLarge.
+type smtpDataReader struct {
+	client *client
+	line   []byte // the unread part of the current line
+	size   int
+	crlf   bool  // the last line read ended with CRLF
+	err    error // io.EOF once the "." line has been read
+}
+
+func newSmtpDataReader(client *client) *smtpDataReader {
+	return &smtpDataReader{client: client, crlf: true}
+}
+
+func (r *smtpDataReader) Read(p []byte) (int, error) {
+	for len(r.line) == 0 {
+		if r.err != nil {
+			return 0, r.err
 		}
-	} else if strings.HasSuffix(client.subject, "\r\n") {
-		// chop off the \r\n
-		client.subject = client.subject[0 : len(client.subject)-2]
-		if (strings.HasPrefix(reply, " ")) || (strings.HasPrefix(reply, "\t")) {
-			// subject is multi-line
-			client.subject = client.subject + reply[1:]
+		r.readLine()
+	}
+	n := copy(p, r.line)
+	r.line = r.line[n:]
+	return n, nil
+}
+
+func (r *smtpDataReader) readLine() {
+	r.client.conn.SetDeadline(time.Now().Add(dataTimeout))
+	line, err := r.client.bufin.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// a long line, the rest of it comes next time
+		err = nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	atLineStart := r.crlf
+	r.crlf = bytes.HasSuffix(line, []byte("\r\n"))
+	if atLineStart && len(line) > 0 && line[0] == '.' {
+		if string(line) == ".\r\n" {
+			r.err = io.EOF
+			if r.size > maxSize {
+				r.err = errDataTooLarge
+			}
+			return
 		}
+		line = line[1:]
+	}
+	if err != nil {
+		r.err = err
+	}
+	r.size += len(line)
+	if r.size <= maxSize {
+		// ReadSlice's buffer is only good until the next read
+		r.line = append(r.line[:0], line...)
 	}
 }
 
+// Sends the reply. With PIPELINING, replies are held back while the
+// client has more commands on the way, RFC 2920 section 3.2.
 func responseWrite(client *client) (err error) {
 	var size int
-	client.conn.SetDeadline(time.Now().Add(timeout * time.Second))
+	client.conn.SetDeadline(time.Now().Add(commandTimeout))
 	size, err = client.bufout.WriteString(client.response)
-	client.bufout.Flush()
 	client.response = client.response[size:]
+	if err != nil {
+		return err
+	}
+	if client.bufin.Buffered() == 0 || client.state == stateData || client.killTime > 0 {
+		err = client.bufout.Flush()
+	}
 	return err
 }
 
+// MAIL FROM may be empty, for bounces
 func validateEmailData(client *client) error {
-	if client.mailFrom == "" {
-		return errors.New("Missing MAIL FROM")
-	}
 	if len(client.rcptTo) == 0 {
 		return errors.New("Missing RCPT TO")
 	}
-	for _, addr := range client.rcptTo {
-		// TODO check the hosts of the rcptTo addresses.
-		addr = addr // noop :P
-	}
 	return nil
 }
 
-func extractEmail(str string) string {
-	var email string
-	if matched := emailRegex.FindStringSubmatch(str); len(matched) > 1 {
-		email = strings.Trim(matched[1], " ")
+// Whether we take mail for addr: it has to be a user on one of the hosts
+// we serve, we don't relay. Returns the address as we store it, or the
+// SMTP reply refusing it.
+func checkRecipient(addr string) (string, string) {
+	token, host := splitAddress(strings.ToLower(addr))
+	if host != GetConfig().SmtpMxHost && !repo.ServesEmailHost(host) {
+		return "", "550 5.7.1 Relaying denied"
+	}
+	if repo.LoadPubHash(token, host) == "" {
+		return "", "550 5.1.1 No such user here"
+	}
+	return token + "@" + host, ""
+}
+
+// Splits "FROM:<alice@example.com> SIZE=1000" into the address and the
+// ESMTP parameters, RFC 5321 section 4.1.2. Returns false if it doesn't
+// start with prefix or the path is malformed.
+func parsePath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || strings.ToUpper(arg[:len(prefix)]) != prefix {
+		return "", nil, false
+	}
+	// a space after the colon isn't allowed, but common
+	arg = strings.TrimLeft(arg[len(prefix):], " ")
+	var path string
+	if strings.HasPrefix(arg, "<") {
+		end := strings.Index(arg, ">")
+		if end < 0 {
+			return "", nil, false
+		}
+		path, arg = arg[1:end], arg[end+1:]
 	} else {
-		email = strings.Trim(str, " ")
+		// no angle brackets isn't allowed either
+		fields := strings.SplitN(arg, " ", 2)
+		path, arg = fields[0], strings.Join(fields[1:], "")
+		if path == "" {
+			return "", nil, false
+		}
+	}
+	// drop source routes, "@relay1,@relay2:alice@example.com"
+	if strings.HasPrefix(path, "@") {
+		path = path[strings.Index(path, ":")+1:]
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Fields(arg) {
+		key, value := param, ""
+		if eq := strings.Index(param, "="); eq >= 0 {
+			key, value = param[:eq], param[eq+1:]
+		}
+		params[strings.ToUpper(key)] = value
 	}
-	if ok := validateAddressSafe(email); !ok {
-		return ""
+	return path, params, true
+}
+
+// With SMTPUTF8, RFC 6531, the sender may use any UTF-8 address
+func validateSenderAddress(addr string, params map[string]string) bool {
+	if _, ok := params["SMTPUTF8"]; ok && utf8.ValidString(addr) {
+		at := strings.LastIndex(addr, "@")
+		return at > 0 && at < len(addr)-1 && !strings.ContainsAny(addr, " \t\r\n<>")
 	}
+	return validateAddressSafe(addr)
+}
 
-	return email
+// Checks the MAIL FROM parameters of the extensions we offer.
+// Returns the SMTP reply refusing them, if any.
+func checkMailParams(params map[string]string) string {
+	for key, value := range params {
+		switch key {
+		case "SIZE":
+			// RFC 1870
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return "501 5.5.4 Bad SIZE parameter"
+			}
+			if size > maxSize {
+				return "552 5.3.4 Message size exceeds fixed maximum message size"
+			}
+		case "BODY":
+			// RFC 6152. Both are passed through as they are.
+			if value = strings.ToUpper(value); value != "7BIT" && value != "8BITMIME" {
+				return "555 5.5.4 Unsupported BODY type"
+			}
+		case "SMTPUTF8":
+			// RFC 6531
+			if value != "" {
+				return "501 5.5.4 SMTPUTF8 takes no value"
+			}
+		default:
+			return "555 5.5.4 Unsupported MAIL FROM parameter " + key
+		}
+	}
+	return ""
 }
 
 // Decode strings in Mime header format
@@ -658,7 +1269,7 @@ func computeThreadID(messageID EmailAddress, ancestorIDs EmailAddresses) EmailAd
 		for _, messageID := range ancestorIDs {
 			ancestors = append(ancestors, messageID.String())
 		}
-		threadIDs := LoadThreadIDsForMessageIDs(ancestors)
+		threadIDs := repo.LoadThreadIDsForMessageIDs(ancestors)
 		// This algo isn't perfect, but might be good enough.
 		for _, threadID := range threadIDs {
 			if threadID != "" {
@@ -5,8 +5,25 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,8 +49,719 @@ func TestSendEmail(t *testing.T) {
 
 	addrs := ParseEmailAddresses(email.To).FilterByHost(*testServer)
 	boxedEmail := &BoxedEmail{Email: *email}
-	err := smtpSendTo(boxedEmail, *testServer, addrs)
+	_, _, err := smtpSendTo(boxedEmail, *testServer, addrs, &tlsPolicy{Status: tlsStatusStartTls})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestOutboxBackoff(t *testing.T) {
+	retry := time.Duration(GetConfig().OutboxRetryMinutes) * time.Minute
+	maxRetry := time.Duration(GetConfig().OutboxMaxRetryMinutes) * time.Minute
+	if d := outboxBackoff(1); d != retry {
+		t.Errorf("outboxBackoff(1) = %v, should be %v", d, retry)
+	}
+	if d := outboxBackoff(3); d != 4*retry && d != maxRetry {
+		t.Errorf("outboxBackoff(3) = %v, should be %v", d, 4*retry)
+	}
+	if d := outboxBackoff(100); d != maxRetry {
+		t.Errorf("outboxBackoff(100) = %v, should be %v", d, maxRetry)
+	}
+}
+
+func TestIsTransientSmtpError(t *testing.T) {
+	if !isTransientSmtpError(&textproto.Error{Code: 451, Msg: "try again later"}) {
+		t.Error("451 should be transient")
+	}
+	if isTransientSmtpError(&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}) {
+		t.Error("550 should be permanent")
+	}
+	if !isTransientSmtpError(errors.New("connection refused")) {
+		t.Error("network errors should be transient")
+	}
+	for _, err := range []error{errNullMx, errNoSuchDomain, errNoMailHost} {
+		if isTransientSmtpError(err) {
+			t.Errorf("%v should be permanent", err)
+		}
+	}
+}
+
+func TestBounce(t *testing.T) {
+	tUser := ensureTestUser()
+	email := &Email{
+		EmailHeader: EmailHeader{
+			MessageID:     "bounced@" + GetConfig().SmtpMxHost,
+			ThreadID:      "bounced@" + GetConfig().SmtpMxHost,
+			UnixTime:      time.Now().Unix() - 10,
+			From:          tUser.EmailAddress,
+			To:            "nobody@example.com,later@example.com",
+			CipherSubject: "hello",
+		},
+		CipherBody: "hello body",
+	}
+	repo.SaveMessage(email)
+	repo.AddMessageToBox(email, tUser.EmailAddress, "sent")
+	failed := []*OutboxRecipient{
+		{0, "nobody@example.com", 1, "failed",
+			smtpErrorString(&textproto.Error{Code: 550, Msg: "5.1.1 no such user"})},
+	}
+	msg := &BoxedEmail{Email: *email, Address: "mx.example.com"}
+
+	data, err := parseSmtpData(strings.NewReader(composeBounce(msg, failed, false, time.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(data.textBody, "<nobody@example.com>: 550 5.1.1 no such user") {
+		t.Errorf("Bounce does not explain the failure:\n%s", data.textBody)
+	}
+	if data.threadID.String() != email.ThreadID {
+		t.Errorf("Bounce should be threaded with %s, got %s", email.ThreadID, data.threadID.String())
+	}
+	if status := bounceStatus(failed[0], false); status != "5.1.1" {
+		t.Errorf("bounceStatus() = %s, should be 5.1.1", status)
+	}
+
+	bounce(msg, failed, false)
+	thread := repo.LoadThreadFromBoxes(tUser.EmailAddress, email.ThreadID)
+	if len(thread) != 2 || thread[1].From != "mailer-daemon@"+GetConfig().SmtpMxHost {
+		t.Fatalf("Expected the bounce in the sender's thread, got %v", thread)
+	}
+	if boxes := repo.BoxesForMessage(tUser.EmailAddress, thread[1].MessageID); len(boxes) != 1 || boxes[0] != "inbox" {
+		t.Fatalf("Expected the bounce in the inbox, got %v", boxes)
+	}
+}
+
+func TestMxHostNames(t *testing.T) {
+	mxs := []*net.MX{
+		{Host: "alt2.mx.example.com.", Pref: 20},
+		{Host: "mx.example.com.", Pref: 5},
+		{Host: "alt1", Pref: 10},
+		{Host: "alt3.mx.example.com.", Pref: 20},
+	}
+	servers, err := mxHostNames("example.com", mxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mx.example.com", "alt1.example.com", "alt2.mx.example.com", "alt3.mx.example.com"}
+	if strings.Join(servers, ",") != strings.Join(expected, ",") {
+		t.Errorf("mxHostNames() returned %v, expected %v", servers, expected)
+	}
+
+	if _, err := mxHostNames("example.com", []*net.MX{{Host: ".", Pref: 0}}); err != errNullMx {
+		t.Errorf("a null MX should not resolve, got %v", err)
+	}
+}
+
+// Answers from a fixed table, counting the lookups that reach it
+type stubResolver struct {
+	mxs      map[string][]*net.MX
+	hosts    map[string]bool
+	nxdomain map[string]bool
+	ttl      time.Duration
+	lookups  int
+}
+
+func (r *stubResolver) LookupMX(host string) ([]*net.MX, time.Duration, error) {
+	r.lookups++
+	if r.nxdomain[host] {
+		return nil, 0, errNoSuchDomain
+	}
+	return r.mxs[host], r.ttl, nil
+}
+
+func (r *stubResolver) LookupHost(host string) ([]string, time.Duration, error) {
+	r.lookups++
+	if !r.hosts[host] {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []string{"192.0.2.1"}, r.ttl, nil
+}
+
+func TestMxCache(t *testing.T) {
+	resolver := &stubResolver{
+		mxs: map[string][]*net.MX{
+			"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+		},
+		hosts: map[string]bool{"plain.example.com": true},
+		ttl:   time.Minute,
+	}
+	now := time.Unix(1380000000, 0)
+	cache := NewMxCache(resolver)
+	cache.now = func() time.Time { return now }
+
+	servers, err := cache.Lookup("example.com")
+	if err != nil || strings.Join(servers, ",") != "mx1.example.com,mx2.example.com" {
+		t.Fatalf("Lookup(example.com) = %v, %v", servers, err)
+	}
+	cache.Lookup("example.com")
+	if resolver.lookups != 1 {
+		t.Errorf("Expected a cached answer, resolved %d times", resolver.lookups)
+	}
+	now = now.Add(2 * time.Minute)
+	cache.Lookup("example.com")
+	if resolver.lookups != 2 {
+		t.Errorf("Expected the answer to expire after its TTL, resolved %d times", resolver.lookups)
+	}
+
+	// no MX records, fall back to the address record
+	servers, err = cache.Lookup("plain.example.com")
+	if err != nil || len(servers) != 1 || servers[0] != "plain.example.com" {
+		t.Errorf("Lookup(plain.example.com) = %v, %v", servers, err)
+	}
+
+	// failures are cached too
+	resolver.lookups = 0
+	if _, err = cache.Lookup("nowhere.example.com"); err != errNoMailHost {
+		t.Errorf("Lookup(nowhere.example.com) = %v, expected %v", err, errNoMailHost)
+	}
+	cache.Lookup("nowhere.example.com")
+	if resolver.lookups != 2 {
+		t.Errorf("Expected the failure to be cached, resolved %d times", resolver.lookups)
+	}
+
+	if flushed := cache.Flush("nowhere.example.com"); flushed != 1 {
+		t.Errorf("Flush(nowhere.example.com) = %d, should be 1", flushed)
+	}
+	resolver.mxs["null.example.com"] = []*net.MX{{Host: ".", Pref: 0}}
+	resolver.nxdomain = map[string]bool{"gone.example.com": true}
+	for host, expected := range map[string]error{
+		"null.example.com": errNullMx,
+		"gone.example.com": errNoSuchDomain,
+	} {
+		if _, err = cache.Lookup(host); err != expected {
+			t.Errorf("Lookup(%s) = %v, expected %v", host, err, expected)
+		}
+	}
+
+	if flushed := cache.Flush(""); flushed != 4 {
+		t.Errorf("Flush() = %d, should be 4", flushed)
+	}
+}
+
+func TestDnsParseResponse(t *testing.T) {
+	query, err := dnsPackQuery(0x1234, "example.com", dnsTypeMX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the question echoed back, with one compressed MX answer:
+	// example.com. 300 IN MX 10 mx.example.com.
+	response := append([]byte{}, query[:len(query)-11]...)
+	response[2], response[3] = 0x81, 0xa0 // authentic data
+	response[7], response[11] = 1, 0
+	response = append(response,
+		0xc0, 12, // name: pointer to the question
+		0, dnsTypeMX, 0, dnsClassIN,
+		0, 0, 0x01, 0x2c, // ttl 300
+		0, 7, // rdlength
+		0, 10, // preference
+		2, 'm', 'x', 0xc0, 12)
+
+	answers, authenticated, err := dnsParseResponse(query, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !authenticated {
+		t.Error("dnsParseResponse() ignored the AD bit")
+	}
+	if len(answers) != 1 || answers[0].MX == nil {
+		t.Fatalf("dnsParseResponse() returned %v", answers)
+	}
+	if mx := answers[0].MX; mx.Host != "mx.example.com." || mx.Pref != 10 {
+		t.Errorf("Parsed MX %s %d, expected mx.example.com. 10", mx.Host, mx.Pref)
+	}
+	if ttl := dnsMinTTL(answers); ttl != 300*time.Second {
+		t.Errorf("dnsMinTTL() = %v, should be 5m", ttl)
+	}
+
+	// an answer to some other question is likely forged
+	for _, other := range [][]byte{
+		mustPackDnsQuery(t, 0x1234, "example.org", dnsTypeMX),
+		mustPackDnsQuery(t, 0x1234, "example.com", dnsTypeTLSA),
+		mustPackDnsQuery(t, 0x4321, "example.com", dnsTypeMX),
+	} {
+		if _, _, err = dnsParseResponse(other, response); err != errDnsMismatch {
+			t.Errorf("dnsParseResponse() = %v for another query, expected %v", err, errDnsMismatch)
+		}
+	}
+	if _, _, err = dnsParseResponse(mustPackDnsQuery(t, 0x1234, "EXAMPLE.com", dnsTypeMX), response); err != nil {
+		t.Errorf("dnsParseResponse() = %v, names should match regardless of case", err)
+	}
+
+	response[3] = 0x83 // NXDOMAIN
+	if _, _, err = dnsParseResponse(query, response); err != errDnsNXDomain {
+		t.Errorf("dnsParseResponse() = %v for NXDOMAIN, expected %v", err, errDnsNXDomain)
+	}
+}
+
+func mustPackDnsQuery(t *testing.T, id uint16, name string, qtype uint16) []byte {
+	query, err := dnsPackQuery(id, name, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestDnsExchangeTcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		length := make([]byte, 2)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err = io.ReadFull(conn, query); err != nil {
+			return
+		}
+		// the question echoed back, no answers
+		response := append([]byte{}, query[:len(query)-11]...)
+		response[2], response[3] = 0x81, 0x80
+		response[11] = 0
+		binary.BigEndian.PutUint16(length, uint16(len(response)))
+		conn.Write(append(length, response...))
+	}()
+
+	resolver := &dnsResolver{Timeout: 5 * time.Second}
+	query := mustPackDnsQuery(t, dnsQueryID(), "example.com", dnsTypeTLSA)
+	answers, _, err := resolver.exchange("tcp", listener.Addr().String(), query)
+	if err != nil || len(answers) != 0 {
+		t.Errorf("exchange() over TCP = %v, %v", answers, err)
+	}
+}
+
+// A self-signed certificate for the SMTP server
+func testTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: GetConfig().SmtpMxHost},
+		DNSNames:     []string{GetConfig().SmtpMxHost},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// Serves SMTP on a free loopback port. stop closes the listener and waits
+// for the clients it accepted, so none outlive the test. Close the client
+// connections first.
+func startTestSmtpServer(t *testing.T, implicitTls bool) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		handleClients(listener, implicitTls)
+		close(done)
+	}()
+	return listener.Addr().String(), func() {
+		listener.Close()
+		<-done
+	}
+}
+
+func TestSmtpServerTls(t *testing.T) {
+	configure()
+	tlsConfig = testTlsConfig(t)
+	clientTlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	// STARTTLS
+	addr, stop := startTestSmtpServer(t, false)
+	defer stop()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS should be advertised")
+	}
+	if err = c.StartTLS(clientTlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS should not be advertised once TLS is running")
+	}
+	if err = c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+	// implicit TLS
+	tlsAddr, stopTls := startTestSmtpServer(t, true)
+	defer stopTls()
+
+	conn, err := tls.Dial("tcp", tlsAddr, clientTlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err = smtp.NewClient(conn, GetConfig().SmtpMxHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS should not be advertised over implicit TLS")
+	}
+	if err = c.Quit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseSmtpDataAttachments(t *testing.T) {
+	data, err := parseSmtpData(strings.NewReader("From: bob@example.com\r\nTo: test@local.scramble.io\r\n" +
+		"Subject: files\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\nSee attached=2E\r\n" +
+		"--inner\r\nContent-Type: text/html\r\n\r\n<p>See attached.</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\nContent-Type: application/pdf; name=\"ignored.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"../report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQK\r\n" +
+		"--outer--\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(data.textBody) != "See attached." {
+		t.Errorf("Expected the plain text version, got %q", data.textBody)
+	}
+	if len(data.attachments) != 1 {
+		t.Fatalf("Expected one attachment and no html, got %d", len(data.attachments))
+	}
+	pdf := data.attachments[0]
+	if pdf.filename != "report.pdf" || pdf.contentType != "application/pdf" || string(pdf.content) != "%PDF-1.4\n" {
+		t.Errorf("Attachment parsed as %s %s %q", pdf.filename, pdf.contentType, pdf.content)
+	}
+
+	// without a text version, the html is kept
+	data, err = parseSmtpData(strings.NewReader("From: bob@example.com\r\nTo: test@local.scramble.io\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>Hi</p>\r\n--b--\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.attachments) != 1 || data.attachments[0].contentType != "text/html" {
+		t.Errorf("Expected the html version as an attachment, got %v", data.attachments)
+	}
+
+	// no Content-Type at all is plain text
+	data, err = parseSmtpData(strings.NewReader("From: bob@example.com\r\nTo: test@local.scramble.io\r\n\r\nHi\r\n"))
+	if err != nil || data.textBody != "Hi\r\n" {
+		t.Errorf("Expected a plain text body, got %q, %v", data.textBody, err)
+	}
+}
+
+func TestSmtpMultipartBody(t *testing.T) {
+	messageID := "attachments@" + GetConfig().SmtpMxHost
+	armored := "-----BEGIN PGP MESSAGE-----\n\nwcBMA\n-----END PGP MESSAGE-----"
+	repo.SaveAttachment(&Attachment{AttachmentHeader{1, "secret.pdf", "application/pdf", 0}, messageID, armored})
+	repo.SaveAttachment(&Attachment{AttachmentHeader{2, "plain.bin", "application/octet-stream", 0}, messageID, "\x00\x01binary"})
+
+	contentType, body := smtpMultipartBody(messageID, "text/plain", "the body", repo.LoadAttachmentHeaders(messageID))
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("smtpMultipartBody() returned Content-Type %s", contentType)
+	}
+	text, _, attachments, err := readMultipart(strings.NewReader(body), mediaType, params["boundary"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "the body" || len(attachments) != 2 {
+		t.Fatalf("Expected the body and two attachments, got %q and %d", text, len(attachments))
+	}
+	if attachments[0].filename != "secret.pdf.asc" || string(attachments[0].content) != armored {
+		t.Errorf("Encrypted attachment came out as %s %q", attachments[0].filename, attachments[0].content)
+	}
+	if attachments[1].filename != "plain.bin" || string(attachments[1].content) != "\x00\x01binary" {
+		t.Errorf("Plain attachment came out as %s %q", attachments[1].filename, attachments[1].content)
+	}
+}
+
+func TestPgpMime(t *testing.T) {
+	armored := "-----BEGIN PGP MESSAGE-----\n\nhQEMA\n-----END PGP MESSAGE-----"
+	armoredSubject := "-----BEGIN PGP MESSAGE-----\n\nhQEMB\n-----END PGP MESSAGE-----"
+
+	// what we send, with the subject for other Scramble servers
+	contentType, body := pgpMimeBody(armored)
+	subjectHeader := strings.Replace(fmt.Sprintf(cipherSubjectHeaderTemplate,
+		wrapLines(base64.StdEncoding.EncodeToString([]byte(armoredSubject)), 20)), "\r\n", "\r\n ", -1)
+	data, err := parseSmtpData(strings.NewReader("From: bob@example.com\r\nTo: test@local.scramble.io" + subjectHeader +
+		"\r\nSubject: Encrypted subject\r\nContent-Type: " + contentType + "\r\n\r\n" + body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.cipherBody != armored || data.cipherSubject != armoredSubject {
+		t.Errorf("Expected the armored body and subject, got %q and %q", data.cipherBody, data.cipherSubject)
+	}
+	if data.textBody != "" || len(data.attachments) != 0 {
+		t.Errorf("Expected nothing but the encrypted payload, got %q and %v", data.textBody, data.attachments)
+	}
+
+	// ...next to attachments
+	messageID := "pgpmime@" + GetConfig().SmtpMxHost
+	repo.SaveAttachment(&Attachment{AttachmentHeader{1, "a.txt", "text/plain", 0}, messageID, armored})
+	contentType, body = smtpMultipartBody(messageID, contentType, body, repo.LoadAttachmentHeaders(messageID))
+	data, err = parseSmtpData(strings.NewReader("From: bob@example.com\r\nTo: test@local.scramble.io\r\n" +
+		"Content-Type: " + contentType + "\r\n\r\n" + body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.cipherBody != armored || len(data.attachments) != 1 {
+		t.Errorf("Expected the encrypted payload and an attachment, got %q and %v", data.cipherBody, data.attachments)
+	}
+
+	// signed by Enigmail. The signed part must survive byte for byte.
+	signedPart := "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\nSigned=2E\r\n"
+	signature := "-----BEGIN PGP SIGNATURE-----\r\n\r\niQEcBAEBAgAG\r\n-----END PGP SIGNATURE-----\r\n"
+	data, err = parseSmtpData(strings.NewReader("From: bob@example.com\r\nTo: test@local.scramble.io\r\n" +
+		"Content-Type: multipart/signed; micalg=pgp-sha1;\r\n" +
+		" protocol=\"application/pgp-signature\"; boundary=\"sig\"\r\n\r\n" +
+		"This is an OpenPGP/MIME signed message (RFC 4880 and 3156)\r\n" +
+		"--sig\r\n" + signedPart + "\r\n--sig\r\n" +
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n\r\n" +
+		signature + "\r\n--sig--\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(data.textBody) != "Signed." || data.cipherBody != "" {
+		t.Errorf("Expected the signed text, got %q", data.textBody)
+	}
+	if len(data.attachments) != 2 {
+		t.Fatalf("Expected the signed part and the signature, got %d attachments", len(data.attachments))
+	}
+	if string(data.attachments[0].content) != signedPart {
+		t.Errorf("Signed part came out as %q", data.attachments[0].content)
+	}
+	if data.attachments[1].contentType != "application/pgp-signature" || string(data.attachments[1].content) != signature {
+		t.Errorf("Signature came out as %s %q", data.attachments[1].contentType, data.attachments[1].content)
+	}
+}
+
+func TestSmtpData(t *testing.T) {
+	configure()
+	tlsConfig = nil
+	defer func(size int) { maxSize = size }(maxSize)
+	maxSize = 1024
+	received := make(chan *SmtpMessage, 1)
+	saveMailChan := SaveMailChan
+	go func() {
+		for msg := range saveMailChan {
+			received <- msg
+			msg.saveSuccess <- true
+		}
+	}()
+
+	addr, stop := startTestSmtpServer(t, false)
+	defer stop()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	send := func(body string) error {
+		if err := c.Mail("bob@example.com"); err != nil {
+			return err
+		}
+		if err := c.Rcpt("test@" + GetConfig().SmtpMxHost); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		w.Write([]byte("From: bob@example.com\r\nTo: test@local.scramble.io\r\n\r\n" + body))
+		return w.Close()
+	}
+
+	// the client dot-stuffs, we unstuff
+	if err = send(".leading dot\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg.data.textBody != ".leading dot\r\n" || len(msg.rcptTo) != 1 {
+		t.Errorf("Expected the leading dot back for one recipient, got %q for %v", msg.data.textBody, msg.rcptTo)
+	}
+
+	// too large, but the session carries on
+	err = send(strings.Repeat("x", 2000) + "\r\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Expected a 552 reply for a message over the size limit, got %v", err)
+	}
+	if err = send("small\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	// declared too large up front
+	id, err := c.Text.Cmd("MAIL FROM:<bob@example.com> SIZE=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(552)
+	c.Text.EndResponse(id)
+	if err != nil {
+		t.Errorf("Expected MAIL FROM with a SIZE over the limit to be refused, got %v", err)
+	}
+}
+
+func TestSmtpRecipients(t *testing.T) {
+	configure()
+	tlsConfig = nil
+	addr, stop := startTestSmtpServer(t, false)
+	defer stop()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Mail("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for rcpt, status := range map[string]string{
+		"test@" + GetConfig().SmtpMxHost:   "",
+		"Test@" + GetConfig().SmtpMxHost:   "",
+		"nobody@" + GetConfig().SmtpMxHost: "5.1.1",
+		"alice@example.com":                "5.7.1",
+	} {
+		err = c.Rcpt(rcpt)
+		if status == "" && err != nil {
+			t.Errorf("RCPT TO:<%s> should be accepted, got %v", rcpt, err)
+		} else if reply, ok := err.(*textproto.Error); status != "" &&
+			(!ok || reply.Code != 550 || !strings.HasPrefix(reply.Msg, status)) {
+			t.Errorf("RCPT TO:<%s> should be refused with 550 %s, got %v", rcpt, status, err)
+		}
+	}
+
+	if err = c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	c.Mail("bob@example.com")
+	c.Rcpt("alice@example.com")
+	if _, err = c.Data(); err == nil || !strings.HasPrefix(err.Error(), "554") {
+		t.Errorf("DATA without recipients should be refused, got %v", err)
+	}
+}
+
+func TestSmtpStateMachine(t *testing.T) {
+	configure()
+	tlsConfig = nil
+	received := make(chan *SmtpMessage, 1)
+	saveMailChan := SaveMailChan
+	go func() {
+		for msg := range saveMailChan {
+			received <- msg
+			msg.saveSuccess <- true
+		}
+	}()
+
+	addr, stop := startTestSmtpServer(t, false)
+	defer stop()
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(code int, what string) string {
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("%s: expected %d, got %v", what, code, err)
+		}
+		return msg
+	}
+	expect(220, "greeting")
+	rcpt := "RCPT TO:<test@" + GetConfig().SmtpMxHost + ">"
+
+	// out of order
+	conn.PrintfLine("MAIL FROM:<bob@example.com>")
+	expect(503, "MAIL before EHLO")
+	conn.PrintfLine("EHLO client.example.com")
+	extensions := expect(250, "EHLO")
+	for _, extension := range []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "SMTPUTF8"} {
+		if !strings.Contains(extensions, "\n"+extension) {
+			t.Errorf("EHLO should advertise %s, got %q", extension, extensions)
+		}
+	}
+	conn.PrintfLine("%s", rcpt)
+	expect(503, "RCPT before MAIL")
+	conn.PrintfLine("DATA")
+	expect(503, "DATA before MAIL")
+	conn.PrintfLine("MAIL FROM:<bob@example.com> FOO=BAR")
+	expect(555, "unknown MAIL parameter")
+
+	// a pipelined bounce, with 8 bit text
+	conn.W.WriteString("MAIL FROM:<> BODY=8BITMIME\r\n" + rcpt + "\r\nDATA\r\n")
+	conn.W.Flush()
+	expect(250, "MAIL")
+	expect(250, "RCPT")
+	expect(354, "DATA")
+	conn.PrintfLine("From: mailer-daemon@example.com\r\nTo: test@local.scramble.io\r\n\r\nGrüße\r\n.")
+	expect(250, "end of DATA")
+	if msg := <-received; msg.mailFrom != "" || msg.data.textBody != "Grüße\r\n" {
+		t.Errorf("Expected a bounce with 8 bit text, got %q from %q", msg.data.textBody, msg.mailFrom)
+	}
+
+	conn.PrintfLine("MAIL FROM:<jörg@example.com>")
+	expect(501, "UTF-8 sender without SMTPUTF8")
+	conn.PrintfLine("MAIL FROM:<jörg@example.com> SMTPUTF8")
+	expect(250, "UTF-8 sender with SMTPUTF8")
+	conn.PrintfLine("MAIL FROM:<bob@example.com>")
+	expect(503, "nested MAIL")
+	conn.PrintfLine("RSET")
+	expect(250, "RSET")
+	conn.PrintfLine("QUIT")
+	expect(221, "QUIT")
+}
+
+func TestSmtpXclient(t *testing.T) {
+	configure()
+	tlsConfig = nil
+	addr, stop := startTestSmtpServer(t, false)
+	defer stop()
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	conn.PrintfLine("EHLO nginx")
+	if _, _, err = conn.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	// nginx forwarding a client it has no address for must not be trusted
+	conn.PrintfLine("XCLIENT ADDR=[UNAVAILABLE] NAME=[UNAVAILABLE]")
+	if _, _, err = conn.ReadResponse(550); err != nil {
+		t.Errorf("XCLIENT without a usable address: %v", err)
+	}
+}
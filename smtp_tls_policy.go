@@ -0,0 +1,442 @@
+/**
+ * Outbound TLS policies.
+ *
+ * By default we use STARTTLS whenever the other side offers it, without
+ * checking its certificate, and fall back to plaintext when it doesn't.
+ * Domains can ask for more:
+ *
+ * DANE (RFC 7672): DNSSEC signed TLSA records for the mx host pin its
+ * certificate. Only honored if our nameserver validates DNSSEC.
+ *
+ * MTA-STS (RFC 8461): the domain publishes a policy over HTTPS listing its
+ * mx hosts. In "enforce" mode, we only deliver to those hosts, over TLS with
+ * a certificate that is valid for the host name.
+ *
+ * Either way we refuse to downgrade. If the policy can't be met, the
+ * delivery fails temporarily and the next mx host gets a try.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a delivery was protected, weakest first. Stored in box.tls_status.
+const (
+	tlsStatusNone     = "none"     // plaintext
+	tlsStatusStartTls = "starttls" // encrypted, certificate not verified
+	tlsStatusMtaSts   = "mta-sts"  // certificate verified for an MTA-STS policy
+	tlsStatusDane     = "dane"     // certificate matched DNSSEC signed TLSA records
+)
+
+var tlsStatusStrength = map[string]int{
+	tlsStatusNone:     0,
+	tlsStatusStartTls: 1,
+	tlsStatusMtaSts:   2,
+	tlsStatusDane:     3,
+}
+
+// Returns the weaker of two tls statuses, ignoring ""
+func weakerTlsStatus(a, b string) string {
+	if a == "" || (b != "" && tlsStatusStrength[b] < tlsStatusStrength[a]) {
+		return b
+	}
+	return a
+}
+
+// How often we look at a domain's _mta-sts TXT record to see if its policy changed
+const mtaStsRecheck = time.Hour
+
+// Upper bound on max_age from RFC 8461, one year
+const mtaStsMaxAge = 31557600 * time.Second
+
+// DNS lookups needed for TLS policies, see dnsResolver
+type TlsPolicyResolver interface {
+	// Returns no records and no error if there are none.
+	LookupTXT(name string) ([]string, error)
+	// Also returns whether the answer, or the failure, is DNSSEC validated.
+	LookupTLSA(name string) ([]*tlsaRecord, bool, error)
+}
+
+// A TLSA record, see RFC 6698
+type tlsaRecord struct {
+	Usage        uint8 // 2 is DANE-TA, 3 is DANE-EE. SMTP ignores the PKIX usages
+	Selector     uint8 // 0 is the full certificate, 1 is its public key
+	MatchingType uint8 // 0 is exact, 1 is SHA-256, 2 is SHA-512
+	Data         []byte
+}
+
+// The TLS that a delivery to one mx host needs
+type tlsPolicy struct {
+	Status  string // what we record if the policy is met
+	Enforce bool   // refuse to deliver if the policy is not met
+
+	tlsa  []*tlsaRecord
+	roots *x509.CertPool // for MTA-STS, nil means the system roots
+}
+
+// Certificates are checked by verify() rather than crypto/tls, so that
+// unenforced policies can still use TLS with a certificate that fails.
+func (p *tlsPolicy) clientConfig(host string) *tls.Config {
+	return &tls.Config{ServerName: host, InsecureSkipVerify: true}
+}
+
+// Checks the certificates an mx host presented during STARTTLS.
+// Returns the status to record for the delivery.
+func (p *tlsPolicy) verify(host string, state tls.ConnectionState) (string, error) {
+	var err error
+	switch p.Status {
+	case tlsStatusDane:
+		err = verifyDane(host, p.tlsa, state.PeerCertificates)
+	case tlsStatusMtaSts:
+		err = verifyPkix(host, p.roots, state.PeerCertificates)
+	default:
+		return tlsStatusStartTls, nil
+	}
+	if err == nil {
+		return p.Status, nil
+	}
+	if p.Enforce {
+		return "", fmt.Errorf("%s policy for %s not met: %v", p.Status, host, err)
+	}
+	log.Printf("SMTP: %s policy for %s not met, delivering anyway (testing mode): %v\n",
+		p.Status, host, err)
+	return tlsStatusStartTls, nil
+}
+
+func verifyPkix(host string, roots *x509.CertPool, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// RFC 7672 section 3.1: a DANE-EE record must match the server's own
+// certificate, names and dates don't matter. A DANE-TA record must match a
+// certificate in the chain, which then acts as the only trusted root.
+func verifyDane(host string, records []*tlsaRecord, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate")
+	}
+	for _, record := range records {
+		switch record.Usage {
+		case 3:
+			if record.matches(certs[0]) {
+				return nil
+			}
+		case 2:
+			for _, cert := range certs[1:] {
+				if !record.matches(cert) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				if verifyPkix(host, roots, certs) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("no TLSA record matches the certificate")
+}
+
+func (record *tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch record.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch record.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, record.Data)
+}
+
+// Whether we can use the record at all. SMTP clients ignore PKIX-TA and PKIX-EE.
+func (record *tlsaRecord) usable() bool {
+	return (record.Usage == 2 || record.Usage == 3) &&
+		record.Selector <= 1 && record.MatchingType <= 2
+}
+
+//
+// MTA-STS
+//
+
+type mtaStsPolicy struct {
+	Id     string // from the _mta-sts TXT record
+	Mode   string // "enforce", "testing" or "none"
+	Mx     []string
+	MaxAge time.Duration
+
+	expires time.Time
+}
+
+// Parses https://mta-sts.<domain>/.well-known/mta-sts.txt
+func parseMtaStsPolicy(body string) (*mtaStsPolicy, error) {
+	policy := &mtaStsPolicy{}
+	version := ""
+	for _, line := range strings.Split(body, "\n") {
+		parts := strings.SplitN(strings.TrimRight(line, "\r"), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.Mx = append(policy.Mx, strings.ToLower(value))
+		case "max_age":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid max_age %q", value)
+			}
+			policy.MaxAge = time.Duration(seconds) * time.Second
+			if policy.MaxAge > mtaStsMaxAge {
+				policy.MaxAge = mtaStsMaxAge
+			}
+		}
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported version %q", version)
+	}
+	if policy.Mode != "enforce" && policy.Mode != "testing" && policy.Mode != "none" {
+		return nil, fmt.Errorf("invalid mode %q", policy.Mode)
+	}
+	if policy.Mode != "none" && len(policy.Mx) == 0 {
+		return nil, errors.New("no mx patterns")
+	}
+	return policy, nil
+}
+
+// Whether host matches one of the policy's mx patterns.
+// "*.example.com" matches "mx.example.com" but not "a.mx.example.com".
+func (policy *mtaStsPolicy) allowsMx(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range policy.Mx {
+		if strings.HasPrefix(pattern, "*.") {
+			suffix := pattern[1:]
+			label := strings.TrimSuffix(host, suffix)
+			if label != host && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// POLICY CACHE
+//
+
+// Looks up and caches the TLS policies of the domains we deliver to.
+// MTA-STS policies are kept for their max_age, and we only fetch them
+// again when the id in the _mta-sts TXT record changes.
+// Safe for concurrent use.
+type TlsPolicyCache struct {
+	resolver  TlsPolicyResolver
+	client    *http.Client
+	policyURL func(domain string) string
+	roots     *x509.CertPool // for verifying mx hosts, nil means the system roots
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*mtaStsEntry
+}
+
+type mtaStsEntry struct {
+	policy  *mtaStsPolicy // nil if the domain has none
+	checked time.Time
+}
+
+var tlsPolicies = NewTlsPolicyCache(systemResolver)
+
+func NewTlsPolicyCache(resolver TlsPolicyResolver) *TlsPolicyCache {
+	return &TlsPolicyCache{
+		resolver: resolver,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return errors.New("MTA-STS policies must not redirect")
+			},
+		},
+		policyURL: func(domain string) string {
+			return "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+		},
+		now:     time.Now,
+		entries: map[string]*mtaStsEntry{},
+	}
+}
+
+// Returns the TLS policy for delivering mail for domain to mxHost.
+// Fails if domain's MTA-STS policy doesn't allow mxHost at all.
+func (c *TlsPolicyCache) ForHost(domain, mxHost string) (*tlsPolicy, error) {
+	// DANE takes precedence over MTA-STS, see RFC 8461 section 2
+	records, authenticated, err := c.resolver.LookupTLSA("_25._tcp." + mxHost)
+	if err != nil {
+		// In a signed zone the records might be there, we can't tell, and
+		// RFC 7672 section 2.2 says to treat the host as unusable rather
+		// than fall back. Broken unsigned zones just don't have DANE.
+		if authenticated {
+			return nil, fmt.Errorf("TLSA lookup failed for %s: %v", mxHost, err)
+		}
+		log.Printf("SMTP: TLSA lookup failed for %s, going without DANE: %v\n", mxHost, err)
+	}
+	usable := []*tlsaRecord{}
+	for _, record := range records {
+		// unvalidated records are worthless
+		if authenticated && record.usable() {
+			usable = append(usable, record)
+		}
+	}
+	if len(usable) > 0 {
+		return &tlsPolicy{Status: tlsStatusDane, Enforce: true, tlsa: usable}, nil
+	}
+
+	policy := c.MtaSts(domain)
+	if policy == nil || policy.Mode == "none" {
+		return &tlsPolicy{Status: tlsStatusStartTls}, nil
+	}
+	enforce := policy.Mode == "enforce"
+	if !policy.allowsMx(mxHost) {
+		if enforce {
+			return nil, fmt.Errorf("%s is not an mx host in the MTA-STS policy of %s", mxHost, domain)
+		}
+		log.Printf("SMTP: %s is not an mx host in the MTA-STS policy of %s (testing mode)\n",
+			mxHost, domain)
+	}
+	return &tlsPolicy{Status: tlsStatusMtaSts, Enforce: enforce, roots: c.roots}, nil
+}
+
+// Returns the current MTA-STS policy for domain, or nil if it has none.
+func (c *TlsPolicyCache) MtaSts(domain string) *mtaStsPolicy {
+	now := c.now()
+	c.mu.Lock()
+	entry := c.entries[domain]
+	c.mu.Unlock()
+	if entry != nil && now.Sub(entry.checked) < mtaStsRecheck {
+		return entry.live(now)
+	}
+
+	var cached *mtaStsPolicy
+	if entry != nil {
+		cached = entry.live(now)
+	}
+	id, err := c.lookupMtaStsId(domain)
+	switch {
+	case err != nil:
+		// keep using the cached policy until it expires, RFC 8461 section 5.1
+		log.Printf("MTA-STS lookup failed for %s: %v\n", domain, err)
+	case id == "":
+		// the domain may have dropped MTA-STS, but a cached policy still holds
+	case cached != nil && cached.Id == id:
+		// unchanged
+	default:
+		policy, err := c.fetchMtaSts(domain)
+		if err != nil {
+			log.Printf("MTA-STS policy fetch failed for %s: %v\n", domain, err)
+			break
+		}
+		policy.Id = id
+		policy.expires = now.Add(policy.MaxAge)
+		cached = policy
+	}
+
+	c.mu.Lock()
+	c.entries[domain] = &mtaStsEntry{cached, now}
+	c.mu.Unlock()
+	return cached
+}
+
+func (entry *mtaStsEntry) live(now time.Time) *mtaStsPolicy {
+	if entry.policy == nil || !now.Before(entry.policy.expires) {
+		return nil
+	}
+	return entry.policy
+}
+
+// Returns the id from the _mta-sts TXT record, "" if there is none
+func (c *TlsPolicyCache) lookupMtaStsId(domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return "", err
+	}
+	id := ""
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		if id != "" {
+			// more than one record means no record, RFC 8461 section 3.1
+			return "", nil
+		}
+		for _, field := range strings.Split(txt, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = field[3:]
+			}
+		}
+	}
+	return id, nil
+}
+
+func (c *TlsPolicyCache) fetchMtaSts(domain string) (*mtaStsPolicy, error) {
+	resp, err := c.client.Get(c.policyURL(domain))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/plain" {
+		return nil, fmt.Errorf("unexpected Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	return parseMtaStsPolicy(string(body))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubTlsResolver struct {
+	txt      map[string][]string
+	tlsa     map[string][]*tlsaRecord
+	tlsaErr  map[string]error
+	insecure map[string]bool // TLSA answers that aren't DNSSEC validated
+}
+
+func (r *stubTlsResolver) LookupTXT(name string) ([]string, error) {
+	return r.txt[name], nil
+}
+
+func (r *stubTlsResolver) LookupTLSA(name string) ([]*tlsaRecord, bool, error) {
+	return r.tlsa[name], !r.insecure[name], r.tlsaErr[name]
+}
+
+func TestParseMtaStsPolicy(t *testing.T) {
+	policy, err := parseMtaStsPolicy("version: STSv1\r\nmode: enforce\r\n" +
+		"mx: mx1.example.com\r\nmx: *.mx.example.net\r\nmax_age: 86400\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Mode != "enforce" || policy.MaxAge != 24*time.Hour || len(policy.Mx) != 2 {
+		t.Fatalf("parseMtaStsPolicy() returned %v", policy)
+	}
+	for host, allowed := range map[string]bool{
+		"mx1.example.com":     true,
+		"MX1.example.com":     true,
+		"mx2.example.com":     false,
+		"a.mx.example.net":    true,
+		"a.b.mx.example.net":  false,
+		"mx.example.net":      false,
+		"evilmx.example.net":  false,
+		"a.mx.example.net.io": false,
+	} {
+		if policy.allowsMx(host) != allowed {
+			t.Errorf("allowsMx(%s) should be %v", host, allowed)
+		}
+	}
+
+	if _, err = parseMtaStsPolicy("version: STSv2\nmode: enforce\nmx: a\nmax_age: 1\n"); err == nil {
+		t.Error("parseMtaStsPolicy() should reject unknown versions")
+	}
+	if _, err = parseMtaStsPolicy("version: STSv1\nmode: enforce\nmax_age: 1\n"); err == nil {
+		t.Error("parseMtaStsPolicy() should require mx patterns")
+	}
+}
+
+func TestTlsPolicyCache(t *testing.T) {
+	// a local stand-in for https://mta-sts.example.com/.well-known/mta-sts.txt
+	mode := "enforce"
+	fetches := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("version: STSv1\nmode: " + mode + "\nmx: *.example.com\nmax_age: 86400\n"))
+	}))
+	defer server.Close()
+
+	resolver := &stubTlsResolver{
+		txt:  map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=1"}},
+		tlsa: map[string][]*tlsaRecord{},
+	}
+	now := time.Unix(1380000000, 0)
+	cache := NewTlsPolicyCache(resolver)
+	cache.client = server.Client()
+	cache.policyURL = func(domain string) string {
+		return server.URL + "/" + domain
+	}
+	cache.now = func() time.Time { return now }
+
+	policy, err := cache.ForHost("example.com", "mx1.example.com")
+	if err != nil || policy.Status != tlsStatusMtaSts || !policy.Enforce {
+		t.Fatalf("ForHost() = %v, %v, expected an enforced MTA-STS policy", policy, err)
+	}
+	if _, err = cache.ForHost("example.com", "mx.elsewhere.com"); err == nil {
+		t.Error("ForHost() should refuse mx hosts that aren't in the policy")
+	}
+
+	// same id, no need to fetch again
+	now = now.Add(2 * mtaStsRecheck)
+	cache.MtaSts("example.com")
+	if fetches != 1 {
+		t.Errorf("Expected the policy to be cached, fetched %d times", fetches)
+	}
+
+	// new id, new policy
+	mode = "testing"
+	resolver.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	now = now.Add(2 * mtaStsRecheck)
+	policy, err = cache.ForHost("example.com", "mx.elsewhere.com")
+	if err != nil || policy.Enforce || fetches != 2 {
+		t.Errorf("ForHost() = %v, %v after %d fetches, expected a policy in testing mode",
+			policy, err, fetches)
+	}
+
+	// no TXT record, the cached policy still holds until max_age
+	delete(resolver.txt, "_mta-sts.example.com")
+	now = now.Add(2 * mtaStsRecheck)
+	if cache.MtaSts("example.com") == nil {
+		t.Error("MtaSts() should keep a policy until it expires")
+	}
+	now = now.Add(48 * time.Hour)
+	if cache.MtaSts("example.com") != nil {
+		t.Error("MtaSts() returned an expired policy")
+	}
+
+	// no policy at all
+	policy, err = cache.ForHost("example.org", "mx.example.org")
+	if err != nil || policy.Status != tlsStatusStartTls || policy.Enforce {
+		t.Errorf("ForHost() = %v, %v, expected opportunistic TLS", policy, err)
+	}
+
+	// DANE wins over MTA-STS
+	resolver.tlsa["_25._tcp.mx.example.org"] = []*tlsaRecord{{3, 1, 1, make([]byte, 32)}}
+	policy, err = cache.ForHost("example.org", "mx.example.org")
+	if err != nil || policy.Status != tlsStatusDane || !policy.Enforce {
+		t.Errorf("ForHost() = %v, %v, expected DANE", policy, err)
+	}
+
+	// a failed TLSA lookup in a signed zone must not downgrade to
+	// MTA-STS or plain STARTTLS
+	resolver.tlsaErr = map[string]error{"_25._tcp.mx2.example.org": errors.New("SERVFAIL")}
+	policy, err = cache.ForHost("example.org", "mx2.example.org")
+	if err == nil || !isTransientSmtpError(err) {
+		t.Errorf("ForHost() = %v, %v, expected a temporary failure", policy, err)
+	}
+	// in an unsigned zone, there is no DANE to downgrade from
+	resolver.insecure = map[string]bool{"_25._tcp.mx2.example.org": true}
+	policy, err = cache.ForHost("example.org", "mx2.example.org")
+	if err != nil || policy.Status != tlsStatusStartTls {
+		t.Errorf("ForHost() = %v, %v, expected opportunistic TLS", policy, err)
+	}
+	// and unvalidated records don't count
+	resolver.insecure["_25._tcp.mx.example.org"] = true
+	policy, err = cache.ForHost("example.org", "mx.example.org")
+	if err != nil || policy.Status != tlsStatusStartTls {
+		t.Errorf("ForHost() = %v, %v, expected unvalidated TLSA records to be ignored", policy, err)
+	}
+}
+
+func TestVerifyDane(t *testing.T) {
+	cert, err := x509.ParseCertificate(testTlsConfig(t).Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	good := &tlsaRecord{3, 1, 1, spkiHash[:]}
+	bad := &tlsaRecord{3, 1, 1, make([]byte, 32)}
+	certs := []*x509.Certificate{cert}
+
+	if err = verifyDane("mx.example.com", []*tlsaRecord{bad, good}, certs); err != nil {
+		t.Errorf("verifyDane() failed for a matching DANE-EE record: %v", err)
+	}
+	if err = verifyDane("mx.example.com", []*tlsaRecord{bad}, certs); err == nil {
+		t.Error("verifyDane() accepted a certificate that matches no record")
+	}
+	full := &tlsaRecord{3, 0, 0, cert.Raw}
+	if err = verifyDane("mx.example.com", []*tlsaRecord{full}, certs); err != nil {
+		t.Errorf("verifyDane() failed for a full certificate record: %v", err)
+	}
+}
+
+func TestSmtpSendToTlsPolicy(t *testing.T) {
+	configure()
+	tlsConfig = nil
+	saveMailChan := SaveMailChan
+	go func() {
+		for msg := range saveMailChan {
+			msg.saveSuccess <- true
+		}
+	}()
+
+	addr, stop := startTestSmtpServer(t, false)
+	defer stop()
+	_, port, _ := net.SplitHostPort(addr)
+	defer func(port string) { remoteSmtpPort = port }(remoteSmtpPort)
+	remoteSmtpPort = port
+
+	email := &BoxedEmail{Email: Email{
+		EmailHeader: EmailHeader{
+			MessageID:     "tls@local.scramble.io",
+			ThreadID:      "tls@local.scramble.io",
+			UnixTime:      time.Now().Unix(),
+			From:          "alice@local.scramble.io",
+			To:            "bob@example.com",
+			CipherSubject: "hello",
+		},
+		CipherBody: "hello world",
+	}}
+	addrs := ParseEmailAddresses(email.To)
+	send := func(policy *tlsPolicy) (string, error) {
+		_, tlsStatus, err := smtpSendTo(email, "127.0.0.1", addrs, policy)
+		return tlsStatus, err
+	}
+
+	// no STARTTLS on offer
+	if status, err := send(&tlsPolicy{Status: tlsStatusStartTls}); err != nil || status != tlsStatusNone {
+		t.Errorf("Opportunistic delivery without TLS returned %s, %v", status, err)
+	}
+	_, err := send(&tlsPolicy{Status: tlsStatusMtaSts, Enforce: true})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Expected an enforced policy to refuse plaintext, got %v", err)
+	}
+	if !isTransientSmtpError(err) {
+		t.Error("An unmet TLS policy should be a temporary failure")
+	}
+
+	// STARTTLS with a certificate pinned by DANE
+	tlsConfig = testTlsConfig(t)
+	cert, _ := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	dane := &tlsPolicy{Status: tlsStatusDane, Enforce: true, tlsa: []*tlsaRecord{{3, 1, 1, spkiHash[:]}}}
+	if status, err := send(dane); err != nil || status != tlsStatusDane {
+		t.Errorf("DANE delivery returned %s, %v", status, err)
+	}
+	dane.tlsa[0].Data = make([]byte, 32)
+	if _, err := send(dane); err == nil {
+		t.Error("Expected delivery to fail when the certificate doesn't match the TLSA records")
+	}
+
+	// MTA-STS in testing mode delivers even though the certificate isn't trusted
+	testingMode := &tlsPolicy{Status: tlsStatusMtaSts, Enforce: false}
+	if status, err := send(testingMode); err != nil || status != tlsStatusStartTls {
+		t.Errorf("MTA-STS testing mode delivery returned %s, %v", status, err)
+	}
+}
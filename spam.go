@@ -0,0 +1,356 @@
+/**
+ * Scores inbound mail for spam.
+ *
+ * Plaintext mail is encrypted for the recipients as soon as it arrives,
+ * so this is the only chance anyone but them gets to look at it. Each
+ * SpamFilter adds points, mail with Config.SpamThreshold or more goes
+ * to the "spam" box instead of the inbox.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// One step of the spam pipeline
+type SpamFilter interface {
+	// Returns the points to add, negative if msg looks legitimate, and
+	// the reasons for them. text is the plaintext subject and body, ""
+	// if the message arrived encrypted.
+	Score(msg *SmtpMessage, text string) (float64, []string)
+}
+
+var bayesFilter = new(bayesSpamFilter)
+
+var spamFilters = []SpamFilter{
+	headerSpamFilter{},
+	authSpamFilter{},
+	bayesFilter,
+}
+
+// Runs msg through spamFilters. Returns its score and whether it's spam.
+// Only mail received from other hosts is scored, see isTrustedClient.
+func scoreSpam(msg *SmtpMessage, text string) (float64, bool) {
+	if msg.auth == nil {
+		return 0, false
+	}
+	score, reasons := 0.0, []string{}
+	for _, filter := range spamFilters {
+		points, why := filter.Score(msg, text)
+		score += points
+		reasons = append(reasons, why...)
+	}
+	isSpam := score >= GetConfig().SpamThreshold
+	log.Printf("Spam score %.1f for %s, spam=%v: %s\n",
+		score, msg.data.messageID.String(), isSpam, strings.Join(reasons, ", "))
+	return score, isSpam
+}
+
+//
+// HEADERS
+//
+
+// Things legitimate mail software doesn't do
+type headerSpamFilter struct{}
+
+func (headerSpamFilter) Score(msg *SmtpMessage, text string) (float64, []string) {
+	score, reasons := 0.0, []string{}
+	add := func(points float64, reason string) {
+		score += points
+		reasons = append(reasons, reason)
+	}
+	header := msg.data.header
+
+	if header.Get("Message-ID") == "" {
+		add(1.0, "no Message-ID")
+	}
+	if date, err := header.Date(); err != nil {
+		add(1.0, "no valid Date")
+	} else if date.After(time.Unix(msg.time, 0).Add(24 * time.Hour)) {
+		add(1.5, "Date in the future")
+	}
+
+	subject := msg.data.subject
+	if strings.TrimSpace(subject) == "" {
+		add(0.5, "no Subject")
+	} else if isShouting(subject) {
+		add(1.5, "Subject in capitals")
+	}
+
+	// "PayPal <service@paypal.com>" <phish@example.org>
+	from := msg.data.from
+	if strings.Contains(from.Name, "@") && !strings.Contains(strings.ToLower(from.Name), strings.ToLower(from.Address)) {
+		add(2.0, "address in From name")
+	}
+	if replyTo, err := mail.ParseAddress(header.Get("Reply-To")); err == nil {
+		_, fromDomain := splitAddress(strings.ToLower(from.Address))
+		_, replyDomain := splitAddress(strings.ToLower(replyTo.Address))
+		if orgDomain(fromDomain) != orgDomain(replyDomain) {
+			add(0.5, "Reply-To elsewhere")
+		}
+	}
+
+	if len(msg.data.toList)+len(msg.data.ccList) > 20 {
+		add(1.0, "many recipients")
+	}
+	if msg.data.textBody == "" && msg.data.cipherBody == "" {
+		for _, part := range msg.data.attachments {
+			if part.contentType == "text/html" {
+				add(1.0, "HTML only")
+				break
+			}
+		}
+	}
+	return score, reasons
+}
+
+// "FREE VIAGRA!!!", but not "RE: FYI"
+func isShouting(subject string) bool {
+	upper, lower := 0, 0
+	for _, r := range subject {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	return upper >= 8 && lower == 0
+}
+
+//
+// SENDER AUTHENTICATION
+//
+
+// Points for the SPF, DKIM and DMARC verdicts, see authenticateSender.
+// DMARC fail with p=reject never gets here.
+var spamAuthPoints = map[string]map[string]float64{
+	"spf": {
+		spfPass:     -0.5,
+		spfFail:     2.0,
+		spfSoftFail: 1.0,
+		spfNone:     0.5,
+	},
+	"dkim": {
+		dkimPass: -0.5,
+		dkimFail: 1.5,
+	},
+	"dmarc": {
+		dmarcPass: -1.0,
+		dmarcFail: 3.0,
+	},
+}
+
+type authSpamFilter struct{}
+
+func (authSpamFilter) Score(msg *SmtpMessage, text string) (float64, []string) {
+	score, reasons := 0.0, []string{}
+	for _, result := range []struct{ method, verdict string }{
+		{"spf", msg.auth.Spf},
+		{"dkim", msg.auth.Dkim},
+		{"dmarc", msg.auth.Dmarc},
+	} {
+		if points := spamAuthPoints[result.method][result.verdict]; points != 0 {
+			score += points
+			reasons = append(reasons, result.method+"="+result.verdict)
+		}
+	}
+	return score, reasons
+}
+
+//
+// BAYES
+//
+
+// Word counts from mail known to be spam or not, see Config.SpamBayesModel
+type BayesModel struct {
+	SpamMessages int
+	HamMessages  int
+	Tokens       map[string][2]int // token -> spam count, ham count
+}
+
+// Most points the model can add, or take away
+const bayesMaxPoints = 4.0
+
+// Tokens with the strongest opinion that get a say, as in Graham's
+// "A Plan for Spam"
+const bayesInterestingTokens = 15
+
+// Scores plaintext against the model at Config.SpamBayesModel, if any
+type bayesSpamFilter struct {
+	mu    sync.Mutex
+	path  string
+	model *BayesModel
+}
+
+func (f *bayesSpamFilter) Score(msg *SmtpMessage, text string) (float64, []string) {
+	model := f.loadModel()
+	if model == nil || text == "" {
+		return 0, nil
+	}
+	probability := model.SpamProbability(text)
+	points := (probability*2 - 1) * bayesMaxPoints
+	return points, []string{fmt.Sprintf("bayes=%.2f", probability)}
+}
+
+// Loads the model again whenever the configured path changes.
+// Returns nil if there is none.
+func (f *bayesSpamFilter) loadModel() *BayesModel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loadModelLocked()
+}
+
+func (f *bayesSpamFilter) loadModelLocked() *BayesModel {
+	path := GetConfig().SpamBayesModel
+	if path == f.path {
+		return f.model
+	}
+	f.path, f.model = path, nil
+	if path == "" {
+		return nil
+	}
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Can't read spam model %s: %v\n", path, err)
+		return nil
+	}
+	model := new(BayesModel)
+	if err = json.Unmarshal(jsonBytes, model); err != nil {
+		log.Printf("Can't parse spam model %s: %v\n", path, err)
+		return nil
+	}
+	f.model = model
+	return model
+}
+
+// Counts text as spam, or not, and saves the model for the next start.
+// Scoring goes on with the old model until the new one is complete.
+// Does nothing without Config.SpamBayesModel. A model that can't be read
+// is started over.
+func (f *bayesSpamFilter) Train(text string, spam bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := GetConfig().SpamBayesModel
+	if path == "" || text == "" {
+		return nil
+	}
+	model := new(BayesModel)
+	if current := f.loadModelLocked(); current != nil {
+		model = current.copy()
+	}
+	model.Train(text, spam)
+
+	jsonBytes, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	// a crash halfway through leaves the old model, not half of one
+	if err = ioutil.WriteFile(path+".tmp", jsonBytes, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	f.model = model
+	return nil
+}
+
+func (m *BayesModel) copy() *BayesModel {
+	c := *m
+	c.Tokens = make(map[string][2]int, len(m.Tokens))
+	for token, counts := range m.Tokens {
+		c.Tokens[token] = counts
+	}
+	return &c
+}
+
+// Counts the tokens of a message known to be spam, or not
+func (m *BayesModel) Train(text string, spam bool) {
+	if m.Tokens == nil {
+		m.Tokens = map[string][2]int{}
+	}
+	if spam {
+		m.SpamMessages++
+	} else {
+		m.HamMessages++
+	}
+	for token := range bayesTokens(text) {
+		counts := m.Tokens[token]
+		if spam {
+			counts[0]++
+		} else {
+			counts[1]++
+		}
+		m.Tokens[token] = counts
+	}
+}
+
+// Combines the probabilities of the most interesting tokens in text.
+// Returns 0.5 if the model doesn't know enough of them.
+func (m *BayesModel) SpamProbability(text string) float64 {
+	if m.SpamMessages == 0 || m.HamMessages == 0 {
+		return 0.5
+	}
+	type tokenProbability struct {
+		token string
+		p     float64
+	}
+	var probabilities []tokenProbability
+	for token := range bayesTokens(text) {
+		counts, ok := m.Tokens[token]
+		if !ok || counts[0]+counts[1] < 2 {
+			continue
+		}
+		spamFreq := float64(counts[0]) / float64(m.SpamMessages)
+		hamFreq := float64(counts[1]) / float64(m.HamMessages)
+		p := spamFreq / (spamFreq + hamFreq)
+		probabilities = append(probabilities, tokenProbability{token, math.Min(0.99, math.Max(0.01, p))})
+	}
+	// ties go by token, the map gives them in a different order every time
+	sort.Slice(probabilities, func(i, j int) bool {
+		a, b := math.Abs(probabilities[i].p-0.5), math.Abs(probabilities[j].p-0.5)
+		if a != b {
+			return a > b
+		}
+		return probabilities[i].token < probabilities[j].token
+	})
+	if len(probabilities) > bayesInterestingTokens {
+		probabilities = probabilities[:bayesInterestingTokens]
+	}
+	if len(probabilities) == 0 {
+		return 0.5
+	}
+	// in log space, long messages would underflow
+	logSpam, logHam := 0.0, 0.0
+	for _, tp := range probabilities {
+		logSpam += math.Log(tp.p)
+		logHam += math.Log(1 - tp.p)
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
+
+// The distinct lowercase words in text, ignoring very short and very long ones
+func bayesTokens(text string) map[string]bool {
+	tokens := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\'' && r != '-'
+	})
+	for _, word := range words {
+		if len(word) >= 3 && len(word) <= 20 {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func spamTestMessage(t *testing.T, raw string, auth *SenderAuth) *SmtpMessage {
+	data, err := parseSmtpData(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SmtpMessage{
+		time:     time.Now().Unix(),
+		mailFrom: data.from.Address,
+		rcptTo:   []string{"test@" + GetConfig().SmtpMxHost},
+		data:     *data,
+		auth:     auth,
+	}
+}
+
+func TestSpamFilters(t *testing.T) {
+	tUser := ensureTestUser()
+	date := time.Now().Format(time.RFC1123Z)
+	ham := spamTestMessage(t, "From: Bob <bob@example.com>\r\nTo: "+tUser.EmailAddress+"\r\n"+
+		"Date: "+date+"\r\nMessage-ID: <ham@example.com>\r\nSubject: Lunch?\r\n\r\nTomorrow at noon?\r\n",
+		&SenderAuth{Spf: spfPass, Dkim: dkimPass, Dmarc: dmarcPass})
+	if score, isSpam := scoreSpam(ham, "Lunch?\nTomorrow at noon?"); score >= 0 || isSpam {
+		t.Errorf("scoreSpam() = %.1f, %v for authenticated mail", score, isSpam)
+	}
+
+	raw := "From: \"service@paypal.com\" <phish@example.org>\r\nTo: " + tUser.EmailAddress + "\r\n" +
+		"Subject: VERIFY YOUR ACCOUNT NOW\r\n\r\nClick here\r\n"
+	spam := spamTestMessage(t, raw, &SenderAuth{Spf: spfSoftFail, Dkim: dkimNone, Dmarc: dmarcFail})
+	score, isSpam := scoreSpam(spam, "")
+	if !isSpam || score < GetConfig().SpamThreshold {
+		t.Errorf("scoreSpam() = %.1f, %v for a phish", score, isSpam)
+	}
+
+	// our own bounces, and mail relayed from this host, aren't scored
+	local := spamTestMessage(t, raw, nil)
+	if score, isSpam := scoreSpam(local, ""); score != 0 || isSpam {
+		t.Errorf("scoreSpam() = %.1f, %v for mail we didn't receive", score, isSpam)
+	}
+
+	if err := deliverMailLocally(spam); err != nil {
+		t.Fatal(err)
+	}
+	id := spam.data.messageID.String()
+	if boxes := repo.BoxesForMessage(tUser.EmailAddress, id); len(boxes) != 1 || boxes[0] != "spam" {
+		t.Fatalf("Expected the phish in the spam box, got %v", boxes)
+	}
+	if email := repo.LoadMessage(id); email.SpamScore != score {
+		t.Errorf("Saved spam score %.1f, expected %.1f", email.SpamScore, score)
+	}
+}
+
+func TestBayesModel(t *testing.T) {
+	model := new(BayesModel)
+	for _, text := range []string{
+		"cheap pills online, buy now",
+		"buy cheap watches now",
+		"winner! claim your cheap prize now",
+	} {
+		model.Train(text, true)
+	}
+	for _, text := range []string{
+		"are we still on for lunch tomorrow",
+		"the meeting notes from tomorrow's review",
+		"lunch at noon, see the notes",
+	} {
+		model.Train(text, false)
+	}
+	if p := model.SpamProbability("buy cheap now"); p < 0.9 {
+		t.Errorf("SpamProbability() = %.2f for spam", p)
+	}
+	if p := model.SpamProbability("notes for lunch tomorrow"); p > 0.1 {
+		t.Errorf("SpamProbability() = %.2f for ham", p)
+	}
+	if p := model.SpamProbability("something else entirely"); p != 0.5 {
+		t.Errorf("SpamProbability() = %.2f for unknown words", p)
+	}
+
+	dir, err := ioutil.TempDir("", "scramble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bayes.json")
+	jsonBytes, _ := json.Marshal(model)
+	if err = ioutil.WriteFile(path, jsonBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c Config) { config = c }(config)
+	filter := new(bayesSpamFilter)
+	if points, _ := filter.Score(nil, "buy cheap now"); points != 0 {
+		t.Errorf("Score() = %.1f without a model", points)
+	}
+	config.SpamBayesModel = path
+	if points, _ := filter.Score(nil, "buy cheap now"); points <= 0 {
+		t.Errorf("Score() = %.1f for spam", points)
+	}
+	if points, _ := filter.Score(nil, ""); points != 0 {
+		t.Errorf("Score() = %.1f for encrypted mail", points)
+	}
+}
+
+func TestBayesTies(t *testing.T) {
+	// as sure about each token, so which ones count decides the outcome
+	model := &BayesModel{SpamMessages: 1, HamMessages: 1, Tokens: map[string][2]int{}}
+	words := []string{}
+	for i := 0; i < 2*bayesInterestingTokens; i++ {
+		word := fmt.Sprintf("word%02d", i)
+		if i%3 == 0 {
+			model.Tokens[word] = [2]int{2, 0}
+		} else {
+			model.Tokens[word] = [2]int{0, 2}
+		}
+		words = append(words, word)
+	}
+	text := strings.Join(words, " ")
+	expected := model.SpamProbability(text)
+	for i := 0; i < 20; i++ {
+		if p := model.SpamProbability(text); p != expected {
+			t.Fatalf("SpamProbability() = %v, then %v for the same text", expected, p)
+		}
+	}
+}
+
+func TestBayesTraining(t *testing.T) {
+	tUser := ensureTestUser()
+	dir, err := ioutil.TempDir("", "scramble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bayes.json")
+	defer func(c Config) { config = c }(config)
+	config.SpamBayesModel = path
+	defer func(f *bayesSpamFilter) { bayesFilter = f }(bayesFilter)
+	bayesFilter = new(bayesSpamFilter)
+
+	// "Not Spam" on mail the filters got wrong
+	email := testEmail("ham@"+GetConfig().SmtpMxHost, "ham@"+GetConfig().SmtpMxHost, 200)
+	repo.SaveMessage(email)
+	repo.AddMessageToBox(email, tUser.EmailAddress, "spam")
+	record := requestAsTestUser(emailHandler, "PUT", "/email/"+email.MessageID,
+		url.Values{"box": {"inbox"}, "plaintext": {"Lunch\nare we still on for lunch tomorrow"}})
+	if record.Code != http.StatusOK {
+		t.Fatalf("PUT /email/id returned %d %s", record.Code, record.Body.String())
+	}
+	// moving it around the inbox and archive says nothing about it
+	requestAsTestUser(emailHandler, "PUT", "/email/"+email.MessageID,
+		url.Values{"box": {"archive"}, "plaintext": {"Lunch\nare we still on for lunch tomorrow"}})
+	requestAsTestUser(emailHandler, "PUT", "/email/"+email.MessageID,
+		url.Values{"box": {"spam"}, "plaintext": {"Cheap pills\nbuy cheap pills now"}})
+
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := new(BayesModel)
+	if err = json.Unmarshal(jsonBytes, saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.SpamMessages != 1 || saved.HamMessages != 1 || saved.Tokens["lunch"] != [2]int{0, 1} {
+		t.Errorf("Saved %+v, expected one spam and one ham message", saved)
+	}
+	for i := 0; i < 2; i++ {
+		bayesFilter.Train("buy cheap pills now", true)
+		bayesFilter.Train("lunch tomorrow", false)
+	}
+	if points, _ := bayesFilter.Score(nil, "cheap pills"); points <= 0 {
+		t.Errorf("Score() = %.1f after training", points)
+	}
+}
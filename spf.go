@@ -0,0 +1,359 @@
+/**
+ * SPF, RFC 7208.
+ *
+ * Checks whether the client that connected to us may send mail
+ * for the domain in MAIL FROM.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF results, RFC 7208 section 2.6
+const (
+	spfNone      = "none"
+	spfNeutral   = "neutral"
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+// RFC 7208 section 4.6.4
+const spfMaxLookups = 10
+
+type spfChecker struct {
+	resolver SenderAuthResolver
+	ip       net.IP
+	sender   string // MAIL FROM, or postmaster@<helo> for bounces
+	helo     string
+	lookups  int
+}
+
+// Evaluates the SPF record of domain for mail from sender, sent by ip.
+func checkSpf(resolver SenderAuthResolver, ip net.IP, domain, sender, helo string) string {
+	checker := &spfChecker{resolver: resolver, ip: ip, sender: sender, helo: helo}
+	return checker.checkHost(domain)
+}
+
+// check_host(), RFC 7208 section 4
+func (c *spfChecker) checkHost(domain string) string {
+	record, result := c.lookupRecord(domain)
+	if record == "" {
+		return result
+	}
+
+	terms := strings.Fields(record)[1:]
+	redirect := ""
+	for _, term := range terms {
+		// modifiers
+		if eq := strings.Index(term, "="); eq > 0 && !strings.ContainsAny(term[:eq], ":/") {
+			if strings.ToLower(term[:eq]) == "redirect" {
+				redirect = term[eq+1:]
+			}
+			continue
+		}
+
+		// mechanisms, with an optional qualifier
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = spfFail, term[1:]
+		case '~':
+			qualifier, term = spfSoftFail, term[1:]
+		case '?':
+			qualifier, term = spfNeutral, term[1:]
+		}
+		match, err := c.matches(domain, term)
+		if err != "" {
+			return err
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != "" {
+			return err
+		}
+		if c.lookups++; c.lookups > spfMaxLookups {
+			return spfPermError
+		}
+		result := c.checkHost(target)
+		if result == spfNone {
+			return spfPermError
+		}
+		return result
+	}
+	return spfNeutral
+}
+
+// Returns the domain's "v=spf1" record, or "" and the result to use
+func (c *spfChecker) lookupRecord(domain string) (string, string) {
+	txts, err := c.resolver.LookupTXT(domain)
+	if err != nil {
+		return "", spfTempError
+	}
+	record := ""
+	for _, txt := range txts {
+		if strings.ToLower(txt) == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			if record != "" {
+				return "", spfPermError
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return "", spfNone
+	}
+	return record, ""
+}
+
+// Whether a mechanism matches the client. A non-empty second return
+// value is an error result that ends the evaluation.
+func (c *spfChecker) matches(domain, term string) (bool, string) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		cidr := strings.TrimPrefix(arg, ":")
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, spfPermError
+		}
+		return network.Contains(c.ip), ""
+	}
+
+	// everything else costs a DNS lookup
+	if c.lookups++; c.lookups > spfMaxLookups {
+		return false, spfPermError
+	}
+	target, ip4Bits, ip6Bits, err := c.parseDomainSpec(arg, domain)
+	if err != "" {
+		return false, err
+	}
+	switch name {
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, spfPermError
+		}
+		switch c.checkHost(target) {
+		case spfPass:
+			return true, ""
+		case spfTempError:
+			return false, spfTempError
+		case spfPermError, spfNone:
+			return false, spfPermError
+		}
+		return false, ""
+	case "a":
+		return c.matchesHost(target, ip4Bits, ip6Bits)
+	case "mx":
+		mxs, _, dnsErr := c.resolver.LookupMX(target)
+		if dnsErr == errNoSuchDomain {
+			// a void lookup, RFC 7208 section 4.6.4
+			return false, ""
+		}
+		if dnsErr != nil {
+			return false, spfTempError
+		}
+		for _, mx := range mxs {
+			if match, err := c.matchesHost(mx.Host, ip4Bits, ip6Bits); match || err != "" {
+				return match, err
+			}
+		}
+		return false, ""
+	case "exists":
+		_, _, dnsErr := c.resolver.LookupHost(target)
+		return dnsErr == nil, ""
+	case "ptr":
+		// deprecated, and expensive. Never matches.
+		return false, ""
+	}
+	return false, spfPermError
+}
+
+// Whether one of host's addresses is within the given prefix of the client's
+func (c *spfChecker) matchesHost(host string, ip4Bits, ip6Bits int) (bool, string) {
+	addrs, _, err := c.resolver.LookupHost(host)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+			return false, ""
+		}
+		return false, spfTempError
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		bits, size := ip6Bits, 128
+		if ip.To4() != nil {
+			bits, size = ip4Bits, 32
+		}
+		if (ip.To4() != nil) != (c.ip.To4() != nil) {
+			continue
+		}
+		network := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+		if network.Contains(c.ip) {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// Parses [":" domain-spec] ["/" ip4-cidr] ["//" ip6-cidr]
+func (c *spfChecker) parseDomainSpec(arg, domain string) (string, int, int, string) {
+	ip4Bits, ip6Bits := 32, 128
+	if i := strings.Index(arg, "//"); i >= 0 {
+		bits, err := strconv.Atoi(arg[i+2:])
+		if err != nil || bits < 0 || bits > 128 {
+			return "", 0, 0, spfPermError
+		}
+		ip6Bits, arg = bits, arg[:i]
+	}
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		bits, err := strconv.Atoi(arg[i+1:])
+		if err != nil || bits < 0 || bits > 32 {
+			return "", 0, 0, spfPermError
+		}
+		ip4Bits, arg = bits, arg[:i]
+	}
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		expanded, err := c.expand(arg[1:], domain)
+		if err != "" {
+			return "", 0, 0, err
+		}
+		target = expanded
+	}
+	return target, ip4Bits, ip6Bits, ""
+}
+
+// Expands macros like %{ir} or %{d2}, RFC 7208 section 7
+func (c *spfChecker) expand(spec, domain string) (string, string) {
+	var out []string
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out = append(out, spec[i:i+1])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", spfPermError
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out = append(out, "%")
+			continue
+		case '_':
+			out = append(out, " ")
+			continue
+		case '-':
+			out = append(out, "%20")
+			continue
+		case '{':
+		default:
+			return "", spfPermError
+		}
+		end := strings.Index(spec[i:], "}")
+		if end < 2 {
+			return "", spfPermError
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value := ""
+		localPart, senderDomain := splitAddress(c.sender)
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value = localPart
+		case "o":
+			value = senderDomain
+		case "d":
+			value = domain
+		case "h":
+			value = c.helo
+		case "i":
+			if ip4 := c.ip.To4(); ip4 != nil {
+				value = ip4.String()
+			} else {
+				nibbles := []string{}
+				for _, b := range c.ip.To16() {
+					nibbles = append(nibbles, fmt.Sprintf("%x.%x", b>>4, b&0xf))
+				}
+				value = strings.Join(nibbles, ".")
+			}
+		case "v":
+			if c.ip.To4() != nil {
+				value = "in-addr"
+			} else {
+				value = "ip6"
+			}
+		default:
+			return "", spfPermError
+		}
+
+		// transformers: keep the rightmost N parts, reverse, custom delimiters
+		transformers := macro[1:]
+		digits := 0
+		for digits < len(transformers) && transformers[digits] >= '0' && transformers[digits] <= '9' {
+			digits++
+		}
+		keep, _ := strconv.Atoi(transformers[:digits])
+		reverse := digits < len(transformers) && (transformers[digits] == 'r' || transformers[digits] == 'R')
+		if reverse {
+			digits++
+		}
+		delimiters := transformers[digits:]
+		if delimiters == "" {
+			delimiters = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		out = append(out, strings.Join(parts, "."))
+	}
+	return strings.Join(out, ""), ""
+}
+
+// "alice@example.com" -> "alice", "example.com"
+func splitAddress(addr string) (string, string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return "postmaster", addr
+	}
+	return addr[:at], addr[at+1:]
+}
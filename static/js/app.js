@@ -18,6 +18,7 @@ var ALGO_SHA1 = 2
 var ALGO_AES128 = 7
 
 var BOX_PAGE_SIZE = 20
+var DRAFT_SAVE_DELAY = 3000 // ms after the user stops typing
 
 var REGEX_TOKEN = /^[a-z0-9][a-z0-9][a-z0-9]+$/
 var REGEX_EMAIL = /^([A-Z0-9._%+-]+)@([A-Z0-9.-]+\.[A-Z]{2,4})$/i
@@ -41,8 +42,7 @@ var CONTACTS_VERSION = 1;
 //
 // sessionStorage["token"] is the username
 // sessionStorage["emailAddress"] is <token>@<host>
-// sessionStorage["passHash"] is the auth key
-// sessionStorage["passHashOld"] is for backwards compatibility
+// sessionStorage["session"] is the secret from POST /login, it expires
 //
 // These are never seen by the server, and never go in cookies or localStorage
 // sessionStorage["passKey"] is AES128 key derived from passphrase, used to encrypt to private key
@@ -82,7 +82,7 @@ function main(){
     bindKeyboardShortcuts()
 
     // are we logged in?
-    if(!sessionStorage["token"] || !sessionStorage["passKey"]) {
+    if(!sessionStorage["session"] || !sessionStorage["passKey"]) {
         console.log("Please log in.");
         displayLogin()
     } else {
@@ -149,16 +149,25 @@ function bindKeyboardShortcuts() {
 //
 
 function bindSidebarEvents() {
-    // Navigate to Inbox, Sent, or Archive
+    // Navigate to Inbox, Drafts, Sent, Archive, Spam or Trash
     $("#tab-inbox").click(function(e){
         loadDecryptAndDisplayBox("inbox")
     })
+    $("#tab-drafts").click(function(e){
+        loadDecryptAndDisplayBox("drafts")
+    })
     $("#tab-sent").click(function(e){
         loadDecryptAndDisplayBox("sent")
     })
     $("#tab-archive").click(function(e){
         loadDecryptAndDisplayBox("archive")
     })
+    $("#tab-spam").click(function(e){
+        loadDecryptAndDisplayBox("spam")
+    })
+    $("#tab-trash").click(function(e){
+        loadDecryptAndDisplayBox("trash")
+    })
 
     // Navigate to Compose
     $("#tab-compose").click(function(e){
@@ -170,15 +179,42 @@ function bindSidebarEvents() {
         displayContacts()
     })
 
-    // Log out: click a link, deletes sessionStorage and refreshes the page
+    // Log out: click a link, ends the session, deletes sessionStorage
+    // and refreshes the page. Or end every session, on every device.
     $("#link-logout").click(function(){
-        sessionStorage.clear()
+        logout(false)
+        return false
+    })
+    $("#link-logout-everywhere").click(function(){
+        logout(true)
+        return false
     })
 
     // Explain keyboard shortcuts
     $("#link-kb-shortcuts").click(function(){
         showModal("kb-shortcuts-template")
     })
+
+    $("#link-change-passphrase").click(function(){
+        displayChangePassphraseModal()
+        return false
+    })
+    $("#link-totp").click(function(){
+        displayTotpModal()
+        return false
+    })
+    $("#link-audit").click(function(){
+        displayAuditModal()
+        return false
+    })
+    $("#link-export").click(function(){
+        exportAccount()
+        return false
+    })
+    $("#link-delete-account").click(function(){
+        displayDeleteAccountModal()
+        return false
+    })
 }
 
 function setSelectedTab(tab) {
@@ -200,8 +236,8 @@ function displayStatus(msg){
 // MODAL DIALOGS
 //
 
-function showModal(templateName){
-    var modalHtml = render(templateName)
+function showModal(templateName, data){
+    var modalHtml = render(templateName, data)
     $("#wrapper").append(modalHtml)
     $(".link-close-modal").click(closeModal)
 }
@@ -244,21 +280,207 @@ function login(token, pass){
     sessionStorage["passKey"] = computeAesKey(token, pass)
     sessionStorage["passKeyOld"] = computeAesKeyOld(token, pass)
 
-    // ...the other one authenticates us. the server sees it.
+    // ...the other one authenticates us. the server sees it,
+    // and trades it for a session.
     sessionStorage["token"] = token
-    sessionStorage["passHash"] = computeAuth(token, pass)
-    sessionStorage["passHashOld"] = computeAuthOld(token, pass)
-
-    // try fetching the inbox
-    $.get("/box/inbox",
-        { offset: 0, limit: BOX_PAGE_SIZE },
-        function(inbox){
-            // logged in successfully!
-            decryptAndDisplayBox(inbox)
+    var passHash = computeAuth(token, pass)
+    var passHashOld = computeAuthOld(token, pass)
+    startSession(token, passHash, passHashOld, function(){
+        upgradeOldAccount(passHash, passHashOld, function(){
+            // try fetching the inbox
+            $.get("/box/inbox",
+                { offset: 0, limit: BOX_PAGE_SIZE },
+                function(inbox){
+                    // logged in successfully!
+                    decryptAndDisplayBox(inbox)
+                }, 'json').fail(function(xhr){
+                    alert(xhr.responseText || "Could not reach the server, try again")
+                }
+            )
+        })
+    })
+}
+
+// Backcompat: old accounts have a SHA1 login hash, and a private key
+// encrypted with a SHA1 derived key. Replaces both with their scrypt
+// versions, same passphrase.
+function upgradeOldAccount(passHash, passHashOld, cb){
+    getPrivateKey(function(){
+        if (!sessionStorage["usedPassKeyOld"]) {
+            cb()
+            return
+        }
+        console.log("Upgrading old account")
+        changePassphrase(passHash, passHashOld, sessionStorage["passKey"], passHash, cb)
+    })
+}
+
+// Logs in with a passphrase hash, keeps the session secret the server returns
+// Users with two-factor authentication are asked for a code, then we try again.
+function startSession(token, passHash, passHashOld, cb, totpCode){
+    $.post("/login", {
+        token:       token,
+        passHash:    passHash,
+        passHashOld: passHashOld || "",
+        totpCode:    totpCode || "",
+    }, function(res){
+        sessionStorage["session"] = res.Session
+        cb()
+    }, 'json').fail(function(xhr){
+        if($.trim(xhr.responseText) == "Two-factor code required"){
+            var code = prompt("Enter the code from your authenticator app, or a recovery code")
+            if(code) startSession(token, passHash, passHashOld, cb, code)
+            return
+        }
+        alert(xhr.responseText || "Could not reach the server, try again")
+    })
+}
+
+// Re-encrypts our private key with newPassKey and replaces our login hash.
+// The server ends all of our sessions and starts a new one for us.
+function changePassphrase(passHash, passHashOld, newPassKey, newPassHash, cb){
+    getPrivateKey(function(){
+        var cipherPrivateKey = passphraseEncrypt(sessionStorage["privateKeyArmored"], newPassKey)
+        $.post("/user/me/password", {
+            passHash:            passHash,
+            passHashOld:         passHashOld,
+            newPassHash:         newPassHash,
+            newCipherPrivateKey: bin2hex(cipherPrivateKey),
+        }, function(res){
+            sessionStorage["session"] = res.Session
+            sessionStorage["passKey"] = newPassKey
+            sessionStorage.removeItem("passKeyOld")
+            sessionStorage.removeItem("usedPassKeyOld")
+            cb()
         }, 'json').fail(function(xhr){
-            alert(xhr.responseText || "Could not reach the server, try again")
+            alert("Changing the passphrase failed: "+xhr.responseText)
+        })
+    })
+}
+
+function displayChangePassphraseModal(){
+    showModal("change-passphrase-template")
+    $("#changePassButton").click(function(){
+        var token = sessionStorage["token"]
+        var oldPass = $("#oldPass").val()
+        var newPass = validateNewPassword("#newPass", "#confirmNewPass")
+        if(newPass == null) return
+        changePassphrase(computeAuth(token, oldPass), computeAuthOld(token, oldPass),
+            computeAesKey(token, newPass), computeAuth(token, newPass), function(){
+                closeModal()
+                displayStatus("Passphrase changed. Other devices were signed out.")
+            })
+    })
+}
+
+function displayTotpModal(){
+    $.get("/user/me/totp/", function(res){
+        showModal("totp-template", res)
+        var token = sessionStorage["token"]
+        $("#totpEnrollButton").click(function(){
+            var pass = $("#totpPass").val()
+            $.post("/user/me/totp/enroll", {
+                passHash:    computeAuth(token, pass),
+                passHashOld: computeAuthOld(token, pass),
+            }, function(enrollment){
+                $("#totpSetup").html(render("totp-setup-template", enrollment))
+                $("#totpVerifyButton").click(verifyTotp)
+            }, 'json').fail(function(xhr){
+                alert(xhr.responseText)
+            })
+        })
+        $("#totpDisableButton").click(function(){
+            var pass = $("#totpPass").val()
+            $.post("/user/me/totp/disable", {
+                passHash:    computeAuth(token, pass),
+                passHashOld: computeAuthOld(token, pass),
+                code:        $("#totpCode").val(),
+            }, function(){
+                closeModal()
+                displayStatus("Two-factor authentication is off")
+            }).fail(function(xhr){
+                alert(xhr.responseText)
+            })
+        })
+    }, 'json')
+}
+
+// Turns two-factor authentication on once the app shows the right code.
+// The server ends all of our other sessions.
+function verifyTotp(){
+    $.post("/user/me/totp/verify", {
+        code: $("#totpCode").val(),
+    }, function(res){
+        sessionStorage["session"] = res.Session
+        closeModal()
+        displayStatus("Two-factor authentication is on. Other devices were signed out.")
+    }, 'json').fail(function(xhr){
+        alert(xhr.responseText)
+    })
+}
+
+// Recent logins and failed logins, so the user can tell if someone is trying
+function displayAuditModal(){
+    $.get("/user/me/audit", { offset: 0, limit: 50 }, function(res){
+        var events = res.Events.map(function(event){
+            return {
+                time:  new Date(event.UnixTime*1000),
+                event: event.Event.replace(/-/g, " "),
+                ip:    event.IP,
+            }
+        })
+        showModal("audit-template", { events: events })
+    }, 'json')
+}
+
+// Downloads a zip of all our mail, still encrypted.
+// A plain link can't send the session header, so it goes through a blob.
+function exportAccount(){
+    displayStatus("Exporting...")
+    var xhr = new XMLHttpRequest()
+    xhr.open("GET", "/user/me/export")
+    xhr.setRequestHeader("x-scramble-session", sessionStorage["session"])
+    xhr.responseType = "blob"
+    xhr.onload = function(){
+        if(xhr.status != 200){
+            alert("Export failed, try again")
+            return
         }
-    )
+        var link = document.createElement("a")
+        link.href = URL.createObjectURL(xhr.response)
+        link.download = "scramble-"+sessionStorage["token"]+".zip"
+        document.body.appendChild(link)
+        link.click()
+        document.body.removeChild(link)
+        displayStatus("Exported")
+    }
+    xhr.send()
+}
+
+function displayDeleteAccountModal(){
+    showModal("delete-account-template")
+    $("#deleteAccountButton").click(function(){
+        var token = sessionStorage["token"]
+        var pass = $("#deleteAccountPass").val()
+        if(!confirm("Delete "+getUserEmail()+" and all of its mail for good?")) return
+        $.post("/user/me/delete", {
+            passHash:    computeAuth(token, pass),
+            passHashOld: computeAuthOld(token, pass),
+            code:        $("#deleteAccountCode").val(),
+        }, function(){
+            sessionStorage.clear()
+            window.location = "/"
+        }).fail(function(xhr){
+            alert(xhr.responseText)
+        })
+    })
+}
+
+function logout(everywhere){
+    $.post("/logout", { everywhere: everywhere }).always(function(){
+        sessionStorage.clear()
+        window.location = "/"
+    })
 }
 
 
@@ -313,7 +535,6 @@ function createAccount(keys){
     var passHash = computeAuth(token, pass)
 
     sessionStorage["token"] = token
-    sessionStorage["passHash"] = passHash
     // save for this session only, never in a cookie or localStorage
     sessionStorage["passKey"] = aesKey
     sessionStorage["privateKeyArmored"] = keys.privateKeyArmored
@@ -329,14 +550,16 @@ function createAccount(keys){
         cipherPrivateKey:bin2hex(cipherPrivateKey)
     }
     $.post("/user/", data, function(){
-        $.get("/box/inbox",
-            { offset: 0, limit: BOX_PAGE_SIZE },
-            function(inbox){
-                decryptAndDisplayBox(inbox)
-            }, 'json').fail(function(){
-                alert("Try refreshing the page, then logging in.")
-            }
-        )
+        startSession(token, passHash, "", function(){
+            $.get("/box/inbox",
+                { offset: 0, limit: BOX_PAGE_SIZE },
+                function(inbox){
+                    decryptAndDisplayBox(inbox)
+                }, 'json').fail(function(){
+                    alert("Try refreshing the page, then logging in.")
+                }
+            )
+        })
     }).fail(function(xhr){
         alert(xhr.responseText)
     })
@@ -355,9 +578,10 @@ function validateToken(){
     }
 }
 
-function validateNewPassword(){
-    var pass1 = $("#createPass").val()
-    var pass2 = $("#confirmPass").val()
+// Reads the new passphrase, by default from the create account form
+function validateNewPassword(passField, confirmField){
+    var pass1 = $(passField || "#createPass").val()
+    var pass2 = $(confirmField || "#confirmPass").val()
     if(pass1 != pass2){
         alert("Passphrases must match")
         return null
@@ -378,9 +602,13 @@ function validateNewPassword(){
 //
 
 function bindBoxEvents(box) {
-    // Click on an email to open it
+    // Click on an email to open it, or on a draft to edit it
     $("#"+box+" .box-items>li").click(function(e){
-        displayEmail($(e.target))
+        if (box == "drafts") {
+            displayDraft($(this).data("msgId"))
+        } else {
+            displayEmail($(e.target))
+        }
     })
     // Click on a pagination link
     $('#'+box+" .box-pagination a").click(function(e) {
@@ -516,6 +744,12 @@ function bindEmailEvents() {
         });
     }));
 
+    $(".email .attachmentLink").click(function(e){
+        e.preventDefault();
+        var email = $(this).closest(".email").data("email");
+        downloadAttachment(email, $(this).data("id"), $(this).text());
+    });
+
     var withLastEmail = function(cb) {
         return function() {
             cb(viewState.getLastEmail());
@@ -527,7 +761,9 @@ function bindEmailEvents() {
     $(".threadControl .forwardButton").click(withLastEmail(emailForward))
     $(".threadControl .archiveButton").click(withLastEmail(function(email){emailMove(email, "archive", true)}))
     $(".threadControl .moveToInboxButton").click(withLastEmail(function(email){emailMove(email, "inbox", true)}))
+    $(".threadControl .spamButton").click(withLastEmail(function(email){emailMove(email, "spam", true)}))
     $(".threadControl .deleteButton").click(withLastEmail(function(email){emailMove(email, "trash", true)}))
+    $(".threadControl .undeleteButton").click(withLastEmail(function(email){emailUndelete(email, true)}))
 }
 
 /**
@@ -555,7 +791,7 @@ function displayEmail(emailHeader){
             msgId:     emailHeader.data("msgId"),
             threadId:  emailHeader.data("threadId"),
             box:       emailHeader.data("box"),
-            subject:   emailHeader.text(),
+            subject:   emailHeader.find(".subject").text(),
         };
     } else if (!emailHeader) {
         return;
@@ -568,7 +804,12 @@ function displayEmail(emailHeader){
 
     $("#content").empty();
     $("li.box-item.current").removeClass("current");
-    $("li.box-item[data-thread-id='"+threadId+"']").addClass("current");
+    var boxItem = $("li.box-item[data-thread-id='"+threadId+"']").addClass("current");
+    if (boxItem.hasClass("unread")) {
+        setFlags({threadIds: threadId, read: true}, function(){
+            boxItem.removeClass("unread")
+        })
+    }
 
     getPrivateKey(function(privateKey) {
 
@@ -643,7 +884,9 @@ function createEmailViewModel(data, box, threadSubject) {
         to:          data.To,
         toAddresses: toAddresses,
         subject:     parsedBody.subject || threadSubject,
+        body:        parsedBody.body,
         htmlBody:    createHyperlinks(parsedBody.body),
+        attachments: data.Attachments || [],
         box:         box,
     };
 }
@@ -664,6 +907,26 @@ function showEmailThread(emails){
     $("#content").empty().append(elThread);
 }
 
+// Fetches an attachment, decrypts it and hands it to the browser as a download
+function downloadAttachment(email, id, filename){
+    getPrivateKey(function(privateKey) {
+        var params = {msgId: email.msgId, id: id};
+        $.get("/email/attachment", params, function(cipherText){
+            var plainText = tryDecodePgp(cipherText, privateKey, null);
+            var bytes = new Uint8Array(plainText.length);
+            for (var i=0; i<plainText.length; i++) {
+                bytes[i] = plainText.charCodeAt(i) & 0xff;
+            }
+            var url = URL.createObjectURL(new Blob([bytes]));
+            var link = $("<a />").attr({href: url, download: filename});
+            $("body").append(link);
+            link[0].click();
+            link.remove();
+            URL.revokeObjectURL(url);
+        }, "text")
+    })
+}
+
 var linkRegex = new RegExp("^http(s)?://[a-z0-9-]+(.[a-z0-9-]+)*(:[0-9]+)?(\/.*)?$", "ig")
 
 // Turns URLS into links in the plaintext.
@@ -702,17 +965,14 @@ function emailForward(email){
 // moveThread: if true, moves all emails in box for thread up to email.unixTime.
 //  (that way, server doesn't move new emails that the user hasn't seen)
 function emailMove(email, box, moveThread){
-    if (box == "trash") {
-        if (moveThread) {
-            if(!confirm("Are you sure you want to delete this thread?")) return;
-        } else {
-            if(!confirm("Are you sure you want to delete this email?")) return;
-        }
-    }
     var params = {
         box: box,
         moveThread: (moveThread || false)
     };
+    // only we can read it, the server learns what spam looks like from it
+    if (box == "spam" || email.box == "spam") {
+        params.plaintext = email.subject + "\n" + email.body
+    }
     $.ajax({
         url: '/email/'+email.msgId,
         type: 'PUT',
@@ -730,6 +990,36 @@ function emailMove(email, box, moveThread){
     })
 }
 
+// Sets read and/or starred on msgIds and/or threadIds, see emailFlagsHandler
+function setFlags(params, cb){
+    $.ajax({
+        url: '/email/flags',
+        type: 'PUT',
+        data: params,
+    }).done(cb).fail(function(xhr){
+        console.log("Setting flags failed: "+xhr.responseText)
+    })
+}
+
+// Moves trashed mail back to the box it was deleted from
+function emailUndelete(email, moveThread){
+    $.ajax({
+        url: '/email/'+email.msgId,
+        type: 'PUT',
+        data: {undelete: true, moveThread: (moveThread || false)},
+    }).done(function(){
+        if (moveThread) {
+            $("#thread").remove();
+            showNextThread();
+        } else {
+            removeEmailFromThread(email);
+        }
+        displayStatus("Undeleted")
+    }).fail(function(xhr){
+        alert("Undelete failed: "+xhr.responseText)
+    })
+}
+
 function getEmailElement(msgId) {
     var elEmail = $(".email[data-msg-id='"+msgId+"']");
     if (elEmail.length != 1) {
@@ -768,10 +1058,35 @@ function showNextThread() {
 // cb: function(emailData), emailData has plaintext components including
 //  msgId, threadId, ancestorIds, subject, to, body...
 function bindComposeEvents(elCompose, cb) {
+    // generate 160-bit (20 byte) message id
+    // secure random generator, so it will be unique
+    // a draft keeps its id, sending it replaces the draft
+    var msgId = elCompose.find("[name='msgId']").val() ||
+        bin2hex(openpgp_crypto_getRandomBytes(20))+"@"+window.location.hostname;
+    elCompose.find("[name='msgId']").val(msgId);
+
+    // autosave a draft once the user stops typing
+    var saveTimer = null;
+    elCompose.find("input,textarea").on("input", function(){
+        clearTimeout(saveTimer);
+        saveTimer = setTimeout(function(){
+            saveDraft(elCompose);
+        }, DRAFT_SAVE_DELAY);
+    });
+
+    elCompose.find(".discardButton").click(function(){
+        clearTimeout(saveTimer);
+        $.ajax({
+            url: '/draft/'+msgId,
+            type: 'DELETE',
+        }).always(function(){
+            displayStatus("Draft discarded");
+            displayCompose();
+        })
+    });
+
     elCompose.find(".sendButton").click(function(){
-        // generate 160-bit (20 byte) message id
-        // secure random generator, so it will be unique
-        var msgId = bin2hex(openpgp_crypto_getRandomBytes(20))+"@"+window.location.hostname;
+        clearTimeout(saveTimer);
         var threadId    = elCompose.find("[name='threadId']").val() || msgId;
         var ancestorIds = elCompose.find("[name='ancestorIds']").val() || "";
         var subject     = elCompose.find("[name='subject']").val();
@@ -790,15 +1105,20 @@ function bindComposeEvents(elCompose, cb) {
     });
 }
 
-function displayCompose(to, subject, body){
+// draft is optional, the one being edited
+function displayCompose(to, subject, body, draft){
     // clean up 
     $(".box").html("");
     viewState.emails = null;
     setSelectedTab($("#tab-compose"));
+    draft = draft || {};
     var elCompose = $(render("compose-template", {
-        to:      to,
-        subject: subject,
-        body:    body || DEFAULT_SIGNATURE,
+        msgId:       draft.MessageID,
+        threadId:    draft.ThreadID,
+        ancestorIds: draft.AncestorIDs,
+        to:          to,
+        subject:     subject,
+        body:        body || DEFAULT_SIGNATURE,
     }));
     $("#content").empty().append(elCompose);
     bindComposeEvents(elCompose, function(emailData) {
@@ -829,6 +1149,47 @@ function displayComposeInline(email, to, subject, body) {
 
 }
 
+// Opens a draft in the compose form, where autosave keeps updating it
+function displayDraft(msgId){
+    $.get("/draft/"+msgId, function(draft){
+        getPrivateKey(function(privateKey){
+            var parsed = parseBody(tryDecodePgp(draft.CipherBody, privateKey));
+            displayCompose(draft.To, parsed.subject, parsed.body, draft);
+        })
+    }, 'json').fail(function(xhr){
+        alert("Loading the draft failed: "+xhr.responseText);
+    })
+}
+
+// Saves a compose form as a draft, encrypted for ourselves only
+function saveDraft(elCompose){
+    var msgId   = elCompose.find("[name='msgId']").val();
+    var subject = elCompose.find("[name='subject']").val();
+    var body    = elCompose.find("[name='body']").val();
+    getPrivateKey(function(privateKey){
+        getPublicKey(function(publicKey){
+            var pubKeys = [publicKey[0]];
+            var data = {
+                threadId:      elCompose.find("[name='threadId']").val() || msgId,
+                ancestorIds:   elCompose.find("[name='ancestorIds']").val() || "",
+                to:            elCompose.find("[name='to']").val(),
+                cipherSubject: openpgp.write_signed_and_encrypted_message(privateKey[0], pubKeys, subject),
+                cipherBody:    openpgp.write_signed_and_encrypted_message(privateKey[0], pubKeys,
+                    "Subject: "+subject+"\n\n"+body),
+            };
+            $.ajax({
+                url: '/draft/'+msgId,
+                type: 'PUT',
+                data: data,
+            }).done(function(){
+                elCompose.find(".draft-status").text("Draft saved");
+            }).fail(function(xhr){
+                console.log("Saving draft failed: "+xhr.responseText);
+            })
+        })
+    })
+}
+
 function sendEmail(msgId, threadId, ancestorIds, to, subject, body, cb){
     // validate email addresses
     var toAddresses = to.split(",").map(trimToLower)
@@ -1120,14 +1481,77 @@ function sendEmailPost(data, cb) {
 // <body lines...>
 // ```
 //
+// PGP/MIME mail from other clients decrypts to a MIME entity instead,
+// see parseMimeEntity.
+//
 // Returns {subject:<subject line>, body:<body...>, ok:<boolean>}
 function parseBody(plaintextBody) {
     var parts = REGEX_BODY.exec(plaintextBody);
-    if (parts == null) {
-        return {body:plaintextBody, ok:false};
-    } else {
+    if (parts != null) {
         return {subject:parts[1], body:parts[2], ok:true};
     }
+    var entity = parseMimeEntity(plaintextBody, false);
+    if (entity != null) {
+        return {subject:entity.subject, body:entity.body, ok:true};
+    }
+    return {body:plaintextBody, ok:false};
+}
+
+// Finds the text of a MIME entity, RFC 2045, and its subject if the
+// sender protected it, eg Enigmail. Parts without a Content-Type are
+// plain text, the entity itself must have one.
+//
+// Returns {subject:<subject line or undefined>, body:<text>} or null
+function parseMimeEntity(entity, isPart) {
+    var end = /(^|\r?\n)\r?\n/.exec(entity);
+    if (end == null) {
+        return null;
+    }
+    var headers = {};
+    entity.substring(0, end.index).replace(/\r?\n[ \t]+/g, " ").split(/\r?\n/).forEach(function(line){
+        var colon = line.indexOf(":");
+        if (colon > 0) {
+            headers[line.substring(0, colon).trim().toLowerCase()] = line.substring(colon+1).trim();
+        }
+    });
+    var body = entity.substring(end.index + end[0].length);
+    var contentType = headers["content-type"] || (isPart ? "text/plain" : null);
+    if (contentType == null) {
+        return null;
+    }
+
+    var boundary = /boundary="?([^";]+)"?/i.exec(contentType);
+    if (/^multipart\//i.test(contentType) && boundary != null) {
+        var parts = body.split("--"+boundary[1]);
+        // skip the preamble, stop at the closing delimiter
+        for (var i = 1; i < parts.length && parts[i].indexOf("--") != 0; i++) {
+            var part = parseMimeEntity(parts[i].replace(/^[ \t]*\r?\n/, ""), true);
+            if (part != null) {
+                return {subject:headers["subject"] || part.subject, body:part.body};
+            }
+        }
+        return null;
+    }
+    if (!/^text\/plain/i.test(contentType)) {
+        return null;
+    }
+
+    var encoding = (headers["content-transfer-encoding"] || "").toLowerCase();
+    if (encoding == "base64") {
+        body = atob(body.replace(/\s/g, ""));
+    } else if (encoding == "quoted-printable") {
+        body = body.replace(/=\r?\n/g, "").replace(/=([0-9A-F]{2})/gi, function(match, hex){
+            return String.fromCharCode(parseInt(hex, 16));
+        });
+    }
+    if (encoding == "base64" || encoding == "quoted-printable") {
+        try {
+            body = decodeURIComponent(escape(body));
+        } catch (e) {
+            // not utf-8, keep the bytes as they are
+        }
+    }
+    return {subject:headers["subject"], body:body};
 }
 
 //
@@ -1629,9 +2053,11 @@ function computeAuthOld(token, pass){
 }
 
 // Symmetric encryption using a key derived from the user's passphrase
-// The user must be logged in: the key must be in sessionStorage
-function passphraseEncrypt(plainText){
-    if(!sessionStorage["passKey"] || sessionStorage["passKey"] == "undefined"){
+// The user must be logged in: the key must be in sessionStorage,
+// unless passKey is given, eg when changing the passphrase
+function passphraseEncrypt(plainText, passKey){
+    passKey = passKey || sessionStorage["passKey"]
+    if(!passKey || passKey == "undefined"){
         alert("Missing passphrase. Please log out and back in.")
         return null
     }
@@ -1639,7 +2065,7 @@ function passphraseEncrypt(plainText){
     return openpgp_crypto_symmetricEncrypt(
         prefixRandom, 
         ALGO_AES128, 
-        sessionStorage["passKey"], 
+        passKey, 
         plainText)
 }
 
@@ -1663,6 +2089,7 @@ function passphraseDecrypt(cipherText){
             sessionStorage["passKeyOld"], 
             cipherText)
         console.log("Warning: old account, used backcompat AES key")
+        sessionStorage["usedPassKeyOld"] = "true"
     }
     return plain
 }
@@ -1880,13 +2307,13 @@ function trimToLower(str){
 // Code that must run in the browser goes in here, so we can run tests in console.
 // For example, code that require jQuery.
 if (typeof window != "undefined") {
-    // Adds cookie-like headers for every request...
+    // Adds a cookie-like session header to every request...
     $.ajaxSetup({
         // http://stackoverflow.com/questions/7686827/how-can-i-add-a-custom-http-header-to-ajax-request-with-js-or-jquery
         beforeSend: function(xhr) {
-            xhr.setRequestHeader('x-scramble-token', sessionStorage["token"]);
-            xhr.setRequestHeader('x-scramble-passHash', sessionStorage["passHash"]);
-            xhr.setRequestHeader('x-scramble-passHashOld', sessionStorage["passHashOld"]);
+            if (sessionStorage["session"]) {
+                xhr.setRequestHeader('x-scramble-session', sessionStorage["session"]);
+            }
         }
     });
 }
@@ -0,0 +1,116 @@
+/**
+ * Two-factor authentication with TOTP, RFC 6238.
+ *
+ * Users who enable it need a code from their authenticator app, or one
+ * of their recovery codes, to log in. Only the server and the app know
+ * the secret. Each code works once.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpStep          = 30 // seconds, what authenticator apps use
+	totpDigits        = 6
+	totpSkew          = 1 // steps of clock drift allowed either way
+	totpRecoveryCodes = 10
+)
+
+// A new random secret, base32 like authenticator apps expect
+func newTotpSecret() string {
+	return base32.StdEncoding.EncodeToString(randomBytes(20))
+}
+
+// For the QR code, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(secret, address string) string {
+	return "otpauth://totp/" + url.PathEscape("Scramble:"+address) +
+		"?secret=" + strings.TrimRight(secret, "=") + "&issuer=Scramble"
+}
+
+// The HOTP value for a counter, RFC 4226 section 5.3
+func totpCode(secret []byte, counter int64, digits int) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := int64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+	mod := int64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Returns the time step code is valid for at now, or 0 if it isn't
+func matchTotp(secret string, code string, now time.Time) int64 {
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpStep
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step, totpDigits)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+// Returns true if the user has no second factor, or if code is a
+// current TOTP code or one of their recovery codes
+func checkSecondFactor(token string, code string, now time.Time) bool {
+	totp := repo.LoadTotp(token)
+	if totp == nil || !totp.Enabled {
+		return true
+	}
+	return checkTotpCode(token, totp, code, now) ||
+		(code != "" && repo.UseRecoveryCode(token, recoveryCodeHash(code)))
+}
+
+// Checks a code from the app. Codes for a time step that was already
+// used don't work, someone may have seen it.
+func checkTotpCode(token string, totp *TotpConfig, code string, now time.Time) bool {
+	step := matchTotp(totp.Secret, strings.TrimSpace(code), now)
+	return step > 0 && repo.UseTotpStep(token, step)
+}
+
+// Returns new recovery codes, eg "k3jd8-2mzq7", and their hashes
+func newRecoveryCodes() ([]string, []string) {
+	codes, hashes := []string{}, []string{}
+	for i := 0; i < totpRecoveryCodes; i++ {
+		chars := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes(5)))
+		code := chars[:5] + "-" + chars[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+	return codes, hashes
+}
+
+// Recovery codes are stored hashed, like session keys.
+// Case, dashes and spaces don't matter.
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomBytes(n int) []byte {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return bytes
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1
+	secret := []byte("12345678901234567890")
+	for unixTime, code := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		if c := totpCode(secret, unixTime/totpStep, 8); c != code {
+			t.Errorf("totpCode() = %s at %d, expected %s", c, unixTime, code)
+		}
+	}
+}
+
+func TestMatchTotp(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpStep
+	key := []byte("12345678901234567890")
+	for _, drift := range []int64{-1, 0, 1} {
+		if s := matchTotp(secret, totpCode(key, step+drift, totpDigits), now); s != step+drift {
+			t.Errorf("matchTotp() = %d for a code %d step(s) off", s, drift)
+		}
+	}
+	for _, code := range []string{totpCode(key, step-2, totpDigits), totpCode(key, step+2, totpDigits), "", "12345"} {
+		if s := matchTotp(secret, code, now); s != 0 {
+			t.Errorf("matchTotp(%q) = %d, expected no match", code, s)
+		}
+	}
+	if s := matchTotp("not base32!", totpCode(key, step, totpDigits), now); s != 0 {
+		t.Errorf("matchTotp() = %d for a broken secret", s)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != totpRecoveryCodes || len(hashes) != totpRecoveryCodes {
+		t.Fatalf("newRecoveryCodes() returned %d codes", len(codes))
+	}
+	if recoveryCodeHash(codes[0]) != hashes[0] || codes[0] == codes[1] {
+		t.Fatalf("newRecoveryCodes() returned %v", codes)
+	}
+	if recoveryCodeHash("ABCDE FGHIJ") != recoveryCodeHash("abcde-fghij") {
+		t.Error("recoveryCodeHash() should ignore case, dashes and spaces")
+	}
+}
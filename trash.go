@@ -0,0 +1,37 @@
+/**
+ * Empties the trash.
+ *
+ * Mail moved to 'trash' can be undeleted until it has been there for
+ * Config.TrashRetentionDays, then it is deleted for good.
+ */
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How often the trash is checked for mail past its retention
+const trashPurgeInterval = time.Hour
+
+func StartTrashPurger() {
+	go func() {
+		for {
+			purgeTrash(time.Now())
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+// Deletes mail trashed more than Config.TrashRetentionDays before now
+func purgeTrash(now time.Time) {
+	days := GetConfig().TrashRetentionDays
+	if days <= 0 {
+		return
+	}
+	before := now.Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	if count := repo.PurgeTrash(before); count > 0 {
+		log.Printf("Purged %d trashed message(s)\n", count)
+	}
+}
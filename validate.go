@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"regexp"
+	"strconv"
 )
 
 // Parts of regular expressions
@@ -13,6 +14,7 @@ var domain = `[A-Z0-9.-]+\.[A-Z]{2,4}`
 var regexHex = regexp.MustCompile("^(?i)[a-f0-9]+$")
 var regexPassHash = regexp.MustCompile("^(?i)[a-f0-9]{40}$")
 var regexHash = regexp.MustCompile("^(?i)[a-f0-9]{40}|[a-z2-7]{16}$")
+var regexSearchChunkID = regexp.MustCompile("^[a-zA-Z0-9_-]{1,64}$")
 var regexToken = regexp.MustCompile("^(?i)[a-z0-9]{3}[a-z0-9]*$")
 var regexAddress = regexp.MustCompile(`^(?i)(`+dotAtom+`)@(`+dotAtom+`)$`)
 var regexHost = regexp.MustCompile(`^(?i)(`+domain+`)$`)
@@ -51,8 +53,28 @@ func validateToken(str string) string {
 	return str
 }
 func validateBox(str string) string {
-	if str != "inbox" && str != "sent" && str != "archive" && str != "trash" {
-		log.Panicf("Expected inbox/sent/archive/trash, got %s", str)
+	if str != "inbox" && str != "sent" && str != "archive" && str != "trash" && str != "spam" {
+		log.Panicf("Expected inbox/sent/archive/trash/spam, got %s", str)
+	}
+	return str
+}
+func validateLabelID(str string) int64 {
+	id, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || id <= 0 {
+		log.Panicf("Invalid label id %s", str)
+	}
+	return id
+}
+func validateSearchVersion(str string) int64 {
+	version, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || version < 0 {
+		log.Panicf("Invalid search index version %s", str)
+	}
+	return version
+}
+func validateSearchChunkID(str string) string {
+	if !regexSearchChunkID.MatchString(str) {
+		log.Panicf("Invalid search chunk id %s", str)
 	}
 	return str
 }